@@ -4,7 +4,10 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"gocode/first/api/i18n"
+	"gocode/first/api/store"
 	"gocode/first/config"
+	"gocode/first/utils"
 	"log"
 	"net/http"
 )
@@ -15,6 +18,14 @@ type Announcement struct {
 	Content  string `json:"content"`
 	CoverImg string `json:"coverImg"`
 	Date     string `json:"date"`
+	// Localized 请求非中文时的译文，标题和内容保持原文以便后台编辑后原样保存
+	Localized *LocalizedAnnouncement `json:"localized,omitempty"`
+}
+
+// LocalizedAnnouncement 公告在请求语言下的标题和内容
+type LocalizedAnnouncement struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
 }
 
 var db *sql.DB
@@ -38,6 +49,14 @@ func init() {
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+
+	if err = utils.EnsureColumn(db, "announcements", "deleted_at", "DATETIME NULL"); err != nil {
+		log.Fatal("Failed to migrate announcements:", err)
+	}
+	// 每家门店发布自己的公告
+	if err = store.EnsureScoped(db, "announcements"); err != nil {
+		log.Fatal("Failed to migrate announcements:", err)
+	}
 }
 func InsertAnnouncement(w http.ResponseWriter, r *http.Request) {
 	var annocement Announcement
@@ -45,8 +64,12 @@ func InsertAnnouncement(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	query := `INSERT INTO announcements (title, content, coverImg,date) VALUES (?, ?, ?,?)`
-	_, err := db.Exec(query, annocement.Title, annocement.Content, annocement.CoverImg, annocement.Date)
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	query := `INSERT INTO announcements (title, content, coverImg,date, store_id) VALUES (?, ?, ?,?, ?)`
+	_, err := db.Exec(query, annocement.Title, annocement.Content, annocement.CoverImg, annocement.Date, storeID)
 	if err != nil {
 		log.Printf("Failed to insert annocement: %v", err)
 		http.Error(w, "Failed to insert annocement", http.StatusInternalServerError)
@@ -61,11 +84,30 @@ func UpdateAnnouncement(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	query := `UPDATE announcements SET title = ?, content = ?, coverImg = ?,date=? WHERE id = ?`
-	_, err := db.Exec(query, annocement.Title, annocement.Content, annocement.CoverImg, annocement.Date, annocement.ID)
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	query := `UPDATE announcements SET title = ?, content = ?, coverImg = ?,date=? WHERE id = ? AND store_id = ? AND deleted_at IS NULL`
+	res, err := db.Exec(query, annocement.Title, annocement.Content, annocement.CoverImg, annocement.Date, annocement.ID, storeID)
 	if err != nil {
 		log.Printf("Failed to update annocement: %v", err)
 		http.Error(w, "Failed to update annocement", http.StatusInternalServerError)
+		return
+	}
+	// 内容没有变化时影响行数也为0，需要确认公告是否存在
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM announcements WHERE id = ? AND store_id = ? AND deleted_at IS NULL)", annocement.ID, storeID).Scan(&exists)
+		if err != nil {
+			log.Printf("Failed to update annocement: %v", err)
+			http.Error(w, "Failed to update annocement", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Announcement not found", http.StatusNotFound)
+			return
+		}
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -77,11 +119,20 @@ func DeleteAnnouncement(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	query := `DELETE FROM announcements WHERE id = ?`
-	_, err := db.Exec(query, annocement.ID)
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	query := `UPDATE announcements SET deleted_at = NOW() WHERE id = ? AND store_id = ? AND deleted_at IS NULL`
+	res, err := db.Exec(query, annocement.ID, storeID)
 	if err != nil {
 		log.Printf("Failed to delete annocement: %v", err)
 		http.Error(w, "Failed to delete annocement", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Announcement not found", http.StatusNotFound)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -89,8 +140,58 @@ func DeleteAnnouncement(w http.ResponseWriter, r *http.Request) {
 }
 
 func FetchAnnouncements(w http.ResponseWriter, r *http.Request) {
-	query := `SELECT id, title, content, coverImg,date FROM announcements`
-	rows, err := db.Query(query)
+	storeID, ok := store.RequestStore(w, r)
+	if !ok {
+		return
+	}
+	writeAnnouncements(w, i18n.RequestLocale(r), `SELECT id, title, content, coverImg,date FROM announcements WHERE deleted_at IS NULL AND store_id = ?`, storeID)
+}
+
+// FetchArchivedAnnouncements 返回门店已归档的公告
+func FetchArchivedAnnouncements(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	writeAnnouncements(w, i18n.DefaultLocale, `SELECT id, title, content, coverImg,date FROM announcements WHERE deleted_at IS NOT NULL AND store_id = ? ORDER BY deleted_at DESC`, storeID)
+}
+
+// RestoreAnnouncement 根据ID恢复已归档的公告
+func RestoreAnnouncement(w http.ResponseWriter, r *http.Request) {
+	var annocement Announcement
+	if err := json.NewDecoder(r.Body).Decode(&annocement); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	res, err := db.Exec(`UPDATE announcements SET deleted_at = NULL WHERE id = ? AND store_id = ? AND deleted_at IS NOT NULL`, annocement.ID, storeID)
+	if err != nil {
+		log.Printf("Failed to restore annocement: %v", err)
+		http.Error(w, "Failed to restore annocement", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Archived announcement not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Announcement restored successfully"})
+}
+
+// writeAnnouncements 执行公告查询，非中文时填充标题和内容的译文后以JSON返回
+func writeAnnouncements(w http.ResponseWriter, locale, query string, args ...any) {
+	translations, err := i18n.Lookup(i18n.EntityAnnouncement, locale)
+	if err != nil {
+		log.Printf("Translation error: %s", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		log.Printf("Query error: %s", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -107,6 +208,12 @@ func FetchAnnouncements(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Error reading data", http.StatusInternalServerError)
 			return
 		}
+		if !i18n.IsDefault(locale) {
+			ann.Localized = &LocalizedAnnouncement{
+				Title:   i18n.Text(translations, ann.ID, "title", ann.Title),
+				Content: i18n.Text(translations, ann.ID, "content", ann.Content),
+			}
+		}
 		announcements = append(announcements, ann)
 	}
 
@@ -3,6 +3,7 @@ package cheapgoods
 import (
 	"encoding/json"
 	"fmt"
+	"gocode/first/api/store"
 	"io"
 	"net/http"
 )
@@ -20,7 +21,11 @@ func HandleProducts(w http.ResponseWriter, r *http.Request) {
 
 		if len(body) == 0 {
 			// 请求体为空，假设是获取并返回所有产品
-			products, err := FetchProducts()
+			storeID, ok := store.RequestStore(w, r)
+			if !ok {
+				return
+			}
+			products, err := FetchProducts(storeID)
 			if err != nil {
 				http.Error(w, "Server error", http.StatusInternalServerError)
 				return
@@ -29,12 +34,17 @@ func HandleProducts(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(products)
 		} else {
-			// 请求体不为空，解析产品信息进行添加或更新
+			// 请求体不为空，解析产品信息进行添加或更新，只能修改管理员自己门店的产品
+			storeID, ok := store.ManagedStore(w, r)
+			if !ok {
+				return
+			}
 			var p Product
 			if err := json.Unmarshal(body, &p); err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			p.StoreID = storeID
 
 			if p.ID > 0 {
 				// 更新产品
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"gocode/first/api/store"
 	"gocode/first/config"
 	"log"
 
@@ -31,6 +32,11 @@ func init() {
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+
+	// 每家门店有自己的特惠商品
+	if err = store.EnsureScoped(db, "cheapgoods"); err != nil {
+		log.Fatal("Failed to migrate cheapgoods:", err)
+	}
 }
 
 type Product struct {
@@ -43,10 +49,12 @@ type Product struct {
 	Addons       []string `json:"addons"`
 	Stock        int      `json:"stock"`
 	Category     string   `json:"category"`
+	StoreID      int      `json:"storeId"`
 }
 
-func FetchProducts() ([]Product, error) {
-	rows, err := db.Query("SELECT id, name, price, imageUrl, sizes, temperatures, addons, stock, category FROM cheapgoods")
+// FetchProducts 返回门店的特惠商品
+func FetchProducts(storeID int) ([]Product, error) {
+	rows, err := db.Query("SELECT id, name, price, imageUrl, sizes, temperatures, addons, stock, category, store_id FROM cheapgoods WHERE store_id = ?", storeID)
 	if err != nil {
 		log.Printf("Failed to execute query: %v", err)
 		return nil, fmt.Errorf("failed to execute query: %w", err)
@@ -59,7 +67,7 @@ func FetchProducts() ([]Product, error) {
 		var p Product
 		var sizes, temperatures, addons string
 
-		if err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.ImageURL, &sizes, &temperatures, &addons, &p.Stock, &p.Category); err != nil {
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.ImageURL, &sizes, &temperatures, &addons, &p.Stock, &p.Category, &p.StoreID); err != nil {
 			log.Printf("Failed to scan product data: %v", err)
 			return nil, fmt.Errorf("failed to scan product data: %w", err)
 		}
@@ -112,14 +120,14 @@ func AddProduct(p Product) error {
 		return err
 	}
 
-	stmt, err := db.Prepare("INSERT INTO cheapgoods(id, name, price, imageUrl, sizes, temperatures, addons, stock, category) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	stmt, err := db.Prepare("INSERT INTO cheapgoods(id, name, price, imageUrl, sizes, temperatures, addons, stock, category, store_id) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		fmt.Println("Error preparing statement:", err)
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(pID, p.Name, p.Price, p.ImageURL, sizes, temperatures, addons, p.Stock, p.Category)
+	_, err = stmt.Exec(pID, p.Name, p.Price, p.ImageURL, sizes, temperatures, addons, p.Stock, p.Category, p.StoreID)
 	if err != nil {
 		fmt.Println("Error executing statement:", err)
 		return err
@@ -144,13 +152,13 @@ func UpdateProduct(p Product) error {
 		return err
 	}
 
-	stmt, err := db.Prepare("UPDATE cheapgoods SET name=?, price=?, imageUrl=?, sizes=?, temperatures=?, addons=?, stock=?, category=? WHERE id=?")
+	stmt, err := db.Prepare("UPDATE cheapgoods SET name=?, price=?, imageUrl=?, sizes=?, temperatures=?, addons=?, stock=?, category=? WHERE id=? AND store_id=?")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(p.Name, p.Price, p.ImageURL, sizes, temperatures, addons, p.Stock, p.Category, p.ID)
+	_, err = stmt.Exec(p.Name, p.Price, p.ImageURL, sizes, temperatures, addons, p.Stock, p.Category, p.ID, p.StoreID)
 	return err
 }
 
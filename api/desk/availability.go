@@ -0,0 +1,227 @@
+package desk
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrOverCapacity 表示预订人数超过餐桌容量
+	ErrOverCapacity = errors.New("party size exceeds table capacity")
+	// ErrReservationConflict 表示预订时段与同一餐桌的其他预订重叠
+	ErrReservationConflict = errors.New("reservation overlaps another booking")
+	// ErrUnknownTable 表示预订的餐桌不存在或已归档
+	ErrUnknownTable = errors.New("unknown table")
+)
+
+const (
+	// defaultReservationDuration 未指定时预订占用餐桌的分钟数
+	defaultReservationDuration = 90
+	// slotStep 查找就近空闲时段的步长
+	slotStep = 15 * time.Minute
+	// slotSearchRange 查找就近空闲时段的前后范围
+	slotSearchRange = 3 * time.Hour
+	// maxSlots 最多返回的就近时段数量
+	maxSlots = 6
+)
+
+// Slot 一个可预订的时段及其空闲餐桌
+type Slot struct {
+	Time   string  `json:"time"`
+	Tables []Table `json:"tables"`
+}
+
+// Availability 空闲餐桌查询结果，请求时段没有空闲餐桌时给出就近的可预订时段
+type Availability struct {
+	Time     string  `json:"time"`
+	Duration int     `json:"duration"`
+	Tables   []Table `json:"tables"`
+	Slots    []Slot  `json:"slots"`
+}
+
+func migrateReservations() error {
+	// 预订ID由数据库生成，避免并发预订取到相同的 MAX(ID)+1
+	if err := utils.EnsureAutoIncrement(db, "reservationList", "ID", "INT NOT NULL"); err != nil {
+		return err
+	}
+	return utils.EnsureColumn(db, "reservationList", "Duration", fmt.Sprintf("INT NOT NULL DEFAULT %d", defaultReservationDuration))
+}
+
+// reservationArgs 返回查询重叠预订所需的参数：新预订的结束时间、开始时间以及不再占用餐桌的状态
+func reservationArgs(start time.Time, duration int) []any {
+	end := start.Add(time.Duration(duration) * time.Minute)
+	args := []any{end.Format(dateTimeLayout), start.Format(dateTimeLayout)}
+	return append(args, inactiveReservationStatuses...)
+}
+
+// overlapCondition 与 [start, end) 重叠且仍然有效的预订
+const overlapCondition = `ReservationTime < ? AND DATE_ADD(ReservationTime, INTERVAL Duration MINUTE) > ?
+	AND Status NOT IN (?, ?, ?, ?)`
+
+// checkReservation 在事务中锁住餐桌，校验餐桌属于预订的门店、容量以及与其他预订是否重叠，excludeID 为正在修改的预订
+func checkReservation(tx *sql.Tx, r Reservation, start time.Time, excludeID int) error {
+	var mergedInto int
+	err := tx.QueryRow("SELECT COALESCE(merged_into, 0) FROM tableList WHERE id = ? AND store_id = ? AND deleted_at IS NULL FOR UPDATE", r.TableID, r.StoreID).Scan(&mergedInto)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %d", ErrUnknownTable, r.TableID)
+	}
+	if err != nil {
+		return err
+	}
+	if mergedInto > 0 {
+		return fmt.Errorf("%w: table %d is merged into %d", ErrTableMerged, r.TableID, mergedInto)
+	}
+
+	// 合并的餐桌按合计容量校验，组内任意一张餐桌上的预订都算冲突
+	capacity, err := groupCapacity(tx, r.TableID)
+	if err != nil {
+		return err
+	}
+	if r.NumOfPeople <= 0 || r.NumOfPeople > capacity {
+		return fmt.Errorf("%w: %d people, capacity %d", ErrOverCapacity, r.NumOfPeople, capacity)
+	}
+
+	args := append([]any{r.TableID, r.TableID, excludeID}, reservationArgs(start, r.Duration)...)
+	var conflict int
+	err = tx.QueryRow(`SELECT COALESCE(MIN(ID), 0) FROM reservationList
+		WHERE Table_ID IN (SELECT id FROM tableList WHERE id = ? OR merged_into = ?) AND ID <> ? AND `+overlapCondition, args...).Scan(&conflict)
+	if err != nil {
+		return err
+	}
+	if conflict > 0 {
+		return fmt.Errorf("%w: reservation %d", ErrReservationConflict, conflict)
+	}
+	return nil
+}
+
+// FindAvailableTables 返回门店容量足够且在 [start, start+duration) 内没有预订的餐桌，按容量从小到大排列；
+// 合并的餐桌作为一张餐桌按合计容量返回，组内任意一张有预订即不空闲；
+// 时段从现在开始时，正在就餐或待清台的餐桌也不算空闲
+func FindAvailableTables(storeID, people int, start time.Time, duration int, now time.Time) ([]Table, error) {
+	all, err := queryTables("SELECT "+tableColumns+" FROM tableList WHERE deleted_at IS NULL AND store_id = ?", storeID)
+	if err != nil {
+		return nil, err
+	}
+	var tables []Table
+	for _, t := range groupTables(all) {
+		if t.Capacity >= people {
+			tables = append(tables, t)
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].Capacity != tables[j].Capacity {
+			return tables[i].Capacity < tables[j].Capacity
+		}
+		return tables[i].ID < tables[j].ID
+	})
+
+	args := append([]any{storeID}, reservationArgs(start, duration)...)
+	rows, err := db.Query("SELECT DISTINCT Table_ID FROM reservationList WHERE store_id = ? AND "+overlapCondition, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reservations: %w", err)
+	}
+	defer rows.Close()
+	booked := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		booked[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	busyNow := !start.After(now.Add(slotStep))
+	free := []Table{}
+	for _, t := range tables {
+		if booked[t.ID] || (busyNow && t.Status != StatusAvailable) {
+			continue
+		}
+		if slices.ContainsFunc(t.Members, func(id int) bool { return booked[id] }) {
+			continue
+		}
+		free = append(free, t)
+	}
+	return free, nil
+}
+
+// FindAvailability 查找门店在请求时段的空闲餐桌，没有时在前后 slotSearchRange 内按步长查找最近的可预订时段
+func FindAvailability(storeID, people int, start time.Time, duration int, now time.Time) (Availability, error) {
+	a := Availability{Time: start.Format(dateTimeLayout), Duration: duration, Slots: []Slot{}}
+
+	var err error
+	if a.Tables, err = FindAvailableTables(storeID, people, start, duration, now); err != nil {
+		return a, err
+	}
+	if len(a.Tables) > 0 {
+		return a, nil
+	}
+
+	for offset := slotStep; offset <= slotSearchRange && len(a.Slots) < maxSlots; offset += slotStep {
+		for _, t := range []time.Time{start.Add(-offset), start.Add(offset)} {
+			if t.Before(now) {
+				continue
+			}
+			tables, err := FindAvailableTables(storeID, people, t, duration, now)
+			if err != nil {
+				return a, err
+			}
+			if len(tables) > 0 && len(a.Slots) < maxSlots {
+				a.Slots = append(a.Slots, Slot{Time: t.Format(dateTimeLayout), Tables: tables})
+			}
+		}
+	}
+	sort.Slice(a.Slots, func(i, j int) bool { return a.Slots[i].Time < a.Slots[j].Time })
+	return a, nil
+}
+
+// HandleAvailability 按人数和时间查询空闲餐桌，参数：people、time（RFC3339）、duration（分钟，可选）
+func HandleAvailability(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	people, err := strconv.Atoi(q.Get("people"))
+	if err != nil || people <= 0 {
+		http.Error(w, "Invalid people", http.StatusBadRequest)
+		return
+	}
+	start, err := time.Parse(time.RFC3339, q.Get("time"))
+	if err != nil {
+		http.Error(w, "Invalid time, expected RFC3339", http.StatusBadRequest)
+		return
+	}
+	duration := defaultReservationDuration
+	if s := q.Get("duration"); s != "" {
+		if duration, err = strconv.Atoi(s); err != nil || duration <= 0 {
+			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	storeID, ok := store.RequestStore(w, r)
+	if !ok {
+		return
+	}
+
+	loc := config.Location()
+	a, err := FindAvailability(storeID, people, start.In(loc), duration, time.Now().In(loc))
+	if err != nil {
+		log.Printf("Failed to find available tables: %v", err)
+		http.Error(w, "Failed to find available tables", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
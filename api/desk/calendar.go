@@ -0,0 +1,402 @@
+package desk
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	// icsTimeLayout iCalendar 的 UTC 时间格式
+	icsTimeLayout = "20060102T150405Z"
+	// icsLineLimit iCalendar 每行最多的字节数，超出时折行
+	icsLineLimit = 75
+	// calendarFeedDays 订阅日历包含从今天起多少天内的预订
+	calendarFeedDays = 60
+)
+
+// CalendarFeed 预订日历的订阅地址，token 作为地址的一部分用于鉴权，撤销后地址失效
+type CalendarFeed struct {
+	Token     string  `json:"token"`
+	Name      string  `json:"name"`
+	StoreID   int     `json:"storeId"`
+	URL       string  `json:"url"`
+	CreatedAt string  `json:"createdAt"`
+	RevokedAt *string `json:"revokedAt"`
+}
+
+// exportColumns 导出预订时的表头
+var exportColumns = []string{"ID", "Name", "NumOfPeople", "ReservationTime", "Duration", "Status", "Table", "Remarks", "Email", "Deposit"}
+
+func migrateCalendar() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS calendar_feeds (
+		token VARCHAR(64) PRIMARY KEY,
+		name VARCHAR(64) NOT NULL DEFAULT '',
+		store_id INT NOT NULL,
+		created_at DATETIME NOT NULL,
+		revoked_at DATETIME NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating calendar_feeds table: %w", err)
+	}
+	// 多门店之前按配置文件的门店号生成的订阅属于默认门店
+	if _, err := db.Exec("UPDATE calendar_feeds SET store_id = ? WHERE store_id NOT IN (SELECT id FROM stores)", store.DefaultID); err != nil {
+		return fmt.Errorf("assigning calendar feeds to the default store: %w", err)
+	}
+	return nil
+}
+
+func feedURL(token string) string {
+	return config.C.Wechat.Domain + "/api/reservation/calendar/" + token + ".ics"
+}
+
+// CreateCalendarFeed 为门店生成新的日历订阅地址
+func CreateCalendarFeed(storeID int, name string) (CalendarFeed, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return CalendarFeed{}, err
+	}
+	f := CalendarFeed{Token: hex.EncodeToString(buf), Name: name, StoreID: storeID, CreatedAt: storeNow()}
+	f.URL = feedURL(f.Token)
+	_, err := db.Exec("INSERT INTO calendar_feeds (token, name, store_id, created_at) VALUES (?, ?, ?, ?)",
+		f.Token, f.Name, f.StoreID, f.CreatedAt)
+	return f, err
+}
+
+// FetchCalendarFeeds 返回门店的全部日历订阅地址
+func FetchCalendarFeeds(storeID int) ([]CalendarFeed, error) {
+	rows, err := db.Query("SELECT token, name, store_id, created_at, revoked_at FROM calendar_feeds WHERE store_id = ? ORDER BY created_at DESC",
+		storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feeds := []CalendarFeed{}
+	for rows.Next() {
+		var f CalendarFeed
+		var revokedAt sql.NullString
+		if err := rows.Scan(&f.Token, &f.Name, &f.StoreID, &f.CreatedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		if revokedAt.Valid {
+			f.RevokedAt = &revokedAt.String
+		}
+		f.URL = feedURL(f.Token)
+		feeds = append(feeds, f)
+	}
+	return feeds, rows.Err()
+}
+
+// feedStore 返回未撤销的订阅 token 所属的门店，token 无效或已撤销时返回 sql.ErrNoRows
+func feedStore(token string) (int, error) {
+	var storeID int
+	err := db.QueryRow("SELECT store_id FROM calendar_feeds WHERE token = ? AND revoked_at IS NULL", token).Scan(&storeID)
+	return storeID, err
+}
+
+// FetchReservationsBetween 返回门店 [from, to) 内的预订，按时间排列
+func FetchReservationsBetween(storeID int, from, to time.Time) ([]Reservation, error) {
+	reservations, err := queryReservations(db, "SELECT "+reservationColumns+" FROM reservationList WHERE store_id = ? AND ReservationTime >= ? AND ReservationTime < ? ORDER BY ReservationTime, ID",
+		storeID, from.Format(dateTimeLayout), to.Format(dateTimeLayout))
+	if reservations == nil {
+		reservations = []Reservation{}
+	}
+	return reservations, err
+}
+
+func tableNames(storeID int) (map[int]string, error) {
+	tables, err := queryTables("SELECT "+tableColumns+" FROM tableList WHERE store_id = ?", storeID)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int]string)
+	for _, t := range tables {
+		names[t.ID] = t.Name
+	}
+	return names, nil
+}
+
+// icsEscape 按 RFC 5545 转义文本值
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// writeICSLine 写入一行内容，超过75字节时折行，不拆开多字节字符
+func writeICSLine(w io.Writer, line string) {
+	limit := icsLineLimit
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		io.WriteString(w, line[:cut]+"\r\n ")
+		line = line[cut:]
+		// 续行以空格开头，占用一个字节
+		limit = icsLineLimit - 1
+	}
+	io.WriteString(w, line+"\r\n")
+}
+
+// icsStatus 把预订状态对应到 VEVENT 的 STATUS
+func icsStatus(status string) string {
+	switch status {
+	case ReservationCancelled, ReservationNoShow:
+		return "CANCELLED"
+	case ReservationAwaitingDeposit:
+		return "TENTATIVE"
+	}
+	return "CONFIRMED"
+}
+
+// WriteICalendar 按 RFC 5545 输出预订日历，时间一律使用 UTC
+func WriteICalendar(w io.Writer, name string, reservations []Reservation, tables map[int]string, now time.Time) error {
+	loc := config.Location()
+	stamp := now.UTC().Format(icsTimeLayout)
+
+	writeICSLine(w, "BEGIN:VCALENDAR")
+	writeICSLine(w, "VERSION:2.0")
+	writeICSLine(w, "PRODID:-//stay//reservations//ZH")
+	writeICSLine(w, "CALSCALE:GREGORIAN")
+	writeICSLine(w, "METHOD:PUBLISH")
+	writeICSLine(w, "X-WR-CALNAME:"+icsEscape(name))
+	writeICSLine(w, "X-WR-TIMEZONE:"+loc.String())
+	for _, r := range reservations {
+		start, err := time.ParseInLocation(dateTimeLayout, r.ReservationTime, loc)
+		if err != nil {
+			return fmt.Errorf("reservation %d: %w", r.ID, err)
+		}
+		end := start.Add(time.Duration(r.Duration) * time.Minute)
+		table := tables[r.TableID]
+		if table == "" {
+			table = strconv.Itoa(r.TableID)
+		}
+
+		description := fmt.Sprintf("人数: %d\n餐桌: %s\n状态: %s", r.NumOfPeople, table, r.Status)
+		if r.Remarks != nil && *r.Remarks != "" {
+			description += "\n备注: " + *r.Remarks
+		}
+		if r.Deposit > 0 {
+			description += fmt.Sprintf("\n订金: %.2f", r.Deposit)
+		}
+
+		writeICSLine(w, "BEGIN:VEVENT")
+		writeICSLine(w, fmt.Sprintf("UID:reservation-%d@store-%d", r.ID, r.StoreID))
+		writeICSLine(w, "DTSTAMP:"+stamp)
+		writeICSLine(w, "DTSTART:"+start.UTC().Format(icsTimeLayout))
+		writeICSLine(w, "DTEND:"+end.UTC().Format(icsTimeLayout))
+		writeICSLine(w, "SUMMARY:"+icsEscape(fmt.Sprintf("%s %d人 %s", r.Name, r.NumOfPeople, table)))
+		writeICSLine(w, "LOCATION:"+icsEscape(table))
+		writeICSLine(w, "DESCRIPTION:"+icsEscape(description))
+		writeICSLine(w, "STATUS:"+icsStatus(r.Status))
+		writeICSLine(w, "END:VEVENT")
+	}
+	writeICSLine(w, "END:VCALENDAR")
+	return nil
+}
+
+func reservationRecord(r Reservation, tables map[int]string) []string {
+	remarks := ""
+	if r.Remarks != nil {
+		remarks = *r.Remarks
+	}
+	return []string{
+		strconv.Itoa(r.ID), r.Name, strconv.Itoa(r.NumOfPeople), r.ReservationTime, strconv.Itoa(r.Duration),
+		r.Status, tables[r.TableID], remarks, r.Email, strconv.FormatFloat(r.Deposit, 'f', 2, 64),
+	}
+}
+
+// HandleCalendarFeeds 返回门店的日历订阅地址
+func HandleCalendarFeeds(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	feeds, err := FetchCalendarFeeds(storeID)
+	if err != nil {
+		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feeds)
+}
+
+// HandleCreateCalendarFeed 生成日历订阅地址，请求体为 {"name": "..."}，name 用于区分订阅的人或设备
+func HandleCreateCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	f, err := CreateCalendarFeed(storeID, requestData.Name)
+	if err != nil {
+		log.Printf("Failed to create calendar feed: %v", err)
+		http.Error(w, "Failed to create calendar feed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(f)
+}
+
+// HandleRevokeCalendarFeed 撤销日历订阅地址，请求体为 {"token": "..."}
+func HandleRevokeCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := db.Exec("UPDATE calendar_feeds SET revoked_at = ? WHERE token = ? AND store_id = ? AND revoked_at IS NULL",
+		storeNow(), requestData.Token, storeID)
+	if err != nil {
+		http.Error(w, "Failed to revoke calendar feed", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Calendar feed not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Calendar feed revoked successfully"))
+}
+
+// HandleCalendarFeed 输出订阅日历，包含今天起 calendarFeedDays 天内的预订；token 无效或已撤销时返回404
+func HandleCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	storeID, err := feedStore(mux.Vars(r)["token"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "Calendar feed not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to check calendar feed", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().In(config.Location())
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	reservations, err := FetchReservationsBetween(storeID, today, today.AddDate(0, 0, calendarFeedDays))
+	if err != nil {
+		log.Printf("Failed to fetch reservations: %v", err)
+		http.Error(w, "Failed to fetch reservations", http.StatusInternalServerError)
+		return
+	}
+	tables, err := tableNames(storeID)
+	if err != nil {
+		http.Error(w, "Failed to fetch tables", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if err := WriteICalendar(w, "预订", reservations, tables, now); err != nil {
+		log.Printf("Error writing calendar feed: %v", err)
+	}
+}
+
+// HandleExportReservations 导出日期区间内的预订，from 与 to 为日期（含 from，不含 to），
+// format 为 ics、xlsx 或 csv（默认）
+func HandleExportReservations(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	loc := config.Location()
+	from, err := time.ParseInLocation("2006-01-02", q.Get("from"), loc)
+	if err != nil {
+		http.Error(w, "Invalid from date", http.StatusBadRequest)
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", q.Get("to"), loc)
+	if err != nil || !to.After(from) {
+		http.Error(w, "Invalid to date", http.StatusBadRequest)
+		return
+	}
+
+	reservations, err := FetchReservationsBetween(storeID, from, to)
+	if err != nil {
+		log.Printf("Failed to fetch reservations: %v", err)
+		http.Error(w, "Failed to fetch reservations", http.StatusInternalServerError)
+		return
+	}
+	tables, err := tableNames(storeID)
+	if err != nil {
+		http.Error(w, "Failed to fetch tables", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("reservations-%s-%s", from.Format("20060102"), to.Format("20060102"))
+	switch q.Get("format") {
+	case "ics":
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.ics", filename))
+		if err := WriteICalendar(w, "预订", reservations, tables, time.Now()); err != nil {
+			log.Printf("Error writing ics export: %v", err)
+		}
+	case "xlsx":
+		f := excelize.NewFile()
+		defer f.Close()
+		sheet := f.GetSheetName(0)
+		if err := f.SetSheetRow(sheet, "A1", &exportColumns); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i, res := range reservations {
+			cell, _ := excelize.CoordinatesToCellName(1, i+2)
+			record := reservationRecord(res, tables)
+			if err := f.SetSheetRow(sheet, cell, &record); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.xlsx", filename))
+		if err := f.Write(w); err != nil {
+			log.Printf("Error writing xlsx export: %v", err)
+		}
+	default:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", filename))
+		// 写入 BOM，便于 Excel 正确识别中文
+		w.Write([]byte("\xEF\xBB\xBF"))
+		cw := csv.NewWriter(w)
+		cw.Write(exportColumns)
+		for _, res := range reservations {
+			cw.Write(reservationRecord(res, tables))
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("Error writing csv export: %v", err)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package desk
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/pay"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/wechatpay-apiv3/wechatpay-go/services/payments/jsapi"
+)
+
+// 订金状态
+const (
+	DepositPending   = "pending"   // 等待支付
+	DepositPaid      = "paid"      // 已支付，到店后抵扣账单
+	DepositApplied   = "applied"   // 已抵扣到订单
+	DepositRefunded  = "refunded"  // 已退还
+	DepositForfeited = "forfeited" // 按规则不予退还
+	DepositCancelled = "cancelled" // 未支付，随预订取消
+)
+
+// ReservationAwaitingDeposit 需要订金且尚未支付的预订状态，此时餐桌仍为该预订保留
+const ReservationAwaitingDeposit = "awaiting_deposit"
+
+// ReservationConfirmed 订金支付后的预订状态
+const ReservationConfirmed = "confirmed"
+
+const defaultDepositPayMinutes = 15
+
+var (
+	// ErrDepositRequired 表示预订需要订金但缺少支付所需的小程序用户
+	ErrDepositRequired = errors.New("deposit required: openid is needed to pay")
+	// ErrNoDeposit 表示预订没有订金
+	ErrNoDeposit = errors.New("reservation has no deposit")
+	// ErrDepositState 表示订金当前状态不允许该操作
+	ErrDepositState = errors.New("invalid deposit state")
+)
+
+// Deposit 预订订金
+type Deposit struct {
+	ReservationID int     `json:"reservationId"`
+	Amount        float64 `json:"amount"`
+	TradeNo       string  `json:"tradeNo"`
+	Status        string  `json:"status"`
+	OrderID       int     `json:"orderId,omitempty"` // 抵扣的订单
+	CreatedAt     string  `json:"createdAt"`
+	SettledAt     string  `json:"settledAt,omitempty"`
+}
+
+func migrateDeposits() error {
+	if err := utils.EnsureColumn(db, "reservationList", "Deposit", "DECIMAL(10,2) NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS reservation_deposits (
+		reservation_id INT PRIMARY KEY,
+		amount DECIMAL(10,2) NOT NULL,
+		trade_no VARCHAR(32) NOT NULL UNIQUE,
+		status VARCHAR(16) NOT NULL,
+		order_id INT NULL,
+		created_at DATETIME NOT NULL,
+		settled_at DATETIME NULL,
+		INDEX idx_status (status)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating reservation_deposits table: %w", err)
+	}
+	return nil
+}
+
+func depositPayWindow() time.Duration {
+	minutes := config.C.Store.Deposit.PayMinutes
+	if minutes <= 0 {
+		minutes = defaultDepositPayMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// depositFor 按订金规则计算预订需要的订金：人数达到 min_people，或顾客爽约次数达到 no_show_threshold
+func depositFor(r Reservation) (float64, error) {
+	policy := config.C.Store.Deposit
+	if policy.PerPerson <= 0 {
+		return 0, nil
+	}
+	amount := math.Round(policy.PerPerson*float64(r.NumOfPeople)*100) / 100
+	if r.NumOfPeople >= policy.MinPeople {
+		return amount, nil
+	}
+	if policy.NoShowThreshold <= 0 {
+		return 0, nil
+	}
+	count, err := CountNoShows(r.OpenID, r.Email)
+	if err != nil {
+		return 0, err
+	}
+	if count >= policy.NoShowThreshold {
+		return amount, nil
+	}
+	return 0, nil
+}
+
+// createDeposit 在创建预订的事务中写入待支付的订金
+func createDeposit(tx *sql.Tx, r Reservation) error {
+	_, err := tx.Exec("INSERT INTO reservation_deposits (reservation_id, amount, trade_no, status, created_at) VALUES (?, ?, ?, ?, ?)",
+		r.ID, r.Deposit, "D"+utils.GetOrderNo(), DepositPending, storeNow())
+	return err
+}
+
+// redeposit 预订人数变化后按订金规则重新计算订金，已支付的订金保持不变：
+// 原本无需订金的预订改为待支付；待支付的订金金额变化时换新的支付单号，不再需要订金时取消并确认预订
+func redeposit(tx *sql.Tx, r *Reservation) error {
+	amount, err := depositFor(*r)
+	if err != nil {
+		return err
+	}
+	var status string
+	err = tx.QueryRow("SELECT status FROM reservation_deposits WHERE reservation_id = ? FOR UPDATE", r.ID).Scan(&status)
+	switch {
+	case err == sql.ErrNoRows:
+		if amount <= 0 {
+			return nil
+		}
+		if r.OpenID == "" {
+			return ErrDepositRequired
+		}
+		r.Deposit, r.Status = amount, ReservationAwaitingDeposit
+		return createDeposit(tx, *r)
+	case err != nil:
+		return err
+	case status != DepositPending || amount == r.Deposit:
+		return nil
+	case amount <= 0:
+		r.Deposit, r.Status = 0, ReservationConfirmed
+		return setDepositStatus(tx, r.ID, DepositPending, DepositCancelled)
+	}
+	r.Deposit = amount
+	_, err = tx.Exec("UPDATE reservation_deposits SET amount = ?, trade_no = ? WHERE reservation_id = ?",
+		amount, "D"+utils.GetOrderNo(), r.ID)
+	return err
+}
+
+func fetchDeposit(reservationID int) (Deposit, error) {
+	var d Deposit
+	var orderID sql.NullInt64
+	var settledAt sql.NullString
+	err := db.QueryRow(`SELECT reservation_id, amount, trade_no, status, order_id, created_at, settled_at
+		FROM reservation_deposits WHERE reservation_id = ?`, reservationID).
+		Scan(&d.ReservationID, &d.Amount, &d.TradeNo, &d.Status, &orderID, &d.CreatedAt, &settledAt)
+	if err == sql.ErrNoRows {
+		return d, ErrNoDeposit
+	}
+	d.OrderID = int(orderID.Int64)
+	d.SettledAt = settledAt.String
+	return d, err
+}
+
+// depositPayment 为待支付的订金创建小程序支付，支付窗口从创建预订时开始计算
+func depositPayment(r Reservation) (*jsapi.PrepayWithRequestPaymentResponse, error) {
+	d, err := fetchDeposit(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if d.Status != DepositPending {
+		return nil, fmt.Errorf("%w: deposit is %s", ErrDepositState, d.Status)
+	}
+	created, err := time.ParseInLocation(dateTimeLayout, d.CreatedAt, config.Location())
+	if err != nil {
+		return nil, err
+	}
+	return pay.Prepay(r.StoreID, r.OpenID, d.TradeNo, d.Amount, "预订订金", fmt.Sprintf("reservation:%d", r.ID), created.Add(depositPayWindow()))
+}
+
+// setDepositStatus 把订金从 from 状态改为 to，状态已被其他请求修改时返回 ErrDepositState
+func setDepositStatus(ex execer, reservationID int, from, to string) error {
+	res, err := ex.Exec("UPDATE reservation_deposits SET status = ?, settled_at = ? WHERE reservation_id = ? AND status = ?",
+		to, storeNow(), reservationID, from)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: deposit is no longer %s", ErrDepositState, from)
+	}
+	return nil
+}
+
+// ConfirmDeposit 向微信支付查询订金是否已支付，已支付时确认预订并发送预订通知；
+// 预订已因超时取消时退还订金
+func ConfirmDeposit(reservationID int) (Deposit, error) {
+	d, err := fetchDeposit(reservationID)
+	if err != nil || d.Status != DepositPending {
+		return d, err
+	}
+	r, err := fetchReservation(reservationID)
+	if err != nil {
+		return d, err
+	}
+	paid, err := pay.TradePaid(r.StoreID, d.TradeNo)
+	if err != nil || !paid {
+		return d, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return d, err
+	}
+	defer tx.Rollback()
+	if err := setDepositStatus(tx, reservationID, DepositPending, DepositPaid); err != nil {
+		return d, err
+	}
+	res, err := tx.Exec("UPDATE reservationList SET Status = ? WHERE ID = ? AND Status = ?",
+		ReservationConfirmed, reservationID, ReservationAwaitingDeposit)
+	if err != nil {
+		return d, err
+	}
+	if err := tx.Commit(); err != nil {
+		return d, err
+	}
+	d.Status = DepositPaid
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		// 支付完成前预订已取消
+		if err := settleDeposit(r, true, "预订已取消"); err != nil {
+			return d, err
+		}
+		return fetchDeposit(reservationID)
+	}
+
+	r.Status = ReservationConfirmed
+	at, err := time.ParseInLocation(dateTimeLayout, r.ReservationTime, config.Location())
+	if err != nil {
+		return d, err
+	}
+	if err := scheduleReservationNotices(r, at); err != nil {
+		log.Println("Failed to schedule reservation notifications:", err)
+	}
+	return d, nil
+}
+
+// settleDeposit 预订取消或爽约时处理订金：已支付的按 refund 退还或不予退还，未支付的随预订取消
+func settleDeposit(r Reservation, refund bool, reason string) error {
+	d, err := fetchDeposit(r.ID)
+	if errors.Is(err, ErrNoDeposit) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch d.Status {
+	case DepositPending:
+		// 顾客可能已支付但尚未确认
+		paid, err := pay.TradePaid(r.StoreID, d.TradeNo)
+		if err != nil && !errors.Is(err, pay.ErrNoClient) {
+			return err
+		}
+		if !paid {
+			return setDepositStatus(db, r.ID, DepositPending, DepositCancelled)
+		}
+		if err := setDepositStatus(db, r.ID, DepositPending, DepositPaid); err != nil {
+			return err
+		}
+	case DepositPaid:
+	default:
+		return nil
+	}
+
+	if !refund {
+		return setDepositStatus(db, r.ID, DepositPaid, DepositForfeited)
+	}
+	if err := pay.Refund(r.StoreID, d.TradeNo, d.TradeNo+"R", d.Amount, d.Amount, reason); err != nil {
+		return err
+	}
+	return setDepositStatus(db, r.ID, DepositPaid, DepositRefunded)
+}
+
+// cancellationRefundable 预订开始前至少 refund_hours 小时取消的可退还订金
+func cancellationRefundable(r Reservation, now time.Time) bool {
+	at, err := time.ParseInLocation(dateTimeLayout, r.ReservationTime, config.Location())
+	if err != nil {
+		return false
+	}
+	return at.Sub(now) >= time.Duration(config.C.Store.Deposit.RefundHours)*time.Hour
+}
+
+// ApplyDeposit 在下单事务中把餐桌上今天已到店预订的订金抵扣到订单，返回抵扣金额，没有可抵扣的订金时返回0
+func ApplyDeposit(tx *sql.Tx, tableID, orderID int) (float64, error) {
+	var reservationID int
+	var amount float64
+	today := time.Now().In(config.Location()).Format("2006-01-02")
+	err := tx.QueryRow(`SELECT d.reservation_id, d.amount FROM reservation_deposits d
+		JOIN reservationList r ON r.ID = d.reservation_id
+		WHERE d.status = ? AND r.Status = ? AND r.Table_ID = ? AND DATE(r.ReservationTime) = ?
+		ORDER BY r.ReservationTime LIMIT 1 FOR UPDATE`,
+		DepositPaid, ReservationSeated, tableID, today).Scan(&reservationID, &amount)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("UPDATE reservation_deposits SET status = ?, order_id = ?, settled_at = ? WHERE reservation_id = ?",
+		DepositApplied, orderID, storeNow(), reservationID)
+	if err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+func writeDepositError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNoDeposit), errors.Is(err, sql.ErrNoRows):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrDepositState):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, pay.ErrNoClient):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		log.Printf("Deposit error: %v", err)
+		http.Error(w, "Failed to process deposit", http.StatusInternalServerError)
+	}
+}
+
+// HandlePayDeposit 重新发起订金支付，返回调起支付的参数
+func HandlePayDeposit(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		ReservationId int `json:"reservationId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	reservation, err := fetchReservation(data.ReservationId)
+	if err != nil {
+		writeDepositError(w, err)
+		return
+	}
+	if reservation.Status != ReservationAwaitingDeposit {
+		writeDepositError(w, fmt.Errorf("%w: reservation is %s", ErrDepositState, reservation.Status))
+		return
+	}
+	payment, err := depositPayment(reservation)
+	if err != nil {
+		writeDepositError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payment)
+}
+
+// HandleConfirmDeposit 小程序支付完成后调用，确认订金并返回订金状态
+func HandleConfirmDeposit(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		ReservationId int `json:"reservationId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	d, err := ConfirmDeposit(data.ReservationId)
+	if err != nil {
+		writeDepositError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// HandleDeposit 查询预订的订金
+func HandleDeposit(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid reservation id", http.StatusBadRequest)
+		return
+	}
+
+	d, err := fetchDeposit(id)
+	if err != nil {
+		writeDepositError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"gocode/first/api/store"
 	"gocode/first/config"
+	"gocode/first/utils"
 	"log"
 	"net/http"
 
@@ -32,6 +34,38 @@ func init() {
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+
+	if err = utils.EnsureColumn(db, "tableList", "deleted_at", "DATETIME NULL"); err != nil {
+		log.Fatal("Failed to migrate tables:", err)
+	}
+	if err = migrateFloor(); err != nil {
+		log.Fatal("Failed to migrate floor plan:", err)
+	}
+	if err = migrateSessions(); err != nil {
+		log.Fatal("Failed to migrate dining sessions:", err)
+	}
+	if err = migrateStatus(); err != nil {
+		log.Fatal("Failed to migrate table status:", err)
+	}
+	if err = migrateReservations(); err != nil {
+		log.Fatal("Failed to migrate reservations:", err)
+	}
+	if err = migrateReservationContacts(); err != nil {
+		log.Fatal("Failed to migrate reservation contacts:", err)
+	}
+	if err = migrateDeposits(); err != nil {
+		log.Fatal("Failed to migrate reservation deposits:", err)
+	}
+	if err = migrateWaitlist(); err != nil {
+		log.Fatal("Failed to migrate waitlist:", err)
+	}
+	if err = migrateCalendar(); err != nil {
+		log.Fatal("Failed to migrate calendar feeds:", err)
+	}
+	// 餐桌、区域、预订和排队按门店区分
+	if err = store.EnsureScoped(db, "tableList", "floor_areas", "reservationList", "waitlist"); err != nil {
+		log.Fatal("Failed to migrate store scope:", err)
+	}
 }
 
 // Table 表示餐桌信息
@@ -41,6 +75,22 @@ type Table struct {
 	Capacity int    `json:"capacity"`
 	Status   string `json:"status"`
 	Image    string `json:"image"`
+	Layout
+	MergedInto int   `json:"mergedInto,omitempty"` // 合并到的主桌
+	Members    []int `json:"members,omitempty"`    // 合并到本桌的其他餐桌，仅在按合并分组时填写
+}
+
+// tableColumns queryTables 解析的列
+const tableColumns = "id, name, capacity, status, image, COALESCE(area_id, 0), pos_x, pos_y, width, height, rotation, shape, COALESCE(merged_into, 0)"
+
+// TableStore 返回餐桌所属的门店，餐桌不存在或已归档时返回 ErrUnknownTable
+func TableStore(tableID int) (int, error) {
+	var storeID int
+	err := db.QueryRow("SELECT store_id FROM tableList WHERE id = ? AND deleted_at IS NULL", tableID).Scan(&storeID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w: %d", ErrUnknownTable, tableID)
+	}
+	return storeID, err
 }
 
 // GetMaxTableID 查询当前最大的餐桌ID
@@ -54,6 +104,27 @@ func GetMaxTableID() (int, error) {
 	return maxID, nil
 }
 
+// queryTables 执行选出餐桌各列的查询并解析结果
+func queryTables(query string, args ...any) ([]Table, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// 遍历查询结果并将数据存入切片
+	var tables []Table
+	for rows.Next() {
+		var table Table
+		if err := rows.Scan(&table.ID, &table.Name, &table.Capacity, &table.Status, &table.Image,
+			&table.AreaID, &table.X, &table.Y, &table.Width, &table.Height, &table.Rotation, &table.Shape, &table.MergedInto); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
 // handleTableData 请求处理函数，用于处理对餐桌数据的请求
 func HandleTableData(w http.ResponseWriter, r *http.Request) {
 	// 设置响应头为 JSON 格式
@@ -65,25 +136,17 @@ func HandleTableData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
 	// 执行查询语句
-	rows, err := db.Query("SELECT id, name, capacity, status, image FROM tablelist")
+	tables, err := queryTables("SELECT "+tableColumns+" FROM tableList WHERE deleted_at IS NULL AND store_id = ?", storeID)
 	if err != nil {
 		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	// 遍历查询结果并将数据存入切片
-	var tables []Table
-	for rows.Next() {
-		var table Table
-		err := rows.Scan(&table.ID, &table.Name, &table.Capacity, &table.Status, &table.Image)
-		if err != nil {
-			http.Error(w, "Failed to scan rows", http.StatusInternalServerError)
-			return
-		}
-		tables = append(tables, table)
-	}
 
 	// 将切片转换为 JSON 格式并返回
 	err = json.NewEncoder(w).Encode(tables)
@@ -106,17 +169,34 @@ func HandleDeskData(w http.ResponseWriter, r *http.Request) {
 
 	// 解析请求体中的 JSON 数据
 	var requestData struct {
-		TableName string `json:"tableName"`
+		ID int `json:"id"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&requestData)
 	if err != nil {
 		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
 		return
 	}
-	fmt.Println("Table Name:", requestData.TableName)
+	if requestData.ID <= 0 {
+		http.Error(w, "Missing table id", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
 
-	// 根据请求中的餐桌名称执行删除操作
-	_, err = db.Exec("DELETE FROM tablelist WHERE name = ?", requestData.TableName)
+	// 根据请求中的餐桌ID将门店的餐桌移入归档
+	res, err := db.Exec("UPDATE tableList SET deleted_at = NOW() WHERE id = ? AND store_id = ? AND deleted_at IS NULL", requestData.ID, storeID)
+	if err != nil {
+		http.Error(w, "Failed to delete table", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Table not found", http.StatusNotFound)
+		return
+	}
+	// 归档的餐桌不再参与合并
+	_, err = db.Exec("UPDATE tableList SET merged_into = NULL WHERE id = ? OR merged_into = ?", requestData.ID, requestData.ID)
 	if err != nil {
 		http.Error(w, "Failed to delete table", http.StatusInternalServerError)
 		return
@@ -145,14 +225,31 @@ func HandleUpdateDeskData(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
 		return
 	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
 
-	// 根据解析出的数据更新数据库中的记录
-	_, err = db.Exec("UPDATE tableList SET name = ?, capacity = ?, status = ?, image = ? WHERE id = ?",
-		updateData.Name, updateData.Capacity, updateData.Status, updateData.Image, updateData.ID)
+	// 根据解析出的数据更新数据库中的记录，状态由订单、会话和清台确认驱动，这里不再修改
+	res, err := db.Exec("UPDATE tableList SET name = ?, capacity = ?, image = ? WHERE id = ? AND store_id = ? AND deleted_at IS NULL",
+		updateData.Name, updateData.Capacity, updateData.Image, updateData.ID, storeID)
 	if err != nil {
 		http.Error(w, "Failed to update table", http.StatusInternalServerError)
 		return
 	}
+	// 内容没有变化时影响行数也为0，需要确认餐桌是否存在
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM tableList WHERE id = ? AND store_id = ? AND deleted_at IS NULL)", updateData.ID, storeID).Scan(&exists)
+		if err != nil {
+			http.Error(w, "Failed to update table", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Table not found", http.StatusNotFound)
+			return
+		}
+	}
 
 	// 返回更新成功的响应
 	w.WriteHeader(http.StatusOK)
@@ -174,6 +271,10 @@ func HandleAddTable(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
 		return
 	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
 
 	// 查询当前最大的餐桌ID
 	maxID, err := GetMaxTableID()
@@ -184,8 +285,20 @@ func HandleAddTable(w http.ResponseWriter, r *http.Request) {
 	newTableID := maxID + 1 // 新餐桌ID为当前最大ID加一
 
 	// 插入数据到数据库，使用newTableID作为新餐桌的ID
-	query := `INSERT INTO tableList (id, name, capacity, status, image) VALUES (?, ?, ?, ?, ?)`
-	_, err = db.Exec(query, newTableID, newTable.Name, newTable.Capacity, newTable.Status, newTable.Image)
+	if newTable.Shape == "" {
+		newTable.Shape = ShapeRect
+	}
+	if newTable.Width <= 0 || newTable.Height <= 0 {
+		newTable.Width, newTable.Height = 80, 80
+	}
+	var areaID sql.NullInt64
+	if newTable.AreaID > 0 {
+		areaID = sql.NullInt64{Int64: int64(newTable.AreaID), Valid: true}
+	}
+	query := `INSERT INTO tableList (id, name, capacity, status, image, area_id, pos_x, pos_y, width, height, rotation, shape, store_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(query, newTableID, newTable.Name, newTable.Capacity, StatusAvailable, newTable.Image,
+		areaID, newTable.X, newTable.Y, newTable.Width, newTable.Height, newTable.Rotation, newTable.Shape, storeID)
 	if err != nil {
 		http.Error(w, "Failed to insert new table", http.StatusInternalServerError)
 		return
@@ -194,3 +307,49 @@ func HandleAddTable(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Table added successfully", "newID": fmt.Sprintf("%d", newTableID)})
 }
+
+// HandleArchivedTables 返回已归档的餐桌
+func HandleArchivedTables(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	tables, err := queryTables("SELECT "+tableColumns+" FROM tableList WHERE deleted_at IS NOT NULL AND store_id = ? ORDER BY deleted_at DESC", storeID)
+	if err != nil {
+		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tables)
+}
+
+// HandleRestoreTable 根据ID恢复已归档的餐桌
+func HandleRestoreTable(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := db.Exec("UPDATE tableList SET deleted_at = NULL WHERE id = ? AND store_id = ? AND deleted_at IS NOT NULL", requestData.ID, storeID)
+	if err != nil {
+		http.Error(w, "Failed to restore table", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Archived table not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Table restored successfully"))
+}
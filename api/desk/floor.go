@@ -0,0 +1,526 @@
+package desk
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/store"
+	"gocode/first/utils"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// 餐桌形状
+const (
+	ShapeRect  = "rect"
+	ShapeRound = "round"
+)
+
+var (
+	// ErrTableMerged 表示餐桌已合并到其他餐桌，或已有其他餐桌合并到它
+	ErrTableMerged = errors.New("table is already merged")
+	// ErrNotMerged 表示餐桌没有合并
+	ErrNotMerged = errors.New("table is not merged")
+	// ErrInvalidLayout 表示平面图数据不合法
+	ErrInvalidLayout = errors.New("invalid floor layout")
+)
+
+// Layout 餐桌在平面图上的位置与形状，坐标和尺寸的单位由前端平面图决定
+type Layout struct {
+	AreaID   int     `json:"areaId"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Width    float64 `json:"width"`
+	Height   float64 `json:"height"`
+	Rotation int     `json:"rotation"` // 顺时针旋转的角度
+	Shape    string  `json:"shape"`    // rect 或 round
+}
+
+// Area 楼面区域，例如大厅、包间、露台
+type Area struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	SortOrder int    `json:"sortOrder"`
+}
+
+type rowQueryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// migrateFloor 创建楼面区域表，并为餐桌增加平面图位置和合并关系
+func migrateFloor() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS floor_areas (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(64) NOT NULL,
+		sort_order INT NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating floor_areas table: %w", err)
+	}
+
+	columns := []struct{ name, definition string }{
+		{"area_id", "INT NULL"},
+		{"pos_x", "DECIMAL(8,2) NOT NULL DEFAULT 0"},
+		{"pos_y", "DECIMAL(8,2) NOT NULL DEFAULT 0"},
+		{"width", "DECIMAL(8,2) NOT NULL DEFAULT 80"},
+		{"height", "DECIMAL(8,2) NOT NULL DEFAULT 80"},
+		{"rotation", "INT NOT NULL DEFAULT 0"},
+		{"shape", "VARCHAR(16) NOT NULL DEFAULT '" + ShapeRect + "'"},
+		{"merged_into", "INT NULL"},
+	}
+	for _, c := range columns {
+		if err := utils.EnsureColumn(db, "tableList", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func placeholders(n int) string {
+	return "?" + strings.Repeat(", ?", n-1)
+}
+
+func intArgs(ids []int) []any {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
+
+// tableHost 返回餐桌所在合并组的主桌，没有合并时返回餐桌本身
+func tableHost(q rowQueryer, tableID int) (int, error) {
+	var host int
+	err := q.QueryRow("SELECT COALESCE(merged_into, id) FROM tableList WHERE id = ? AND deleted_at IS NULL", tableID).Scan(&host)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w: %d", ErrUnknownTable, tableID)
+	}
+	return host, err
+}
+
+// groupCapacity 返回主桌与合并到它的餐桌的总容量
+func groupCapacity(q rowQueryer, hostID int) (int, error) {
+	var capacity int
+	err := q.QueryRow("SELECT COALESCE(SUM(capacity), 0) FROM tableList WHERE (id = ? OR merged_into = ?) AND deleted_at IS NULL",
+		hostID, hostID).Scan(&capacity)
+	return capacity, err
+}
+
+// groupTables 把被合并的餐桌并入主桌：主桌的容量为合计容量，Members 列出被合并的餐桌
+func groupTables(tables []Table) []Table {
+	index := make(map[int]int)
+	var grouped []Table
+	for _, t := range tables {
+		if t.MergedInto == 0 {
+			index[t.ID] = len(grouped)
+			grouped = append(grouped, t)
+		}
+	}
+	for _, t := range tables {
+		if i, ok := index[t.MergedInto]; ok && t.MergedInto != 0 {
+			grouped[i].Capacity += t.Capacity
+			grouped[i].Members = append(grouped[i].Members, t.ID)
+		}
+	}
+	return grouped
+}
+
+// FetchAreas 返回门店的全部楼面区域
+func FetchAreas(storeID int) ([]Area, error) {
+	rows, err := db.Query("SELECT id, name, sort_order FROM floor_areas WHERE store_id = ? ORDER BY sort_order, id", storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	areas := []Area{}
+	for rows.Next() {
+		var a Area
+		if err := rows.Scan(&a.ID, &a.Name, &a.SortOrder); err != nil {
+			return nil, err
+		}
+		areas = append(areas, a)
+	}
+	return areas, rows.Err()
+}
+
+// TablePlacement 一张餐桌在平面图上的位置
+type TablePlacement struct {
+	ID int `json:"id"`
+	Layout
+}
+
+// SaveLayout 批量保存门店餐桌在平面图上的位置，AreaID 为0表示不属于任何区域；
+// 餐桌和区域都必须属于该门店
+func SaveLayout(storeID int, placements []TablePlacement) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, p := range placements {
+		if p.Shape == "" {
+			p.Shape = ShapeRect
+		}
+		if p.Shape != ShapeRect && p.Shape != ShapeRound {
+			return fmt.Errorf("%w: unknown shape %q", ErrInvalidLayout, p.Shape)
+		}
+		if p.Width <= 0 || p.Height <= 0 {
+			return fmt.Errorf("%w: table %d has no size", ErrInvalidLayout, p.ID)
+		}
+		var areaID sql.NullInt64
+		if p.AreaID > 0 {
+			var exists bool
+			if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM floor_areas WHERE id = ? AND store_id = ?)", p.AreaID, storeID).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("%w: unknown area %d", ErrInvalidLayout, p.AreaID)
+			}
+			areaID = sql.NullInt64{Int64: int64(p.AreaID), Valid: true}
+		}
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM tableList WHERE id = ? AND store_id = ? AND deleted_at IS NULL)", p.ID, storeID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %d", ErrUnknownTable, p.ID)
+		}
+		_, err = tx.Exec("UPDATE tableList SET area_id = ?, pos_x = ?, pos_y = ?, width = ?, height = ?, rotation = ?, shape = ? WHERE id = ? AND store_id = ?",
+			areaID, p.X, p.Y, p.Width, p.Height, ((p.Rotation%360)+360)%360, p.Shape, p.ID, storeID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// MergeTables 把门店的餐桌合并到主桌，合并后共用主桌的就餐会话和账单，预订和可用性按合计容量计算；
+// 所有餐桌都必须属于该门店，被合并的餐桌不能有进行中的会话，也不能是其他合并组的主桌
+func MergeTables(storeID, hostID int, memberIDs []int) error {
+	ids := []int{hostID}
+	seen := map[int]bool{hostID: true}
+	for _, id := range memberIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	members := ids[1:]
+	if len(members) == 0 {
+		return fmt.Errorf("%w: no tables to merge into %d", ErrInvalidLayout, hostID)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, status, COALESCE(merged_into, 0) FROM tableList WHERE id IN ("+placeholders(len(ids))+") AND store_id = ? AND deleted_at IS NULL FOR UPDATE",
+		append(intArgs(ids), storeID)...)
+	if err != nil {
+		return err
+	}
+	status := make(map[int]string)
+	for rows.Next() {
+		var id, mergedInto int
+		var s string
+		if err := rows.Scan(&id, &s, &mergedInto); err != nil {
+			rows.Close()
+			return err
+		}
+		status[id] = s
+		if mergedInto != 0 && (id == hostID || mergedInto != hostID) {
+			rows.Close()
+			return fmt.Errorf("%w: table %d is merged into %d", ErrTableMerged, id, mergedInto)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, ok := status[id]; !ok {
+			return fmt.Errorf("%w: %d", ErrUnknownTable, id)
+		}
+	}
+
+	var hosts int
+	err = tx.QueryRow("SELECT COUNT(*) FROM tableList WHERE merged_into IN ("+placeholders(len(members))+")", intArgs(members)...).Scan(&hosts)
+	if err != nil {
+		return err
+	}
+	if hosts > 0 {
+		return fmt.Errorf("%w: a table to merge has tables merged into it", ErrTableMerged)
+	}
+
+	var sessions int
+	err = tx.QueryRow("SELECT COUNT(*) FROM dining_sessions WHERE closed_at IS NULL AND table_id IN ("+placeholders(len(members))+")",
+		intArgs(members)...).Scan(&sessions)
+	if err != nil {
+		return err
+	}
+	if sessions > 0 {
+		return fmt.Errorf("%w: a table to merge has an open dining session", ErrStatusTransition)
+	}
+
+	_, err = tx.Exec("UPDATE tableList SET merged_into = ? WHERE id IN ("+placeholders(len(members))+")",
+		append([]any{hostID}, intArgs(members)...)...)
+	if err != nil {
+		return fmt.Errorf("merging tables: %w", err)
+	}
+	for _, id := range members {
+		if err := setTableStatus(tx, id, status[hostID], fmt.Sprintf("merged into %d", hostID)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SplitTables 拆开合并的餐桌：传入主桌时拆开整组，传入被合并的餐桌时只拆出这一张；
+// 会话和账单留在主桌，拆出的餐桌正在就餐时改为待清台；餐桌必须属于该门店
+func SplitTables(storeID, tableID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var mergedInto int
+	err = tx.QueryRow("SELECT COALESCE(merged_into, 0) FROM tableList WHERE id = ? AND store_id = ? AND deleted_at IS NULL FOR UPDATE", tableID, storeID).Scan(&mergedInto)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %d", ErrUnknownTable, tableID)
+	}
+	if err != nil {
+		return err
+	}
+
+	query, arg := "SELECT id, status FROM tableList WHERE merged_into = ? FOR UPDATE", tableID
+	if mergedInto > 0 {
+		query = "SELECT id, status FROM tableList WHERE id = ? FOR UPDATE"
+	}
+	rows, err := tx.Query(query, arg)
+	if err != nil {
+		return err
+	}
+	status := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var s string
+		if err := rows.Scan(&id, &s); err != nil {
+			rows.Close()
+			return err
+		}
+		status[id] = s
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(status) == 0 {
+		return fmt.Errorf("%w: %d", ErrNotMerged, tableID)
+	}
+
+	for id, s := range status {
+		if _, err := tx.Exec("UPDATE tableList SET merged_into = NULL WHERE id = ?", id); err != nil {
+			return fmt.Errorf("splitting tables: %w", err)
+		}
+		if s == StatusOccupied {
+			if err := setTableStatus(tx, id, StatusCleaning, "split"); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func writeFloorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUnknownTable):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvalidLayout):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrTableMerged), errors.Is(err, ErrNotMerged), errors.Is(err, ErrStatusTransition):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Floor plan error: %v", err)
+		http.Error(w, "Failed to update floor plan", http.StatusInternalServerError)
+	}
+}
+
+// HandleAreas 返回全部楼面区域
+func HandleAreas(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	areas, err := FetchAreas(storeID)
+	if err != nil {
+		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(areas)
+}
+
+// HandleSaveArea 新增或修改楼面区域，ID 为0时新增
+func HandleSaveArea(w http.ResponseWriter, r *http.Request) {
+	var a Area
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(a.Name) == "" {
+		http.Error(w, "Missing area name", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	if a.ID == 0 {
+		res, err := db.Exec("INSERT INTO floor_areas (name, sort_order, store_id) VALUES (?, ?, ?)", a.Name, a.SortOrder, storeID)
+		if err != nil {
+			http.Error(w, "Failed to save area", http.StatusInternalServerError)
+			return
+		}
+		id, _ := res.LastInsertId()
+		a.ID = int(id)
+	} else {
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM floor_areas WHERE id = ? AND store_id = ?", a.ID, storeID).Scan(&exists); err != nil {
+			http.Error(w, "Failed to save area", http.StatusInternalServerError)
+			return
+		}
+		if exists == 0 {
+			http.Error(w, "Area not found", http.StatusNotFound)
+			return
+		}
+		if _, err := db.Exec("UPDATE floor_areas SET name = ?, sort_order = ? WHERE id = ?", a.Name, a.SortOrder, a.ID); err != nil {
+			http.Error(w, "Failed to save area", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// HandleDeleteArea 删除楼面区域，区域内的餐桌改为不属于任何区域
+func HandleDeleteArea(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to delete area", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM floor_areas WHERE id = ? AND store_id = ?", requestData.ID, storeID)
+	if err != nil {
+		http.Error(w, "Failed to delete area", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Area not found", http.StatusNotFound)
+		return
+	}
+	if _, err := tx.Exec("UPDATE tableList SET area_id = NULL WHERE area_id = ? AND store_id = ?", requestData.ID, storeID); err != nil {
+		http.Error(w, "Failed to delete area", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete area", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Area deleted successfully"))
+}
+
+// HandleSaveLayout 批量保存平面图上餐桌的位置，请求体为餐桌位置数组
+func HandleSaveLayout(w http.ResponseWriter, r *http.Request) {
+	var placements []TablePlacement
+	if err := json.NewDecoder(r.Body).Decode(&placements); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	if err := SaveLayout(storeID, placements); err != nil {
+		writeFloorError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Layout saved successfully"))
+}
+
+// HandleMergeTables 合并餐桌，请求体为 {"hostId": N, "tableIds": [...]}
+func HandleMergeTables(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		HostID   int   `json:"hostId"`
+		TableIDs []int `json:"tableIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	if err := MergeTables(storeID, requestData.HostID, requestData.TableIDs); err != nil {
+		writeFloorError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Tables merged successfully"))
+}
+
+// HandleSplitTables 拆开合并的餐桌，请求体为 {"id": N}
+func HandleSplitTables(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	if err := SplitTables(storeID, requestData.ID); err != nil {
+		writeFloorError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Tables split successfully"))
+}
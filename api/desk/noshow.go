@@ -0,0 +1,247 @@
+package desk
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/notify"
+	"gocode/first/api/pay"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 预订状态；其余状态由前台自由填写，均视为有效预订
+const (
+	ReservationSeated = "seated"
+	ReservationNoShow = "no_show"
+)
+
+const defaultNoShowGraceMinutes = 15
+
+// ErrReservationState 表示预订当前状态不允许该操作
+var ErrReservationState = errors.New("invalid reservation state")
+
+// NoShowHistory 顾客的爽约记录
+type NoShowHistory struct {
+	Count        int           `json:"count"`
+	Reservations []Reservation `json:"reservations"`
+}
+
+func noShowGrace() time.Duration {
+	minutes := config.C.Store.NoShowGraceMinutes
+	if minutes <= 0 {
+		minutes = defaultNoShowGraceMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// customerCondition 按 openid 或邮箱识别同一位顾客，两者都为空时返回 false
+func customerCondition(openID, email string) (string, []any, bool) {
+	switch {
+	case openID != "" && email != "":
+		return "(OpenID = ? OR Email = ?)", []any{openID, email}, true
+	case openID != "":
+		return "OpenID = ?", []any{openID}, true
+	case email != "":
+		return "Email = ?", []any{email}, true
+	}
+	return "", nil, false
+}
+
+// CountNoShows 返回顾客的爽约次数
+func CountNoShows(openID, email string) (int, error) {
+	cond, args, ok := customerCondition(openID, email)
+	if !ok {
+		return 0, nil
+	}
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM reservationList WHERE Status = ? AND "+cond,
+		append([]any{ReservationNoShow}, args...)...).Scan(&count)
+	return count, err
+}
+
+// FetchNoShowHistory 返回顾客在门店的爽约记录，最近的在前
+func FetchNoShowHistory(storeID int, openID, email string) (NoShowHistory, error) {
+	h := NoShowHistory{Reservations: []Reservation{}}
+	cond, args, ok := customerCondition(openID, email)
+	if !ok {
+		return h, nil
+	}
+	reservations, err := queryReservations(db, "SELECT "+reservationColumns+" FROM reservationList WHERE store_id = ? AND Status = ? AND "+cond+" ORDER BY ReservationTime DESC",
+		append([]any{storeID, ReservationNoShow}, args...)...)
+	if err != nil {
+		return h, err
+	}
+	if reservations != nil {
+		h.Reservations = reservations
+	}
+	h.Count = len(h.Reservations)
+	return h, nil
+}
+
+// ArriveReservation 顾客到店入座：预订改为已入座，餐桌进入就餐状态，不再发送到店提醒；
+// 订金在该餐桌下单时抵扣
+func ArriveReservation(storeID, id int) error {
+	r, err := fetchReservation(id)
+	if err != nil {
+		return err
+	}
+	if r.StoreID != storeID {
+		return sql.ErrNoRows
+	}
+	if r.Status == ReservationAwaitingDeposit {
+		return fmt.Errorf("%w: deposit is not paid", ErrReservationState)
+	}
+	for _, s := range inactiveReservationStatuses {
+		if r.Status == s {
+			return fmt.Errorf("%w: reservation is %s", ErrReservationState, r.Status)
+		}
+	}
+
+	if _, err := db.Exec("UPDATE reservationList SET Status = ? WHERE ID = ? AND store_id = ?", ReservationSeated, id, storeID); err != nil {
+		return err
+	}
+	if err := MarkOccupied(r.TableID, fmt.Sprintf("reservation %d", id)); err != nil {
+		return err
+	}
+	return notify.CancelPending(refReservation, id, EventReservationReminder)
+}
+
+// expireUnpaidDeposits 取消超过支付时限仍未支付订金的预订，释放餐桌
+func expireUnpaidDeposits(now time.Time) error {
+	deadline := now.Add(-depositPayWindow()).In(config.Location()).Format(dateTimeLayout)
+	reservations, err := queryReservations(db, "SELECT "+reservationColumns+` FROM reservationList
+		WHERE Status = ? AND ID IN (SELECT reservation_id FROM reservation_deposits WHERE status = ? AND created_at < ?)`,
+		ReservationAwaitingDeposit, DepositPending, deadline)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range reservations {
+		// 超时前刚完成支付的按已支付确认
+		d, err := ConfirmDeposit(r.ID)
+		if err != nil && !errors.Is(err, pay.ErrNoClient) {
+			log.Printf("Failed to confirm deposit for reservation %d: %v", r.ID, err)
+			continue
+		}
+		if d.Status != DepositPending {
+			continue
+		}
+		res, err := db.Exec("UPDATE reservationList SET Status = ? WHERE ID = ? AND Status = ?",
+			ReservationCancelled, r.ID, ReservationAwaitingDeposit)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			if err := setDepositStatus(db, r.ID, DepositPending, DepositCancelled); err != nil {
+				log.Printf("Failed to cancel deposit for reservation %d: %v", r.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// markNoShows 把超过宽限时间仍未到店的有效预订记为爽约，并按规则处理订金
+func markNoShows(now time.Time) error {
+	args := append([]any{int(noShowGrace() / time.Minute), now.In(config.Location()).Format(dateTimeLayout), ReservationAwaitingDeposit},
+		inactiveReservationStatuses...)
+	reservations, err := queryReservations(db, "SELECT "+reservationColumns+` FROM reservationList
+		WHERE DATE_ADD(ReservationTime, INTERVAL ? MINUTE) < ? AND Status NOT IN (?, ?, ?, ?, ?)`, args...)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range reservations {
+		res, err := db.Exec("UPDATE reservationList SET Status = ? WHERE ID = ? AND Status = ?", ReservationNoShow, r.ID, r.Status)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		if err := notify.CancelPending(refReservation, r.ID, ""); err != nil {
+			log.Printf("Failed to cancel notifications for reservation %d: %v", r.ID, err)
+		}
+		if err := settleDeposit(r, config.C.Store.Deposit.RefundNoShow, "爽约"); err != nil {
+			log.Printf("Failed to settle deposit for reservation %d: %v", r.ID, err)
+		}
+	}
+	return nil
+}
+
+// RunReservationScheduler 按固定间隔取消超时未付订金的预订并标记爽约，应在单独的 goroutine 中运行
+func RunReservationScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		if err := expireUnpaidDeposits(now); err != nil {
+			log.Printf("Error expiring unpaid deposits: %v", err)
+		}
+		if err := markNoShows(now); err != nil {
+			log.Printf("Error marking no-shows: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// HandleArriveReservation 前台确认顾客到店，请求体为 {"reservationId": N}
+func HandleArriveReservation(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		ReservationId int `json:"reservationId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	err := ArriveReservation(storeID, data.ReservationId)
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrReservationState):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Failed to seat reservation: %v", err)
+		http.Error(w, "Failed to seat reservation", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Reservation seated successfully"))
+}
+
+// HandleNoShowHistory 查询顾客在门店的爽约记录，仅门店管理员可用；参数：openid、email，至少提供一个
+func HandleNoShowHistory(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	openID, email := q.Get("openid"), q.Get("email")
+	if openID == "" && email == "" {
+		http.Error(w, "openid or email is required", http.StatusBadRequest)
+		return
+	}
+
+	h, err := FetchNoShowHistory(storeID, openID, email)
+	if err != nil {
+		log.Printf("Failed to fetch no-show history: %v", err)
+		http.Error(w, "Failed to fetch no-show history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h)
+}
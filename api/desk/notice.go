@@ -0,0 +1,165 @@
+package desk
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"gocode/first/api/notify"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 预订通知事件
+const (
+	EventReservationConfirmed = "reservation_confirmed"
+	EventReservationReminder  = "reservation_reminder"
+	EventReservationCancelled = "reservation_cancelled"
+)
+
+// ReservationCancelled 预订取消后的状态
+const ReservationCancelled = "cancelled"
+
+// refReservation 通知队列中预订记录的类型
+const refReservation = "reservation"
+
+const defaultReminderMinutes = 120
+
+func migrateReservationContacts() error {
+	if err := utils.EnsureColumn(db, "reservationList", "Email", "VARCHAR(255) NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := utils.EnsureColumn(db, "reservationList", "OpenID", "VARCHAR(64) NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	return utils.EnsureColumn(db, "reservationList", "Phone", "VARCHAR(32) NOT NULL DEFAULT ''")
+}
+
+func reminderBefore() time.Duration {
+	minutes := config.C.Store.ReminderMinutes
+	if minutes <= 0 {
+		minutes = defaultReminderMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// reservationMessage 生成预订相关的通知
+func reservationMessage(event string, r Reservation) notify.Message {
+	var tableName string
+	if err := db.QueryRow("SELECT name FROM tableList WHERE id = ?", r.TableID).Scan(&tableName); err != nil {
+		tableName = fmt.Sprintf("%d号桌", r.TableID)
+	}
+
+	m := notify.Message{
+		Event:   event,
+		OpenID:  r.OpenID,
+		Email:   r.Email,
+		StoreID: r.StoreID,
+		Fields: map[string]string{
+			"name":  r.Name,
+			"time":  r.ReservationTime,
+			"table": tableName,
+		},
+	}
+	switch event {
+	case EventReservationConfirmed:
+		m.Title = "预订成功"
+		m.Lines = []string{
+			fmt.Sprintf("%s，您好：", r.Name),
+			fmt.Sprintf("您已成功预订 %s 的 %s，共 %d 位。", r.ReservationTime, tableName, r.NumOfPeople),
+		}
+	case EventReservationReminder:
+		m.Title = "预订提醒"
+		m.Lines = []string{
+			fmt.Sprintf("%s，您好：", r.Name),
+			fmt.Sprintf("您预订的 %s 将于 %s 开始，期待您的光临。", tableName, r.ReservationTime),
+		}
+	case EventReservationCancelled:
+		m.Title = "预订已取消"
+		m.Fields["note"] = "预订已取消"
+		m.Lines = []string{
+			fmt.Sprintf("%s，您好：", r.Name),
+			fmt.Sprintf("您在 %s 的预订已取消。", r.ReservationTime),
+		}
+	}
+	return m
+}
+
+// scheduleReservationNotices 预订创建后立即发送确认，并在开始前 reminder_minutes 分钟发送提醒
+func scheduleReservationNotices(r Reservation, at time.Time) error {
+	if r.Email == "" && r.OpenID == "" {
+		return nil
+	}
+	now := time.Now()
+	if err := notify.Enqueue(reservationMessage(EventReservationConfirmed, r), now, refReservation, r.ID); err != nil {
+		return err
+	}
+	if remindAt := at.Add(-reminderBefore()); remindAt.After(now) {
+		return notify.Enqueue(reservationMessage(EventReservationReminder, r), remindAt, refReservation, r.ID)
+	}
+	return nil
+}
+
+// rescheduleReservationNotices 预订时间或餐桌修改后撤回旧的提醒，按新的预订重新发送确认和提醒
+func rescheduleReservationNotices(r Reservation, at time.Time) error {
+	if err := notify.CancelPending(refReservation, r.ID, EventReservationReminder); err != nil {
+		return err
+	}
+	return scheduleReservationNotices(r, at)
+}
+
+// cancelReservationNotices 取消预订尚未发送的提醒，预订尚未开始时通知顾客预订已取消
+func cancelReservationNotices(r Reservation) error {
+	if err := notify.CancelPending(refReservation, r.ID, ""); err != nil {
+		return err
+	}
+	if r.Email == "" && r.OpenID == "" || r.Status == ReservationCancelled {
+		return nil
+	}
+	at, err := time.ParseInLocation(dateTimeLayout, r.ReservationTime, config.Location())
+	if err != nil || at.Before(time.Now()) {
+		return err
+	}
+	return notify.Enqueue(reservationMessage(EventReservationCancelled, r), time.Now(), refReservation, r.ID)
+}
+
+// CancelReservation 取消预订并通知顾客，预订记录保留
+func CancelReservation(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		ReservationId int `json:"reservationId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	reservation, err := fetchReservation(data.ReservationId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reservation.Status == ReservationCancelled {
+		http.Error(w, "Reservation is already cancelled", http.StatusConflict)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE reservationList SET Status = ? WHERE ID = ?", ReservationCancelled, reservation.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := cancelReservationNotices(reservation); err != nil {
+		log.Println("Failed to send cancellation notice:", err)
+	}
+	if err := settleDeposit(reservation, cancellationRefundable(reservation, time.Now()), "预订取消"); err != nil {
+		log.Println("Failed to settle deposit:", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Reservation cancelled successfully"))
+}
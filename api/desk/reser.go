@@ -3,6 +3,9 @@ package desk
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"gocode/first/api/store"
+	"gocode/first/config"
 	"log"
 	"net/http"
 	"time"
@@ -16,35 +19,52 @@ type Reservation struct {
 	ReservationTime string  `json:"reservationTime"`
 	Status          string  `json:"status"`
 	TableID         int     `json:"tableId"`
-	Remarks         *string `json:"remarks"` // 将Remarks字段声明为指针类型
+	Remarks         *string `json:"remarks"`  // 将Remarks字段声明为指针类型
+	Duration        int     `json:"duration"` // 占用餐桌的分钟数
+	Email           string  `json:"email"`    // 接收预订通知的邮箱
+	OpenID          string  `json:"openid"`   // 接收订阅消息的小程序用户
+	Deposit         float64 `json:"deposit"`  // 需要支付的订金，0表示无需订金
+	Phone           string  `json:"phone"`
+	StoreID         int     `json:"storeId"` // 预订的门店
 }
 
-// GetAllReservations 查询所有预订信息
-func GetAllReservations(db *sql.DB) ([]Reservation, error) {
+// reservationColumns 预订的完整列，顺序与 scanReservation 的解析顺序一致
+const reservationColumns = "ID, Name, NumOfPeople, ReservationTime, Status, Table_ID, Remarks, Duration, Email, OpenID, Deposit, Phone, store_id"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanReservation 解析一行 reservationColumns
+func scanReservation(row rowScanner) (Reservation, error) {
+	var reservation Reservation
+	var remarks sql.NullString // 使用sql.NullString来处理可能为NULL的字符串
+
+	err := row.Scan(&reservation.ID, &reservation.Name, &reservation.NumOfPeople, &reservation.ReservationTime, &reservation.Status, &reservation.TableID,
+		&remarks, &reservation.Duration, &reservation.Email, &reservation.OpenID, &reservation.Deposit, &reservation.Phone, &reservation.StoreID)
+
+	// 检查remarks是否为有效值，为NULL时Reservation.Remarks保持nil
+	if remarks.Valid {
+		reservation.Remarks = &remarks.String
+	}
+	return reservation, err
+}
+
+// queryReservations 执行查询并解析预订信息，查询的列必须为 reservationColumns
+func queryReservations(db *sql.DB, query string, args ...any) ([]Reservation, error) {
 	var reservations []Reservation
 
-	rows, err := db.Query("SELECT * FROM reservationlist")
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var reservation Reservation
-		var remarks sql.NullString // 使用sql.NullString来处理可能为NULL的字符串
-
-		if err := rows.Scan(&reservation.ID, &reservation.Name, &reservation.NumOfPeople, &reservation.ReservationTime, &reservation.Status, &reservation.TableID, &remarks); err != nil {
+		reservation, err := scanReservation(rows)
+		if err != nil {
 			return nil, err
 		}
-
-		// 检查remarks是否为有效值
-		if remarks.Valid {
-			reservation.Remarks = &remarks.String // 如果有效，则将其赋值给Reservation.Remarks
-		} else {
-			// 如果为NULL，则将Reservation.Remarks置为nil
-			reservation.Remarks = nil
-		}
-
 		reservations = append(reservations, reservation)
 	}
 	if err := rows.Err(); err != nil {
@@ -54,6 +74,11 @@ func GetAllReservations(db *sql.DB) ([]Reservation, error) {
 	return reservations, nil
 }
 
+func fetchReservation(id int) (Reservation, error) {
+	return scanReservation(db.QueryRow("SELECT "+reservationColumns+" FROM reservationList WHERE ID = ?", id))
+}
+
+// HandleGetAllReservations 按条件分页查询预订，参数见 parseReservationQuery
 func HandleGetAllReservations(w http.ResponseWriter, r *http.Request) {
 	// 设置响应头为 JSON 格式
 	w.Header().Set("Content-Type", "application/json")
@@ -64,22 +89,30 @@ func HandleGetAllReservations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 调用 desk 包中的 GetAllReservations
-	reservations, err := GetAllReservations(db)
+	q, err := parseReservationQuery(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if q.StoreID, ok = store.ManagedStore(w, r); !ok {
 		return
 	}
 
-	// 返回查询到的全部预订信息（此处应有适当的 JSON 格式化和错误处理）
-	jsonReservations, err := json.Marshal(reservations)
+	page, err := SearchReservations(q)
 	if err != nil {
-		http.Error(w, "Failed to marshal JSON", http.StatusInternalServerError)
+		log.Println("Failed to query reservations:", err)
+		http.Error(w, "Failed to query reservations", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	w.Write(jsonReservations)
+	// 未传分页参数时保持原来的数组格式
+	if !q.Paged {
+		json.NewEncoder(w).Encode(page.Items)
+		return
+	}
+	json.NewEncoder(w).Encode(page)
 }
 
 // GetMaxReservationID 获取当前最大的预订ID
@@ -105,34 +138,112 @@ func AddReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 获取当前最大的预订ID，并加一作为新的预订信息的ID
-	maxID, err := GetMaxReservationID(db)
-	if err != nil {
-		log.Println("Failed to get max reservation ID:", err)
-		http.Error(w, "Failed to get max reservation ID", http.StatusInternalServerError)
+	storeID, ok := store.RequestStore(w, r)
+	if !ok {
 		return
 	}
-	reservation.ID = maxID + 1
+	reservation.StoreID = storeID
+
+	if reservation.Duration <= 0 {
+		reservation.Duration = defaultReservationDuration
+	}
 
-	// 将字符串解析为时间
+	// 将字符串解析为时间，并换算为门店时区
 	parsedTime, err := time.Parse(time.RFC3339, reservation.ReservationTime)
 	if err != nil {
 		log.Println("Failed to parse reservation time:", err)
 		http.Error(w, "Failed to parse reservation time", http.StatusBadRequest)
 		return
 	}
+	parsedTime = parsedTime.In(config.Location())
+
+	// 按订金规则计算订金，需要订金的预订在支付前保持待支付状态
+	if reservation.Deposit, err = depositFor(reservation); err != nil {
+		log.Println("Failed to check deposit policy:", err)
+		http.Error(w, "Failed to check deposit policy", http.StatusInternalServerError)
+		return
+	}
+	if reservation.Deposit > 0 {
+		if reservation.OpenID == "" {
+			http.Error(w, ErrDepositRequired.Error(), http.StatusBadRequest)
+			return
+		}
+		reservation.Status = ReservationAwaitingDeposit
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// 校验餐桌容量以及与已有预订是否冲突
+	if err := checkReservation(tx, reservation, parsedTime, 0); err != nil {
+		switch {
+		case errors.Is(err, ErrReservationConflict), errors.Is(err, ErrTableMerged):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrOverCapacity), errors.Is(err, ErrUnknownTable):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			log.Println("Failed to check reservation:", err)
+			http.Error(w, "Failed to check reservation", http.StatusInternalServerError)
+		}
+		return
+	}
 
 	// 将时间格式化为数据库所需的日期时间格式
-	formattedTime := parsedTime.Format("2006-01-02 15:04:05")
+	formattedTime := parsedTime.Format(dateTimeLayout)
 
-	// 插入预订信息到数据库
-	_, err = db.Exec("INSERT INTO reservationList (ID, Name, NumOfPeople, ReservationTime, Status, Table_ID, Remarks) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		reservation.ID, reservation.Name, reservation.NumOfPeople, formattedTime, reservation.Status, reservation.TableID, reservation.Remarks)
+	// 插入预订信息到数据库，ID由数据库自增生成
+	res, err := tx.Exec(`INSERT INTO reservationList (Name, NumOfPeople, ReservationTime, Status, Table_ID, Remarks, Duration, Email, OpenID, Deposit, Phone, store_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		reservation.Name, reservation.NumOfPeople, formattedTime, reservation.Status, reservation.TableID, reservation.Remarks,
+		reservation.Duration, reservation.Email, reservation.OpenID, reservation.Deposit, reservation.Phone, reservation.StoreID)
 	if err != nil {
 		log.Println("Failed to insert reservation into database:", err)
 		http.Error(w, "Failed to insert reservation into database", http.StatusInternalServerError)
 		return
 	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Println("Failed to get reservation ID:", err)
+		http.Error(w, "Failed to insert reservation into database", http.StatusInternalServerError)
+		return
+	}
+	reservation.ID = int(id)
+	if reservation.Deposit > 0 {
+		if err := createDeposit(tx, reservation); err != nil {
+			log.Println("Failed to create deposit:", err)
+			http.Error(w, "Failed to insert reservation into database", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Failed to commit reservation:", err)
+		http.Error(w, "Failed to insert reservation into database", http.StatusInternalServerError)
+		return
+	}
+
+	reservation.ReservationTime = formattedTime
+
+	// 需要订金时返回预订和调起支付的参数，订金支付成功后再发送预订确认；
+	// 创建支付失败时 payment 为空，可通过 /api/reservation/deposit/pay 重新发起
+	if reservation.Deposit > 0 {
+		payment, err := depositPayment(reservation)
+		if err != nil {
+			log.Println("Failed to create deposit payment:", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"reservation": reservation, "payment": payment})
+		return
+	}
+
+	// 通知发送失败不影响预订本身
+	if err := scheduleReservationNotices(reservation, parsedTime); err != nil {
+		log.Println("Failed to schedule reservation notifications:", err)
+	}
 
 	// 打印预订成功信息
 	log.Println("Reservation added successfully")
@@ -160,13 +271,31 @@ func DeleteReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	reservation, err := fetchReservation(data.ReservationId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// 在数据库中执行删除预订信息的操作
-	_, err := db.Exec("DELETE FROM reservationList WHERE ID = ?", data.ReservationId)
+	_, err = db.Exec("DELETE FROM reservationList WHERE ID = ?", data.ReservationId)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// 删除仍然有效的预订视为取消，通知顾客
+	if err := cancelReservationNotices(reservation); err != nil {
+		log.Println("Failed to send cancellation notice:", err)
+	}
+	if err := settleDeposit(reservation, cancellationRefundable(reservation, time.Now()), "预订取消"); err != nil {
+		log.Println("Failed to settle deposit:", err)
+	}
+
 	// 返回成功响应
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Reservation deleted successfully"))
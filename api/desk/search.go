@@ -0,0 +1,295 @@
+package desk
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/notify"
+	"gocode/first/config"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReservationPageSize = 20
+	maxReservationPageSize     = 100
+)
+
+// ErrInvalidUpdate 表示预订修改内容不合法
+var ErrInvalidUpdate = errors.New("invalid reservation update")
+
+// ReservationQuery 预订查询条件，零值字段表示不过滤
+type ReservationQuery struct {
+	StoreID  int       // 门店，0表示全部门店
+	From     time.Time // 预订时间下限（含）
+	To       time.Time // 预订时间上限（不含）
+	Statuses []string
+	TableID  int
+	Keyword  string // 匹配顾客姓名或电话
+	Page     int
+	PageSize int
+	Paged    bool // 是否传了 page 或 pageSize，未传时返回全部结果
+}
+
+// ReservationPage 分页后的预订
+type ReservationPage struct {
+	Total    int           `json:"total"`
+	Page     int           `json:"page"`
+	PageSize int           `json:"pageSize"`
+	Items    []Reservation `json:"items"`
+}
+
+// parseReservationQuery 从URL参数解析查询条件：
+// from、to 为门店时区的日期（2006-01-02，to 当天包含在内），status 可用逗号分隔多个，
+// tableId、q（姓名或电话）、page、pageSize（两者都未传时不分页）
+func parseReservationQuery(r *http.Request) (ReservationQuery, error) {
+	v := r.URL.Query()
+	q := ReservationQuery{
+		Keyword:  strings.TrimSpace(v.Get("q")),
+		Page:     1,
+		PageSize: defaultReservationPageSize,
+	}
+
+	var err error
+	if s := v.Get("from"); s != "" {
+		if q.From, err = time.ParseInLocation("2006-01-02", s, config.Location()); err != nil {
+			return q, fmt.Errorf("invalid from %q", s)
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if q.To, err = time.ParseInLocation("2006-01-02", s, config.Location()); err != nil {
+			return q, fmt.Errorf("invalid to %q", s)
+		}
+		q.To = q.To.AddDate(0, 0, 1)
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.To.After(q.From) {
+		return q, fmt.Errorf("to is before from")
+	}
+	for _, s := range strings.Split(v.Get("status"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			q.Statuses = append(q.Statuses, s)
+		}
+	}
+	if s := v.Get("tableId"); s != "" {
+		if q.TableID, err = strconv.Atoi(s); err != nil {
+			return q, fmt.Errorf("invalid tableId %q", s)
+		}
+	}
+	q.Paged = v.Has("page") || v.Has("pageSize")
+	if s := v.Get("page"); s != "" {
+		if q.Page, err = strconv.Atoi(s); err != nil || q.Page < 1 {
+			return q, fmt.Errorf("invalid page %q", s)
+		}
+	}
+	if s := v.Get("pageSize"); s != "" {
+		if q.PageSize, err = strconv.Atoi(s); err != nil || q.PageSize < 1 {
+			return q, fmt.Errorf("invalid pageSize %q", s)
+		}
+		if q.PageSize > maxReservationPageSize {
+			q.PageSize = maxReservationPageSize
+		}
+	}
+
+	return q, nil
+}
+
+// escapeLike 转义 LIKE 中的通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// SearchReservations 按条件查询预订，按预订时间排列，q.Paged 为 false 时返回全部结果
+func SearchReservations(q ReservationQuery) (ReservationPage, error) {
+	page := ReservationPage{Page: q.Page, PageSize: q.PageSize, Items: []Reservation{}}
+
+	var conds []string
+	var args []any
+	if q.StoreID > 0 {
+		conds = append(conds, "store_id = ?")
+		args = append(args, q.StoreID)
+	}
+	if !q.From.IsZero() {
+		conds = append(conds, "ReservationTime >= ?")
+		args = append(args, q.From.Format(dateTimeLayout))
+	}
+	if !q.To.IsZero() {
+		conds = append(conds, "ReservationTime < ?")
+		args = append(args, q.To.Format(dateTimeLayout))
+	}
+	if len(q.Statuses) > 0 {
+		conds = append(conds, "Status IN ("+placeholders(len(q.Statuses))+")")
+		for _, s := range q.Statuses {
+			args = append(args, s)
+		}
+	}
+	if q.TableID > 0 {
+		conds = append(conds, "Table_ID = ?")
+		args = append(args, q.TableID)
+	}
+	if q.Keyword != "" {
+		kw := "%" + escapeLike(q.Keyword) + "%"
+		conds = append(conds, "(Name LIKE ? OR Phone LIKE ?)")
+		args = append(args, kw, kw)
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM reservationList"+where, args...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+	if page.Total == 0 {
+		return page, nil
+	}
+
+	query := "SELECT " + reservationColumns + " FROM reservationList" + where + " ORDER BY ReservationTime, ID"
+	if q.Paged {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, q.PageSize, (q.Page-1)*q.PageSize)
+	}
+	items, err := queryReservations(db, query, args...)
+	if err != nil {
+		return page, err
+	}
+	if items != nil {
+		page.Items = items
+	}
+	return page, nil
+}
+
+// ReservationUpdate 预订的修改内容，为空的字段保持不变
+type ReservationUpdate struct {
+	ID              int     `json:"reservationId"`
+	ReservationTime *string `json:"reservationTime"` // RFC3339
+	NumOfPeople     *int    `json:"numOfPeople"`
+	TableID         *int    `json:"tableId"`
+	Duration        *int    `json:"duration"`
+	Name            *string `json:"name"`
+	Phone           *string `json:"phone"`
+	Remarks         *string `json:"remarks"`
+}
+
+// UpdateReservation 修改仍然有效的预订，时间、人数或餐桌变化时重新校验容量和冲突，人数变化时重新计算订金；
+// 时间或餐桌变化后按新的时间重新安排提醒并通知顾客
+func UpdateReservation(u ReservationUpdate) (Reservation, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Reservation{}, err
+	}
+	defer tx.Rollback()
+
+	r, err := scanReservation(tx.QueryRow("SELECT "+reservationColumns+" FROM reservationList WHERE ID = ? FOR UPDATE", u.ID))
+	if err != nil {
+		return r, err
+	}
+	for _, s := range inactiveReservationStatuses {
+		if r.Status == s {
+			return r, fmt.Errorf("%w: reservation is %s", ErrReservationState, r.Status)
+		}
+	}
+
+	start, err := time.ParseInLocation(dateTimeLayout, r.ReservationTime, config.Location())
+	if err != nil {
+		return r, err
+	}
+	oldStart, oldTable, oldPeople, oldStatus := start, r.TableID, r.NumOfPeople, r.Status
+
+	if u.ReservationTime != nil {
+		t, err := time.Parse(time.RFC3339, *u.ReservationTime)
+		if err != nil {
+			return r, fmt.Errorf("%w: invalid reservation time", ErrInvalidUpdate)
+		}
+		start = t.In(config.Location())
+		r.ReservationTime = start.Format(dateTimeLayout)
+	}
+	if u.NumOfPeople != nil {
+		r.NumOfPeople = *u.NumOfPeople
+	}
+	if u.TableID != nil {
+		r.TableID = *u.TableID
+	}
+	if u.Duration != nil {
+		if *u.Duration <= 0 {
+			return r, fmt.Errorf("%w: invalid duration", ErrInvalidUpdate)
+		}
+		r.Duration = *u.Duration
+	}
+	if u.Name != nil {
+		r.Name = *u.Name
+	}
+	if u.Phone != nil {
+		r.Phone = *u.Phone
+	}
+	if u.Remarks != nil {
+		r.Remarks = u.Remarks
+	}
+
+	if err := checkReservation(tx, r, start, r.ID); err != nil {
+		return r, err
+	}
+	if r.NumOfPeople != oldPeople {
+		if err := redeposit(tx, &r); err != nil {
+			return r, err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE reservationList SET Name = ?, NumOfPeople = ?, ReservationTime = ?, Table_ID = ?, Remarks = ?, Duration = ?, Phone = ?, Status = ?, Deposit = ?
+		WHERE ID = ?`, r.Name, r.NumOfPeople, r.ReservationTime, r.TableID, r.Remarks, r.Duration, r.Phone, r.Status, r.Deposit, r.ID)
+	if err != nil {
+		return r, err
+	}
+	if err := tx.Commit(); err != nil {
+		return r, err
+	}
+
+	// 待支付订金的预订在支付后才发送确认和提醒
+	switch {
+	case r.Status == ReservationAwaitingDeposit && oldStatus != ReservationAwaitingDeposit:
+		if err := notify.CancelPending(refReservation, r.ID, ""); err != nil {
+			log.Printf("Failed to cancel notifications for reservation %d: %v", r.ID, err)
+		}
+	case r.Status != ReservationAwaitingDeposit && oldStatus == ReservationAwaitingDeposit:
+		if err := scheduleReservationNotices(r, start); err != nil {
+			log.Printf("Failed to schedule notifications for reservation %d: %v", r.ID, err)
+		}
+	case r.Status != ReservationAwaitingDeposit && (!start.Equal(oldStart) || r.TableID != oldTable):
+		if err := rescheduleReservationNotices(r, start); err != nil {
+			log.Printf("Failed to reschedule notifications for reservation %d: %v", r.ID, err)
+		}
+	}
+	return r, nil
+}
+
+// HandleUpdateReservation 修改预订，请求体见 ReservationUpdate，返回修改后的预订
+func HandleUpdateReservation(w http.ResponseWriter, r *http.Request) {
+	var u ReservationUpdate
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	reservation, err := UpdateReservation(u)
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrReservationState), errors.Is(err, ErrReservationConflict), errors.Is(err, ErrTableMerged):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, ErrInvalidUpdate), errors.Is(err, ErrOverCapacity), errors.Is(err, ErrUnknownTable), errors.Is(err, ErrDepositRequired):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("Failed to update reservation: %v", err)
+		http.Error(w, "Failed to update reservation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservation)
+}
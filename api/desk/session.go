@@ -0,0 +1,410 @@
+package desk
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/skip2/go-qrcode"
+)
+
+var (
+	// ErrNoQRSecret 表示未配置二维码签名密钥
+	ErrNoQRSecret = errors.New("store.qr_secret is not configured")
+	// ErrInvalidToken 表示二维码 token 签名错误、已轮换或不属于本门店
+	ErrInvalidToken = errors.New("invalid table token")
+	// ErrSessionClosed 表示就餐会话不存在或已结束
+	ErrSessionClosed = errors.New("dining session is closed")
+)
+
+const (
+	defaultQRSize = 256
+	maxQRSize     = 1024
+)
+
+// Session 扫码后开启的就餐会话，同一餐桌同时只有一个进行中的会话
+type Session struct {
+	ID        string  `json:"id"`
+	TableID   int     `json:"tableId"`
+	TableName string  `json:"tableName"`
+	StoreID   int     `json:"storeId"`
+	OpenedAt  string  `json:"openedAt"`
+	ClosedAt  *string `json:"closedAt"`
+}
+
+// migrateSessions 创建就餐会话表，并为餐桌增加二维码版本号，轮换版本号可使旧二维码失效
+func migrateSessions() error {
+	if err := utils.EnsureColumn(db, "tableList", "qr_version", "INT NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS dining_sessions (
+		id VARCHAR(32) PRIMARY KEY,
+		table_id INT NOT NULL,
+		store_id INT NOT NULL,
+		opened_at DATETIME NOT NULL,
+		closed_at DATETIME NULL,
+		INDEX idx_table (table_id, closed_at)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating dining_sessions table: %w", err)
+	}
+	return nil
+}
+
+// signTable 计算餐桌 token 的签名
+func signTable(payload string) (string, error) {
+	secret := config.C.Store.QRSecret
+	if secret == "" {
+		return "", ErrNoQRSecret
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// TableToken 返回写入餐桌二维码的 token，格式为 门店.餐桌.版本.签名，门店为餐桌所属的门店
+func TableToken(tableID int) (string, error) {
+	var storeID, version int
+	err := db.QueryRow("SELECT store_id, qr_version FROM tableList WHERE id = ? AND deleted_at IS NULL", tableID).Scan(&storeID, &version)
+	if err != nil {
+		return "", err
+	}
+
+	payload := fmt.Sprintf("%d.%d.%d", storeID, tableID, version)
+	sig, err := signTable(payload)
+	if err != nil {
+		return "", err
+	}
+	return payload + "." + sig, nil
+}
+
+// ParseTableToken 校验 token 的签名、门店与二维码版本，返回餐桌ID；
+// 多门店之前打印的二维码以配置文件中的门店签名，仍可用于默认门店的餐桌
+func ParseTableToken(token string) (int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return 0, ErrInvalidToken
+	}
+	sig, err := signTable(strings.Join(parts[:3], "."))
+	if err != nil {
+		return 0, err
+	}
+	if !hmac.Equal([]byte(sig), []byte(parts[3])) {
+		return 0, ErrInvalidToken
+	}
+
+	storeID, err1 := strconv.Atoi(parts[0])
+	tableID, err2 := strconv.Atoi(parts[1])
+	version, err3 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, ErrInvalidToken
+	}
+
+	var tableStore, current int
+	err = db.QueryRow("SELECT store_id, qr_version FROM tableList WHERE id = ? AND deleted_at IS NULL", tableID).Scan(&tableStore, &current)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	legacy := tableStore == store.DefaultID && storeID == config.C.Store.ID
+	if storeID != tableStore && !legacy || current != version {
+		return 0, ErrInvalidToken
+	}
+	return tableID, nil
+}
+
+// qrContent 返回二维码中编码的内容，配置了点餐页面地址时为带 token 参数的地址
+func qrContent(token string) string {
+	if config.C.Store.OrderURL == "" {
+		return token
+	}
+	sep := "?"
+	if strings.Contains(config.C.Store.OrderURL, "?") {
+		sep = "&"
+	}
+	return config.C.Store.OrderURL + sep + "token=" + url.QueryEscape(token)
+}
+
+// renderSVG 把二维码矩阵绘制为 SVG，每个模块为一个单位，由 viewBox 缩放到 size 像素
+func renderSVG(q *qrcode.QRCode, size int) []byte {
+	bitmap := q.Bitmap()
+	n := len(bitmap)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
+
+func newSessionID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// OpenSession 校验扫码 token 并返回餐桌进行中的会话，没有时开启新会话
+func OpenSession(token string) (Session, error) {
+	tableID, err := ParseTableToken(token)
+	if err != nil {
+		return Session{}, err
+	}
+
+	// 合并的餐桌扫任意一张的二维码都进入主桌的会话
+	if tableID, err = tableHost(db, tableID); err != nil {
+		return Session{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Session{}, err
+	}
+	defer tx.Rollback()
+
+	// 锁住餐桌行，避免同一餐桌同时扫码开启两个会话
+	var tableName string
+	var storeID int
+	if err := tx.QueryRow("SELECT name, store_id FROM tableList WHERE id = ? FOR UPDATE", tableID).Scan(&tableName, &storeID); err != nil {
+		return Session{}, err
+	}
+
+	var id string
+	err = tx.QueryRow("SELECT id FROM dining_sessions WHERE table_id = ? AND closed_at IS NULL", tableID).Scan(&id)
+	if err == sql.ErrNoRows {
+		if id, err = newSessionID(); err != nil {
+			return Session{}, err
+		}
+		_, err = tx.Exec("INSERT INTO dining_sessions (id, table_id, store_id, opened_at) VALUES (?, ?, ?, NOW())",
+			id, tableID, storeID)
+		if err == nil {
+			err = setTableStatus(tx, tableID, StatusOccupied, "session "+id)
+		}
+	}
+	if err != nil {
+		return Session{}, fmt.Errorf("opening dining session: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return Session{}, err
+	}
+
+	return fetchSession(id)
+}
+
+func fetchSession(id string) (Session, error) {
+	var s Session
+	var closedAt sql.NullString
+	err := db.QueryRow(`SELECT s.id, s.table_id, t.name, s.store_id, s.opened_at, s.closed_at
+		FROM dining_sessions s JOIN tableList t ON t.id = s.table_id WHERE s.id = ?`, id).
+		Scan(&s.ID, &s.TableID, &s.TableName, &s.StoreID, &s.OpenedAt, &closedAt)
+	if err != nil {
+		return s, err
+	}
+	if closedAt.Valid {
+		s.ClosedAt = &closedAt.String
+	}
+	return s, nil
+}
+
+// LookupSession 返回进行中的就餐会话，会话不存在或已结束时返回 ErrSessionClosed
+func LookupSession(id string) (Session, error) {
+	s, err := fetchSession(id)
+	if err == sql.ErrNoRows || (err == nil && s.ClosedAt != nil) {
+		return s, ErrSessionClosed
+	}
+	return s, err
+}
+
+// CloseSession 结账后结束门店的就餐会话，餐桌进入待清台状态
+func CloseSession(storeID int, id string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var tableID int
+	err = tx.QueryRow("SELECT table_id FROM dining_sessions WHERE id = ? AND store_id = ? AND closed_at IS NULL FOR UPDATE", id, storeID).Scan(&tableID)
+	if err == sql.ErrNoRows {
+		return ErrSessionClosed
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE dining_sessions SET closed_at = NOW() WHERE id = ?", id); err != nil {
+		return err
+	}
+	if err := setTableStatus(tx, tableID, StatusCleaning, "session "+id+" settled"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// HandleTableQRCode 返回餐桌的二维码图片，format 为 png（默认）或 svg，size 为边长像素；
+// 二维码带有签名 token，只有餐桌所属门店的管理员可以获取
+func HandleTableQRCode(w http.ResponseWriter, r *http.Request) {
+	tableID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid table id", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	tableStore, err := TableStore(tableID)
+	if errors.Is(err, ErrUnknownTable) || err == nil && tableStore != storeID {
+		http.Error(w, "Table not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up table: %v", err)
+		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+		return
+	}
+	size := defaultQRSize
+	if s := r.URL.Query().Get("size"); s != "" {
+		if size, err = strconv.Atoi(s); err != nil || size < 64 || size > maxQRSize {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, err := TableToken(tableID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Table not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to sign table token: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	q, err := qrcode.New(qrContent(token), qrcode.Medium)
+	if err != nil {
+		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(renderSVG(q, size))
+		return
+	}
+	png, err := q.PNG(size)
+	if err != nil {
+		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
+
+// HandleRotateQRCode 轮换餐桌的二维码版本号，旧二维码随即失效；仅餐桌所属门店的管理员可用
+func HandleRotateQRCode(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := db.Exec("UPDATE tableList SET qr_version = qr_version + 1 WHERE id = ? AND store_id = ? AND deleted_at IS NULL", requestData.ID, storeID)
+	if err != nil {
+		http.Error(w, "Failed to rotate QR code", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Table not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("QR code rotated successfully"))
+}
+
+// HandleOpenSession 校验扫码得到的 token 并返回就餐会话，之后下单时带上会话ID即可关联餐桌
+func HandleOpenSession(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	s, err := OpenSession(requestData.Token)
+	if err != nil {
+		if errors.Is(err, ErrInvalidToken) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		log.Printf("Failed to open dining session: %v", err)
+		http.Error(w, "Failed to open dining session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// HandleCloseSession 员工结账后结束就餐会话，仅会话所属门店的管理员可用
+func HandleCloseSession(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	if err := CloseSession(storeID, requestData.ID); err != nil {
+		if errors.Is(err, ErrSessionClosed) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to close dining session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Dining session closed successfully"))
+}
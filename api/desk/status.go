@@ -0,0 +1,398 @@
+package desk
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 餐桌状态；reserved 不落库，由即将到来的预订在查询时推导
+const (
+	StatusAvailable = "available"
+	StatusOccupied  = "occupied"
+	StatusReserved  = "reserved"
+	StatusCleaning  = "cleaning"
+)
+
+// reservedLead 预订开始前多久把空闲餐桌显示为已预订
+const reservedLead = time.Hour
+
+// dateTimeLayout 数据库中 DATETIME 列的文本格式
+const dateTimeLayout = "2006-01-02 15:04:05"
+
+// inactiveReservationStatuses 不再占用餐桌的预订状态
+var inactiveReservationStatuses = []any{"cancelled", "completed", "no_show", "seated"}
+
+// ErrStatusTransition 表示餐桌当前状态不允许该操作
+var ErrStatusTransition = errors.New("invalid table status transition")
+
+// StatusChange 餐桌状态变化记录
+type StatusChange struct {
+	ID        int    `json:"id"`
+	TableID   int    `json:"tableId"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason"`
+	ChangedAt string `json:"changedAt"`
+}
+
+// FloorTable 楼面实时状态中的一张餐桌
+type FloorTable struct {
+	Table
+	SessionID       string `json:"sessionId,omitempty"`
+	GroupCapacity   int    `json:"groupCapacity,omitempty"`   // 合并后的合计容量，仅主桌填写
+	Since           string `json:"since,omitempty"`           // 进入当前状态的时间
+	NextReservation string `json:"nextReservation,omitempty"` // 下一个预订的时间
+}
+
+// Turnover 某张餐桌在统计区间内的翻台情况
+type Turnover struct {
+	TableID    int     `json:"tableId"`
+	TableName  string  `json:"tableName"`
+	Seatings   int     `json:"seatings"`
+	AvgMinutes float64 `json:"avgMinutes"` // 平均每次就餐占用的分钟数
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// migrateStatus 创建餐桌状态记录表，并把手工填写的旧状态统一为空闲
+func migrateStatus() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS table_status_log (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		table_id INT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		changed_at DATETIME NOT NULL,
+		INDEX idx_table_time (table_id, changed_at)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating table_status_log table: %w", err)
+	}
+
+	_, err = db.Exec("UPDATE tableList SET status = ? WHERE status NOT IN (?, ?, ?)",
+		StatusAvailable, StatusAvailable, StatusOccupied, StatusCleaning)
+	if err != nil {
+		return fmt.Errorf("normalizing table status: %w", err)
+	}
+	return nil
+}
+
+func storeNow() string {
+	return time.Now().In(config.Location()).Format(dateTimeLayout)
+}
+
+// setTableStatus 更新餐桌状态，状态有变化时写入记录；合并到该餐桌的餐桌状态随之变化
+func setTableStatus(ex execer, tableID int, status, reason string) error {
+	_, err := ex.Exec(`INSERT INTO table_status_log (table_id, status, reason, changed_at)
+		SELECT id, ?, ?, ? FROM tableList WHERE (id = ? OR merged_into = ?) AND status <> ?`,
+		status, reason, storeNow(), tableID, tableID, status)
+	if err != nil {
+		return fmt.Errorf("logging table status: %w", err)
+	}
+	_, err = ex.Exec("UPDATE tableList SET status = ? WHERE (id = ? OR merged_into = ?) AND status <> ?", status, tableID, tableID, status)
+	if err != nil {
+		return fmt.Errorf("updating table status: %w", err)
+	}
+	return nil
+}
+
+// MarkOccupied 扫码就餐的订单下到餐桌上时把餐桌（合并时为整组）标记为就餐中
+func MarkOccupied(tableID int, reason string) error {
+	host, err := tableHost(db, tableID)
+	if err != nil {
+		return err
+	}
+	return setTableStatus(db, host, StatusOccupied, reason)
+}
+
+// ConfirmCleaned 员工确认清台后把餐桌恢复为空闲，只有待清台的餐桌可以确认；合并的餐桌整组确认
+func ConfirmCleaned(storeID, tableID int) error {
+	tableStore, err := TableStore(tableID)
+	if errors.Is(err, ErrUnknownTable) || err == nil && tableStore != storeID {
+		return sql.ErrNoRows
+	}
+	if err != nil {
+		return err
+	}
+	host, err := tableHost(db, tableID)
+	if err != nil {
+		return err
+	}
+	var status string
+	if err := db.QueryRow("SELECT status FROM tableList WHERE id = ?", host).Scan(&status); err != nil {
+		return err
+	}
+	if status != StatusCleaning {
+		return fmt.Errorf("%w: table is %s", ErrStatusTransition, status)
+	}
+	return setTableStatus(db, host, StatusAvailable, "cleaned")
+}
+
+// FetchFloor 返回门店全部餐桌的实时状态，空闲且即将有预订的餐桌显示为已预订
+func FetchFloor(storeID int, now time.Time) ([]FloorTable, error) {
+	tables, err := queryTables("SELECT "+tableColumns+" FROM tableList WHERE deleted_at IS NULL AND store_id = ? ORDER BY id", storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	floor := make([]FloorTable, len(tables))
+	index := make(map[int]int)
+	for i, t := range tables {
+		floor[i] = FloorTable{Table: t}
+		index[t.ID] = i
+	}
+	// 主桌列出合并到它的餐桌并显示合计容量
+	for _, t := range tables {
+		if i, ok := index[t.MergedInto]; ok {
+			floor[i].Members = append(floor[i].Members, t.ID)
+			floor[i].GroupCapacity += t.Capacity
+		}
+	}
+	for i := range floor {
+		if len(floor[i].Members) > 0 {
+			floor[i].GroupCapacity += floor[i].Capacity
+		}
+	}
+
+	rows, err := db.Query("SELECT table_id, id FROM dining_sessions WHERE closed_at IS NULL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	for rows.Next() {
+		var tableID int
+		var id string
+		if err := rows.Scan(&tableID, &id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if i, ok := index[tableID]; ok {
+			floor[i].SessionID = id
+		}
+	}
+	rows.Close()
+	// 被合并的餐桌共用主桌的会话
+	for i := range floor {
+		if h, ok := index[floor[i].MergedInto]; ok {
+			floor[i].SessionID = floor[h].SessionID
+		}
+	}
+
+	rows, err = db.Query(`SELECT l.table_id, l.changed_at FROM table_status_log l
+		JOIN (SELECT table_id, MAX(id) AS id FROM table_status_log GROUP BY table_id) last ON last.id = l.id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query status log: %w", err)
+	}
+	for rows.Next() {
+		var tableID int
+		var since string
+		if err := rows.Scan(&tableID, &since); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if i, ok := index[tableID]; ok {
+			floor[i].Since = since
+		}
+	}
+	rows.Close()
+
+	now = now.In(config.Location())
+	args := append([]any{now.Format(dateTimeLayout)}, inactiveReservationStatuses...)
+	rows, err = db.Query(`SELECT Table_ID, MIN(ReservationTime) FROM reservationList
+		WHERE ReservationTime >= ? AND Status NOT IN (?, ?, ?, ?) GROUP BY Table_ID`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reservations: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tableID int
+		var next string
+		if err := rows.Scan(&tableID, &next); err != nil {
+			return nil, err
+		}
+		i, ok := index[tableID]
+		if !ok {
+			continue
+		}
+		floor[i].NextReservation = next
+		at, err := time.ParseInLocation(dateTimeLayout, next, config.Location())
+		if err == nil && floor[i].Status == StatusAvailable && at.Sub(now) <= reservedLead {
+			floor[i].Status = StatusReserved
+		}
+	}
+	return floor, rows.Err()
+}
+
+// FetchStatusHistory 返回门店区间内的状态记录，tableID 为0时包含门店全部餐桌
+func FetchStatusHistory(storeID, tableID int, from, to string) ([]StatusChange, error) {
+	query := `SELECT id, table_id, status, reason, changed_at FROM table_status_log
+		WHERE table_id IN (SELECT id FROM tableList WHERE store_id = ?) AND changed_at >= ? AND changed_at < ?`
+	args := []any{storeID, from, to}
+	if tableID > 0 {
+		query += " AND table_id = ?"
+		args = append(args, tableID)
+	}
+	query += " ORDER BY table_id, changed_at, id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query status log: %w", err)
+	}
+	defer rows.Close()
+
+	changes := []StatusChange{}
+	for rows.Next() {
+		var c StatusChange
+		if err := rows.Scan(&c.ID, &c.TableID, &c.Status, &c.Reason, &c.ChangedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan status log: %w", err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// computeTurnover 根据按餐桌和时间排序的状态记录统计翻台次数与平均占用时长；
+// 区间结束时仍在就餐的不计入平均时长
+func computeTurnover(changes []StatusChange, names map[int]string) []Turnover {
+	var result []Turnover
+	var occupiedAt time.Time
+	var total time.Duration
+	var closed int
+	for i, c := range changes {
+		if i == 0 || changes[i-1].TableID != c.TableID {
+			result = append(result, Turnover{TableID: c.TableID, TableName: names[c.TableID]})
+			occupiedAt = time.Time{}
+			total, closed = 0, 0
+		}
+		t := &result[len(result)-1]
+		at, err := time.Parse(dateTimeLayout, c.ChangedAt)
+		if err != nil {
+			continue
+		}
+
+		if c.Status == StatusOccupied {
+			t.Seatings++
+			occupiedAt = at
+		} else if !occupiedAt.IsZero() {
+			total += at.Sub(occupiedAt)
+			closed++
+			occupiedAt = time.Time{}
+		}
+		if closed > 0 {
+			t.AvgMinutes = total.Minutes() / float64(closed)
+		}
+	}
+	return result
+}
+
+// HandleFloorStatus 返回楼面上全部餐桌的实时状态
+func HandleFloorStatus(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	floor, err := FetchFloor(storeID, time.Now())
+	if err != nil {
+		log.Printf("Failed to fetch floor status: %v", err)
+		http.Error(w, "Failed to fetch floor status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(floor)
+}
+
+// HandleConfirmCleaned 员工确认餐桌已清理完毕
+func HandleConfirmCleaned(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	err := ConfirmCleaned(storeID, requestData.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Table not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrStatusTransition) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to confirm table cleaned: %v", err)
+		http.Error(w, "Failed to update table status", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Table is available"))
+}
+
+// HandleStatusHistory 返回状态变化记录与翻台统计，from 与 to 为日期（含 from，不含 to），默认最近7天
+func HandleStatusHistory(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		TableID int    `json:"tableId"`
+		From    string `json:"from"`
+		To      string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	today := time.Now().In(config.Location())
+	from, to := today.AddDate(0, 0, -6), today.AddDate(0, 0, 1)
+	var err error
+	if requestData.From != "" {
+		if from, err = time.Parse("2006-01-02", requestData.From); err != nil {
+			http.Error(w, "Invalid from date", http.StatusBadRequest)
+			return
+		}
+	}
+	if requestData.To != "" {
+		if to, err = time.Parse("2006-01-02", requestData.To); err != nil {
+			http.Error(w, "Invalid to date", http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, err := FetchStatusHistory(storeID, requestData.TableID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		log.Printf("Failed to fetch status history: %v", err)
+		http.Error(w, "Failed to fetch status history", http.StatusInternalServerError)
+		return
+	}
+
+	tables, err := queryTables("SELECT "+tableColumns+" FROM tableList WHERE store_id = ?", storeID)
+	if err != nil {
+		http.Error(w, "Failed to execute query", http.StatusInternalServerError)
+		return
+	}
+	names := make(map[int]string)
+	for _, t := range tables {
+		names[t.ID] = t.Name
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Changes  []StatusChange `json:"changes"`
+		Turnover []Turnover     `json:"turnover"`
+	}{changes, computeTurnover(changes, names)})
+}
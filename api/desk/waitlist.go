@@ -0,0 +1,486 @@
+package desk
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/notify"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// 排队状态
+const (
+	WaitWaiting   = "waiting"
+	WaitCalled    = "called"
+	WaitSeated    = "seated"
+	WaitCancelled = "cancelled"
+	WaitExpired   = "expired"
+)
+
+// defaultSeatingMinutes 没有翻台记录时假定的每桌就餐时长
+const defaultSeatingMinutes = 45
+
+var (
+	// ErrNoWaitingParty 表示没有能坐进该餐桌的排队顾客
+	ErrNoWaitingParty = errors.New("no waiting party fits this table")
+	// ErrWaitlistState 表示排队记录当前状态不允许该操作
+	ErrWaitlistState = errors.New("invalid waitlist state")
+)
+
+// WaitlistEntry 一组排队的顾客
+type WaitlistEntry struct {
+	ID        int    `json:"id"`
+	TicketNo  int    `json:"ticketNo"` // 当天的排队号
+	PartySize int    `json:"partySize"`
+	Name      string `json:"name"`
+	Phone     string `json:"phone"`
+	OpenID    string `json:"openid"`
+	Email     string `json:"email"`
+	Status    string `json:"status"`
+	TableID   int    `json:"tableId"`
+	CreatedAt string `json:"createdAt"`
+	CalledAt  string `json:"calledAt"`
+	StoreID   int    `json:"storeId"`
+
+	Position      int `json:"position"`      // 排队中的位置，从1开始，不在排队时为0
+	EstimatedWait int `json:"estimatedWait"` // 预计等待分钟数
+}
+
+func migrateWaitlist() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS waitlist (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		ticket_no INT NOT NULL,
+		party_size INT NOT NULL,
+		name VARCHAR(64) NOT NULL DEFAULT '',
+		phone VARCHAR(32) NOT NULL DEFAULT '',
+		openid VARCHAR(64) NOT NULL DEFAULT '',
+		email VARCHAR(255) NOT NULL DEFAULT '',
+		status VARCHAR(16) NOT NULL,
+		table_id INT NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		called_at DATETIME NULL,
+		seated_at DATETIME NULL,
+		INDEX idx_status (status, id)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating waitlist table: %w", err)
+	}
+	return nil
+}
+
+func storeToday() string {
+	return time.Now().In(config.Location()).Format("2006-01-02")
+}
+
+// expireStale 前一天未入座的排队作废，排队号每天从1开始
+func expireStale() error {
+	_, err := db.Exec("UPDATE waitlist SET status = ? WHERE status IN (?, ?) AND created_at < ?",
+		WaitExpired, WaitWaiting, WaitCalled, storeToday())
+	return err
+}
+
+const waitlistColumns = "id, ticket_no, party_size, name, phone, openid, email, status, table_id, created_at, COALESCE(called_at, ''), store_id"
+
+func scanWaitlist(rows *sql.Rows) ([]WaitlistEntry, error) {
+	defer rows.Close()
+	entries := []WaitlistEntry{}
+	for rows.Next() {
+		var e WaitlistEntry
+		if err := rows.Scan(&e.ID, &e.TicketNo, &e.PartySize, &e.Name, &e.Phone, &e.OpenID, &e.Email,
+			&e.Status, &e.TableID, &e.CreatedAt, &e.CalledAt, &e.StoreID); err != nil {
+			return nil, fmt.Errorf("failed to scan waitlist: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func fetchWaitlistEntry(id int) (WaitlistEntry, error) {
+	rows, err := db.Query("SELECT "+waitlistColumns+" FROM waitlist WHERE id = ?", id)
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+	entries, err := scanWaitlist(rows)
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+	if len(entries) == 0 {
+		return WaitlistEntry{}, sql.ErrNoRows
+	}
+	return entries[0], nil
+}
+
+// averageSeatingMinutes 根据门店最近7天的翻台记录估算容量足够的餐桌每桌就餐时长
+func averageSeatingMinutes(storeID, partySize int) (float64, error) {
+	today := time.Now().In(config.Location())
+	changes, err := FetchStatusHistory(storeID, 0, today.AddDate(0, 0, -7).Format("2006-01-02"), today.AddDate(0, 0, 1).Format("2006-01-02"))
+	if err != nil {
+		return 0, err
+	}
+
+	tables, err := queryTables("SELECT "+tableColumns+" FROM tableList WHERE deleted_at IS NULL AND capacity >= ? AND store_id = ?", partySize, storeID)
+	if err != nil {
+		return 0, err
+	}
+	suitable := make(map[int]bool)
+	for _, t := range tables {
+		suitable[t.ID] = true
+	}
+
+	var total float64
+	var seatings int
+	for _, t := range computeTurnover(changes, nil) {
+		if suitable[t.TableID] && t.AvgMinutes > 0 {
+			total += t.AvgMinutes * float64(t.Seatings)
+			seatings += t.Seatings
+		}
+	}
+	if seatings == 0 {
+		return defaultSeatingMinutes, nil
+	}
+	return total / float64(seatings), nil
+}
+
+// estimate 计算排队位置与预计等待时间：空闲餐桌先满足排在前面的顾客，
+// 其余顾客按容量足够的餐桌数量分批，每批等待一个平均就餐时长
+func estimate(e *WaitlistEntry) error {
+	if e.Status != WaitWaiting {
+		e.Position, e.EstimatedWait = 0, 0
+		return nil
+	}
+
+	var ahead int
+	err := db.QueryRow("SELECT COUNT(*) FROM waitlist WHERE status = ? AND id < ? AND store_id = ?", WaitWaiting, e.ID, e.StoreID).Scan(&ahead)
+	if err != nil {
+		return err
+	}
+	e.Position = ahead + 1
+
+	var suitable, free int
+	err = db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(status = ?), 0) FROM tableList WHERE deleted_at IS NULL AND capacity >= ? AND store_id = ?`,
+		StatusAvailable, e.PartySize, e.StoreID).Scan(&suitable, &free)
+	if err != nil {
+		return err
+	}
+	if suitable == 0 || e.Position <= free {
+		e.EstimatedWait = 0
+		return nil
+	}
+
+	avg, err := averageSeatingMinutes(e.StoreID, e.PartySize)
+	if err != nil {
+		return err
+	}
+	rounds := math.Ceil(float64(e.Position-free) / float64(suitable))
+	e.EstimatedWait = int(math.Round(rounds * avg))
+	return nil
+}
+
+// JoinWaitlist 顾客在 e.StoreID 门店取号排队，返回带排队位置与预计等待时间的记录
+func JoinWaitlist(e WaitlistEntry) (WaitlistEntry, error) {
+	if e.PartySize <= 0 {
+		return e, fmt.Errorf("%w: party size is required", ErrWaitlistState)
+	}
+	if e.Phone == "" && e.OpenID == "" && e.Email == "" {
+		return e, fmt.Errorf("%w: phone, openid or email is required", ErrWaitlistState)
+	}
+	if err := expireStale(); err != nil {
+		return e, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return e, err
+	}
+	defer tx.Rollback()
+
+	today := storeToday()
+	err = tx.QueryRow("SELECT COALESCE(MAX(ticket_no), 0) + 1 FROM waitlist WHERE created_at >= ? AND store_id = ? FOR UPDATE", today, e.StoreID).Scan(&e.TicketNo)
+	if err != nil {
+		return e, err
+	}
+	res, err := tx.Exec(`INSERT INTO waitlist (ticket_no, party_size, name, phone, openid, email, status, created_at, store_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, e.TicketNo, e.PartySize, e.Name, e.Phone, e.OpenID, e.Email, WaitWaiting, storeNow(), e.StoreID)
+	if err != nil {
+		return e, fmt.Errorf("inserting waitlist entry: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return e, err
+	}
+	if err := tx.Commit(); err != nil {
+		return e, err
+	}
+
+	entry, err := fetchWaitlistEntry(int(id))
+	if err != nil {
+		return entry, err
+	}
+	return entry, estimate(&entry)
+}
+
+// FetchWaitlist 返回门店今天排队中和已叫号的顾客
+func FetchWaitlist(storeID int) ([]WaitlistEntry, error) {
+	if err := expireStale(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT "+waitlistColumns+" FROM waitlist WHERE status IN (?, ?) AND store_id = ? ORDER BY id", WaitWaiting, WaitCalled, storeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query waitlist: %w", err)
+	}
+	entries, err := scanWaitlist(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if err := estimate(&entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// CallNext 为空出的餐桌叫号：选出最早排队且人数不超过餐桌容量的顾客，并通知顾客
+func CallNext(tableID int) (WaitlistEntry, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+	defer tx.Rollback()
+
+	// 合并的餐桌叫号到主桌，按合计容量匹配
+	if tableID, err = tableHost(tx, tableID); err != nil {
+		return WaitlistEntry{}, err
+	}
+	var tableName string
+	var storeID int
+	if err = tx.QueryRow("SELECT name, store_id FROM tableList WHERE id = ?", tableID).Scan(&tableName, &storeID); err != nil {
+		return WaitlistEntry{}, err
+	}
+	capacity, err := groupCapacity(tx, tableID)
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+
+	var id int
+	err = tx.QueryRow("SELECT id FROM waitlist WHERE status = ? AND party_size <= ? AND store_id = ? ORDER BY id LIMIT 1 FOR UPDATE",
+		WaitWaiting, capacity, storeID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return WaitlistEntry{}, ErrNoWaitingParty
+	}
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+
+	_, err = tx.Exec("UPDATE waitlist SET status = ?, table_id = ?, called_at = ? WHERE id = ?", WaitCalled, tableID, storeNow(), id)
+	if err != nil {
+		return WaitlistEntry{}, fmt.Errorf("calling waitlist entry: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return WaitlistEntry{}, err
+	}
+
+	e, err := fetchWaitlistEntry(id)
+	if err != nil {
+		return e, err
+	}
+
+	// 通知失败不影响叫号，员工仍可现场叫号
+	err = notify.Send(notify.Message{
+		Event:   "waitlist_called",
+		OpenID:  e.OpenID,
+		Email:   e.Email,
+		StoreID: e.StoreID,
+		Title:   fmt.Sprintf("请到 %s 入座", tableName),
+		Fields: map[string]string{
+			"ticket": strconv.Itoa(e.TicketNo),
+			"table":  tableName,
+			"note":   "请尽快到前台入座",
+		},
+		Lines: []string{
+			fmt.Sprintf("您的排队号 %d 已叫到。", e.TicketNo),
+			fmt.Sprintf("请到 %s 入座，过号请联系前台。", tableName),
+		},
+	})
+	if err != nil && !errors.Is(err, notify.ErrNoChannel) {
+		log.Printf("Failed to notify waitlist entry %d: %v", e.ID, err)
+	}
+	return e, nil
+}
+
+// SeatParty 已叫号的顾客入座，餐桌进入就餐状态
+func SeatParty(id int) error {
+	e, err := fetchWaitlistEntry(id)
+	if err != nil {
+		return err
+	}
+	if e.Status != WaitCalled {
+		return fmt.Errorf("%w: entry is %s", ErrWaitlistState, e.Status)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE waitlist SET status = ?, seated_at = ? WHERE id = ?", WaitSeated, storeNow(), id); err != nil {
+		return err
+	}
+	if err := setTableStatus(tx, e.TableID, StatusOccupied, fmt.Sprintf("waitlist %d", e.TicketNo)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CancelWaitlist 取消排队或过号
+func CancelWaitlist(id int) error {
+	res, err := db.Exec("UPDATE waitlist SET status = ? WHERE id = ? AND status IN (?, ?)", WaitCancelled, id, WaitWaiting, WaitCalled)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: entry %d is not waiting", ErrWaitlistState, id)
+	}
+	return nil
+}
+
+// writeWaitlistError 按错误类型返回对应的状态码
+func writeWaitlistError(w http.ResponseWriter, err error) {
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "Waitlist entry not found", http.StatusNotFound)
+	case errors.Is(err, ErrUnknownTable):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNoWaitingParty), errors.Is(err, ErrWaitlistState):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Waitlist error: %v", err)
+		http.Error(w, "Waitlist error", http.StatusInternalServerError)
+	}
+}
+
+// HandleWaitlist 返回排队中和已叫号的顾客
+func HandleWaitlist(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	entries, err := FetchWaitlist(storeID)
+	if err != nil {
+		writeWaitlistError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// HandleJoinWaitlist 顾客取号排队
+func HandleJoinWaitlist(w http.ResponseWriter, r *http.Request) {
+	var e WaitlistEntry
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if e.StoreID, ok = store.RequestStore(w, r); !ok {
+		return
+	}
+
+	entry, err := JoinWaitlist(e)
+	if errors.Is(err, ErrWaitlistState) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeWaitlistError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// HandleWaitlistEntry 返回一条排队记录及其当前位置与预计等待时间
+func HandleWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid waitlist id", http.StatusBadRequest)
+		return
+	}
+
+	e, err := fetchWaitlistEntry(id)
+	if err == nil {
+		err = estimate(&e)
+	}
+	if err != nil {
+		writeWaitlistError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+// HandleCallNext 餐桌空出后叫下一位，请求体为 {"tableId": N}
+func HandleCallNext(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		TableID int `json:"tableId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	e, err := CallNext(requestData.TableID)
+	if err != nil {
+		writeWaitlistError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+// HandleSeatParty 已叫号的顾客入座
+func HandleSeatParty(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := SeatParty(requestData.ID); err != nil {
+		writeWaitlistError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Party seated successfully"))
+}
+
+// HandleCancelWaitlist 取消排队
+func HandleCancelWaitlist(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := CancelWaitlist(requestData.ID); err != nil {
+		writeWaitlistError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Waitlist entry cancelled"))
+}
@@ -4,8 +4,10 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"gocode/first/api/store"
 	"log"
 	"math/rand"
+	"mime"
 	"net/http"
 	"net/smtp"
 	"time"
@@ -68,10 +70,31 @@ func VerifyCodeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("验证码正确"))
 }
 
-// sendEmail 发送邮件，使用 TLS 加密
-func sendEmail(recipient, code string) error {
+// sendEmail 发送验证码邮件，并记录验证码及其过期时间
+func sendEmail(storeID int, recipient, code string) error {
+	message := fmt.Sprintf(`
+		<p style="font-family: 'Lucida Handwriting', cursive; color: #555; font-size: 16px; line-height: 1.6; text-align: center;">
+		<span style="display: block; margin-bottom: 20px; font-size: 14px; color: #B94A5A;">花开再美，怎如初见</span>
+		<span style="background-color: #FADADD; color: #D6336C; padding: 5px 10px; border-radius: 15px; box-shadow: 0 2px 4px rgba(0, 0, 0, 0.1); text-shadow: 0.5px 0.5px 1px #FADADD; font-family: 'Comic Sans MS', cursive, sans-serif; font-size: 18px;">
+			你的验证码是 :
+		</span> 
+		<strong style="display: inline-block; background-color: #FFE0F0; border: 1px dashed #FFAEC0; padding: 12px 20px; margin-top: 10px; border-radius: 25px; font-size: 20px; color: #D6336C; box-shadow: 0 4px 8px rgba(0, 0, 0, 0.1); text-shadow: 1px 1px 2px pink;">
+			%s
+		</strong>
+		</p>
+		`, code)
+
+	// 在发送邮件前，存储验证码及其过期时间
+	codeMap[recipient] = code
+	codeExpiry[recipient] = time.Now().Add(10 * time.Minute) // 假设验证码10分钟后过期
+
+	return SendHTML(storeID, recipient, "Verification Code", message)
+}
+
+// SendHTML 使用门店的邮箱配置通过 TLS 发送一封套用统一模板的 HTML 邮件，message 为正文部分的 HTML
+func SendHTML(storeID int, recipient, subject, message string) error {
 	// 从数据库获取邮箱配置
-	emailConfig, err := GetEmailConfig() // 假设 GetEmailConfig 是已经实现的函数
+	emailConfig, err := GetEmailConfig(storeID)
 	if err != nil {
 		log.Printf("Error getting email configuration: %v", err)
 		return err
@@ -86,17 +109,6 @@ func sendEmail(recipient, code string) error {
 	// 替换动态内容
 	blogURL := "https://www.staykoi.asia" // 示例URL
 	blogEngName := "stay点餐"               // 示例博客名
-	message := fmt.Sprintf(`
-		<p style="font-family: 'Lucida Handwriting', cursive; color: #555; font-size: 16px; line-height: 1.6; text-align: center;">
-		<span style="display: block; margin-bottom: 20px; font-size: 14px; color: #B94A5A;">花开再美，怎如初见</span>
-		<span style="background-color: #FADADD; color: #D6336C; padding: 5px 10px; border-radius: 15px; box-shadow: 0 2px 4px rgba(0, 0, 0, 0.1); text-shadow: 0.5px 0.5px 1px #FADADD; font-family: 'Comic Sans MS', cursive, sans-serif; font-size: 18px;">
-			你的验证码是 :
-		</span> 
-		<strong style="display: inline-block; background-color: #FFE0F0; border: 1px dashed #FFAEC0; padding: 12px 20px; margin-top: 10px; border-radius: 25px; font-size: 20px; color: #D6336C; box-shadow: 0 4px 8px rgba(0, 0, 0, 0.1); text-shadow: 1px 1px 2px pink;">
-			%s
-		</strong>
-		</p>
-		`, code)
 
 	logoURL := emailConfig.LogoURL // 从数据库获取的Logo URL
 
@@ -118,10 +130,8 @@ func sendEmail(recipient, code string) error {
 `, logoURL, message, blogURL, time.Now().Year(), blogURL, blogEngName)
 
 	// 构建邮件头
-	header := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Verification Code\r\nMIME-Version: 1.0\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n", emailConfig.Sender, recipient)
-	// 在发送邮件前，存储验证码及其过期时间
-	codeMap[recipient] = code
-	codeExpiry[recipient] = time.Now().Add(10 * time.Minute) // 假设验证码10分钟后过期
+	header := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n",
+		emailConfig.Sender, recipient, mime.QEncoding.Encode("UTF-8", subject))
 	// 使用 tls 包的 Dial 函数创建到 SMTP 服务器的 SSL 连接
 	smtpAddr := fmt.Sprintf("%s:%d", emailConfig.SMTP, emailConfig.Port)
 	tlsConfig := &tls.Config{
@@ -195,9 +205,13 @@ func SendTestEmailHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	storeID, ok := store.RequestStore(w, r)
+	if !ok {
+		return
+	}
 
-	code := GenerateCode()                // 调用 email 包中的方法生成验证码
-	err := sendEmail(request.Email, code) // 发送邮件
+	code := GenerateCode()                         // 调用 email 包中的方法生成验证码
+	err := sendEmail(storeID, request.Email, code) // 发送邮件
 	if err != nil {
 		http.Error(w, "发送邮件失败: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"gocode/first/api/store"
 	"gocode/first/config"
 	"log"
 	"net/http"
@@ -41,18 +42,35 @@ func init() {
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+
+	// 每家门店可以使用自己的发件邮箱
+	if err = store.EnsureScoped(db, "email"); err != nil {
+		log.Fatal("Failed to migrate email config:", err)
+	}
 }
 
-func updateEmailConfig(ec *EmailConfig) error {
-	query := `UPDATE email SET logo_url=?, smtp=?, port=?, password=?, server_address=? WHERE id=1`
-	_, err := db.Exec(query, ec.LogoURL, ec.SMTP, ec.Port, ec.Password, ec.ServerAddress)
+// updateEmailConfig 保存门店的邮箱配置，门店还没有配置时新增一条
+func updateEmailConfig(storeID int, ec *EmailConfig) error {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM email WHERE store_id = ?", storeID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		query := `INSERT INTO email (logo_url, smtp, port, sender, password, server_address, store_id) VALUES (?, ?, ?, ?, ?, ?, ?)`
+		_, err := db.Exec(query, ec.LogoURL, ec.SMTP, ec.Port, ec.Sender, ec.Password, ec.ServerAddress, storeID)
+		return err
+	}
+	query := `UPDATE email SET logo_url=?, smtp=?, port=?, password=?, server_address=? WHERE store_id=?`
+	_, err := db.Exec(query, ec.LogoURL, ec.SMTP, ec.Port, ec.Password, ec.ServerAddress, storeID)
 	return err
 }
 
-func GetEmailConfig() (*EmailConfig, error) {
+// GetEmailConfig 返回门店的邮箱配置，门店没有配置时使用默认门店的配置
+func GetEmailConfig(storeID int) (*EmailConfig, error) {
 	ec := &EmailConfig{}
-	query := `SELECT logo_url, smtp, port, sender, password, server_address FROM email WHERE id=1`
-	row := db.QueryRow(query)
+	query := `SELECT logo_url, smtp, port, sender, password, server_address FROM email
+		WHERE store_id IN (?, ?) ORDER BY store_id = ? DESC, id LIMIT 1`
+	row := db.QueryRow(query, storeID, store.DefaultID, storeID)
 	err := row.Scan(&ec.LogoURL, &ec.SMTP, &ec.Port, &ec.Sender, &ec.Password, &ec.ServerAddress)
 	if err != nil {
 		return nil, err
@@ -73,8 +91,12 @@ func HandleUpdateEmailConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
 
-	err = updateEmailConfig(&ec)
+	err = updateEmailConfig(storeID, &ec)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -91,8 +113,13 @@ func HandleGetEmailConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
 	// 移除查询sender的逻辑
-	ec, err := GetEmailConfig() // 直接调用getEmailConfig获取配置
+	ec, err := GetEmailConfig(storeID) // 直接调用getEmailConfig获取配置
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -0,0 +1,340 @@
+package i18n
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/config"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// DefaultLocale 菜单与公告原文使用的语言，请求该语言时不做翻译
+const DefaultLocale = "zh"
+
+// 可翻译的实体类型
+const (
+	EntityProduct      = "product"
+	EntityCategory     = "category"
+	EntityAnnouncement = "announcement"
+	// EntityOption 商品的规格、温度、加料选项；按原文翻译，entity_id 固定为0，field 为选项原文
+	EntityOption = "option"
+)
+
+// entityFields 各实体类型允许翻译的字段，选项类型的字段为原文不做限制
+var entityFields = map[string][]string{
+	EntityProduct:      {"name"},
+	EntityCategory:     {"name"},
+	EntityAnnouncement: {"title", "content"},
+	EntityOption:       nil,
+}
+
+// ErrInvalidTranslation 表示翻译的实体类型、字段或语言不合法
+var ErrInvalidTranslation = errors.New("invalid translation")
+
+// Translation 某个实体字段在某种语言下的译文
+type Translation struct {
+	ID         int    `json:"id"`
+	EntityType string `json:"entityType"`
+	EntityID   int    `json:"entityId"`
+	Locale     string `json:"locale"`
+	Field      string `json:"field"`
+	Value      string `json:"value"`
+}
+
+var db *sql.DB
+
+func init() {
+	var err error
+
+	// 从配置文件中获取数据库连接信息
+	dbc := config.DBConfig
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
+		dbc.Username, dbc.Password, dbc.Host, dbc.Port, dbc.Database)
+
+	// 使用配置信息打开数据库连接
+	db, err = sql.Open("mysql", dsn)
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+
+	// 检查与数据库的连接
+	err = db.Ping()
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS translations (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		entity_type VARCHAR(32) NOT NULL,
+		entity_id INT NOT NULL,
+		locale VARCHAR(16) NOT NULL,
+		field VARCHAR(191) NOT NULL,
+		value TEXT NOT NULL,
+		UNIQUE KEY uniq_translation (entity_type, entity_id, locale, field)
+	)`)
+	if err != nil {
+		log.Fatal("Failed to migrate translations:", err)
+	}
+}
+
+// normalizeLocale 统一语言标签的写法，例如 "en_US" 转为 "en-us"
+func normalizeLocale(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
+
+// baseLocale 返回语言标签的主语言部分，例如 "en-us" 返回 "en"
+func baseLocale(locale string) string {
+	base, _, _ := strings.Cut(locale, "-")
+	return base
+}
+
+// IsDefault 判断语言是否为原文语言
+func IsDefault(locale string) bool {
+	return locale == "" || baseLocale(locale) == DefaultLocale
+}
+
+// RequestLocale 返回请求希望使用的语言：优先取 lang 参数，其次取 Accept-Language 中权重最高的语言，都没有时返回默认语言
+func RequestLocale(r *http.Request) string {
+	if lang := normalizeLocale(r.URL.Query().Get("lang")); lang != "" {
+		return lang
+	}
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = normalizeLocale(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		tags = append(tags, weighted{tag, q})
+	}
+	if len(tags) == 0 {
+		return DefaultLocale
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	return tags[0].tag
+}
+
+// Lookup 返回某类实体在给定语言下的译文，键依次为实体ID与字段；
+// 没有对应地区的译文时退回到主语言，例如 "en-us" 退回 "en"
+func Lookup(entityType, locale string) (map[int]map[string]string, error) {
+	result := make(map[int]map[string]string)
+	if IsDefault(locale) {
+		return result, nil
+	}
+
+	// 按地区标签优先的顺序读取，后读到的覆盖先读到的
+	rows, err := db.Query(`SELECT entity_id, field, value FROM translations
+		WHERE entity_type = ? AND locale IN (?, ?) ORDER BY locale = ?`,
+		entityType, baseLocale(locale), locale, locale)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query translations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var field, value string
+		if err := rows.Scan(&id, &field, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan translation: %w", err)
+		}
+		if result[id] == nil {
+			result[id] = make(map[string]string)
+		}
+		result[id][field] = value
+	}
+	return result, rows.Err()
+}
+
+// Options 返回商品选项的译文，键为选项原文
+func Options(locale string) (map[string]string, error) {
+	t, err := Lookup(EntityOption, locale)
+	if err != nil {
+		return nil, err
+	}
+	if t[0] == nil {
+		return map[string]string{}, nil
+	}
+	return t[0], nil
+}
+
+// Text 返回译文，没有译文时返回原文
+func Text(t map[int]map[string]string, id int, field, fallback string) string {
+	if v, ok := t[id][field]; ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func validateTranslation(t *Translation) error {
+	t.Locale = normalizeLocale(t.Locale)
+	if t.Locale == "" || IsDefault(t.Locale) {
+		return fmt.Errorf("%w: locale %q", ErrInvalidTranslation, t.Locale)
+	}
+	fields, ok := entityFields[t.EntityType]
+	if !ok {
+		return fmt.Errorf("%w: entity type %q", ErrInvalidTranslation, t.EntityType)
+	}
+	if t.EntityType == EntityOption {
+		t.EntityID = 0
+		if t.Field == "" {
+			return fmt.Errorf("%w: option text is required", ErrInvalidTranslation)
+		}
+		return nil
+	}
+	if t.EntityID <= 0 {
+		return fmt.Errorf("%w: entity id is required", ErrInvalidTranslation)
+	}
+	for _, f := range fields {
+		if f == t.Field {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: field %q of %s", ErrInvalidTranslation, t.Field, t.EntityType)
+}
+
+// FetchTranslations 返回译文，entityType 与 entityID 为零值时不过滤
+func FetchTranslations(entityType string, entityID int) ([]Translation, error) {
+	query := "SELECT id, entity_type, entity_id, locale, field, value FROM translations WHERE 1 = 1"
+	var args []any
+	if entityType != "" {
+		query += " AND entity_type = ?"
+		args = append(args, entityType)
+	}
+	if entityID > 0 {
+		query += " AND entity_id = ?"
+		args = append(args, entityID)
+	}
+	query += " ORDER BY entity_type, entity_id, locale, field"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query translations: %w", err)
+	}
+	defer rows.Close()
+
+	translations := []Translation{}
+	for rows.Next() {
+		var t Translation
+		if err := rows.Scan(&t.ID, &t.EntityType, &t.EntityID, &t.Locale, &t.Field, &t.Value); err != nil {
+			return nil, fmt.Errorf("failed to scan translation: %w", err)
+		}
+		translations = append(translations, t)
+	}
+	return translations, rows.Err()
+}
+
+// SaveTranslations 批量新增或覆盖译文，译文为空时删除该条翻译
+func SaveTranslations(translations []Translation) error {
+	for i := range translations {
+		if err := validateTranslation(&translations[i]); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, t := range translations {
+		if t.Value == "" {
+			_, err = tx.Exec("DELETE FROM translations WHERE entity_type = ? AND entity_id = ? AND locale = ? AND field = ?",
+				t.EntityType, t.EntityID, t.Locale, t.Field)
+		} else {
+			_, err = tx.Exec(`INSERT INTO translations (entity_type, entity_id, locale, field, value) VALUES (?, ?, ?, ?, ?)
+				ON DUPLICATE KEY UPDATE value = VALUES(value)`,
+				t.EntityType, t.EntityID, t.Locale, t.Field, t.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("saving translation: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// HandleTranslations 请求体为空或只带过滤条件时返回译文列表
+func HandleTranslations(w http.ResponseWriter, r *http.Request) {
+	var filter Translation
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &filter); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	translations, err := FetchTranslations(filter.EntityType, filter.EntityID)
+	if err != nil {
+		log.Printf("Failed to fetch translations: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(translations)
+}
+
+// HandleSaveTranslations 批量保存译文，请求体为译文数组
+func HandleSaveTranslations(w http.ResponseWriter, r *http.Request) {
+	var translations []Translation
+	if err := json.NewDecoder(r.Body).Decode(&translations); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := SaveTranslations(translations); err != nil {
+		if errors.Is(err, ErrInvalidTranslation) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to save translations: %v", err)
+		http.Error(w, "Failed to save translations", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Translations saved successfully"))
+}
+
+// HandleDeleteTranslation 根据ID删除一条译文
+func HandleDeleteTranslation(w http.ResponseWriter, r *http.Request) {
+	var t Translation
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM translations WHERE id = ?", t.ID); err != nil {
+		log.Printf("Failed to delete translation: %v", err)
+		http.Error(w, "Failed to delete translation", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Translation deleted successfully"))
+}
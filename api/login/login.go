@@ -6,7 +6,9 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"gocode/first/api/store"
 	"gocode/first/config"
+	"log"
 	"net/http"
 	"time"
 
@@ -22,6 +24,8 @@ type Response struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
 	Token   string `json:"token,omitempty"`
+	Role    string `json:"role,omitempty"`   // owner 或 manager
+	Stores  []int  `json:"stores,omitempty"` // 可以管理的门店
 }
 
 func GenerateToken() string {
@@ -33,23 +37,29 @@ func GenerateToken() string {
 	return token
 }
 
-func checkCredentials(username, password string) bool {
+// login 校验用户名密码，成功时保存新的登录 token，后续请求通过 Authorization: Bearer <token> 识别管理员
+func login(username, password string) (string, bool) {
 	// 使用配置中的数据库连接信息
 	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
 		config.DBConfig.Username, config.DBConfig.Password, config.DBConfig.Host, config.DBConfig.Port, config.DBConfig.Database))
 	if err != nil {
 		fmt.Println("Failed to connect to database:", err)
-		return false
+		return "", false
 	}
 	defer db.Close()
 
 	var id int
 	err = db.QueryRow("SELECT id FROM manager WHERE username = ? AND password = ?", username, password).Scan(&id)
 	if err != nil || id == 0 {
-		return false
+		return "", false
 	}
 
-	return true
+	token := GenerateToken()
+	if _, err := db.Exec("UPDATE manager SET token = ? WHERE id = ?", token, id); err != nil {
+		log.Println("Failed to save login token:", err)
+		return "", false
+	}
+	return token, true
 }
 
 func HandleLogin(w http.ResponseWriter, r *http.Request) {
@@ -60,9 +70,13 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if checkCredentials(req.Username, req.Password) {
-		token := GenerateToken()
-		response := Response{"success", "Login successful", token}
+	if token, ok := login(req.Username, req.Password); ok {
+		response := Response{Status: "success", Message: "Login successful", Token: token}
+		if m, err := store.ManagerByToken(token); err != nil {
+			log.Println("Failed to load manager stores:", err)
+		} else if m != nil {
+			response.Role, response.Stores = m.Role, m.Stores
+		}
 		json.NewEncoder(w).Encode(response)
 	} else {
 		response := Response{Status: "error", Message: "Invalid username or password", Token: ""}
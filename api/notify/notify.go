@@ -0,0 +1,96 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"gocode/first/api/email"
+	"html"
+	"log"
+	"sort"
+	"strings"
+)
+
+// ErrNoChannel 表示没有适用于接收人的通知渠道
+var ErrNoChannel = errors.New("no notification channel for recipient")
+
+// Message 发给顾客的一条通知，依次尝试各通知渠道
+type Message struct {
+	Event  string            // 通知事件，对应 config.Wechat.Templates 的键
+	OpenID string            // 小程序用户 openid
+	Email  string            // 邮箱
+	Title  string            // 邮件标题
+	Fields map[string]string // 通知内容字段，例如 table、time
+	Lines  []string          // 邮件正文，每项一段
+	// 发出通知的门店，邮件使用该门店的发件邮箱，为0时使用默认门店
+	StoreID int
+}
+
+// emailBody 把通知正文转为邮件 HTML，没有正文时按字段名排序列出字段
+func emailBody(m Message) string {
+	lines := m.Lines
+	if len(lines) == 0 {
+		keys := make([]string, 0, len(m.Fields))
+		for k := range m.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			lines = append(lines, k+": "+m.Fields[k])
+		}
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		fmt.Fprintf(&b, `<p style="font-size: 16px; line-height: 1.6;">%s</p>`, html.EscapeString(line))
+	}
+	return b.String()
+}
+
+// Channel 通知渠道
+type Channel interface {
+	Name() string
+	// Send 发送通知，接收人缺少该渠道所需的信息时返回 ErrSkip
+	Send(m Message) error
+}
+
+// ErrSkip 表示渠道不适用于该通知，例如接收人没有 openid
+var ErrSkip = errors.New("channel not applicable")
+
+// channels 按优先级排列的通知渠道
+var channels = []Channel{wechatChannel{}, emailChannel{}}
+
+// Register 追加一个通知渠道，应在 init 中调用
+func Register(c Channel) {
+	channels = append(channels, c)
+}
+
+type emailChannel struct{}
+
+func (emailChannel) Name() string { return "email" }
+
+func (emailChannel) Send(m Message) error {
+	if m.Email == "" {
+		return ErrSkip
+	}
+	return email.SendHTML(m.StoreID, m.Email, m.Title, emailBody(m))
+}
+
+// Send 按优先级依次尝试各渠道，第一个发送成功即返回
+func Send(m Message) error {
+	var lastErr error
+	for _, c := range channels {
+		err := c.Send(m)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrSkip) {
+			continue
+		}
+		log.Printf("Notification %s via %s failed: %v", m.Event, c.Name(), err)
+		lastErr = err
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	return ErrNoChannel
+}
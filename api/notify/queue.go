@@ -0,0 +1,176 @@
+package notify
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"gocode/first/config"
+	"log"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+const (
+	// maxAttempts 发送失败后最多尝试的次数
+	maxAttempts = 5
+	// retryDelay 每次失败后推迟的时间，按尝试次数递增
+	retryDelay = 5 * time.Minute
+	// batchSize 每轮最多发送的通知数
+	batchSize = 50
+
+	dateTimeLayout = "2006-01-02 15:04:05"
+)
+
+var db *sql.DB
+
+func init() {
+	var err error
+
+	// 从配置文件中获取数据库连接信息
+	dbc := config.DBConfig
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
+		dbc.Username, dbc.Password, dbc.Host, dbc.Port, dbc.Database)
+
+	// 使用配置信息打开数据库连接
+	db, err = sql.Open("mysql", dsn)
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+
+	// 检查与数据库的连接
+	err = db.Ping()
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS notification_queue (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		event VARCHAR(64) NOT NULL,
+		ref_type VARCHAR(32) NOT NULL DEFAULT '',
+		ref_id INT NOT NULL DEFAULT 0,
+		message TEXT NOT NULL,
+		send_at DATETIME NOT NULL,
+		sent_at DATETIME NULL,
+		cancelled TINYINT(1) NOT NULL DEFAULT 0,
+		attempts INT NOT NULL DEFAULT 0,
+		last_error VARCHAR(512) NOT NULL DEFAULT '',
+		INDEX idx_due (sent_at, cancelled, send_at),
+		INDEX idx_ref (ref_type, ref_id)
+	)`)
+	if err != nil {
+		log.Fatal("Failed to migrate notification queue:", err)
+	}
+}
+
+// storedMessage 通知在队列中的存储格式
+type storedMessage struct {
+	OpenID string            `json:"openid"`
+	Email  string            `json:"email"`
+	Title  string            `json:"title"`
+	Fields map[string]string `json:"fields"`
+	Lines  []string          `json:"lines"`
+	Store  int               `json:"store_id,omitempty"`
+}
+
+func localTime(t time.Time) string {
+	return t.In(config.Location()).Format(dateTimeLayout)
+}
+
+// Enqueue 把通知写入队列，在 sendAt 之后由 RunScheduler 发送；refType 与 refID 标明通知关联的业务记录，便于取消
+func Enqueue(m Message, sendAt time.Time, refType string, refID int) error {
+	b, err := json.Marshal(storedMessage{OpenID: m.OpenID, Email: m.Email, Title: m.Title, Fields: m.Fields, Lines: m.Lines, Store: m.StoreID})
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO notification_queue (event, ref_type, ref_id, message, send_at) VALUES (?, ?, ?, ?, ?)",
+		m.Event, refType, refID, string(b), localTime(sendAt))
+	if err != nil {
+		return fmt.Errorf("enqueueing notification: %w", err)
+	}
+	return nil
+}
+
+// CancelPending 取消关联业务记录尚未发送的通知，event 为空时取消全部事件
+func CancelPending(refType string, refID int, event string) error {
+	query := "UPDATE notification_queue SET cancelled = 1 WHERE ref_type = ? AND ref_id = ? AND sent_at IS NULL"
+	args := []any{refType, refID}
+	if event != "" {
+		query += " AND event = ?"
+		args = append(args, event)
+	}
+	_, err := db.Exec(query, args...)
+	return err
+}
+
+type queuedMessage struct {
+	id       int
+	attempts int
+	message  Message
+}
+
+// sendDue 发送到期的通知，失败的通知推迟后重试，超过 maxAttempts 次后不再发送
+func sendDue(now time.Time) error {
+	rows, err := db.Query(`SELECT id, event, message, attempts FROM notification_queue
+		WHERE sent_at IS NULL AND cancelled = 0 AND attempts < ? AND send_at <= ? ORDER BY send_at, id LIMIT ?`,
+		maxAttempts, localTime(now), batchSize)
+	if err != nil {
+		return fmt.Errorf("querying due notifications: %w", err)
+	}
+
+	var due []queuedMessage
+	for rows.Next() {
+		var q queuedMessage
+		var raw string
+		if err := rows.Scan(&q.id, &q.message.Event, &raw, &q.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		var s storedMessage
+		if err := json.Unmarshal([]byte(raw), &s); err != nil {
+			log.Printf("Invalid queued notification %d: %v", q.id, err)
+			continue
+		}
+		q.message.OpenID, q.message.Email, q.message.Title = s.OpenID, s.Email, s.Title
+		q.message.Fields, q.message.Lines, q.message.StoreID = s.Fields, s.Lines, s.Store
+		due = append(due, q)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, q := range due {
+		if err := Send(q.message); err != nil {
+			attempts := q.attempts + 1
+			retryAt := now.Add(time.Duration(attempts) * retryDelay)
+			msg := err.Error()
+			if len(msg) > 512 {
+				msg = msg[:512]
+			}
+			if _, err := db.Exec("UPDATE notification_queue SET attempts = ?, last_error = ?, send_at = ? WHERE id = ?",
+				attempts, msg, localTime(retryAt), q.id); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := db.Exec("UPDATE notification_queue SET sent_at = ?, attempts = attempts + 1 WHERE id = ?", localTime(now), q.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunScheduler 按固定间隔发送队列中到期的通知，应在单独的 goroutine 中运行；
+// 队列保存在数据库中，重启后未发送的通知会继续发送
+func RunScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := sendDue(time.Now()); err != nil {
+			log.Printf("Error sending queued notifications: %v", err)
+		}
+		<-ticker.C
+	}
+}
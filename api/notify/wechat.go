@@ -0,0 +1,119 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gocode/first/config"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// accessToken 缓存小程序接口调用凭据
+var accessToken struct {
+	sync.Mutex
+	value   string
+	expires time.Time
+}
+
+// fetchAccessToken 返回小程序接口调用凭据，过期前5分钟刷新
+func fetchAccessToken() (string, error) {
+	accessToken.Lock()
+	defer accessToken.Unlock()
+
+	if accessToken.value != "" && time.Now().Before(accessToken.expires) {
+		return accessToken.value, nil
+	}
+
+	wechat := config.C.Wechat
+	requestURL := "https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=" +
+		url.QueryEscape(wechat.AppID) + "&secret=" + url.QueryEscape(wechat.AppSecret)
+	resp, err := httpClient.Get(requestURL)
+	if err != nil {
+		return "", fmt.Errorf("requesting access token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		ErrCode     int    `json:"errcode"`
+		ErrMsg      string `json:"errmsg"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decoding access token: %w", err)
+	}
+	if result.ErrCode != 0 {
+		return "", fmt.Errorf("access token error %d: %s", result.ErrCode, result.ErrMsg)
+	}
+
+	accessToken.value = result.AccessToken
+	accessToken.expires = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - 5*time.Minute)
+	return accessToken.value, nil
+}
+
+// truncate 订阅消息的 thing 类关键词最长20个字符
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
+
+// wechatChannel 小程序订阅消息渠道，事件需在 config.Wechat.Templates 中配置模板
+type wechatChannel struct{}
+
+func (wechatChannel) Name() string { return "wechat" }
+
+// Send 发送小程序订阅消息
+func (wechatChannel) Send(m Message) error {
+	tpl, ok := config.C.Wechat.Templates[m.Event]
+	if !ok || tpl.ID == "" || m.OpenID == "" {
+		return ErrSkip
+	}
+
+	token, err := fetchAccessToken()
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string]map[string]string)
+	for field, key := range tpl.Fields {
+		if v, ok := m.Fields[field]; ok {
+			data[key] = map[string]string{"value": truncate(v, 20)}
+		}
+	}
+	body, err := json.Marshal(map[string]any{
+		"touser":      m.OpenID,
+		"template_id": tpl.ID,
+		"page":        tpl.Page,
+		"data":        data,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Post("https://api.weixin.qq.com/cgi-bin/message/subscribe/send?access_token="+url.QueryEscape(token),
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("sending subscribe message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("decoding subscribe response: %w", err)
+	}
+	if result.ErrCode != 0 {
+		return fmt.Errorf("subscribe message error %d: %s", result.ErrCode, result.ErrMsg)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package order
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// 订单的就餐方式
+const (
+	TypeDineIn   = "dine_in"  // 堂食，关联餐桌或扫码就餐会话
+	TypeTakeaway = "takeaway" // 外带，到店取餐
+	TypeDelivery = "delivery" // 外送，送到顾客地址簿中的地址
+)
+
+const defaultPickupLeadMinutes = 15
+
+// ErrInvalidFulfillment 表示订单的就餐方式或对应信息不合法
+var ErrInvalidFulfillment = errors.New("invalid fulfillment")
+
+// Fees 外带与外送订单在商品金额之外收取的费用，外送订单同时返回配送区域的起送金额和预计送达时间
+type Fees struct {
+	Subtotal     float64 `json:"subtotal"` // 商品金额
+	PackagingFee float64 `json:"packagingFee"`
+	DeliveryFee  float64 `json:"deliveryFee"`
+	Total        float64 `json:"total"`
+	MinAmount    float64 `json:"minAmount,omitempty"`
+	ETAMinutes   int     `json:"etaMinutes,omitempty"`
+	Zone         string  `json:"zone,omitempty"`
+}
+
+// address 顾客地址簿中的一条地址
+type address struct {
+	Address string
+	Phone   string
+	Lat     float64
+	Lng     float64
+	Located bool // 是否填写了坐标
+}
+
+// lookupAddress 查询属于 email 的地址
+func lookupAddress(personID int, email string) (address, error) {
+	var a address
+	var area string
+	var lat, lng sql.NullFloat64
+	err := db.QueryRow("SELECT address, area, phone, lat, lng FROM pesonlist WHERE id = ? AND email = ?", personID, email).
+		Scan(&a.Address, &area, &a.Phone, &lat, &lng)
+	if err == sql.ErrNoRows {
+		return a, fmt.Errorf("%w: address %d not found for %s", ErrInvalidFulfillment, personID, email)
+	}
+	a.Address = area + a.Address
+	a.Lat, a.Lng, a.Located = lat.Float64, lng.Float64, lat.Valid && lng.Valid
+	return a, err
+}
+
+func migrateFulfillment() error {
+	columns := []struct{ name, definition string }{
+		{"order_type", "VARCHAR(16) NOT NULL DEFAULT 'dine_in'"},
+		{"pickup_time", "DATETIME NULL"},
+		{"person_id", "INT NULL"},
+		{"delivery_address", "VARCHAR(255) NOT NULL DEFAULT ''"},
+		{"delivery_phone", "VARCHAR(32) NOT NULL DEFAULT ''"},
+		{"packaging_fee", "DECIMAL(10,2) NOT NULL DEFAULT 0"},
+		{"delivery_fee", "DECIMAL(10,2) NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		if err := utils.EnsureColumn(db, "orders", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pickupLead() time.Duration {
+	minutes := config.C.Store.Fulfillment.PickupLeadMinutes
+	if minutes <= 0 {
+		minutes = defaultPickupLeadMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// orderFees 计算订单的打包费，外送费由 prepareFulfillment 按配送区域算好，o.OrderPrice 为商品金额
+func orderFees(o Order, quote DeliveryQuote) Fees {
+	policy := config.C.Store.Fulfillment
+	f := Fees{Subtotal: o.OrderPrice}
+	if o.Type == TypeTakeaway || o.Type == TypeDelivery {
+		items := 0
+		for _, d := range o.Detail {
+			items += d.GoodsNumber
+		}
+		f.PackagingFee = roundCents(policy.PackagingFee * float64(items))
+	}
+	if o.Type == TypeDelivery {
+		f.DeliveryFee, f.MinAmount, f.ETAMinutes, f.Zone = quote.Fee, quote.MinAmount, quote.ETAMinutes, quote.Zone
+	}
+	f.Total = roundCents(f.Subtotal + f.PackagingFee + f.DeliveryFee)
+	return f
+}
+
+// prepareFulfillment 校验就餐方式对应的信息并补全：未填写时与 order_type 列的默认值一致为堂食，不收打包费；
+// 外带的取餐时间为空表示尽快取餐，填写了即为预约订单，需在可预约天数内且门店营业；外送地址取自下单用户地址簿中的一条，按地址坐标匹配配送区域报价
+func prepareFulfillment(o *Order, now time.Time) (DeliveryQuote, error) {
+	var quote DeliveryQuote
+	if o.Type == "" {
+		o.Type = TypeDineIn
+	}
+
+	switch o.Type {
+	case TypeDineIn:
+		if o.PickupTime != "" || o.PersonID > 0 {
+			return quote, fmt.Errorf("%w: dine-in orders have no pickup time or address", ErrInvalidFulfillment)
+		}
+		return quote, nil
+	case TypeTakeaway, TypeDelivery:
+		if o.SessionID != "" || o.TableID > 0 {
+			return quote, fmt.Errorf("%w: %s orders cannot be placed at a table", ErrInvalidFulfillment, o.Type)
+		}
+	default:
+		return quote, fmt.Errorf("%w: unknown order type %q", ErrInvalidFulfillment, o.Type)
+	}
+
+	if o.Type == TypeTakeaway {
+		if o.PersonID > 0 {
+			return quote, fmt.Errorf("%w: takeaway orders have no address", ErrInvalidFulfillment)
+		}
+		if o.PickupTime == "" {
+			return quote, nil
+		}
+		t, err := time.Parse(time.RFC3339, o.PickupTime)
+		if err != nil {
+			return quote, fmt.Errorf("%w: invalid pickup time", ErrInvalidFulfillment)
+		}
+		if t.Before(now.Add(pickupLead())) {
+			return quote, fmt.Errorf("%w: pickup time must be at least %d minutes from now", ErrInvalidFulfillment, int(pickupLead()/time.Minute))
+		}
+		if err := checkPickupTime(o.StoreID, t, now); err != nil {
+			return quote, err
+		}
+		// 预约订单在取餐时间前 releaseLead 才出现在后厨，提前不足的立即出单
+		o.PickupTime = t.In(config.Location()).Format("2006-01-02 15:04:05")
+		o.ReleaseAt = t.Add(-releaseLead()).In(config.Location()).Format("2006-01-02 15:04:05")
+		return quote, nil
+	}
+
+	// 外送
+	if o.PickupTime != "" {
+		return quote, fmt.Errorf("%w: delivery orders have no pickup time", ErrInvalidFulfillment)
+	}
+	if o.PersonID <= 0 {
+		return quote, fmt.Errorf("%w: delivery orders need an address", ErrInvalidFulfillment)
+	}
+	a, err := lookupAddress(o.PersonID, o.OrderUser)
+	if err != nil {
+		return quote, err
+	}
+	if !a.Located {
+		zones, err := FetchZones(o.StoreID, true)
+		if err != nil {
+			return quote, err
+		}
+		if len(zones) > 0 {
+			return quote, fmt.Errorf("%w: address %d has no coordinates", ErrInvalidFulfillment, o.PersonID)
+		}
+	}
+	quote, err = QuoteDelivery(o.StoreID, a.Lat, a.Lng, o.OrderPrice)
+	if errors.Is(err, ErrOutOfZone) {
+		return quote, fmt.Errorf("%w: %v", ErrInvalidFulfillment, err)
+	}
+	if err != nil {
+		return quote, err
+	}
+	if o.OrderPrice < quote.MinAmount {
+		return quote, fmt.Errorf("%w: delivery requires at least %.2f of goods", ErrInvalidFulfillment, quote.MinAmount)
+	}
+	o.Address, o.Phone = a.Address, a.Phone
+	if a.Located {
+		o.Lat, o.Lng = &a.Lat, &a.Lng
+	}
+	o.DeliveryZone = quote.ZoneID
+	return quote, nil
+}
+
+// HandleQuoteOrder 按就餐方式校验订单并返回费用明细，不创建订单；请求体与 /api/orders/add 相同
+func HandleQuoteOrder(w http.ResponseWriter, r *http.Request) {
+	var o Order
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	if !resolveOrderStore(w, r, &o) {
+		return
+	}
+
+	quote, err := prepareFulfillment(&o, time.Now())
+	if err != nil {
+		if errors.Is(err, ErrInvalidFulfillment) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error checking fulfillment: %v", err)
+		http.Error(w, "Failed to check order", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orderFees(o, quote))
+}
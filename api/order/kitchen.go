@@ -0,0 +1,199 @@
+package order
+
+import (
+	"database/sql"
+	"encoding/json"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// forecastWeeks 备餐预测参考过去几周同一星期几的销量
+const forecastWeeks = 4
+
+// KitchenOrder 后厨待出餐的订单
+type KitchenOrder struct {
+	OrderID     int           `json:"order_id"`
+	OrderNumber string        `json:"order_number"`
+	Type        string        `json:"order_type"`
+	TableID     int           `json:"table_id,omitempty"`
+	PickupTime  string        `json:"pickup_time,omitempty"`
+	CreateTime  string        `json:"create_time"`
+	Scheduled   bool          `json:"scheduled"` // 预约订单
+	Detail      []OrderDetail `json:"detail"`
+}
+
+// PrepItem 某天一种商品的备餐预测，套餐按组成商品统计
+type PrepItem struct {
+	GoodsName string  `json:"goods_name"`
+	Scheduled int     `json:"scheduled"` // 当天已预约的数量
+	Average   float64 `json:"average"`   // 过去几周同一星期几的平均销量
+	Expected  int     `json:"expected"`  // 建议备餐量，平均销量已包含往常的预约，取两者较大值
+}
+
+// FetchKitchenOrders 返回门店今天已支付、已放到后厨且尚未出餐的订单，按取餐或下单时间排序；
+// 预约订单在 release_at 之前不出现
+func FetchKitchenOrders(storeID int, now time.Time) ([]KitchenOrder, error) {
+	now = now.In(config.Location())
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	rows, err := db.Query(`SELECT order_id, order_number, order_type, COALESCE(table_id, 0), COALESCE(pickup_time, ''), create_time, release_at IS NOT NULL
+		FROM orders
+		WHERE store_id = ? AND `+paidCondition+` AND (release_at IS NULL OR release_at <= ?) AND CAST(is_send AS CHAR) NOT IN ('1', 'true')
+			AND COALESCE(pickup_time, create_time) >= ?
+		ORDER BY COALESCE(pickup_time, create_time), order_id`,
+		storeID, now.Format("2006-01-02 15:04:05"), today.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []KitchenOrder{}
+	for rows.Next() {
+		var o KitchenOrder
+		if err := rows.Scan(&o.OrderID, &o.OrderNumber, &o.Type, &o.TableID, &o.PickupTime, &o.CreateTime, &o.Scheduled); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range orders {
+		if orders[i].Detail, err = fetchOrderDetails(strconv.Itoa(orders[i].OrderID)); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+// countGoods 统计门店 [from, to) 内出餐的商品数量，预约订单按取餐时间、其余按下单时间计算；
+// scheduledOnly 为 true 时只统计预约订单
+func countGoods(storeID int, from, to time.Time, scheduledOnly bool) (map[string]int, error) {
+	query := `SELECT d.goods_name, d.goods_number, d.components FROM orderDetails d JOIN orders o ON o.order_id = d.order_id
+		WHERE o.store_id = ? AND COALESCE(o.pickup_time, o.create_time) >= ? AND COALESCE(o.pickup_time, o.create_time) < ?`
+	if scheduledOnly {
+		query += " AND o.release_at IS NOT NULL"
+	}
+	rows, err := db.Query(query, storeID, from.Format("2006-01-02 15:04:05"), to.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var number int
+		var components sql.NullString
+		if err := rows.Scan(&name, &number, &components); err != nil {
+			return nil, err
+		}
+		if !components.Valid || components.String == "" {
+			counts[name] += number
+			continue
+		}
+		var parts []OrderComponent
+		if err := json.Unmarshal([]byte(components.String), &parts); err != nil {
+			log.Printf("Error unmarshalling components of %s: %v", name, err)
+			counts[name] += number
+			continue
+		}
+		for _, c := range parts {
+			counts[c.GoodsName] += c.GoodsNumber * number
+		}
+	}
+	return counts, rows.Err()
+}
+
+// Forecast 返回门店某天的备餐预测：当天已预约的数量与过去 forecastWeeks 周同一星期几的平均销量
+func Forecast(storeID int, date time.Time) ([]PrepItem, error) {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, config.Location())
+	scheduled, err := countGoods(storeID, day, day.AddDate(0, 0, 1), true)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]int)
+	for week := 1; week <= forecastWeeks; week++ {
+		from := day.AddDate(0, 0, -7*week)
+		counts, err := countGoods(storeID, from, from.AddDate(0, 0, 1), false)
+		if err != nil {
+			return nil, err
+		}
+		for name, n := range counts {
+			totals[name] += n
+		}
+	}
+
+	items := make(map[string]*PrepItem)
+	item := func(name string) *PrepItem {
+		if items[name] == nil {
+			items[name] = &PrepItem{GoodsName: name}
+		}
+		return items[name]
+	}
+	for name, n := range scheduled {
+		item(name).Scheduled = n
+	}
+	for name, n := range totals {
+		item(name).Average = math.Round(float64(n)/forecastWeeks*10) / 10
+	}
+
+	forecast := make([]PrepItem, 0, len(items))
+	for _, it := range items {
+		it.Expected = max(it.Scheduled, int(math.Ceil(it.Average)))
+		forecast = append(forecast, *it)
+	}
+	sort.Slice(forecast, func(i, j int) bool { return forecast[i].GoodsName < forecast[j].GoodsName })
+	return forecast, nil
+}
+
+// HandleKitchenOrders 返回后厨待出餐的订单
+func HandleKitchenOrders(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	orders, err := FetchKitchenOrders(storeID, time.Now())
+	if err != nil {
+		log.Printf("Error fetching kitchen orders: %v", err)
+		http.Error(w, "Failed to fetch kitchen orders", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+// HandlePrepForecast 返回 ?date=2006-01-02 当天的备餐预测，未指定日期时为今天
+func HandlePrepForecast(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	date := time.Now().In(config.Location())
+	if v := r.URL.Query().Get("date"); v != "" {
+		d, err := time.ParseInLocation("2006-01-02", v, config.Location())
+		if err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		date = d
+	}
+
+	forecast, err := Forecast(storeID, date)
+	if err != nil {
+		log.Printf("Error building prep forecast: %v", err)
+		http.Error(w, "Failed to build prep forecast", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(forecast)
+}
@@ -3,11 +3,18 @@ package order
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"gocode/first/api/desk"
+	"gocode/first/api/product"
+	"gocode/first/api/store"
 	"gocode/first/config"
+	"gocode/first/utils"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
@@ -15,25 +22,55 @@ import (
 
 // OrderDetail 结构体代表订单详情
 type OrderDetail struct {
-	GoodsName       string  `json:"goods_name"`
-	GoodsWeight     string  `json:"goods_weight"`
-	GoodsNumber     int     `json:"goods_number"`
-	GoodsPrice      float64 `json:"goods_price"`
-	GoodsTotalPrice float64 `json:"goods_total_price"`
-	URL             string  `json:"url"`
-	GoodsStatus     string  `json:"goods_status"`
+	GoodsName       string           `json:"goods_name"`
+	GoodsWeight     string           `json:"goods_weight"`
+	GoodsNumber     int              `json:"goods_number"`
+	GoodsPrice      float64          `json:"goods_price"`
+	GoodsTotalPrice float64          `json:"goods_total_price"`
+	URL             string           `json:"url"`
+	GoodsStatus     string           `json:"goods_status"`
+	Seat            int              `json:"seat,omitempty"`       // 座位号，0 表示全桌共享
+	Components      []OrderComponent `json:"components,omitempty"` // 套餐中选中的组成商品
 }
 
+// OrderComponent 套餐订单项中的一个组成商品，数量为每份套餐中的数量
+type OrderComponent struct {
+	SlotName    string  `json:"slot_name"`
+	GoodsName   string  `json:"goods_name"`
+	GoodsNumber int     `json:"goods_number"`
+	ExtraPrice  float64 `json:"extra_price"`
+}
+
+// paidCondition 已支付的订单，pay_status 可能存为 1 或 true
+const paidCondition = "CAST(pay_status AS CHAR) IN ('1', 'true')"
+
 // Order 结构体代表一个订单及其详情
 type Order struct {
-	OrderID     int           `json:"order_id"`
-	OrderNumber string        `json:"order_number"`
-	OrderPrice  float64       `json:"order_price"`
-	OrderUser   string        `json:"order_user"`
-	PayStatus   string        `json:"pay_status"`
-	IsSend      string        `json:"is_send"`
-	CreateTime  string        `json:"create_time"`
-	Detail      []OrderDetail `json:"detail"`
+	OrderID     int      `json:"order_id"`
+	OrderNumber string   `json:"order_number"`
+	OrderPrice  float64  `json:"order_price"`
+	OrderUser   string   `json:"order_user"`
+	PayStatus   string   `json:"pay_status"`
+	IsSend      string   `json:"is_send"`
+	CreateTime  string   `json:"create_time"`
+	SessionID   string   `json:"session_id,omitempty"` // 扫码就餐会话，下单时带上即关联餐桌
+	TableID     int      `json:"table_id,omitempty"`
+	Deposit     float64  `json:"deposit,omitempty"`     // 预订订金抵扣的金额，应付金额为 order_price 减去该金额
+	Type        string   `json:"order_type"`            // 就餐方式：dine_in、takeaway、delivery
+	PickupTime  string   `json:"pickup_time,omitempty"` // 外带取餐时间，下单时为 RFC3339，为空表示尽快取餐
+	ReleaseAt   string   `json:"release_at,omitempty"`  // 预约订单放到后厨的时间
+	PersonID    int      `json:"person_id,omitempty"`   // 外送地址，pesonlist 中的一条
+	Address     string   `json:"address,omitempty"`
+	Phone       string   `json:"phone,omitempty"`
+	Lat         *float64 `json:"lat,omitempty"` // 外送地址坐标
+	Lng         *float64 `json:"lng,omitempty"`
+	// 外送地址所在的配送区域
+	DeliveryZone int `json:"delivery_zone,omitempty"`
+	// 打包费与外送费已计入 order_price
+	PackagingFee float64       `json:"packaging_fee,omitempty"`
+	DeliveryFee  float64       `json:"delivery_fee,omitempty"`
+	StoreID      int           `json:"store_id"` // 下单的门店，取自请求
+	Detail       []OrderDetail `json:"detail"`
 }
 
 type UpdateOrderRequest struct {
@@ -67,18 +104,55 @@ func init() {
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+
+	if err = utils.EnsureColumn(db, "orderDetails", "components", "TEXT NULL"); err != nil {
+		log.Fatal("Failed to migrate order details:", err)
+	}
+	if err = utils.EnsureColumn(db, "orderDetails", "seat", "INT NOT NULL DEFAULT 0"); err != nil {
+		log.Fatal("Failed to migrate order details:", err)
+	}
+	if err = utils.EnsureColumn(db, "orders", "session_id", "VARCHAR(32) NULL"); err != nil {
+		log.Fatal("Failed to migrate orders:", err)
+	}
+	if err = utils.EnsureColumn(db, "orders", "table_id", "INT NULL"); err != nil {
+		log.Fatal("Failed to migrate orders:", err)
+	}
+	if err = utils.EnsureColumn(db, "orders", "deposit", "DECIMAL(10,2) NOT NULL DEFAULT 0"); err != nil {
+		log.Fatal("Failed to migrate orders:", err)
+	}
+	if err = migrateFulfillment(); err != nil {
+		log.Fatal("Failed to migrate order types:", err)
+	}
+	if err = migrateZones(); err != nil {
+		log.Fatal("Failed to migrate delivery zones:", err)
+	}
+	if err = migrateSplits(); err != nil {
+		log.Fatal("Failed to migrate order splits:", err)
+	}
+	if err = migratePreorders(); err != nil {
+		log.Fatal("Failed to migrate scheduled orders:", err)
+	}
+	// 订单和配送区域按门店区分，订单明细、分单等随所属订单
+	if err = store.EnsureScoped(db, "orders", "delivery_zones"); err != nil {
+		log.Fatal("Failed to migrate store scope:", err)
+	}
 }
 func CheckOrder(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
 	// Prepare and execute the SQL queries
 	var orderCount int
-	err := db.QueryRow("SELECT COUNT(*) FROM orders").Scan(&orderCount)
+	err := db.QueryRow("SELECT COUNT(*) FROM orders WHERE store_id = ?", storeID).Scan(&orderCount)
 	if err != nil {
 		http.Error(w, "Failed to query total number of orders", http.StatusInternalServerError)
 		return
 	}
 
 	var totalPrice float64
-	err = db.QueryRow("SELECT SUM(order_price) FROM orders").Scan(&totalPrice)
+	err = db.QueryRow("SELECT COALESCE(SUM(order_price), 0) FROM orders WHERE store_id = ?", storeID).Scan(&totalPrice)
 	if err != nil {
 		http.Error(w, "Failed to query total price of orders", http.StatusInternalServerError)
 		return
@@ -135,8 +209,15 @@ func GetSpecificOrder(w http.ResponseWriter, r *http.Request) {
 
 // 用于从数据库获取订单列表
 func GetOrders(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
 	orders := []Order{}
-	rows, err := db.Query(`SELECT order_id, order_number, order_price, order_user, pay_status, is_send, create_time FROM orders`)
+	rows, err := db.Query(`SELECT order_id, order_number, order_price, order_user, pay_status, is_send, create_time,
+		COALESCE(session_id, ''), COALESCE(table_id, 0), deposit, order_type, COALESCE(pickup_time, ''), COALESCE(release_at, ''), COALESCE(person_id, 0),
+		delivery_address, delivery_phone, packaging_fee, delivery_fee, store_id FROM orders WHERE store_id = ?`, storeID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -145,12 +226,49 @@ func GetOrders(w http.ResponseWriter, r *http.Request) {
 
 	for rows.Next() {
 		var o Order
-		if err := rows.Scan(&o.OrderID, &o.OrderNumber, &o.OrderPrice, &o.OrderUser, &o.PayStatus, &o.IsSend, &o.CreateTime); err != nil {
+		if err := rows.Scan(&o.OrderID, &o.OrderNumber, &o.OrderPrice, &o.OrderUser, &o.PayStatus, &o.IsSend, &o.CreateTime, &o.SessionID, &o.TableID, &o.Deposit,
+			&o.Type, &o.PickupTime, &o.ReleaseAt, &o.PersonID, &o.Address, &o.Phone, &o.PackagingFee, &o.DeliveryFee, &o.StoreID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, o)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+// GetSessionOrders 返回一个就餐会话中下的全部订单及其明细
+func GetSessionOrders(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["session_id"]
+	rows, err := db.Query(`SELECT order_id, order_number, order_price, order_user, pay_status, is_send, create_time, table_id, deposit
+		FROM orders WHERE session_id = ? ORDER BY order_id`, sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		o := Order{SessionID: sessionID}
+		if err := rows.Scan(&o.OrderID, &o.OrderNumber, &o.OrderPrice, &o.OrderUser, &o.PayStatus, &o.IsSend, &o.CreateTime, &o.TableID, &o.Deposit); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		orders = append(orders, o)
 	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range orders {
+		if orders[i].Detail, err = fetchOrderDetails(strconv.Itoa(orders[i].OrderID)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(orders)
@@ -166,26 +284,132 @@ func GetOrderDetail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	details := []OrderDetail{}
-	query := `SELECT goods_name, goods_weight, goods_number, goods_price, goods_total_price, url, goods_status FROM orderDetails WHERE order_id = ?`
-	rows, err := db.Query(query, orderID)
+	details, err := fetchOrderDetails(orderID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(details)
+}
+
+// fetchOrderDetails 查询订单的全部明细，包括套餐的组成商品
+func fetchOrderDetails(orderID string) ([]OrderDetail, error) {
+	details := []OrderDetail{}
+	query := `SELECT goods_name, goods_weight, goods_number, goods_price, goods_total_price, url, goods_status, components, seat FROM orderDetails WHERE order_id = ?`
+	rows, err := db.Query(query, orderID)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var d OrderDetail
-		if err := rows.Scan(&d.GoodsName, &d.GoodsWeight, &d.GoodsNumber, &d.GoodsPrice, &d.GoodsTotalPrice, &d.URL, &d.GoodsStatus); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		var components sql.NullString
+		if err := rows.Scan(&d.GoodsName, &d.GoodsWeight, &d.GoodsNumber, &d.GoodsPrice, &d.GoodsTotalPrice, &d.URL, &d.GoodsStatus, &components, &d.Seat); err != nil {
+			return nil, err
+		}
+		if components.Valid && components.String != "" {
+			if err := json.Unmarshal([]byte(components.String), &d.Components); err != nil {
+				log.Printf("Error unmarshalling components of %s: %v", d.GoodsName, err)
+			}
 		}
 		details = append(details, d)
 	}
+	return details, rows.Err()
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(details)
+// resolveBundles 校验套餐订单项的选择与价格，并补全组成商品的加价；普通商品不能带组成商品
+func resolveBundles(storeID int, details []OrderDetail) error {
+	for i := range details {
+		bundle, err := product.LookupBundle(storeID, details[i].GoodsName)
+		if err != nil {
+			return err
+		}
+		if bundle == nil {
+			// 组成商品只来自套餐的选择，不能由客户端为普通商品指定
+			if len(details[i].Components) > 0 {
+				return fmt.Errorf("%w: %s is not a bundle", product.ErrInvalidBundle, details[i].GoodsName)
+			}
+			continue
+		}
+
+		choices := make([]product.BundleChoice, 0, len(details[i].Components))
+		for _, c := range details[i].Components {
+			choices = append(choices, product.BundleChoice{Slot: c.SlotName, Product: c.GoodsName, Quantity: c.GoodsNumber})
+		}
+		price, resolved, err := bundle.PriceChoices(choices)
+		if err != nil {
+			return err
+		}
+		if math.Abs(price-details[i].GoodsPrice) > 0.005 {
+			return fmt.Errorf("%w: %s should cost %.2f", product.ErrInvalidBundle, bundle.Name, price)
+		}
+
+		details[i].Components = details[i].Components[:0]
+		for _, c := range resolved {
+			details[i].Components = append(details[i].Components, OrderComponent{
+				SlotName:    c.Slot,
+				GoodsName:   c.Product,
+				GoodsNumber: c.Quantity,
+				ExtraPrice:  c.ExtraPrice,
+			})
+		}
+	}
+	return nil
+}
+
+// resolveOrderStore 确定订单所属的门店：扫码就餐的订单关联会话所在的餐桌，
+// 堂食订单属于餐桌所在的门店，请求明确指定了其他门店时拒绝；其余订单属于请求指定的门店。
+// 不经扫码直接指定 table_id 只允许该门店的管理员代客下单，避免顾客抵扣其他餐桌的预订订金。
+// 出错时写入错误响应并返回 false
+func resolveOrderStore(w http.ResponseWriter, r *http.Request, o *Order) bool {
+	requested, ok := store.RequestStore(w, r)
+	if !ok {
+		return false
+	}
+	o.StoreID = requested
+
+	if o.SessionID != "" {
+		s, err := desk.LookupSession(o.SessionID)
+		if errors.Is(err, desk.ErrSessionClosed) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return false
+		}
+		if err != nil {
+			log.Printf("Error looking up dining session: %v", err)
+			http.Error(w, "Failed to check dining session", http.StatusInternalServerError)
+			return false
+		}
+		o.TableID = s.TableID
+	}
+	if o.TableID <= 0 {
+		return true
+	}
+	staff := o.SessionID == ""
+	if staff {
+		if requested, ok = store.ManagedStore(w, r); !ok {
+			return false
+		}
+	}
+
+	tableStore, err := desk.TableStore(o.TableID)
+	if errors.Is(err, desk.ErrUnknownTable) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if err != nil {
+		log.Printf("Error looking up table store: %v", err)
+		http.Error(w, "Failed to check table", http.StatusInternalServerError)
+		return false
+	}
+	if (staff || store.Specified(r)) && tableStore != requested {
+		http.Error(w, fmt.Sprintf("table %d does not belong to store %d", o.TableID, requested), http.StatusBadRequest)
+		return false
+	}
+	o.StoreID = tableStore
+	return true
 }
 
 func AddOrder(w http.ResponseWriter, r *http.Request) {
@@ -196,6 +420,69 @@ func AddOrder(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !resolveOrderStore(w, r, &newOrder) {
+		return
+	}
+
+	// 按就餐方式校验取餐时间或外送地址，并把打包费和外送费计入订单金额
+	quote, err := prepareFulfillment(&newOrder, time.Now())
+	if err != nil {
+		if errors.Is(err, ErrInvalidFulfillment) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error checking fulfillment: %v", err)
+		http.Error(w, "Failed to check order", http.StatusInternalServerError)
+		return
+	}
+	fees := orderFees(newOrder, quote)
+	newOrder.PackagingFee, newOrder.DeliveryFee, newOrder.OrderPrice = fees.PackagingFee, fees.DeliveryFee, fees.Total
+
+	// 门店不营业、已过最后点单时间或暂停接单时不接受订单，预约订单按取餐时间判断
+	if err := store.CheckOrdering(newOrder.StoreID, time.Now(), pickupAt(newOrder)); err != nil {
+		if errors.Is(err, store.ErrClosed) || errors.Is(err, store.ErrPaused) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Error checking store status: %v", err)
+		http.Error(w, "Failed to check store status", http.StatusInternalServerError)
+		return
+	}
+
+	// 校验所有商品在出餐时都在供应时段内，预约订单按取餐时间校验
+	names := make([]string, 0, len(newOrder.Detail))
+	for _, detail := range newOrder.Detail {
+		names = append(names, detail.GoodsName)
+	}
+	if err := product.CheckAvailable(newOrder.StoreID, names, fulfillmentTime(newOrder, time.Now())); err != nil {
+		if errors.Is(err, product.ErrUnavailable) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Error checking product availability: %v", err)
+		http.Error(w, "Failed to check product availability", http.StatusInternalServerError)
+		return
+	}
+
+	// 扫码就餐的订单关联会话所在的餐桌
+	var sessionID sql.NullString
+	var tableID sql.NullInt64
+	if newOrder.SessionID != "" {
+		sessionID = sql.NullString{String: newOrder.SessionID, Valid: true}
+	}
+	if newOrder.TableID > 0 {
+		tableID = sql.NullInt64{Int64: int64(newOrder.TableID), Valid: true}
+	}
+
+	if err := resolveBundles(newOrder.StoreID, newOrder.Detail); err != nil {
+		if errors.Is(err, product.ErrInvalidBundle) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error resolving bundles: %v", err)
+		http.Error(w, "Failed to check bundles", http.StatusInternalServerError)
+		return
+	}
 
 	// 开始数据库事务
 	tx, err := db.Begin()
@@ -211,8 +498,33 @@ func AddOrder(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// 插入订单基本信息
-	query := `INSERT INTO orders(order_number, order_price, order_user, pay_status, is_send, create_time) VALUES(?, ?, ?, ?, ?, ?)`
-	res, err := tx.Exec(query, newOrder.OrderNumber, newOrder.OrderPrice, newOrder.OrderUser, newOrder.PayStatus, newOrder.IsSend, newOrder.CreateTime)
+	var pickupTime, releaseAt sql.NullString
+	var personID, zoneID sql.NullInt64
+	if newOrder.PickupTime != "" {
+		// 预约订单占用取餐时段的名额
+		if err := reserveSlot(tx, newOrder.StoreID, newOrder.PickupTime); err != nil {
+			if errors.Is(err, ErrSlotFull) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			log.Printf("Error checking pickup slot: %v", err)
+			http.Error(w, "Failed to check pickup slot", http.StatusInternalServerError)
+			return
+		}
+		pickupTime = sql.NullString{String: newOrder.PickupTime, Valid: true}
+		releaseAt = sql.NullString{String: newOrder.ReleaseAt, Valid: true}
+	}
+	if newOrder.PersonID > 0 {
+		personID = sql.NullInt64{Int64: int64(newOrder.PersonID), Valid: true}
+	}
+	if newOrder.DeliveryZone > 0 {
+		zoneID = sql.NullInt64{Int64: int64(newOrder.DeliveryZone), Valid: true}
+	}
+	query := `INSERT INTO orders(order_number, order_price, order_user, pay_status, is_send, create_time, session_id, table_id,
+		order_type, pickup_time, release_at, person_id, delivery_address, delivery_phone, packaging_fee, delivery_fee, delivery_zone, delivery_lat, delivery_lng, store_id)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := tx.Exec(query, newOrder.OrderNumber, newOrder.OrderPrice, newOrder.OrderUser, newOrder.PayStatus, newOrder.IsSend, newOrder.CreateTime, sessionID, tableID,
+		newOrder.Type, pickupTime, releaseAt, personID, newOrder.Address, newOrder.Phone, newOrder.PackagingFee, newOrder.DeliveryFee, zoneID, newOrder.Lat, newOrder.Lng, newOrder.StoreID)
 	if err != nil {
 		log.Printf("Error inserting order: %v", err)
 		http.Error(w, "Failed to insert order", http.StatusInternalServerError)
@@ -228,14 +540,57 @@ func AddOrder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 插入订单详情
-	detailQuery := `INSERT INTO orderDetails(order_id, goods_name, goods_weight, goods_number, goods_price, goods_total_price, url, goods_status) VALUES(?, ?, ?, ?, ?, ?, ?, ?)`
+	detailQuery := `INSERT INTO orderDetails(order_id, goods_name, goods_weight, goods_number, goods_price, goods_total_price, url, goods_status, components, seat) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	for _, detail := range newOrder.Detail {
-		_, err := tx.Exec(detailQuery, lastId, detail.GoodsName, detail.GoodsWeight, detail.GoodsNumber, detail.GoodsPrice, detail.GoodsTotalPrice, detail.URL, detail.GoodsStatus)
+		var components sql.NullString
+		if len(detail.Components) > 0 {
+			b, err := json.Marshal(detail.Components)
+			if err != nil {
+				log.Printf("Error marshalling components: %v", err)
+				http.Error(w, "Failed to insert order detail", http.StatusInternalServerError)
+				return
+			}
+			components = sql.NullString{String: string(b), Valid: true}
+		}
+
+		_, err := tx.Exec(detailQuery, lastId, detail.GoodsName, detail.GoodsWeight, detail.GoodsNumber, detail.GoodsPrice, detail.GoodsTotalPrice, detail.URL, detail.GoodsStatus, components, detail.Seat)
 		if err != nil {
 			log.Printf("Error inserting order detail: %v", err)
 			http.Error(w, "Failed to insert order detail", http.StatusInternalServerError)
 			return
 		}
+
+		// 套餐按组成商品扣减库存
+		for _, c := range detail.Components {
+			quantity := c.GoodsNumber * detail.GoodsNumber
+			res, err := tx.Exec("UPDATE products SET stock = stock - ? WHERE name = ? AND store_id = ? AND stock >= ? AND deleted_at IS NULL", quantity, c.GoodsName, newOrder.StoreID, quantity)
+			if err != nil {
+				log.Printf("Error decrementing stock: %v", err)
+				http.Error(w, "Failed to update stock", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, fmt.Sprintf("Insufficient stock for %s", c.GoodsName), http.StatusConflict)
+				return
+			}
+		}
+	}
+
+	// 餐桌上已到店预订的订金抵扣到该餐桌的第一笔订单，餐桌已由 resolveOrderStore 校验来自扫码会话或门店员工
+	if newOrder.TableID > 0 {
+		deposit, err := desk.ApplyDeposit(tx, newOrder.TableID, int(lastId))
+		if err != nil {
+			log.Printf("Error applying reservation deposit: %v", err)
+			http.Error(w, "Failed to apply reservation deposit", http.StatusInternalServerError)
+			return
+		}
+		if deposit > 0 {
+			if _, err := tx.Exec("UPDATE orders SET deposit = ? WHERE order_id = ?", deposit, lastId); err != nil {
+				log.Printf("Error applying reservation deposit: %v", err)
+				http.Error(w, "Failed to apply reservation deposit", http.StatusInternalServerError)
+				return
+			}
+		}
 	}
 
 	// 提交事务
@@ -245,9 +600,17 @@ func AddOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 扫码就餐的订单下单后餐桌进入就餐状态；会话结账时 CloseSession 把餐桌转为待清台，
+	// 没有会话的订单不会结束占用，因此不改变餐桌状态
+	if newOrder.SessionID != "" && newOrder.TableID > 0 {
+		if err := desk.MarkOccupied(newOrder.TableID, fmt.Sprintf("order %d", lastId)); err != nil {
+			log.Printf("Error updating table status: %v", err)
+		}
+	}
+
 	// 发送成功响应
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(map[string]string{"message": "New order added successfully"}); err != nil {
+	if err := json.NewEncoder(w).Encode(map[string]any{"message": "New order added successfully", "orderId": lastId, "fees": fees}); err != nil {
 		log.Printf("Error encoding response: %v", err)
 	}
 }
@@ -281,17 +644,33 @@ func UpdateOrder(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid is send status", http.StatusBadRequest)
 		return
 	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
 
-	// 构造SQL更新语句
+	// 构造SQL更新语句，只能修改本门店的订单
 	// 注意安全性，避免SQL注入
-	query := `UPDATE orders SET order_number = ?, order_price = ?, pay_status = ?, is_send = ? WHERE order_id = ?`
+	query := `UPDATE orders SET order_number = ?, order_price = ?, pay_status = ?, is_send = ? WHERE order_id = ? AND store_id = ?`
 
 	// 执行SQL更新语句
-	_, err = db.Exec(query, req.OrderNumber, orderPrice, payStatus, isSend, orderID)
+	res, err := db.Exec(query, req.OrderNumber, orderPrice, payStatus, isSend, orderID, storeID)
 	if err != nil {
 		http.Error(w, "Failed to update order", http.StatusInternalServerError)
 		return
 	}
+	// 内容没有变化时影响行数也为0，需要确认订单是否存在
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM orders WHERE order_id = ? AND store_id = ?)", orderID, storeID).Scan(&exists); err != nil {
+			http.Error(w, "Failed to update order", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+	}
 
 	// 返回成功响应
 	w.WriteHeader(http.StatusOK)
@@ -305,6 +684,10 @@ func BatchDeleteOrders(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
 
 	// 开始数据库事务
 	tx, err := db.Begin()
@@ -314,7 +697,8 @@ func BatchDeleteOrders(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	query := "DELETE FROM orders WHERE order_id = ?"
+	// 只能删除本门店的订单，有订单不存在时整批不删除
+	query := "DELETE FROM orders WHERE order_id = ? AND store_id = ?"
 	stmt, err := tx.Prepare(query)
 	if err != nil {
 		http.Error(w, "Failed to prepare delete statement", http.StatusInternalServerError)
@@ -324,10 +708,20 @@ func BatchDeleteOrders(w http.ResponseWriter, r *http.Request) {
 
 	// 遍历订单ID数组，执行删除操作
 	for _, orderId := range req.OrderIds {
-		if _, err := stmt.Exec(orderId); err != nil {
+		if err := releaseSlot(tx, storeID, orderId); err != nil {
+			log.Printf("Error releasing pickup slot of order %d: %v", orderId, err)
 			http.Error(w, "Failed to delete order", http.StatusInternalServerError)
 			return
 		}
+		res, err := stmt.Exec(orderId, storeID)
+		if err != nil {
+			http.Error(w, "Failed to delete order", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, fmt.Sprintf("Order %d not found", orderId), http.StatusNotFound)
+			return
+		}
 	}
 
 	// 提交事务
@@ -0,0 +1,251 @@
+package order
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultSlotMinutes    = 15
+	defaultReleaseMinutes = 30
+	defaultMaxDays        = 7
+)
+
+// ErrSlotFull 表示取餐时段的预约订单已满
+var ErrSlotFull = errors.New("pickup slot is full")
+
+// Slot 一个取餐时段及其预约情况
+type Slot struct {
+	Start     string `json:"start"` // 格式 15:04
+	End       string `json:"end"`
+	Booked    int    `json:"booked"`
+	Capacity  int    `json:"capacity"` // 为0表示不限
+	Available bool   `json:"available"`
+}
+
+func migratePreorders() error {
+	if err := utils.EnsureColumn(db, "orders", "release_at", "DATETIME NULL"); err != nil {
+		return err
+	}
+	// 每个取餐时段一行计数，下单时锁住该行再占用名额
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS pickup_slots (
+		store_id INT NOT NULL,
+		slot_start DATETIME NOT NULL,
+		booked INT NOT NULL DEFAULT 0,
+		PRIMARY KEY (store_id, slot_start)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating pickup_slots table: %w", err)
+	}
+	return nil
+}
+
+func slotLength() time.Duration {
+	minutes := config.C.Store.Scheduling.SlotMinutes
+	if minutes <= 0 {
+		minutes = defaultSlotMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func releaseLead() time.Duration {
+	minutes := config.C.Store.Scheduling.ReleaseMinutes
+	if minutes <= 0 {
+		minutes = defaultReleaseMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func maxDays() int {
+	if n := config.C.Store.Scheduling.MaxDays; n > 0 {
+		return n
+	}
+	return defaultMaxDays
+}
+
+// slotStart 返回 t 所在取餐时段的开始时间，时段从每天零点起按固定长度划分
+func slotStart(t time.Time) time.Time {
+	t = t.In(config.Location())
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return midnight.Add(t.Sub(midnight) / slotLength() * slotLength())
+}
+
+// checkPickupTime 校验预约的取餐时间在可预约的天数内且门店营业
+func checkPickupTime(storeID int, t, now time.Time) error {
+	t, now = t.In(config.Location()), now.In(config.Location())
+	last := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).AddDate(0, 0, maxDays()+1)
+	if !t.Before(last) {
+		return fmt.Errorf("%w: pickup time must be within %d days", ErrInvalidFulfillment, maxDays())
+	}
+	open, err := store.OpenAt(storeID, t)
+	if err != nil {
+		return err
+	}
+	if !open {
+		return fmt.Errorf("%w: the store is closed at the pickup time", ErrInvalidFulfillment)
+	}
+	return nil
+}
+
+// pickupAt 返回预约订单的取餐时间，非预约订单返回零值
+func pickupAt(o Order) time.Time {
+	if o.Type != TypeTakeaway || o.PickupTime == "" {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", o.PickupTime, config.Location())
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// fulfillmentTime 返回订单出餐的时间，预约订单为取餐时间，其余为 now；用于校验商品供应时段
+func fulfillmentTime(o Order, now time.Time) time.Time {
+	if t := pickupAt(o); !t.IsZero() {
+		return t
+	}
+	return now
+}
+
+// reserveSlot 在下单事务中锁住取餐时段的计数行，检查余量后占用一个名额，避免并发下单超订；
+// 计数行首次创建时按已有的预约订单数初始化
+func reserveSlot(tx *sql.Tx, storeID int, pickupTime string) error {
+	capacity := config.C.Store.Scheduling.SlotCapacity
+	if capacity <= 0 {
+		return nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", pickupTime, config.Location())
+	if err != nil {
+		return err
+	}
+	start := slotStart(t)
+	from, to := start.Format("2006-01-02 15:04:05"), start.Add(slotLength()).Format("2006-01-02 15:04:05")
+
+	_, err = tx.Exec(`INSERT INTO pickup_slots (store_id, slot_start, booked)
+		SELECT ?, ?, COUNT(*) FROM orders WHERE order_type = ? AND store_id = ? AND pickup_time >= ? AND pickup_time < ?
+		ON DUPLICATE KEY UPDATE booked = booked`,
+		storeID, from, TypeTakeaway, storeID, from, to)
+	if err != nil {
+		return err
+	}
+	var booked int
+	err = tx.QueryRow("SELECT booked FROM pickup_slots WHERE store_id = ? AND slot_start = ? FOR UPDATE", storeID, from).Scan(&booked)
+	if err != nil {
+		return err
+	}
+	if booked >= capacity {
+		return fmt.Errorf("%w: %s", ErrSlotFull, start.Format("15:04"))
+	}
+	_, err = tx.Exec("UPDATE pickup_slots SET booked = booked + 1 WHERE store_id = ? AND slot_start = ?", storeID, from)
+	return err
+}
+
+// releaseSlot 删除门店的预约订单时归还其占用的取餐时段名额
+func releaseSlot(tx *sql.Tx, storeID, orderID int) error {
+	var pickup string
+	err := tx.QueryRow("SELECT pickup_time FROM orders WHERE order_id = ? AND store_id = ? AND order_type = ? AND pickup_time IS NOT NULL",
+		orderID, storeID, TypeTakeaway).Scan(&pickup)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", pickup, config.Location())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE pickup_slots SET booked = booked - 1 WHERE store_id = ? AND slot_start = ? AND booked > 0",
+		storeID, slotStart(t).Format("2006-01-02 15:04:05"))
+	return err
+}
+
+// FetchSlots 返回门店某天的全部营业时段内的取餐时段，早于最短取餐准备时间或已约满的时段不可预约
+func FetchSlots(storeID int, date time.Time, now time.Time) ([]Slot, error) {
+	cal, err := store.LoadCalendar(storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, config.Location())
+	next := day.AddDate(0, 0, 1)
+	rows, err := db.Query("SELECT pickup_time FROM orders WHERE order_type = ? AND store_id = ? AND pickup_time >= ? AND pickup_time < ?",
+		TypeTakeaway, storeID, day.Format("2006-01-02 15:04:05"), next.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	booked := make(map[string]int)
+	for rows.Next() {
+		var pickup string
+		if err := rows.Scan(&pickup); err != nil {
+			return nil, err
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", pickup, config.Location())
+		if err != nil {
+			continue
+		}
+		booked[slotStart(t).Format("15:04")]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	capacity := config.C.Store.Scheduling.SlotCapacity
+	if capacity < 0 {
+		capacity = 0
+	}
+	earliest := now.Add(pickupLead())
+	slots := []Slot{}
+	for start := day; start.Before(next); start = start.Add(slotLength()) {
+		if !cal.OpenAt(start) {
+			continue
+		}
+		s := Slot{
+			Start:    start.Format("15:04"),
+			End:      start.Add(slotLength()).Format("15:04"),
+			Capacity: capacity,
+		}
+		s.Booked = booked[s.Start]
+		s.Available = !start.Before(earliest) && (capacity == 0 || s.Booked < capacity)
+		slots = append(slots, s)
+	}
+	return slots, nil
+}
+
+// HandleSlots 返回 ?date=2006-01-02 当天的取餐时段，未指定日期时为今天
+func HandleSlots(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.RequestStore(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now().In(config.Location())
+	date := now
+	if v := r.URL.Query().Get("date"); v != "" {
+		d, err := time.ParseInLocation("2006-01-02", v, config.Location())
+		if err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		date = d
+	}
+
+	slots, err := FetchSlots(storeID, date, now)
+	if err != nil {
+		log.Printf("Error fetching pickup slots: %v", err)
+		http.Error(w, "Failed to fetch pickup slots", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slots)
+}
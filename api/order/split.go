@@ -0,0 +1,949 @@
+package order
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/pay"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// 分单方式
+const (
+	SplitByItem = "item" // 按菜品分配到各份
+	SplitBySeat = "seat" // 按下单时的座位号，每个座位一份，共享菜品平均分摊
+	SplitEven   = "even" // 平均分成 N 份
+)
+
+// 分单状态
+const (
+	SplitOpen    = "open"    // 还有未支付的份
+	SplitSettled = "settled" // 全部支付，订单已标记为已支付
+	SplitVoid    = "void"    // 重新分单时作废
+)
+
+// 每一份的状态
+const (
+	PartPending = "pending"
+	PartPaid    = "paid"
+)
+
+// 每一份的支付方式
+const (
+	MethodWechat = "wechat"
+	MethodAlipay = "alipay"
+	MethodCash   = "cash"
+)
+
+const (
+	maxSplitParts  = 20
+	partPayMinutes = 15
+)
+
+var (
+	// ErrInvalidSplit 表示分单请求不合法
+	ErrInvalidSplit = errors.New("invalid split")
+	// ErrSplitState 表示分单或其中一份的当前状态不允许该操作
+	ErrSplitState = errors.New("invalid split state")
+)
+
+// SplitItem 分配到一份中的菜品，Shared 表示按座位分单时多个座位共享的菜品
+type SplitItem struct {
+	OrderID     int     `json:"orderId"`
+	GoodsName   string  `json:"goodsName"`
+	GoodsNumber int     `json:"goodsNumber"`
+	Amount      float64 `json:"amount"`
+	Shared      bool    `json:"shared,omitempty"`
+}
+
+// SplitPart 分单中的一份，单独支付并单独出具小票
+type SplitPart struct {
+	ID      int         `json:"id"`
+	SplitID int         `json:"splitId"`
+	PartNo  int         `json:"partNo"`
+	Seat    int         `json:"seat,omitempty"`
+	Amount  float64     `json:"amount"`
+	Method  string      `json:"method,omitempty"`
+	TradeNo string      `json:"tradeNo,omitempty"`
+	Status  string      `json:"status"`
+	PaidAt  string      `json:"paidAt,omitempty"`
+	Items   []SplitItem `json:"items"`
+}
+
+// Split 一个订单或一个就餐会话的分单
+type Split struct {
+	ID        int         `json:"id"`
+	OrderID   int         `json:"orderId,omitempty"`
+	SessionID string      `json:"sessionId,omitempty"`
+	Mode      string      `json:"mode"`
+	Amount    float64     `json:"amount"`
+	Status    string      `json:"status"`
+	CreatedAt string      `json:"createdAt"`
+	SettledAt string      `json:"settledAt,omitempty"`
+	Parts     []SplitPart `json:"parts"`
+}
+
+// SplitRequest 分单请求，OrderID 与 SessionID 二选一；
+// 平均分单填写 Parts，按菜品分单填写 Items，每个元素为一份中的菜品
+type SplitRequest struct {
+	OrderID   int           `json:"orderId"`
+	SessionID string        `json:"sessionId"`
+	Mode      string        `json:"mode"`
+	Parts     int           `json:"parts"`
+	Items     [][]SplitItem `json:"items"`
+}
+
+func migrateSplits() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS order_splits (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id INT NULL,
+		session_id VARCHAR(32) NULL,
+		mode VARCHAR(16) NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		created_at DATETIME NOT NULL,
+		settled_at DATETIME NULL,
+		INDEX idx_order (order_id),
+		INDEX idx_session (session_id)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating order_splits table: %w", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS order_split_parts (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		split_id INT NOT NULL,
+		part_no INT NOT NULL,
+		seat INT NOT NULL DEFAULT 0,
+		amount DECIMAL(10,2) NOT NULL,
+		method VARCHAR(16) NOT NULL DEFAULT '',
+		trade_no VARCHAR(32) NULL UNIQUE,
+		status VARCHAR(16) NOT NULL,
+		paid_at DATETIME NULL,
+		INDEX idx_split (split_id)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating order_split_parts table: %w", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS order_split_items (
+		part_id INT NOT NULL,
+		order_id INT NOT NULL,
+		goods_name VARCHAR(255) NOT NULL,
+		goods_number INT NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		shared TINYINT(1) NOT NULL DEFAULT 0,
+		INDEX idx_part (part_id)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating order_split_items table: %w", err)
+	}
+	// 分单时账单包含的订单，结清时只把这些订单标记为已支付
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS order_split_orders (
+		split_id INT NOT NULL,
+		order_id INT NOT NULL,
+		PRIMARY KEY (split_id, order_id),
+		INDEX idx_order (order_id)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating order_split_orders table: %w", err)
+	}
+	_, err = db.Exec(`INSERT IGNORE INTO order_split_orders (split_id, order_id)
+		SELECT s.id, o.order_id FROM order_splits s JOIN orders o ON o.order_id = s.order_id OR o.session_id = s.session_id
+		WHERE s.status <> ? AND NOT EXISTS (SELECT 1 FROM order_split_orders x WHERE x.split_id = s.id)`, SplitVoid)
+	if err != nil {
+		return fmt.Errorf("backfilling order_split_orders: %w", err)
+	}
+	// 每一份发起过的全部支付，重新发起支付后之前的支付完成时仍能确认
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS order_split_payments (
+		trade_no VARCHAR(32) PRIMARY KEY,
+		part_id INT NOT NULL,
+		method VARCHAR(16) NOT NULL,
+		created_at DATETIME NOT NULL,
+		INDEX idx_part (part_id)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating order_split_payments table: %w", err)
+	}
+	_, err = db.Exec(`INSERT IGNORE INTO order_split_payments (trade_no, part_id, method, created_at)
+		SELECT trade_no, id, method, NOW() FROM order_split_parts WHERE trade_no IS NOT NULL AND method <> ?`, MethodCash)
+	if err != nil {
+		return fmt.Errorf("backfilling order_split_payments: %w", err)
+	}
+	return nil
+}
+
+func storeNow() string {
+	return time.Now().In(config.Location()).Format("2006-01-02 15:04:05")
+}
+
+// billLine 账单中同一订单的同一商品，数量与金额已合并
+type billLine struct {
+	OrderID int
+	Name    string
+	Seat    int
+	Number  int
+	Amount  float64
+}
+
+// bill 待分单的订单及其应付金额（扣除预订订金）
+type bill struct {
+	OrderIDs []int
+	Payable  float64
+	Lines    []billLine
+}
+
+// loadBill 读取订单或会话下全部未支付订单的明细，已支付的订单不再计入
+func loadBill(orderID int, sessionID string) (bill, error) {
+	var b bill
+	var rows *sql.Rows
+	var err error
+	if sessionID != "" {
+		rows, err = db.Query("SELECT order_id, order_price - deposit, "+paidCondition+" FROM orders WHERE session_id = ? ORDER BY order_id", sessionID)
+	} else {
+		rows, err = db.Query("SELECT order_id, order_price - deposit, "+paidCondition+" FROM orders WHERE order_id = ?", orderID)
+	}
+	if err != nil {
+		return b, err
+	}
+	defer rows.Close()
+	found := false
+	for rows.Next() {
+		var id int
+		var payable float64
+		var paid bool
+		if err := rows.Scan(&id, &payable, &paid); err != nil {
+			return b, err
+		}
+		found = true
+		if paid {
+			continue
+		}
+		b.OrderIDs = append(b.OrderIDs, id)
+		b.Payable += payable
+	}
+	if err := rows.Err(); err != nil {
+		return b, err
+	}
+	if !found {
+		return b, sql.ErrNoRows
+	}
+	if len(b.OrderIDs) == 0 {
+		return b, fmt.Errorf("%w: the bill is already paid", ErrSplitState)
+	}
+	b.Payable = math.Round(b.Payable*100) / 100
+
+	for _, id := range b.OrderIDs {
+		details, err := fetchOrderDetails(strconv.Itoa(id))
+		if err != nil {
+			return b, err
+		}
+		for _, d := range details {
+			found := false
+			for i := range b.Lines {
+				l := &b.Lines[i]
+				if l.OrderID == id && l.Name == d.GoodsName && l.Seat == d.Seat {
+					l.Number += d.GoodsNumber
+					l.Amount += d.GoodsTotalPrice
+					found = true
+					break
+				}
+			}
+			if !found {
+				b.Lines = append(b.Lines, billLine{OrderID: id, Name: d.GoodsName, Seat: d.Seat, Number: d.GoodsNumber, Amount: d.GoodsTotalPrice})
+			}
+		}
+	}
+	return b, nil
+}
+
+// allocate 按权重把 total 分配到各份，按分计算，尾差由前几份承担，保证合计等于 total
+func allocate(total float64, weights []float64) []float64 {
+	totalCents := int64(math.Round(total * 100))
+	var sum float64
+	for _, w := range weights {
+		sum += w
+	}
+	if sum <= 0 {
+		weights = make([]float64, len(weights))
+		for i := range weights {
+			weights[i] = 1
+		}
+		sum = float64(len(weights))
+	}
+
+	cents := make([]int64, len(weights))
+	var assigned int64
+	for i, w := range weights {
+		cents[i] = int64(math.Floor(float64(totalCents) * w / sum))
+		assigned += cents[i]
+	}
+	for i := 0; assigned < totalCents; i = (i + 1) % len(cents) {
+		cents[i]++
+		assigned++
+	}
+
+	amounts := make([]float64, len(cents))
+	for i, c := range cents {
+		amounts[i] = float64(c) / 100
+	}
+	return amounts
+}
+
+// planSplit 按分单方式计算每一份包含的菜品和权重
+func planSplit(req SplitRequest, b bill) ([]SplitPart, []float64, error) {
+	var parts []SplitPart
+	var weights []float64
+
+	switch req.Mode {
+	case SplitEven:
+		if req.Parts < 2 || req.Parts > maxSplitParts {
+			return nil, nil, fmt.Errorf("%w: parts must be between 2 and %d", ErrInvalidSplit, maxSplitParts)
+		}
+		for i := 0; i < req.Parts; i++ {
+			parts = append(parts, SplitPart{Items: []SplitItem{}})
+			weights = append(weights, 1)
+		}
+
+	case SplitBySeat:
+		seats := map[int]int{} // 座位号到份的下标
+		var shared []billLine
+		for _, l := range b.Lines {
+			if l.Seat == 0 {
+				shared = append(shared, l)
+				continue
+			}
+			if _, ok := seats[l.Seat]; !ok {
+				seats[l.Seat] = len(parts)
+				parts = append(parts, SplitPart{Seat: l.Seat})
+			}
+		}
+		if len(parts) < 2 {
+			return nil, nil, fmt.Errorf("%w: at least two seats are needed", ErrInvalidSplit)
+		}
+		sort.Slice(parts, func(i, j int) bool { return parts[i].Seat < parts[j].Seat })
+		for i := range parts {
+			seats[parts[i].Seat] = i
+		}
+		weights = make([]float64, len(parts))
+		for _, l := range b.Lines {
+			if l.Seat == 0 {
+				continue
+			}
+			i := seats[l.Seat]
+			parts[i].Items = append(parts[i].Items, SplitItem{OrderID: l.OrderID, GoodsName: l.Name, GoodsNumber: l.Number, Amount: l.Amount})
+			weights[i] += l.Amount
+		}
+		for _, l := range shared {
+			shares := allocate(l.Amount, make([]float64, len(parts)))
+			for i := range parts {
+				parts[i].Items = append(parts[i].Items, SplitItem{OrderID: l.OrderID, GoodsName: l.Name, GoodsNumber: l.Number, Amount: shares[i], Shared: true})
+				weights[i] += shares[i]
+			}
+		}
+
+	case SplitByItem:
+		if len(req.Items) < 2 || len(req.Items) > maxSplitParts {
+			return nil, nil, fmt.Errorf("%w: parts must be between 2 and %d", ErrInvalidSplit, maxSplitParts)
+		}
+		// 每个订单中每种商品的剩余数量，分配完后必须全部为 0
+		type key struct {
+			order int
+			name  string
+		}
+		remaining := map[key]int{}
+		unitPrice := map[key]float64{}
+		for _, l := range b.Lines {
+			k := key{l.OrderID, l.Name}
+			remaining[k] += l.Number
+			unitPrice[k] += l.Amount
+		}
+		for k := range unitPrice {
+			unitPrice[k] /= float64(remaining[k])
+		}
+
+		for _, items := range req.Items {
+			part := SplitPart{}
+			var weight float64
+			for _, item := range items {
+				k := key{item.OrderID, item.GoodsName}
+				if len(b.OrderIDs) == 1 && item.OrderID == 0 {
+					k.order = b.OrderIDs[0]
+				}
+				if item.GoodsNumber <= 0 || remaining[k] < item.GoodsNumber {
+					return nil, nil, fmt.Errorf("%w: %s x%d is not on the bill", ErrInvalidSplit, item.GoodsName, item.GoodsNumber)
+				}
+				remaining[k] -= item.GoodsNumber
+				amount := math.Round(unitPrice[k]*float64(item.GoodsNumber)*100) / 100
+				part.Items = append(part.Items, SplitItem{OrderID: k.order, GoodsName: item.GoodsName, GoodsNumber: item.GoodsNumber, Amount: amount})
+				weight += amount
+			}
+			if len(part.Items) == 0 {
+				return nil, nil, fmt.Errorf("%w: a part has no items", ErrInvalidSplit)
+			}
+			parts = append(parts, part)
+			weights = append(weights, weight)
+		}
+		for k, n := range remaining {
+			if n > 0 {
+				return nil, nil, fmt.Errorf("%w: %s x%d is not assigned", ErrInvalidSplit, k.name, n)
+			}
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown mode %q", ErrInvalidSplit, req.Mode)
+	}
+	return parts, weights, nil
+}
+
+// CreateSplit 把订单或会话的账单拆成多份；尚未有任何一份支付的旧分单作废，已有份支付时不能重新分单
+func CreateSplit(req SplitRequest) (Split, error) {
+	if (req.OrderID > 0) == (req.SessionID != "") {
+		return Split{}, fmt.Errorf("%w: either orderId or sessionId is required", ErrInvalidSplit)
+	}
+	b, err := loadBill(req.OrderID, req.SessionID)
+	if err != nil {
+		return Split{}, err
+	}
+	if b.Payable <= 0 {
+		return Split{}, fmt.Errorf("%w: nothing to pay", ErrInvalidSplit)
+	}
+	parts, weights, err := planSplit(req, b)
+	if err != nil {
+		return Split{}, err
+	}
+	amounts := allocate(b.Payable, weights)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Split{}, err
+	}
+	defer tx.Rollback()
+
+	if err := lockBill(tx, b.OrderIDs); err != nil {
+		return Split{}, err
+	}
+	if err := voidOpenSplits(tx, b.OrderIDs); err != nil {
+		return Split{}, err
+	}
+
+	s := Split{OrderID: req.OrderID, SessionID: req.SessionID, Mode: req.Mode, Amount: b.Payable, Status: SplitOpen, CreatedAt: storeNow()}
+	var orderID sql.NullInt64
+	var sessionID sql.NullString
+	if req.OrderID > 0 {
+		orderID = sql.NullInt64{Int64: int64(req.OrderID), Valid: true}
+	} else {
+		sessionID = sql.NullString{String: req.SessionID, Valid: true}
+	}
+	res, err := tx.Exec("INSERT INTO order_splits (order_id, session_id, mode, amount, status, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		orderID, sessionID, s.Mode, s.Amount, s.Status, s.CreatedAt)
+	if err != nil {
+		return s, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return s, err
+	}
+	s.ID = int(id)
+	for _, orderID := range b.OrderIDs {
+		if _, err := tx.Exec("INSERT INTO order_split_orders (split_id, order_id) VALUES (?, ?)", s.ID, orderID); err != nil {
+			return s, err
+		}
+	}
+
+	for i := range parts {
+		p := &parts[i]
+		p.SplitID, p.PartNo, p.Amount, p.Status = s.ID, i+1, amounts[i], PartPending
+		if p.Items == nil {
+			p.Items = []SplitItem{}
+		}
+		res, err := tx.Exec("INSERT INTO order_split_parts (split_id, part_no, seat, amount, status) VALUES (?, ?, ?, ?, ?)",
+			p.SplitID, p.PartNo, p.Seat, p.Amount, p.Status)
+		if err != nil {
+			return s, err
+		}
+		partID, err := res.LastInsertId()
+		if err != nil {
+			return s, err
+		}
+		p.ID = int(partID)
+		for _, item := range p.Items {
+			_, err := tx.Exec("INSERT INTO order_split_items (part_id, order_id, goods_name, goods_number, amount, shared) VALUES (?, ?, ?, ?, ?, ?)",
+				p.ID, item.OrderID, item.GoodsName, item.GoodsNumber, item.Amount, item.Shared)
+			if err != nil {
+				return s, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return s, err
+	}
+	s.Parts = parts
+	return s, nil
+}
+
+// orderIDArgs 返回 IN 条件的占位符和参数
+func orderIDArgs(orderIDs []int) (string, []any) {
+	args := make([]any, len(orderIDs))
+	for i, id := range orderIDs {
+		args[i] = id
+	}
+	return "?" + strings.Repeat(", ?", len(orderIDs)-1), args
+}
+
+// lockBill 锁住账单上的订单，分单期间有订单已支付时要求重新分单
+func lockBill(tx *sql.Tx, orderIDs []int) error {
+	in, args := orderIDArgs(orderIDs)
+	var paid int
+	if err := tx.QueryRow("SELECT COALESCE(SUM("+paidCondition+"), 0) FROM orders WHERE order_id IN ("+in+") FOR UPDATE", args...).Scan(&paid); err != nil {
+		return err
+	}
+	if paid > 0 {
+		return fmt.Errorf("%w: the bill has changed, please split again", ErrSplitState)
+	}
+	return nil
+}
+
+// voidOpenSplits 作废包含这些订单且未支付的分单，不论分单是按订单还是按会话创建的
+func voidOpenSplits(tx *sql.Tx, orderIDs []int) error {
+	in, args := orderIDArgs(orderIDs)
+	cond := "id IN (SELECT split_id FROM order_split_orders WHERE order_id IN (" + in + "))"
+	var paid int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM order_split_parts WHERE status = ? AND split_id IN
+		(SELECT id FROM order_splits WHERE status = ? AND `+cond+`)`, append([]any{PartPaid, SplitOpen}, args...)...).Scan(&paid)
+	if err != nil {
+		return err
+	}
+	if paid > 0 {
+		return fmt.Errorf("%w: the bill is partly paid", ErrSplitState)
+	}
+	var settled int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM order_splits WHERE status = ? AND "+cond, append([]any{SplitSettled}, args...)...).Scan(&settled); err != nil {
+		return err
+	}
+	if settled > 0 {
+		return fmt.Errorf("%w: the bill is already paid", ErrSplitState)
+	}
+	_, err = tx.Exec("UPDATE order_splits SET status = ? WHERE status = ? AND "+cond, append([]any{SplitVoid, SplitOpen}, args...)...)
+	return err
+}
+
+// FetchSplit 查询分单及其每一份
+func FetchSplit(id int) (Split, error) {
+	var s Split
+	var orderID sql.NullInt64
+	var sessionID, settledAt sql.NullString
+	err := db.QueryRow("SELECT id, order_id, session_id, mode, amount, status, created_at, settled_at FROM order_splits WHERE id = ?", id).
+		Scan(&s.ID, &orderID, &sessionID, &s.Mode, &s.Amount, &s.Status, &s.CreatedAt, &settledAt)
+	if err != nil {
+		return s, err
+	}
+	s.OrderID, s.SessionID, s.SettledAt = int(orderID.Int64), sessionID.String, settledAt.String
+
+	rows, err := db.Query("SELECT id FROM order_split_parts WHERE split_id = ? ORDER BY part_no", id)
+	if err != nil {
+		return s, err
+	}
+	var ids []int
+	for rows.Next() {
+		var partID int
+		if err := rows.Scan(&partID); err != nil {
+			rows.Close()
+			return s, err
+		}
+		ids = append(ids, partID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+
+	s.Parts = []SplitPart{}
+	for _, partID := range ids {
+		p, err := fetchPart(partID)
+		if err != nil {
+			return s, err
+		}
+		s.Parts = append(s.Parts, p)
+	}
+	return s, nil
+}
+
+// fetchPart 查询一份及其菜品
+func fetchPart(id int) (SplitPart, error) {
+	var p SplitPart
+	var tradeNo, paidAt sql.NullString
+	err := db.QueryRow("SELECT id, split_id, part_no, seat, amount, method, trade_no, status, paid_at FROM order_split_parts WHERE id = ?", id).
+		Scan(&p.ID, &p.SplitID, &p.PartNo, &p.Seat, &p.Amount, &p.Method, &tradeNo, &p.Status, &paidAt)
+	if err != nil {
+		return p, err
+	}
+	p.TradeNo, p.PaidAt = tradeNo.String, paidAt.String
+
+	rows, err := db.Query("SELECT order_id, goods_name, goods_number, amount, shared FROM order_split_items WHERE part_id = ?", id)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+	p.Items = []SplitItem{}
+	for rows.Next() {
+		var item SplitItem
+		if err := rows.Scan(&item.OrderID, &item.GoodsName, &item.GoodsNumber, &item.Amount, &item.Shared); err != nil {
+			return p, err
+		}
+		p.Items = append(p.Items, item)
+	}
+	return p, rows.Err()
+}
+
+// openPart 查询仍可支付的一份，所属分单必须仍未结清
+func openPart(id int) (SplitPart, error) {
+	p, err := fetchPart(id)
+	if err != nil {
+		return p, err
+	}
+	var status string
+	if err := db.QueryRow("SELECT status FROM order_splits WHERE id = ?", p.SplitID).Scan(&status); err != nil {
+		return p, err
+	}
+	if status != SplitOpen {
+		return p, fmt.Errorf("%w: split is %s", ErrSplitState, status)
+	}
+	if p.Status != PartPending {
+		return p, fmt.Errorf("%w: part is %s", ErrSplitState, p.Status)
+	}
+	return p, nil
+}
+
+// splitStore 返回分单所属订单的门店，按门店的商户发起和查询支付
+func splitStore(splitID int) (int, error) {
+	var storeID int
+	err := db.QueryRow(`SELECT o.store_id FROM order_splits s
+		JOIN orders o ON o.order_id = s.order_id OR o.session_id = s.session_id
+		WHERE s.id = ? LIMIT 1`, splitID).Scan(&storeID)
+	return storeID, err
+}
+
+// PayPart 发起一份的支付：微信返回小程序调起支付的参数，支付宝返回二维码内容，现金由收银员收款后直接记为已支付
+func PayPart(id int, method, openID string) (any, error) {
+	p, err := openPart(id)
+	if err != nil {
+		return nil, err
+	}
+	if method == MethodCash {
+		return nil, markPartPaid(p, MethodCash, "")
+	}
+	if method != MethodWechat && method != MethodAlipay {
+		return nil, fmt.Errorf("%w: unknown method %q", ErrInvalidSplit, method)
+	}
+	if method == MethodWechat && openID == "" {
+		return nil, fmt.Errorf("%w: openid is required for wechat pay", ErrInvalidSplit)
+	}
+
+	storeID, err := splitStore(p.SplitID)
+	if err != nil {
+		return nil, err
+	}
+
+	// 每次发起支付使用新的商户订单号并记录下来，确认时查询发起过的全部支付
+	tradeNo := "S" + utils.GetOrderNo()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE order_split_parts SET method = ?, trade_no = ? WHERE id = ? AND status = ?", method, tradeNo, p.ID, PartPending)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("%w: part is no longer pending", ErrSplitState)
+	}
+	_, err = tx.Exec("INSERT INTO order_split_payments (trade_no, part_id, method, created_at) VALUES (?, ?, ?, ?)", tradeNo, p.ID, method, storeNow())
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	description := fmt.Sprintf("分单 %d-%d", p.SplitID, p.PartNo)
+	if method == MethodAlipay {
+		qrCode, err := pay.AlipayPrecreate(storeID, tradeNo, p.Amount, description)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"qrCode": qrCode, "tradeNo": tradeNo}, nil
+	}
+	return pay.Prepay(storeID, openID, tradeNo, p.Amount, description, fmt.Sprintf("split:%d", p.ID), time.Now().Add(partPayMinutes*time.Minute))
+}
+
+// partPayment 为一份发起过的一次支付
+type partPayment struct {
+	TradeNo string
+	Method  string
+}
+
+// fetchPartPayments 返回一份发起过的全部支付，最近发起的在前
+func fetchPartPayments(partID int) ([]partPayment, error) {
+	rows, err := db.Query("SELECT trade_no, method FROM order_split_payments WHERE part_id = ? ORDER BY created_at DESC", partID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var payments []partPayment
+	for rows.Next() {
+		var pp partPayment
+		if err := rows.Scan(&pp.TradeNo, &pp.Method); err != nil {
+			return nil, err
+		}
+		payments = append(payments, pp)
+	}
+	return payments, rows.Err()
+}
+
+// ConfirmPart 向支付渠道查询一份发起过的支付是否有已支付的，已支付时记录并在全部结清后把订单标记为已支付
+func ConfirmPart(id int) (SplitPart, error) {
+	p, err := fetchPart(id)
+	if err != nil || p.Status != PartPending {
+		return p, err
+	}
+	payments, err := fetchPartPayments(id)
+	if err != nil || len(payments) == 0 {
+		return p, err
+	}
+
+	storeID, err := splitStore(p.SplitID)
+	if err != nil {
+		return p, err
+	}
+
+	for _, pp := range payments {
+		var paid bool
+		switch pp.Method {
+		case MethodWechat:
+			paid, err = pay.TradePaid(storeID, pp.TradeNo)
+		case MethodAlipay:
+			paid, err = pay.AlipayPaid(storeID, pp.TradeNo)
+		}
+		if err != nil {
+			return p, err
+		}
+		if paid {
+			if err := markPartPaid(p, pp.Method, pp.TradeNo); err != nil {
+				return p, err
+			}
+			return fetchPart(id)
+		}
+	}
+	return p, nil
+}
+
+// markPartPaid 记录一份已支付，tradeNo 为实际完成的支付，现金为空；
+// 这是分单的最后一份时分单结清，分单时账单上的订单标记为已支付
+func markPartPaid(p SplitPart, method, tradeNo string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 锁住分单，避免最后两份同时支付时都认为还有未支付的份
+	var status string
+	err = tx.QueryRow("SELECT status FROM order_splits WHERE id = ? FOR UPDATE", p.SplitID).Scan(&status)
+	if err != nil {
+		return err
+	}
+	now := storeNow()
+	res, err := tx.Exec("UPDATE order_split_parts SET status = ?, method = ?, trade_no = COALESCE(NULLIF(?, ''), trade_no), paid_at = ? WHERE id = ? AND status = ?",
+		PartPaid, method, tradeNo, now, p.ID, PartPending)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: part is no longer pending", ErrSplitState)
+	}
+
+	var pending int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM order_split_parts WHERE split_id = ? AND status = ?", p.SplitID, PartPending).Scan(&pending); err != nil {
+		return err
+	}
+	// 分单作废后才支付成功的份仍记为已支付，由收银员处理退款
+	if pending == 0 && status == SplitOpen {
+		if _, err := tx.Exec("UPDATE order_splits SET status = ?, settled_at = ? WHERE id = ?", SplitSettled, now, p.SplitID); err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE orders SET pay_status = ? WHERE order_id IN (SELECT order_id FROM order_split_orders WHERE split_id = ?)", true, p.SplitID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// formatPartReceipt 生成一份的小票
+func formatPartReceipt(s Split, p SplitPart) string {
+	var b strings.Builder
+	if s.SessionID != "" {
+		fmt.Fprintf(&b, "就餐会话: %s\n", s.SessionID)
+	} else {
+		fmt.Fprintf(&b, "订单: %d\n", s.OrderID)
+	}
+	fmt.Fprintf(&b, "分单: 第 %d/%d 份", p.PartNo, len(s.Parts))
+	if p.Seat > 0 {
+		fmt.Fprintf(&b, " (%d号座)", p.Seat)
+	}
+	b.WriteString("\n")
+	b.WriteString(ticketRule)
+	for _, item := range p.Items {
+		name := item.GoodsName
+		if item.Shared {
+			name += " (共享)"
+		}
+		fmt.Fprintf(&b, "%s x%d  %.2f\n", name, item.GoodsNumber, item.Amount)
+	}
+	if s.Mode == SplitEven {
+		fmt.Fprintf(&b, "账单合计 %.2f，平均分为 %d 份\n", s.Amount, len(s.Parts))
+	}
+	b.WriteString(ticketRule)
+	fmt.Fprintf(&b, "应付: %.2f\n", p.Amount)
+	if p.Status == PartPaid {
+		fmt.Fprintf(&b, "支付方式: %s\n", p.Method)
+		fmt.Fprintf(&b, "支付时间: %s\n", p.PaidAt)
+	} else {
+		b.WriteString("未支付\n")
+	}
+	return b.String()
+}
+
+func writeSplitError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, ErrInvalidSplit):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrSplitState):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, pay.ErrNoClient), errors.Is(err, pay.ErrNoAlipay):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		log.Printf("Split error: %v", err)
+		http.Error(w, "Failed to process split", http.StatusInternalServerError)
+	}
+}
+
+// HandleCreateSplit 分单，请求体见 SplitRequest，返回分单及每一份的金额
+func HandleCreateSplit(w http.ResponseWriter, r *http.Request) {
+	var req SplitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	s, err := CreateSplit(req)
+	if err != nil {
+		writeSplitError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// HandleSplit 查询分单
+func HandleSplit(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid split id", http.StatusBadRequest)
+		return
+	}
+
+	s, err := FetchSplit(id)
+	if err != nil {
+		writeSplitError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// HandlePayPart 发起一份的支付，请求体为 {"partId": N, "method": "wechat|alipay|cash", "openId": "..."}
+func HandlePayPart(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		PartID int    `json:"partId"`
+		Method string `json:"method"`
+		OpenID string `json:"openId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	payment, err := PayPart(data.PartID, data.Method, data.OpenID)
+	if err != nil {
+		writeSplitError(w, err)
+		return
+	}
+	p, err := fetchPart(data.PartID)
+	if err != nil {
+		writeSplitError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"part": p, "payment": payment})
+}
+
+// HandleConfirmPart 顾客支付完成后调用，确认支付并返回该份的状态
+func HandleConfirmPart(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		PartID int `json:"partId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	p, err := ConfirmPart(data.PartID)
+	if err != nil {
+		writeSplitError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// GetPartReceipt 返回一份的纯文本小票
+func GetPartReceipt(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["part_id"])
+	if err != nil {
+		http.Error(w, "Invalid part id", http.StatusBadRequest)
+		return
+	}
+
+	p, err := fetchPart(id)
+	if err != nil {
+		writeSplitError(w, err)
+		return
+	}
+	s, err := FetchSplit(p.SplitID)
+	if err != nil {
+		writeSplitError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(formatPartReceipt(s, p)))
+}
@@ -0,0 +1,119 @@
+package order
+
+import (
+	"database/sql"
+	"fmt"
+	"gocode/first/api/product"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const ticketRule = "--------------------------------\n"
+
+// GetKitchenTicket 返回给后厨打印的纯文本小票，套餐会逐行列出组成商品
+func GetKitchenTicket(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["order_id"]
+	if orderID == "" {
+		http.Error(w, "Missing order_id", http.StatusBadRequest)
+		return
+	}
+
+	var o Order
+	err := db.QueryRow(`SELECT order_id, order_number, create_time, COALESCE(table_id, 0), order_type, COALESCE(pickup_time, ''), delivery_address, store_id
+		FROM orders WHERE order_id = ?`, orderID).
+		Scan(&o.OrderID, &o.OrderNumber, &o.CreateTime, &o.TableID, &o.Type, &o.PickupTime, &o.Address, &o.StoreID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying order %s: %v", orderID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	o.Detail, err = fetchOrderDetails(orderID)
+	if err != nil {
+		log.Printf("Error querying order details %s: %v", orderID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	allergens, err := product.FetchAllergens(o.StoreID, ticketGoods(o))
+	if err != nil {
+		log.Printf("Error querying allergens %s: %v", orderID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(formatTicket(o, allergens)))
+}
+
+// ticketGoods 返回小票上出现的全部商品名称，包括套餐的组成商品
+func ticketGoods(o Order) []string {
+	var names []string
+	for _, d := range o.Detail {
+		names = append(names, d.GoodsName)
+		for _, c := range d.Components {
+			names = append(names, c.GoodsName)
+		}
+	}
+	return names
+}
+
+// formatTicket 生成后厨小票，含有过敏原的商品下方打印提示，allergens 的键为商品名称
+func formatTicket(o Order, allergens map[string][]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "订单号: %s\n", o.OrderNumber)
+	fmt.Fprintf(&b, "下单时间: %s\n", o.CreateTime)
+	writeFulfillment(&b, o)
+	b.WriteString(ticketRule)
+	for _, d := range o.Detail {
+		fmt.Fprintf(&b, "%s x%d", d.GoodsName, d.GoodsNumber)
+		if d.GoodsWeight != "" {
+			fmt.Fprintf(&b, " (%s)", d.GoodsWeight)
+		}
+		if d.Seat > 0 {
+			fmt.Fprintf(&b, " [%d号座]", d.Seat)
+		}
+		b.WriteString("\n")
+		writeAllergens(&b, "  ", allergens[d.GoodsName])
+		for _, c := range d.Components {
+			fmt.Fprintf(&b, "  - %s: %s x%d\n", c.SlotName, c.GoodsName, c.GoodsNumber*d.GoodsNumber)
+			writeAllergens(&b, "    ", allergens[c.GoodsName])
+		}
+	}
+	b.WriteString(ticketRule)
+	return b.String()
+}
+
+// writeFulfillment 打印就餐方式，外带和外送提示后厨打包
+func writeFulfillment(b *strings.Builder, o Order) {
+	switch o.Type {
+	case TypeTakeaway:
+		pickup := "尽快"
+		if o.PickupTime != "" {
+			pickup = o.PickupTime
+		}
+		fmt.Fprintf(b, "** 外带（打包） 取餐时间: %s **\n", pickup)
+	case TypeDelivery:
+		b.WriteString("** 外送（打包） **\n")
+		fmt.Fprintf(b, "地址: %s\n", o.Address)
+	default:
+		if o.TableID > 0 {
+			fmt.Fprintf(b, "堂食 餐桌: %d\n", o.TableID)
+		} else {
+			b.WriteString("堂食\n")
+		}
+	}
+}
+
+func writeAllergens(b *strings.Builder, indent string, labels []string) {
+	if len(labels) > 0 {
+		fmt.Fprintf(b, "%s!! 含过敏原: %s\n", indent, strings.Join(labels, "、"))
+	}
+}
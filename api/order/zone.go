@@ -0,0 +1,355 @@
+package order
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// 配送区域的形状
+const (
+	ZonePolygon = "polygon" // 多边形，顶点为 [纬度, 经度]
+	ZoneRadius  = "radius"  // 以门店为圆心的环形，距离在 [MinKm, MaxKm) 内
+)
+
+var (
+	// ErrInvalidZone 表示配送区域的设置不合法
+	ErrInvalidZone = errors.New("invalid delivery zone")
+	// ErrOutOfZone 表示地址不在任何配送区域内
+	ErrOutOfZone = errors.New("address is outside the delivery area")
+)
+
+// Zone 配送区域，区域重叠时按 Sort 从小到大取第一个
+type Zone struct {
+	ID         int          `json:"id"`
+	Name       string       `json:"name"`
+	Kind       string       `json:"kind"`
+	Polygon    [][2]float64 `json:"polygon,omitempty"`
+	MinKm      float64      `json:"minKm,omitempty"`
+	MaxKm      float64      `json:"maxKm,omitempty"`
+	MinAmount  float64      `json:"minAmount"`
+	Fee        float64      `json:"fee"`
+	FreeOver   float64      `json:"freeOver,omitempty"` // 商品金额达到该值免外送费，为0时不免
+	ETAMinutes int          `json:"etaMinutes"`
+	Sort       int          `json:"sort"`
+	Active     bool         `json:"active"`
+}
+
+// DeliveryQuote 外送报价
+type DeliveryQuote struct {
+	ZoneID     int     `json:"zoneId"`
+	Zone       string  `json:"zone"`
+	DistanceKm float64 `json:"distanceKm"`
+	Fee        float64 `json:"fee"`
+	MinAmount  float64 `json:"minAmount"`
+	ETAMinutes int     `json:"etaMinutes"`
+}
+
+func migrateZones() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS delivery_zones (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(64) NOT NULL,
+		kind VARCHAR(16) NOT NULL,
+		polygon TEXT NULL,
+		min_km DECIMAL(6,2) NOT NULL DEFAULT 0,
+		max_km DECIMAL(6,2) NOT NULL DEFAULT 0,
+		min_amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+		fee DECIMAL(10,2) NOT NULL DEFAULT 0,
+		free_over DECIMAL(10,2) NOT NULL DEFAULT 0,
+		eta_minutes INT NOT NULL DEFAULT 0,
+		sort INT NOT NULL DEFAULT 0,
+		active TINYINT(1) NOT NULL DEFAULT 1
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating delivery_zones table: %w", err)
+	}
+	columns := []struct{ name, definition string }{
+		{"delivery_zone", "INT NULL"},
+		{"delivery_lat", "DECIMAL(10,7) NULL"},
+		{"delivery_lng", "DECIMAL(10,7) NULL"},
+	}
+	for _, c := range columns {
+		if err := utils.EnsureColumn(db, "orders", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pointInPolygon 射线法判断坐标是否在多边形内，城市范围内把经纬度当作平面坐标
+func pointInPolygon(lat, lng float64, polygon [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		yi, xi := polygon[i][0], polygon[i][1]
+		yj, xj := polygon[j][0], polygon[j][1]
+		if (yi > lat) != (yj > lat) && lng < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Contains 判断坐标是否在区域内，distance 为到门店的距离
+func (z Zone) Contains(lat, lng, distance float64) bool {
+	switch z.Kind {
+	case ZonePolygon:
+		return pointInPolygon(lat, lng, z.Polygon)
+	case ZoneRadius:
+		return distance >= z.MinKm && distance < z.MaxKm
+	}
+	return false
+}
+
+func (z Zone) validate() error {
+	if z.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidZone)
+	}
+	switch z.Kind {
+	case ZonePolygon:
+		if len(z.Polygon) < 3 {
+			return fmt.Errorf("%w: a polygon needs at least 3 points", ErrInvalidZone)
+		}
+		for _, p := range z.Polygon {
+			if p[0] < -90 || p[0] > 90 || p[1] < -180 || p[1] > 180 {
+				return fmt.Errorf("%w: invalid point %v", ErrInvalidZone, p)
+			}
+		}
+	case ZoneRadius:
+		if z.MinKm < 0 || z.MaxKm <= z.MinKm {
+			return fmt.Errorf("%w: maxKm must be greater than minKm", ErrInvalidZone)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidZone, z.Kind)
+	}
+	if z.Fee < 0 || z.MinAmount < 0 || z.FreeOver < 0 || z.ETAMinutes < 0 {
+		return fmt.Errorf("%w: amounts cannot be negative", ErrInvalidZone)
+	}
+	return nil
+}
+
+// FetchZones 返回门店的配送区域，activeOnly 时只返回启用的
+func FetchZones(storeID int, activeOnly bool) ([]Zone, error) {
+	query := `SELECT id, name, kind, COALESCE(polygon, ''), min_km, max_km, min_amount, fee, free_over, eta_minutes, sort, active
+		FROM delivery_zones WHERE store_id = ?`
+	if activeOnly {
+		query += " AND active = 1"
+	}
+	rows, err := db.Query(query+" ORDER BY sort, id", storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := []Zone{}
+	for rows.Next() {
+		var z Zone
+		var polygon string
+		if err := rows.Scan(&z.ID, &z.Name, &z.Kind, &polygon, &z.MinKm, &z.MaxKm, &z.MinAmount, &z.Fee, &z.FreeOver, &z.ETAMinutes, &z.Sort, &z.Active); err != nil {
+			return nil, err
+		}
+		if polygon != "" {
+			if err := json.Unmarshal([]byte(polygon), &z.Polygon); err != nil {
+				log.Printf("Error unmarshalling polygon of zone %d: %v", z.ID, err)
+			}
+		}
+		zones = append(zones, z)
+	}
+	return zones, rows.Err()
+}
+
+// QuoteDelivery 按坐标匹配门店的配送区域并计算外送费，距离从门店坐标算起；
+// 没有设置配送区域时按 fulfillment 的统一规则报价
+func QuoteDelivery(storeID int, lat, lng, subtotal float64) (DeliveryQuote, error) {
+	var q DeliveryQuote
+	storeLat, storeLng, err := store.Coordinates(storeID)
+	if err != nil {
+		return q, err
+	}
+	q.DistanceKm = math.Round(utils.DistanceKm(storeLat, storeLng, lat, lng)*100) / 100
+
+	zones, err := FetchZones(storeID, true)
+	if err != nil {
+		return q, err
+	}
+	if len(zones) == 0 {
+		policy := config.C.Store.Fulfillment
+		q.MinAmount = policy.MinDeliveryAmount
+		if policy.FreeDeliveryOver <= 0 || subtotal < policy.FreeDeliveryOver {
+			q.Fee = policy.DeliveryFee
+		}
+		return q, nil
+	}
+
+	for _, z := range zones {
+		if !z.Contains(lat, lng, q.DistanceKm) {
+			continue
+		}
+		q.ZoneID, q.Zone, q.MinAmount, q.ETAMinutes = z.ID, z.Name, z.MinAmount, z.ETAMinutes
+		if z.FreeOver <= 0 || subtotal < z.FreeOver {
+			q.Fee = z.Fee
+		}
+		return q, nil
+	}
+	return q, ErrOutOfZone
+}
+
+// HandleZones 返回全部配送区域
+func HandleZones(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	zones, err := FetchZones(storeID, false)
+	if err != nil {
+		log.Printf("Error querying delivery zones: %v", err)
+		http.Error(w, "Failed to query delivery zones", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zones)
+}
+
+// HandleSaveZone 新建或修改配送区域，id 为0时新建
+func HandleSaveZone(w http.ResponseWriter, r *http.Request) {
+	var z Zone
+	if err := json.NewDecoder(r.Body).Decode(&z); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	if err := z.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	var polygon sql.NullString
+	if z.Kind == ZonePolygon {
+		b, err := json.Marshal(z.Polygon)
+		if err != nil {
+			http.Error(w, "Failed to encode polygon", http.StatusInternalServerError)
+			return
+		}
+		polygon = sql.NullString{String: string(b), Valid: true}
+	} else {
+		z.Polygon = nil
+	}
+
+	if z.ID == 0 {
+		res, err := db.Exec(`INSERT INTO delivery_zones (name, kind, polygon, min_km, max_km, min_amount, fee, free_over, eta_minutes, sort, active, store_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			z.Name, z.Kind, polygon, z.MinKm, z.MaxKm, z.MinAmount, z.Fee, z.FreeOver, z.ETAMinutes, z.Sort, z.Active, storeID)
+		if err != nil {
+			log.Printf("Error inserting delivery zone: %v", err)
+			http.Error(w, "Failed to save delivery zone", http.StatusInternalServerError)
+			return
+		}
+		id, _ := res.LastInsertId()
+		z.ID = int(id)
+	} else {
+		res, err := db.Exec(`UPDATE delivery_zones SET name = ?, kind = ?, polygon = ?, min_km = ?, max_km = ?, min_amount = ?, fee = ?,
+			free_over = ?, eta_minutes = ?, sort = ?, active = ? WHERE id = ? AND store_id = ?`,
+			z.Name, z.Kind, polygon, z.MinKm, z.MaxKm, z.MinAmount, z.Fee, z.FreeOver, z.ETAMinutes, z.Sort, z.Active, z.ID, storeID)
+		if err != nil {
+			log.Printf("Error updating delivery zone: %v", err)
+			http.Error(w, "Failed to save delivery zone", http.StatusInternalServerError)
+			return
+		}
+		var exists int
+		if n, _ := res.RowsAffected(); n == 0 {
+			if err := db.QueryRow("SELECT COUNT(*) FROM delivery_zones WHERE id = ? AND store_id = ?", z.ID, storeID).Scan(&exists); err != nil || exists == 0 {
+				http.Error(w, "Delivery zone not found", http.StatusNotFound)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(z)
+}
+
+// HandleDeleteZone 删除配送区域
+func HandleDeleteZone(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM delivery_zones WHERE id = ? AND store_id = ?", data.ID, storeID)
+	if err != nil {
+		http.Error(w, "Failed to delete delivery zone", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Delivery zone not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Delivery zone deleted successfully"))
+}
+
+// HandleDeliveryQuote 结账前查询外送费、起送金额和预计送达时间；
+// 参数：lat、lng 为地址坐标，subtotal 为商品金额；公开接口不按地址簿ID查询，避免泄露其他顾客的地址
+func HandleDeliveryQuote(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.RequestStore(w, r)
+	if !ok {
+		return
+	}
+	v := r.URL.Query()
+	subtotal, err := strconv.ParseFloat(v.Get("subtotal"), 64)
+	if err != nil && v.Get("subtotal") != "" {
+		http.Error(w, "Invalid subtotal", http.StatusBadRequest)
+		return
+	}
+
+	lat, err := strconv.ParseFloat(v.Get("lat"), 64)
+	if err != nil {
+		http.Error(w, "Invalid lat", http.StatusBadRequest)
+		return
+	}
+	lng, err := strconv.ParseFloat(v.Get("lng"), 64)
+	if err != nil {
+		http.Error(w, "Invalid lng", http.StatusBadRequest)
+		return
+	}
+
+	q, err := QuoteDelivery(storeID, lat, lng, subtotal)
+	if err != nil {
+		writeQuoteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q)
+}
+
+func writeQuoteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrOutOfZone):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrInvalidFulfillment):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Error quoting delivery: %v", err)
+		http.Error(w, "Failed to quote delivery", http.StatusInternalServerError)
+	}
+}
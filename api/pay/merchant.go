@@ -0,0 +1,95 @@
+package pay
+
+import (
+	"database/sql"
+	"fmt"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"log"
+	"sync"
+
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+)
+
+var db *sql.DB
+
+func init() {
+	var err error
+
+	// 从配置文件中获取数据库连接信息
+	dbc := config.DBConfig
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
+		dbc.Username, dbc.Password, dbc.Host, dbc.Port, dbc.Database)
+
+	// 使用配置信息打开数据库连接
+	db, err = sql.Open("mysql", dsn)
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+
+	// 检查与数据库的连接
+	err = db.Ping()
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	// 每家门店使用自己的微信支付和支付宝商户
+	if err = store.EnsureScoped(db, "wpay", "pay"); err != nil {
+		log.Fatal("Failed to migrate payment config:", err)
+	}
+}
+
+// merchant 一家门店的微信支付商户
+type merchant struct {
+	client *core.Client
+	wechat config.Wechat
+}
+
+var (
+	merchantMu sync.Mutex
+	merchants  = make(map[int]merchant)
+)
+
+// merchantFor 返回门店的微信支付商户：默认门店使用启动时创建的客户端，
+// 其他门店按 wpay 表中的配置创建客户端并缓存，保存配置后重新创建
+func merchantFor(storeID int) (merchant, error) {
+	if storeID == 0 || storeID == store.DefaultID {
+		if utils.Client == nil {
+			return merchant{}, ErrNoClient
+		}
+		return merchant{client: utils.Client, wechat: config.C.Wechat}, nil
+	}
+
+	merchantMu.Lock()
+	defer merchantMu.Unlock()
+	if m, ok := merchants[storeID]; ok {
+		return m, nil
+	}
+
+	// 回调域名等与商户无关的配置沿用配置文件
+	w := config.C.Wechat
+	err := db.QueryRow("SELECT AppID, AppSecret, MchId, MchKey, MchNumber, PrivateKey FROM wpay WHERE store_id = ? LIMIT 1", storeID).
+		Scan(&w.AppID, &w.AppSecret, &w.MchId, &w.MchKey, &w.MchNumber, &w.PrivateKey)
+	if err == sql.ErrNoRows {
+		return merchant{}, fmt.Errorf("%w for store %d", ErrNoClient, storeID)
+	}
+	if err != nil {
+		return merchant{}, err
+	}
+	client := utils.NewWeChatClientFor(w)
+	if client == nil {
+		return merchant{}, fmt.Errorf("%w for store %d", ErrNoClient, storeID)
+	}
+
+	m := merchant{client: client, wechat: w}
+	merchants[storeID] = m
+	return m, nil
+}
+
+// forgetMerchant 门店修改微信支付配置后丢弃缓存的客户端
+func forgetMerchant(storeID int) {
+	merchantMu.Lock()
+	defer merchantMu.Unlock()
+	delete(merchants, storeID)
+}
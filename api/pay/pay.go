@@ -4,7 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"gocode/first/config"
+	"gocode/first/api/store"
 	"log"
 	"net/http"
 	"time"
@@ -22,14 +22,12 @@ type AlipayConfig struct {
 
 // HandleAlipayConfig 处理支付宝配置的HTTP请求
 func HandleAlipayConfig(w http.ResponseWriter, r *http.Request) {
-	// 连接到数据库
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
-		config.DBConfig.Username, config.DBConfig.Password, config.DBConfig.Host, config.DBConfig.Port, config.DBConfig.Database))
-	if err != nil {
-		fmt.Println("Failed to connect to database:", err)
+	// 每家门店单独配置
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
 		return
 	}
-	defer db.Close()
+	var err error
 
 	switch r.Method {
 	case "POST":
@@ -39,20 +37,20 @@ func HandleAlipayConfig(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// 检查是否存在相同的app_id
+		// 检查门店是否已有配置
 		var exists int
-		err = db.QueryRow("SELECT COUNT(*) FROM pay WHERE app_id = ?", config.AppID).Scan(&exists)
+		err = db.QueryRow("SELECT COUNT(*) FROM pay WHERE store_id = ?", storeID).Scan(&exists)
 		if err != nil && err != sql.ErrNoRows {
 			http.Error(w, "数据库查询错误", http.StatusInternalServerError)
 			return
 		}
 
 		if exists > 0 {
-			// 存在相同的app_id，执行更新操作
-			_, err = db.Exec("UPDATE pay SET private_key = ?, alipay_public_key = ? WHERE app_id = ?", config.PrivateKey, config.AlipayPublicKey, config.AppID)
+			// 已有配置，执行更新操作
+			_, err = db.Exec("UPDATE pay SET private_key = ?, alipay_public_key = ?, app_id = ? WHERE store_id = ?", config.PrivateKey, config.AlipayPublicKey, config.AppID, storeID)
 		} else {
-			// 不存在相同的app_id，执行插入操作
-			_, err = db.Exec("UPDATE pay SET private_key = ?, alipay_public_key = ?, app_id = ? WHERE id = 1 LIMIT 1", config.PrivateKey, config.AlipayPublicKey, config.AppID)
+			// 没有配置，执行插入操作
+			_, err = db.Exec("INSERT INTO pay (store_id, app_id, private_key, alipay_public_key) VALUES (?, ?, ?, ?)", storeID, config.AppID, config.PrivateKey, config.AlipayPublicKey)
 		}
 
 		if err != nil {
@@ -64,9 +62,9 @@ func HandleAlipayConfig(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"message": "支付宝配置成功保存"})
 
 	case "GET":
-		// 查询最大id的配置
+		// 查询门店的配置
 		var config AlipayConfig
-		err := db.QueryRow("SELECT app_id, private_key, alipay_public_key FROM pay ORDER BY id ASC LIMIT 1").Scan(&config.AppID, &config.PrivateKey, &config.AlipayPublicKey)
+		err := db.QueryRow("SELECT app_id, private_key, alipay_public_key FROM pay WHERE store_id = ? ORDER BY id ASC LIMIT 1", storeID).Scan(&config.AppID, &config.PrivateKey, &config.AlipayPublicKey)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				http.Error(w, "未找到配置", http.StatusNotFound)
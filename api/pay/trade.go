@@ -0,0 +1,155 @@
+package pay
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/smartwalle/alipay/v3"
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+	"github.com/wechatpay-apiv3/wechatpay-go/services/payments/jsapi"
+	"github.com/wechatpay-apiv3/wechatpay-go/services/refunddomestic"
+)
+
+// ErrNoClient 表示微信支付客户端未初始化，通常是商户证书没有配置
+var ErrNoClient = errors.New("wechat pay client is not configured")
+
+// ErrNoAlipay 表示后台没有保存支付宝配置
+var ErrNoAlipay = errors.New("alipay is not configured")
+
+// tradeSuccess 微信支付订单已支付的状态
+const tradeSuccess = "SUCCESS"
+
+// cents 把元换算为分
+func cents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// Prepay 使用门店的商户创建小程序支付订单，返回调起支付所需的参数；expire 之后未支付的订单自动关闭
+func Prepay(storeID int, openID, tradeNo string, amount float64, description, attach string, expire time.Time) (*jsapi.PrepayWithRequestPaymentResponse, error) {
+	m, err := merchantFor(storeID)
+	if err != nil {
+		return nil, err
+	}
+	wechat := m.wechat
+	svc := jsapi.JsapiApiService{Client: m.client}
+	resp, _, err := svc.PrepayWithRequestPayment(context.TODO(),
+		jsapi.PrepayRequest{
+			Appid:       core.String(wechat.AppID),
+			Mchid:       core.String(wechat.MchId),
+			Description: core.String(description),
+			OutTradeNo:  core.String(tradeNo),
+			Attach:      core.String(attach),
+			NotifyUrl:   core.String(wechat.Domain + "/payment/notify"),
+			TimeExpire:  core.Time(expire),
+			Amount: &jsapi.Amount{
+				Total:    core.Int64(cents(amount)),
+				Currency: core.String("CNY"),
+			},
+			Payer: &jsapi.Payer{
+				Openid: core.String(openID),
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("prepaying %s: %w", tradeNo, err)
+	}
+	return resp, nil
+}
+
+// TradePaid 查询门店商户的订单是否已支付成功
+func TradePaid(storeID int, tradeNo string) (bool, error) {
+	m, err := merchantFor(storeID)
+	if err != nil {
+		return false, err
+	}
+	svc := jsapi.JsapiApiService{Client: m.client}
+	resp, _, err := svc.QueryOrderByOutTradeNo(context.TODO(), jsapi.QueryOrderByOutTradeNoRequest{
+		OutTradeNo: core.String(tradeNo),
+		Mchid:      core.String(m.wechat.MchId),
+	})
+	if err != nil {
+		return false, fmt.Errorf("querying %s: %w", tradeNo, err)
+	}
+	return resp.TradeState != nil && *resp.TradeState == tradeSuccess, nil
+}
+
+// Refund 对门店商户已支付的订单退款，total 为原订单金额，refundNo 相同的请求只退一笔
+func Refund(storeID int, tradeNo, refundNo string, amount, total float64, reason string) error {
+	m, err := merchantFor(storeID)
+	if err != nil {
+		return err
+	}
+	svc := refunddomestic.RefundsApiService{Client: m.client}
+	_, _, err = svc.Create(context.TODO(), refunddomestic.CreateRequest{
+		OutTradeNo:  core.String(tradeNo),
+		OutRefundNo: core.String(refundNo),
+		Reason:      core.String(reason),
+		Amount: &refunddomestic.AmountReq{
+			Refund:   core.Int64(cents(amount)),
+			Total:    core.Int64(cents(total)),
+			Currency: core.String("CNY"),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("refunding %s: %w", tradeNo, err)
+	}
+	return nil
+}
+
+// alipayClient 按门店在后台保存的支付宝配置创建客户端，与 TestPayment 一样使用沙箱模式
+func alipayClient(storeID int) (*alipay.Client, error) {
+	var c AlipayConfig
+	err := db.QueryRow("SELECT app_id, private_key, alipay_public_key FROM pay WHERE store_id = ? ORDER BY id ASC LIMIT 1", storeID).Scan(&c.AppID, &c.PrivateKey, &c.AlipayPublicKey)
+	if err == sql.ErrNoRows || err == nil && c.AppID == "" {
+		return nil, ErrNoAlipay
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := alipay.New(c.AppID, c.PrivateKey, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.LoadAliPayPublicKey(c.AlipayPublicKey); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// AlipayPrecreate 使用门店的支付宝商户创建当面付订单，返回顾客扫码支付的二维码内容
+func AlipayPrecreate(storeID int, tradeNo string, amount float64, subject string) (string, error) {
+	client, err := alipayClient(storeID)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.TradePreCreate(alipay.TradePreCreate{Trade: alipay.Trade{
+		OutTradeNo:  tradeNo,
+		TotalAmount: fmt.Sprintf("%.2f", amount),
+		Subject:     subject,
+	}})
+	if err != nil {
+		return "", fmt.Errorf("precreating %s: %w", tradeNo, err)
+	}
+	if resp.Code != KSuccessCode {
+		return "", fmt.Errorf("precreating %s: %s %s", tradeNo, resp.Code, resp.Msg)
+	}
+	return resp.QRCode, nil
+}
+
+// AlipayPaid 查询门店支付宝商户的订单是否已支付成功
+func AlipayPaid(storeID int, tradeNo string) (bool, error) {
+	client, err := alipayClient(storeID)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.TradeQuery(alipay.TradeQuery{OutTradeNo: tradeNo})
+	if err != nil {
+		return false, fmt.Errorf("querying %s: %w", tradeNo, err)
+	}
+	return resp.TradeStatus == alipay.TradeStatusSuccess || resp.TradeStatus == alipay.TradeStatusFinished, nil
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"gocode/first/api/store"
 	"gocode/first/config"
 	"gocode/first/utils"
 	"log"
@@ -26,16 +28,17 @@ type Wpay struct {
 type PaymentData struct {
 	OpenId string  `json:"openId"`
 	Amount float64 `json:"amount"`
+	// 支付的订单，预约订单的取餐时间以订单保存的为准；为0表示不关联订单
+	OrderID int `json:"orderId,omitempty"`
 }
 
+// HandleWeixinConfig 读取或保存门店的微信支付配置
 func HandleWeixinConfig(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
-		config.DBConfig.Username, config.DBConfig.Password, config.DBConfig.Host, config.DBConfig.Port, config.DBConfig.Database))
-	if err != nil {
-		fmt.Println("Failed to connect to database:", err)
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
 		return
 	}
-	defer db.Close()
+	var err error
 	switch r.Method {
 	case "POST":
 		var wpay Wpay
@@ -46,20 +49,21 @@ func HandleWeixinConfig(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		fmt.Println(wpay.AppSecret)
-		// 检查是否存在相同的app_id
+		// 检查门店是否已有配置
 		var exists int
-		err = db.QueryRow("SELECT COUNT(*) FROM wpay WHERE AppID = ?", wpay.AppID).Scan(&exists)
+		err = db.QueryRow("SELECT COUNT(*) FROM wpay WHERE store_id = ?", storeID).Scan(&exists)
 		if err != nil && err != sql.ErrNoRows {
 			http.Error(w, "数据库查询错误", http.StatusInternalServerError)
 			return
 		}
 		if exists > 0 {
-			// 存在相同的app_id，执行更新操作
-			_, err = db.Exec("UPDATE wpay SET AppSecret = ?, Mchid = ?,Mchkey=?, MchNumber=?,PrivateKey=? ,AppID = ? LIMIT 1", wpay.AppSecret, wpay.MchID, wpay.MchKey, wpay.MchNumber, wpay.PrivateKey, wpay.AppID)
+			// 已有配置，执行更新操作
+			_, err = db.Exec("UPDATE wpay SET AppSecret = ?, Mchid = ?,Mchkey=?, MchNumber=?,PrivateKey=? ,AppID = ? WHERE store_id = ? LIMIT 1", wpay.AppSecret, wpay.MchID, wpay.MchKey, wpay.MchNumber, wpay.PrivateKey, wpay.AppID, storeID)
 		} else {
-			// 不存在相同的app_id，执行插入操作
-			_, err = db.Exec("UPDATE wpay SET AppSecret = ?, Mchid = ?,Mchkey=?, MchNumber=?,PrivateKey=? ,AppID = ? LIMIT 1", wpay.AppSecret, wpay.MchID, wpay.MchKey, wpay.MchNumber, wpay.PrivateKey, wpay.AppID)
+			// 没有配置，执行插入操作
+			_, err = db.Exec("INSERT INTO wpay (store_id, AppID, AppSecret, MchId, MchKey, MchNumber, PrivateKey) VALUES (?, ?, ?, ?, ?, ?, ?)", storeID, wpay.AppID, wpay.AppSecret, wpay.MchID, wpay.MchKey, wpay.MchNumber, wpay.PrivateKey)
 		}
+		forgetMerchant(storeID)
 
 		if err != nil {
 			http.Error(w, fmt.Sprintf("数据库操作错误: %s", err.Error()), http.StatusInternalServerError)
@@ -69,9 +73,9 @@ func HandleWeixinConfig(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{"message": "微信配置成功保存"})
 	case "GET":
-		// 查询最大id的配置
+		// 查询门店的配置
 		var wpay Wpay
-		err := db.QueryRow("SELECT AppID,AppSecret,MchId, MchKey,MchNumber,PrivateKey FROM wpay LIMIT 1").Scan(&wpay.AppID, &wpay.AppSecret, &wpay.MchID, &wpay.MchKey, &wpay.MchNumber, &wpay.PrivateKey)
+		err := db.QueryRow("SELECT AppID,AppSecret,MchId, MchKey,MchNumber,PrivateKey FROM wpay WHERE store_id = ? LIMIT 1", storeID).Scan(&wpay.AppID, &wpay.AppSecret, &wpay.MchID, &wpay.MchKey, &wpay.MchNumber, &wpay.PrivateKey)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				http.Error(w, "未找到配置", http.StatusNotFound)
@@ -103,13 +107,55 @@ func Payment(w http.ResponseWriter, r *http.Request) {
 		log.Printf("解析请求数据出错: %v", err)
 		return
 	}
+	// 门店不接单时不创建支付
+	storeID, err := store.Resolve(r)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"msg":  err.Error(),
+			"code": 404,
+		})
+		return
+	}
+	var pickup time.Time
+	if paymentData.OrderID > 0 {
+		if storeID, pickup, err = orderPickup(paymentData.OrderID); err != nil {
+			if err == sql.ErrNoRows {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"msg":  "订单不存在",
+					"code": 404,
+				})
+				return
+			}
+			log.Printf("查询订单出错: %v", err)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"msg":  "查询订单出错",
+				"code": 500,
+			})
+			return
+		}
+	}
+	if err := store.CheckOrdering(storeID, time.Now(), pickup); err != nil {
+		if errors.Is(err, store.ErrClosed) || errors.Is(err, store.ErrPaused) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"msg":  err.Error(),
+				"code": 409,
+			})
+			return
+		}
+		log.Printf("检查门店状态出错: %v", err)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"msg":  "检查门店状态出错",
+			"code": 500,
+		})
+		return
+	}
 	orderNumber := utils.GetOrderNo()
-	resp, _, err := orderPaymentPrepayData(paymentData.OpenId, orderNumber, paymentData.Amount, "支付测试", "", time.Now().Unix()+60*30, "/payment/notify")
+	resp, _, err := orderPaymentPrepayData(storeID, paymentData.OpenId, orderNumber, paymentData.Amount, "支付测试", "", time.Now().Unix()+60*30, "/payment/notify")
 	if err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"msg": "下单错误",
 		})
-		log.Fatalf("下单出错:%v", err.Error())
+		log.Printf("下单出错:%v", err.Error())
 		return
 	}
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -119,10 +165,26 @@ func Payment(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// 用户openid,订单编号,下单金额,备注,详情,超时时间,回调结果地址
-func orderPaymentPrepayData(openId, tradeNo string, amount float64, body, attach string, timeExpire int64, notifyUrl string) (resp *jsapi.PrepayWithRequestPaymentResponse, result *core.APIResult, err error) {
-	wechat := config.C.Wechat
-	svc := jsapi.JsapiApiService{Client: utils.Client}
+// orderPickup 返回订单所属门店和保存的取餐时间，即时订单的取餐时间为零值
+func orderPickup(orderID int) (int, time.Time, error) {
+	var storeID int
+	var pickupTime sql.NullString
+	err := db.QueryRow("SELECT store_id, pickup_time FROM orders WHERE order_id = ?", orderID).Scan(&storeID, &pickupTime)
+	if err != nil || !pickupTime.Valid {
+		return storeID, time.Time{}, err
+	}
+	pickup, err := time.ParseInLocation("2006-01-02 15:04:05", pickupTime.String, config.Location())
+	return storeID, pickup, err
+}
+
+// 门店,用户openid,订单编号,下单金额,备注,详情,超时时间,回调结果地址
+func orderPaymentPrepayData(storeID int, openId, tradeNo string, amount float64, body, attach string, timeExpire int64, notifyUrl string) (resp *jsapi.PrepayWithRequestPaymentResponse, result *core.APIResult, err error) {
+	m, err := merchantFor(storeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	wechat := m.wechat
+	svc := jsapi.JsapiApiService{Client: m.client}
 
 	// 得到prepay_id，以及调起支付所需的参数和签名
 	duration := time.Second * time.Duration(timeExpire)
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"gocode/first/config"
+	"gocode/first/utils"
 	"log"
 	"net/http"
 )
@@ -16,6 +17,9 @@ type Person struct {
 	Address string `json:"address"`
 	Area    string `json:"area"`
 	Phone   string `json:"phone"`
+	// 地址坐标，外送时用于判断配送区域
+	Lat *float64 `json:"lat,omitempty"`
+	Lng *float64 `json:"lng,omitempty"`
 }
 
 var db *sql.DB // 全局数据库连接
@@ -39,6 +43,13 @@ func init() {
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+
+	if err = utils.EnsureColumn(db, "pesonlist", "lat", "DECIMAL(10,7) NULL"); err != nil {
+		log.Fatal("Failed to migrate person list:", err)
+	}
+	if err = utils.EnsureColumn(db, "pesonlist", "lng", "DECIMAL(10,7) NULL"); err != nil {
+		log.Fatal("Failed to migrate person list:", err)
+	}
 }
 func InsertPerson(w http.ResponseWriter, r *http.Request) {
 	var person Person
@@ -49,8 +60,8 @@ func InsertPerson(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 插入数据
-	query := `INSERT INTO pesonlist (email,gender,address,area,phone) VALUES (?, ?, ?, ?, ?)`
-	_, err := db.Exec(query, person.Email, person.Gender, person.Address, person.Area, person.Phone)
+	query := `INSERT INTO pesonlist (email,gender,address,area,phone,lat,lng) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, person.Email, person.Gender, person.Address, person.Area, person.Phone, person.Lat, person.Lng)
 	if err != nil {
 		fmt.Printf("Error inserting Person: %v\n", err) // 添加此行
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -75,14 +86,15 @@ func UpdatePerson(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	query := `UPDATE pesonlist SET gender =?,address=?,area=?,phone=? WHERE id = ?`
-	_, err := db.Exec(query, person.Gender, person.Address, person.Area, person.Phone, person.ID)
+	// 未传坐标时保留原有坐标
+	query := `UPDATE pesonlist SET gender =?,address=?,area=?,phone=?,lat=COALESCE(?, lat),lng=COALESCE(?, lng) WHERE id = ?`
+	_, err := db.Exec(query, person.Gender, person.Address, person.Area, person.Phone, person.Lat, person.Lng, person.ID)
 	if err != nil {
 		fmt.Printf("Error updating Person: %v\n", err) // 添加此行
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	query = `UPDATE user SET address =?,phone=? WHERE email = ?`
+	query = `UPDATE user SET address =?,phone=? WHERE email = ? AND deleted_at IS NULL`
 	_, err = db.Exec(query, person.Address, person.Phone, person.Email)
 	if err != nil {
 		fmt.Printf("Error updating Person: %v\n", err) // 添加此行
@@ -119,7 +131,7 @@ func GetPersonList(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	rows, err := db.Query("SELECT * FROM pesonlist where email=?", person.Email)
+	rows, err := db.Query("SELECT id, email, gender, address, area, phone, lat, lng FROM pesonlist where email=?", person.Email)
 	if err != nil {
 		fmt.Printf("Error querying Person: %v\n", err) // 添加此行
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -129,7 +141,7 @@ func GetPersonList(w http.ResponseWriter, r *http.Request) {
 	var persons []Person
 	for rows.Next() {
 		var person Person
-		if err := rows.Scan(&person.ID, &person.Email, &person.Gender, &person.Address, &person.Area, &person.Phone); err != nil {
+		if err := rows.Scan(&person.ID, &person.Email, &person.Gender, &person.Address, &person.Area, &person.Phone, &person.Lat, &person.Lng); err != nil {
 			fmt.Printf("Error scanning Person: %v\n", err) // 添加此行
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
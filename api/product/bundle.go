@@ -0,0 +1,254 @@
+package product
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"gocode/first/utils"
+)
+
+// ErrInvalidBundle 表示套餐的选择不符合套餐规则
+var ErrInvalidBundle = errors.New("invalid bundle choice")
+
+// BundleSlot 套餐中的一个选择位，例如“主食”“饮品”；只有一个选项且必选的选择位即为固定组成
+type BundleSlot struct {
+	ID         int            `json:"id"`
+	Name       string         `json:"name"`
+	SortOrder  int            `json:"sortOrder"`
+	MinChoices int            `json:"minChoices"`
+	MaxChoices int            `json:"maxChoices"`
+	Options    []BundleOption `json:"options"`
+}
+
+// BundleOption 选择位中可选的商品及其加价
+type BundleOption struct {
+	ID          int     `json:"id"`
+	ProductID   int     `json:"productId"`
+	ProductName string  `json:"productName"`
+	ExtraPrice  float64 `json:"extraPrice"`
+}
+
+// BundleChoice 下单时在某个选择位上选中的商品
+type BundleChoice struct {
+	Slot       string
+	Product    string
+	Quantity   int
+	ExtraPrice float64
+}
+
+func migrateBundles() error {
+	if err := utils.EnsureColumn(db, "products", "is_bundle", "TINYINT(1) NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS bundle_slots (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		bundle_id INT NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		sort_order INT NOT NULL DEFAULT 0,
+		min_choices INT NOT NULL DEFAULT 1,
+		max_choices INT NOT NULL DEFAULT 1,
+		INDEX idx_bundle (bundle_id)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating bundle_slots table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS bundle_slot_options (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		slot_id INT NOT NULL,
+		product_id INT NOT NULL,
+		extra_price DECIMAL(10, 2) NOT NULL DEFAULT 0,
+		INDEX idx_slot (slot_id)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating bundle_slot_options table: %w", err)
+	}
+
+	return nil
+}
+
+func validateBundleSlots(slots []BundleSlot) error {
+	seen := make(map[string]bool)
+	for _, s := range slots {
+		if s.Name == "" {
+			return fmt.Errorf("%w: slot name is required", ErrInvalidBundle)
+		}
+		if seen[s.Name] {
+			return fmt.Errorf("%w: duplicate slot %q", ErrInvalidBundle, s.Name)
+		}
+		seen[s.Name] = true
+		if s.MinChoices < 0 || s.MaxChoices < s.MinChoices || s.MaxChoices == 0 {
+			return fmt.Errorf("%w: slot %q has invalid min/max choices", ErrInvalidBundle, s.Name)
+		}
+		if len(s.Options) == 0 {
+			return fmt.Errorf("%w: slot %q has no options", ErrInvalidBundle, s.Name)
+		}
+	}
+	return nil
+}
+
+// saveBundleSlots 在保存商品的事务中用给定的选择位整体替换套餐原有的选择位，slots 为空时清空
+func saveBundleSlots(tx *sql.Tx, bundleID, storeID int, slots []BundleSlot) error {
+	_, err := tx.Exec("DELETE o FROM bundle_slot_options o JOIN bundle_slots s ON s.id = o.slot_id WHERE s.bundle_id = ?", bundleID)
+	if err != nil {
+		return fmt.Errorf("deleting bundle options: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM bundle_slots WHERE bundle_id = ?", bundleID); err != nil {
+		return fmt.Errorf("deleting bundle slots: %w", err)
+	}
+
+	for _, s := range slots {
+		res, err := tx.Exec("INSERT INTO bundle_slots (bundle_id, name, sort_order, min_choices, max_choices) VALUES (?, ?, ?, ?, ?)",
+			bundleID, s.Name, s.SortOrder, s.MinChoices, s.MaxChoices)
+		if err != nil {
+			return fmt.Errorf("inserting bundle slot: %w", err)
+		}
+		slotID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		for _, o := range s.Options {
+			productID := o.ProductID
+			if productID == 0 {
+				if err := tx.QueryRow("SELECT id FROM products WHERE name = ? AND store_id = ? AND deleted_at IS NULL", o.ProductName, storeID).Scan(&productID); err != nil {
+					if err == sql.ErrNoRows {
+						return fmt.Errorf("%w: component %q not found", ErrInvalidBundle, o.ProductName)
+					}
+					return err
+				}
+			}
+			if productID == bundleID {
+				return fmt.Errorf("%w: bundle cannot contain itself", ErrInvalidBundle)
+			}
+			_, err := tx.Exec("INSERT INTO bundle_slot_options (slot_id, product_id, extra_price) VALUES (?, ?, ?)",
+				slotID, productID, o.ExtraPrice)
+			if err != nil {
+				return fmt.Errorf("inserting bundle option: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchBundleSlots 返回各套餐的选择位，键为套餐ID
+func fetchBundleSlots() (map[int][]BundleSlot, error) {
+	rows, err := db.Query(`SELECT s.bundle_id, s.id, s.name, s.sort_order, s.min_choices, s.max_choices,
+			o.id, o.product_id, p.name, o.extra_price
+		FROM bundle_slots s
+		JOIN bundle_slot_options o ON o.slot_id = s.id
+		JOIN products p ON p.id = o.product_id AND p.deleted_at IS NULL
+		ORDER BY s.bundle_id, s.sort_order, s.id, o.id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query bundle slots: %w", err)
+	}
+	defer rows.Close()
+
+	slots := make(map[int][]BundleSlot)
+	for rows.Next() {
+		var bundleID int
+		var s BundleSlot
+		var o BundleOption
+		if err := rows.Scan(&bundleID, &s.ID, &s.Name, &s.SortOrder, &s.MinChoices, &s.MaxChoices,
+			&o.ID, &o.ProductID, &o.ProductName, &o.ExtraPrice); err != nil {
+			return nil, fmt.Errorf("failed to scan bundle slot: %w", err)
+		}
+
+		list := slots[bundleID]
+		if n := len(list); n > 0 && list[n-1].ID == s.ID {
+			list[n-1].Options = append(list[n-1].Options, o)
+		} else {
+			s.Options = []BundleOption{o}
+			list = append(list, s)
+		}
+		slots[bundleID] = list
+	}
+	return slots, rows.Err()
+}
+
+// attachBundleSlots 为列表中的套餐商品填充选择位
+func attachBundleSlots(products []Product) error {
+	slots, err := fetchBundleSlots()
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		if products[i].IsBundle {
+			products[i].Slots = slots[products[i].ID]
+		}
+	}
+	return nil
+}
+
+// LookupBundle 按名称查找门店的套餐，名称对应的不是套餐时返回 nil
+func LookupBundle(storeID int, name string) (*Product, error) {
+	var p Product
+	err := db.QueryRow("SELECT id, name, price FROM products WHERE name = ? AND store_id = ? AND is_bundle = 1 AND deleted_at IS NULL", name, storeID).Scan(&p.ID, &p.Name, &p.Price)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	slots, err := fetchBundleSlots()
+	if err != nil {
+		return nil, err
+	}
+	p.IsBundle = true
+	p.Slots = slots[p.ID]
+	return &p, nil
+}
+
+// PriceChoices 校验套餐的选择，返回套餐单价（基础价加各选项加价）以及补全加价后的选择；
+// 只有一个选项的必选选择位在未选择时自动补上
+func (p Product) PriceChoices(choices []BundleChoice) (float64, []BundleChoice, error) {
+	bySlot := make(map[string][]BundleChoice)
+	for _, c := range choices {
+		if c.Quantity <= 0 {
+			c.Quantity = 1
+		}
+		bySlot[c.Slot] = append(bySlot[c.Slot], c)
+	}
+
+	price := p.Price
+	var resolved []BundleChoice
+	for _, s := range p.Slots {
+		picked := bySlot[s.Name]
+		delete(bySlot, s.Name)
+		if len(picked) == 0 && s.MinChoices > 0 && len(s.Options) == 1 {
+			picked = []BundleChoice{{Slot: s.Name, Product: s.Options[0].ProductName, Quantity: s.MinChoices}}
+		}
+
+		count := 0
+		for _, c := range picked {
+			option, ok := findOption(s, c.Product)
+			if !ok {
+				return 0, nil, fmt.Errorf("%w: %q is not an option of %q", ErrInvalidBundle, c.Product, s.Name)
+			}
+			c.ExtraPrice = option.ExtraPrice
+			price += option.ExtraPrice * float64(c.Quantity)
+			count += c.Quantity
+			resolved = append(resolved, c)
+		}
+		if count < s.MinChoices || count > s.MaxChoices {
+			return 0, nil, fmt.Errorf("%w: %q requires %d-%d choices", ErrInvalidBundle, s.Name, s.MinChoices, s.MaxChoices)
+		}
+	}
+	for slot := range bySlot {
+		return 0, nil, fmt.Errorf("%w: unknown slot %q", ErrInvalidBundle, slot)
+	}
+
+	return price, resolved, nil
+}
+
+func findOption(s BundleSlot, productName string) (BundleOption, bool) {
+	for _, o := range s.Options {
+		if o.ProductName == productName {
+			return o, true
+		}
+	}
+	return BundleOption{}, false
+}
@@ -0,0 +1,352 @@
+package product
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/i18n"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrUnknownCategory 表示商品引用了不存在的分类
+	ErrUnknownCategory = errors.New("unknown category")
+	// ErrCategoryInUse 表示分类下仍有商品，不能删除
+	ErrCategoryInUse = errors.New("category is still used by products")
+	// ErrCategoryExists 表示已有同名分类
+	ErrCategoryExists = errors.New("category name already exists")
+	// ErrCategoryNotFound 表示分类不存在
+	ErrCategoryNotFound = errors.New("category not found")
+)
+
+// Category 菜单分类
+type Category struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	SortOrder int    `json:"sortOrder"`
+	Icon      string `json:"icon"`
+	Active    bool   `json:"active"`
+	StartTime string `json:"startTime"` // 每日开始供应时间，格式 15:04，为空表示全天
+	EndTime   string `json:"endTime"`   // 每日结束供应时间，格式 15:04，为空表示全天
+	// LocalizedName 请求非中文时的译文，Name 保持原文以便后台编辑后原样保存
+	LocalizedName string `json:"localizedName,omitempty"`
+}
+
+// CategoryGroup 按分类分组的商品列表
+type CategoryGroup struct {
+	Category Category  `json:"category"`
+	Products []Product `json:"products"`
+}
+
+const clockLayout = "15:04"
+
+// migrateCategories 创建分类表，并把商品上已有的分类字符串迁移为分类记录
+func migrateCategories() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS categories (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(64) NOT NULL UNIQUE,
+		sort_order INT NOT NULL DEFAULT 0,
+		icon VARCHAR(255) NOT NULL DEFAULT '',
+		active TINYINT(1) NOT NULL DEFAULT 1,
+		start_time VARCHAR(5) NOT NULL DEFAULT '',
+		end_time VARCHAR(5) NOT NULL DEFAULT ''
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating categories table: %w", err)
+	}
+
+	if err := utils.EnsureColumn(db, "products", "category_id", "INT NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// 已有的分类字符串去重后写入分类表，再回填商品的分类ID
+	_, err = db.Exec(`INSERT IGNORE INTO categories (name)
+		SELECT DISTINCT TRIM(category) FROM products WHERE category IS NOT NULL AND TRIM(category) <> ''`)
+	if err != nil {
+		return fmt.Errorf("migrating category names: %w", err)
+	}
+	_, err = db.Exec(`UPDATE products p JOIN categories c ON c.name = TRIM(p.category)
+		SET p.category_id = c.id WHERE p.category_id = 0`)
+	if err != nil {
+		return fmt.Errorf("linking products to categories: %w", err)
+	}
+
+	return nil
+}
+
+// OpenAt 判断分类在给定时间是否处于供应时段
+func (c Category) OpenAt(t time.Time) bool {
+	if !c.Active {
+		return false
+	}
+	return utils.InClockRange(t.Format(clockLayout), c.StartTime, c.EndTime)
+}
+
+func validateCategory(c Category) error {
+	if c.Name == "" {
+		return errors.New("category name is required")
+	}
+	return validateClockRange(c.StartTime, c.EndTime)
+}
+
+// FetchCategories 按排序返回全部分类
+func FetchCategories() ([]Category, error) {
+	rows, err := db.Query("SELECT id, name, sort_order, icon, active, start_time, end_time FROM categories ORDER BY sort_order, id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query categories: %w", err)
+	}
+	defer rows.Close()
+
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name, &c.SortOrder, &c.Icon, &c.Active, &c.StartTime, &c.EndTime); err != nil {
+			return nil, fmt.Errorf("failed to scan category: %w", err)
+		}
+		categories = append(categories, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error after scanning categories: %w", err)
+	}
+
+	return categories, nil
+}
+
+func AddCategory(c *Category) error {
+	if err := validateCategory(*c); err != nil {
+		return err
+	}
+
+	res, err := db.Exec("INSERT INTO categories (name, sort_order, icon, active, start_time, end_time) VALUES (?, ?, ?, ?, ?, ?)",
+		c.Name, c.SortOrder, c.Icon, c.Active, c.StartTime, c.EndTime)
+	if utils.IsDuplicateKey(err) {
+		return fmt.Errorf("%w: %s", ErrCategoryExists, c.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("inserting category: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	c.ID = int(id)
+	return nil
+}
+
+// UpdateCategory 更新分类，并同步商品上冗余保存的分类名称；分类不存在时返回 ErrCategoryNotFound
+func UpdateCategory(c Category) error {
+	if err := validateCategory(c); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE categories SET name = ?, sort_order = ?, icon = ?, active = ?, start_time = ?, end_time = ? WHERE id = ?",
+		c.Name, c.SortOrder, c.Icon, c.Active, c.StartTime, c.EndTime, c.ID)
+	if utils.IsDuplicateKey(err) {
+		return fmt.Errorf("%w: %s", ErrCategoryExists, c.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("updating category: %w", err)
+	}
+	// 内容没有变化时影响行数也为0，需要确认分类是否存在
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", c.ID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %d", ErrCategoryNotFound, c.ID)
+		}
+	}
+	if _, err := tx.Exec("UPDATE products SET category = ? WHERE category_id = ?", c.Name, c.ID); err != nil {
+		return fmt.Errorf("renaming product category: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// DeleteCategory 删除分类，仍有商品使用时拒绝删除
+func DeleteCategory(id int) error {
+	var used int
+	if err := db.QueryRow("SELECT COUNT(*) FROM products WHERE category_id = ? AND deleted_at IS NULL", id).Scan(&used); err != nil {
+		return err
+	}
+	if used > 0 {
+		return fmt.Errorf("%w: %d products", ErrCategoryInUse, used)
+	}
+
+	_, err := db.Exec("DELETE FROM categories WHERE id = ?", id)
+	return err
+}
+
+// resolveCategory 校验商品的分类，并把分类ID与名称补全
+func resolveCategory(p *Product) error {
+	var err error
+	switch {
+	case p.CategoryID > 0:
+		err = db.QueryRow("SELECT name FROM categories WHERE id = ?", p.CategoryID).Scan(&p.Category)
+	case p.Category != "":
+		err = db.QueryRow("SELECT id FROM categories WHERE name = ?", p.Category).Scan(&p.CategoryID)
+	default:
+		return nil
+	}
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %v %q", ErrUnknownCategory, p.CategoryID, p.Category)
+	}
+	return err
+}
+
+// FetchProductMenu 返回门店按分类排序分组且满足筛选条件的商品，all 为 false 时只包含当前供应中的分类和商品
+func FetchProductMenu(storeID int, all bool, now time.Time, filter DietaryFilter) ([]CategoryGroup, error) {
+	now = now.In(config.Location())
+
+	categories, err := FetchCategories()
+	if err != nil {
+		return nil, err
+	}
+	products, err := FetchProducts(storeID)
+	if err != nil {
+		return nil, err
+	}
+	a, err := loadAvailability()
+	if err != nil {
+		return nil, err
+	}
+	if err := attachBundleSlots(products); err != nil {
+		return nil, err
+	}
+
+	byCategory := make(map[int][]Product)
+	for _, p := range products {
+		if !all && !a.open(TargetProduct, p.ID, now) {
+			continue
+		}
+		if !filter.Matches(p) {
+			continue
+		}
+		byCategory[p.CategoryID] = append(byCategory[p.CategoryID], p)
+	}
+
+	groups := []CategoryGroup{}
+	for _, c := range categories {
+		if !all && (!c.OpenAt(now) || !a.open(TargetCategory, c.ID, now)) {
+			continue
+		}
+		if len(byCategory[c.ID]) == 0 {
+			continue
+		}
+		groups = append(groups, CategoryGroup{Category: c, Products: byCategory[c.ID]})
+	}
+	// 未分类的商品放在最后
+	if len(byCategory[0]) > 0 {
+		groups = append(groups, CategoryGroup{Category: Category{Name: "其他", Active: true}, Products: byCategory[0]})
+	}
+
+	return groups, nil
+}
+
+// HandleCategories 请求体为空时返回全部分类，否则根据是否带ID添加或更新分类；
+// 分类为各门店共用，添加和修改仅店主可用
+func HandleCategories(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(body) == 0 {
+		categories, err := FetchCategories()
+		if err == nil {
+			err = LocalizeCategories(categories, i18n.RequestLocale(r))
+		}
+		if err != nil {
+			log.Printf("Failed to fetch categories: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(categories)
+		return
+	}
+
+	if !store.RequireOwner(w, r) {
+		return
+	}
+	var c Category
+	if err := json.Unmarshal(body, &c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateCategory(c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if c.ID > 0 {
+		err = UpdateCategory(c)
+	} else {
+		err = AddCategory(&c)
+	}
+	if errors.Is(err, ErrCategoryExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ErrCategoryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save category: %v", err)
+		http.Error(w, "Failed to save category", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(c)
+}
+
+// HandleDeleteCategory 处理删除分类的请求，仅店主可用
+func HandleDeleteCategory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !store.RequireOwner(w, r) {
+		return
+	}
+
+	var c Category
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := DeleteCategory(c.ID); err != nil {
+		if errors.Is(err, ErrCategoryInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Failed to delete category: %v", err)
+		http.Error(w, "Failed to delete category", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Category deleted successfully"))
+}
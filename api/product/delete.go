@@ -1,11 +1,23 @@
 package product
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"gocode/first/api/store"
+	"gocode/first/utils"
+	"log"
 	"net/http"
 )
 
+// ErrNameInUse 表示恢复的商品与现有商品重名
+var ErrNameInUse = errors.New("an active product already uses this name")
+
+func migrateSoftDelete() error {
+	return utils.EnsureColumn(db, "products", "deleted_at", "DATETIME NULL")
+}
+
 // HandleDeleteProduct 处理删除商品的HTTP请求
 func HandleDeleteProduct(w http.ResponseWriter, r *http.Request) {
 	// 仅允许POST方法
@@ -14,15 +26,27 @@ func HandleDeleteProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 假设请求的body包含要删除的商品信息，例如 {"name": "ProductName"}
+	// 请求的body包含要删除的商品ID，例如 {"id": 1}
 	var product Product
 	err := json.NewDecoder(r.Body).Decode(&product)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if product.ID <= 0 {
+		http.Error(w, "Missing product id", http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
 
-	err = DeleteProductByName(product.Name)
+	err = DeleteProductByID(storeID, product.ID)
+	if errors.Is(err, ErrProductNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to delete product", http.StatusInternalServerError)
 		return
@@ -32,20 +56,92 @@ func HandleDeleteProduct(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Product deleted successfully"))
 }
 
-// DeleteProductByName 从数据库中删除一个产品
-func DeleteProductByName(name string) error {
-	// 准备SQL语句
-	stmt, err := db.Prepare("DELETE FROM products WHERE name = ?")
+// DeleteProductByID 将门店的商品移入归档，历史订单仍可引用；商品不存在、已归档或不属于该门店时返回 ErrProductNotFound
+func DeleteProductByID(storeID, id int) error {
+	res, err := db.Exec("UPDATE products SET deleted_at = NOW() WHERE id = ? AND store_id = ? AND deleted_at IS NULL", id, storeID)
 	if err != nil {
-		return fmt.Errorf("error preparing delete statement: %w", err)
+		return fmt.Errorf("error archiving product: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrProductNotFound
 	}
-	defer stmt.Close()
 
-	// 执行SQL语句
-	_, err = stmt.Exec(name)
+	return nil
+}
+
+// RestoreProduct 从归档中恢复门店的商品，已不存在的分类会被清空；门店没有该归档商品时返回 ErrProductNotFound
+func RestoreProduct(storeID, id int) error {
+	var name string
+	err := db.QueryRow("SELECT name FROM products WHERE id = ? AND store_id = ? AND deleted_at IS NOT NULL", id, storeID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return ErrProductNotFound
+	}
 	if err != nil {
-		return fmt.Errorf("error executing delete statement: %w", err)
+		return err
 	}
 
-	return nil
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE name = ? AND store_id = ? AND deleted_at IS NULL)", name, storeID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: %s", ErrNameInUse, name)
+	}
+
+	_, err = db.Exec(`UPDATE products p LEFT JOIN categories c ON c.id = p.category_id
+		SET p.deleted_at = NULL, p.category_id = COALESCE(c.id, 0), p.category = COALESCE(c.name, '')
+		WHERE p.id = ? AND p.store_id = ?`, id, storeID)
+	return err
+}
+
+// FetchArchivedProducts 返回门店已归档的商品
+func FetchArchivedProducts(storeID int) ([]Product, error) {
+	return queryProducts("SELECT "+productColumns+" FROM products WHERE deleted_at IS NOT NULL AND store_id = ? ORDER BY deleted_at DESC", storeID)
+}
+
+// HandleArchivedProducts 返回已归档商品列表
+func HandleArchivedProducts(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	products, err := FetchArchivedProducts(storeID)
+	if err != nil {
+		log.Printf("Error fetching archived products: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(products)
+}
+
+// HandleRestoreProduct 根据ID恢复已归档的商品
+func HandleRestoreProduct(w http.ResponseWriter, r *http.Request) {
+	var product Product
+	if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	if err := RestoreProduct(storeID, product.ID); err != nil {
+		if errors.Is(err, ErrNameInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrProductNotFound) {
+			http.Error(w, "Archived product not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error restoring product %d: %v", product.ID, err)
+		http.Error(w, "Failed to restore product", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Product restored successfully"))
 }
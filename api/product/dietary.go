@@ -0,0 +1,227 @@
+package product
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/utils"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidDietary 表示过敏原、饮食标签或辣度不合法
+var ErrInvalidDietary = errors.New("invalid dietary information")
+
+// AllergenLabels 支持的过敏原标签及其中文名称，后厨小票上打印中文名称
+var AllergenLabels = map[string]string{
+	"dairy":     "乳制品",
+	"egg":       "蛋类",
+	"gluten":    "麸质",
+	"nuts":      "坚果",
+	"peanut":    "花生",
+	"soy":       "大豆",
+	"sesame":    "芝麻",
+	"fish":      "鱼类",
+	"shellfish": "甲壳类",
+}
+
+// DietaryLabels 支持的饮食标签及其中文名称
+var DietaryLabels = map[string]string{
+	"vegetarian": "素食",
+	"vegan":      "纯素",
+	"halal":      "清真",
+}
+
+// MaxSpicyLevel 最高辣度，0 表示不辣
+const MaxSpicyLevel = 3
+
+// Nutrition 每份的营养成分，能量单位为千卡，其余为克，钠为毫克
+type Nutrition struct {
+	Calories float64 `json:"calories"`
+	Protein  float64 `json:"protein"`
+	Fat      float64 `json:"fat"`
+	Carbs    float64 `json:"carbs"`
+	Sugar    float64 `json:"sugar"`
+	Sodium   float64 `json:"sodium"`
+}
+
+func migrateDietary() error {
+	columns := []struct{ name, definition string }{
+		{"allergens", "TEXT NULL"},
+		{"dietary", "TEXT NULL"},
+		{"spicy_level", "INT NOT NULL DEFAULT 0"},
+		{"nutrition", "TEXT NULL"},
+	}
+	for _, c := range columns {
+		if err := utils.EnsureColumn(db, "products", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeTags 将标签转为小写并去重，遇到不在 known 中的标签时返回错误
+func normalizeTags(tags []string, known map[string]string, kind string) ([]string, error) {
+	seen := make(map[string]bool)
+	out := []string{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		if _, ok := known[t]; !ok {
+			return nil, fmt.Errorf("%w: unknown %s %q", ErrInvalidDietary, kind, t)
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// validateDietary 校验并规范商品的过敏原、饮食标签、辣度与营养成分
+func validateDietary(p *Product) error {
+	var err error
+	if p.Allergens, err = normalizeTags(p.Allergens, AllergenLabels, "allergen"); err != nil {
+		return err
+	}
+	if p.Dietary, err = normalizeTags(p.Dietary, DietaryLabels, "dietary label"); err != nil {
+		return err
+	}
+	if p.SpicyLevel < 0 || p.SpicyLevel > MaxSpicyLevel {
+		return fmt.Errorf("%w: spicy level must be 0-%d", ErrInvalidDietary, MaxSpicyLevel)
+	}
+	if n := p.Nutrition; n != nil {
+		if n.Calories < 0 || n.Protein < 0 || n.Fat < 0 || n.Carbs < 0 || n.Sugar < 0 || n.Sodium < 0 {
+			return fmt.Errorf("%w: nutrition values cannot be negative", ErrInvalidDietary)
+		}
+	}
+	return nil
+}
+
+// dietaryValues 返回写入数据库的过敏原、饮食标签与营养成分，没有营养成分时为 NULL
+func dietaryValues(p Product) (allergens, dietary []byte, nutrition sql.NullString, err error) {
+	if allergens, err = json.Marshal(p.Allergens); err != nil {
+		return
+	}
+	if dietary, err = json.Marshal(p.Dietary); err != nil {
+		return
+	}
+	if p.Nutrition != nil {
+		var b []byte
+		if b, err = json.Marshal(p.Nutrition); err != nil {
+			return
+		}
+		nutrition = sql.NullString{String: string(b), Valid: true}
+	}
+	return
+}
+
+// scanDietary 解析从数据库读出的过敏原、饮食标签与营养成分
+func scanDietary(p *Product, allergens, dietary, nutrition sql.NullString) error {
+	p.Allergens = []string{}
+	p.Dietary = []string{}
+	if allergens.Valid && allergens.String != "" {
+		if err := json.Unmarshal([]byte(allergens.String), &p.Allergens); err != nil {
+			return err
+		}
+	}
+	if dietary.Valid && dietary.String != "" {
+		if err := json.Unmarshal([]byte(dietary.String), &p.Dietary); err != nil {
+			return err
+		}
+	}
+	if nutrition.Valid && nutrition.String != "" {
+		p.Nutrition = &Nutrition{}
+		if err := json.Unmarshal([]byte(nutrition.String), p.Nutrition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DietaryFilter 按过敏原、饮食标签与辣度筛选商品
+type DietaryFilter struct {
+	ExcludeAllergens []string // 不能含有的过敏原
+	Dietary          []string // 必须全部满足的饮食标签
+	MaxSpicy         int      // 最高辣度，小于0表示不限
+}
+
+// parseDietaryFilter 从URL参数 excludeAllergens、dietary（逗号分隔）与 maxSpicy 解析筛选条件
+func parseDietaryFilter(v url.Values) (DietaryFilter, error) {
+	f := DietaryFilter{MaxSpicy: -1}
+
+	var err error
+	if f.ExcludeAllergens, err = normalizeTags(strings.Split(v.Get("excludeAllergens"), ","), AllergenLabels, "allergen"); err != nil {
+		return f, err
+	}
+	if f.Dietary, err = normalizeTags(strings.Split(v.Get("dietary"), ","), DietaryLabels, "dietary label"); err != nil {
+		return f, err
+	}
+	if s := v.Get("maxSpicy"); s != "" {
+		if f.MaxSpicy, err = strconv.Atoi(s); err != nil || f.MaxSpicy < 0 {
+			return f, fmt.Errorf("%w: maxSpicy %q", ErrInvalidDietary, s)
+		}
+	}
+	return f, nil
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches 判断商品是否满足筛选条件
+func (f DietaryFilter) Matches(p Product) bool {
+	for _, a := range f.ExcludeAllergens {
+		if containsTag(p.Allergens, a) {
+			return false
+		}
+	}
+	for _, d := range f.Dietary {
+		if !containsTag(p.Dietary, d) {
+			return false
+		}
+	}
+	return f.MaxSpicy < 0 || p.SpicyLevel <= f.MaxSpicy
+}
+
+// FetchAllergens 按商品名称返回门店含有过敏原的商品及其过敏原中文名称
+func FetchAllergens(storeID int, names []string) (map[string][]string, error) {
+	result := make(map[string][]string)
+	if len(names) == 0 {
+		return result, nil
+	}
+
+	query := "SELECT name, allergens FROM products WHERE deleted_at IS NULL AND store_id = ? AND name IN (?" + strings.Repeat(", ?", len(names)-1) + ")"
+	args := []any{storeID}
+	for _, n := range names {
+		args = append(args, n)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query allergens: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var allergens sql.NullString
+		if err := rows.Scan(&name, &allergens); err != nil {
+			return nil, fmt.Errorf("failed to scan allergens: %w", err)
+		}
+		var p Product
+		if err := scanDietary(&p, allergens, sql.NullString{}, sql.NullString{}); err != nil {
+			return nil, fmt.Errorf("invalid allergens of %q: %w", name, err)
+		}
+		for _, a := range p.Allergens {
+			result[name] = append(result[name], AllergenLabels[a])
+		}
+	}
+	return result, rows.Err()
+}
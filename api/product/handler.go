@@ -2,9 +2,13 @@ package product
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"gocode/first/api/i18n"
+	"gocode/first/api/store"
 	"io"
 	"net/http"
+	"time"
 )
 
 // HandleProducts 根据请求方法返回所有产品或根据POST请求的内容更新或添加产品
@@ -19,8 +23,25 @@ func HandleProducts(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if len(body) == 0 {
-			// 请求体为空，假设是获取并返回所有产品
-			products, err := FetchProducts()
+			// 请求体为空，按分类分组返回产品；all=true 时包含未上架或不在供应时段的分类，仅管理员可用
+			all := r.URL.Query().Get("all") == "true"
+			resolve := store.RequestStore
+			if all {
+				resolve = store.ManagedStore
+			}
+			storeID, ok := resolve(w, r)
+			if !ok {
+				return
+			}
+			filter, err := parseDietaryFilter(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			products, err := FetchProductMenu(storeID, all, time.Now(), filter)
+			if err == nil {
+				err = LocalizeMenu(products, i18n.RequestLocale(r))
+			}
 			if err != nil {
 				http.Error(w, "Server error", http.StatusInternalServerError)
 				return
@@ -29,16 +50,29 @@ func HandleProducts(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(products)
 		} else {
-			// 请求体不为空，解析产品信息进行添加或更新
+			// 请求体不为空，解析产品信息进行添加或更新，只能修改管理员自己门店的产品
+			storeID, ok := store.ManagedStore(w, r)
+			if !ok {
+				return
+			}
 			var p Product
 			if err := json.Unmarshal(body, &p); err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			p.StoreID = storeID
 
 			if p.ID > 0 {
 				// 更新产品
 				err := UpdateProduct(p)
+				if errors.Is(err, ErrProductNotFound) {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				if errors.Is(err, ErrUnknownCategory) || errors.Is(err, ErrInvalidBundle) || errors.Is(err, ErrInvalidDietary) {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
 				if err != nil {
 					http.Error(w, "Failed to update product", http.StatusInternalServerError)
 					return
@@ -48,7 +82,10 @@ func HandleProducts(w http.ResponseWriter, r *http.Request) {
 				fmt.Println(p)
 
 				err := AddProduct(p)
-
+				if errors.Is(err, ErrUnknownCategory) || errors.Is(err, ErrInvalidBundle) || errors.Is(err, ErrInvalidDietary) {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
 				if err != nil {
 					http.Error(w, "Failed to add product", http.StatusInternalServerError)
 					return
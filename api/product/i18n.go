@@ -0,0 +1,111 @@
+package product
+
+import (
+	"gocode/first/api/i18n"
+)
+
+// LocalizedProduct 商品在请求语言下的展示文本；商品原有字段保持中文原文，下单和库存仍按原文名称处理
+type LocalizedProduct struct {
+	Name         string   `json:"name"`
+	Category     string   `json:"category"`
+	Sizes        []string `json:"sizes"`
+	Temperatures []string `json:"temperatures"`
+	Addons       []string `json:"addons"`
+}
+
+// localizer 缓存一次请求所需的译文
+type localizer struct {
+	products   map[int]map[string]string
+	categories map[int]map[string]string
+	options    map[string]string
+}
+
+// newLocalizer 读取给定语言的译文，原文语言返回 nil
+func newLocalizer(locale string) (*localizer, error) {
+	if i18n.IsDefault(locale) {
+		return nil, nil
+	}
+
+	var l localizer
+	var err error
+	if l.products, err = i18n.Lookup(i18n.EntityProduct, locale); err != nil {
+		return nil, err
+	}
+	if l.categories, err = i18n.Lookup(i18n.EntityCategory, locale); err != nil {
+		return nil, err
+	}
+	if l.options, err = i18n.Options(locale); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (l *localizer) optionList(values []string) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = v
+		if t, ok := l.options[v]; ok && t != "" {
+			out[i] = t
+		}
+	}
+	return out
+}
+
+func (l *localizer) product(p *Product) {
+	if l == nil {
+		return
+	}
+	p.Localized = &LocalizedProduct{
+		Name:         i18n.Text(l.products, p.ID, "name", p.Name),
+		Category:     i18n.Text(l.categories, p.CategoryID, "name", p.Category),
+		Sizes:        l.optionList(p.Sizes),
+		Temperatures: l.optionList(p.Temperatures),
+		Addons:       l.optionList(p.Addons),
+	}
+}
+
+// category 填充分类名称的译文，原文保持不变
+func (l *localizer) category(c *Category) {
+	if l == nil {
+		return
+	}
+	c.LocalizedName = i18n.Text(l.categories, c.ID, "name", c.Name)
+}
+
+// LocalizeCategories 为分类填充给定语言的译文
+func LocalizeCategories(categories []Category, locale string) error {
+	l, err := newLocalizer(locale)
+	if err != nil {
+		return err
+	}
+	for i := range categories {
+		l.category(&categories[i])
+	}
+	return nil
+}
+
+func localizeSearchItems(items []SearchItem, locale string) error {
+	l, err := newLocalizer(locale)
+	if err != nil {
+		return err
+	}
+	for i := range items {
+		l.product(&items[i].Product)
+	}
+	return nil
+}
+
+// LocalizeMenu 为分组菜单中的分类和商品填充给定语言的译文
+func LocalizeMenu(groups []CategoryGroup, locale string) error {
+	l, err := newLocalizer(locale)
+	if err != nil {
+		return err
+	}
+	for i := range groups {
+		l.category(&groups[i].Category)
+		for j := range groups[i].Products {
+			l.product(&groups[i].Products[j])
+		}
+	}
+	return nil
+}
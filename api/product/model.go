@@ -3,15 +3,21 @@ package product
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"gocode/first/api/store"
 	"gocode/first/config"
 	"log"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
 var db *sql.DB
 
+// ErrProductNotFound 表示产品不存在、已归档或不属于该门店
+var ErrProductNotFound = errors.New("product not found")
+
 func init() {
 	var err error
 
@@ -31,22 +37,64 @@ func init() {
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+
+	if err = migrateSoftDelete(); err != nil {
+		log.Fatal("Failed to migrate products:", err)
+	}
+	if err = migrateCategories(); err != nil {
+		log.Fatal("Failed to migrate categories:", err)
+	}
+	if err = migrateSchedules(); err != nil {
+		log.Fatal("Failed to migrate schedules:", err)
+	}
+	if err = migrateBundles(); err != nil {
+		log.Fatal("Failed to migrate bundles:", err)
+	}
+	if err = migratePrices(); err != nil {
+		log.Fatal("Failed to migrate price history:", err)
+	}
+	if err = migrateDietary(); err != nil {
+		log.Fatal("Failed to migrate dietary information:", err)
+	}
+	// 商品按门店区分，分类在各门店间共用
+	if err = store.EnsureScoped(db, "products"); err != nil {
+		log.Fatal("Failed to migrate store scope:", err)
+	}
 }
 
 type Product struct {
-	ID           int      `json:"id"`
-	Name         string   `json:"name"`
-	Price        float64  `json:"price"`
-	ImageURL     string   `json:"imageUrl"`
-	Sizes        []string `json:"sizes"`
-	Temperatures []string `json:"temperatures"`
-	Addons       []string `json:"addons"`
-	Stock        int      `json:"stock"`
-	Category     string   `json:"category"`
+	ID           int          `json:"id"`
+	Name         string       `json:"name"`
+	Price        float64      `json:"price"`
+	ImageURL     string       `json:"imageUrl"`
+	Sizes        []string     `json:"sizes"`
+	Temperatures []string     `json:"temperatures"`
+	Addons       []string     `json:"addons"`
+	Stock        int          `json:"stock"`
+	Category     string       `json:"category"`
+	CategoryID   int          `json:"categoryId"`
+	IsBundle     bool         `json:"isBundle"`
+	Slots        []BundleSlot `json:"slots,omitempty"` // 套餐的选择位，仅套餐商品有
+	Allergens    []string     `json:"allergens"`       // 过敏原标签，见 AllergenLabels
+	Dietary      []string     `json:"dietary"`         // 饮食标签，见 DietaryLabels
+	SpicyLevel   int          `json:"spicyLevel"`      // 辣度 0-3
+	Nutrition    *Nutrition   `json:"nutrition,omitempty"`
+	StoreID      int          `json:"storeId"` // 所属门店
+
+	Localized *LocalizedProduct `json:"localized,omitempty"` // 请求非中文时的译文
+}
+
+// productColumns 商品的完整列，顺序与 queryProducts 的解析顺序一致
+const productColumns = "id, name, price, imageUrl, sizes, temperatures, addons, stock, category, category_id, is_bundle, allergens, dietary, spicy_level, nutrition, store_id"
+
+// FetchProducts 返回门店未归档的商品
+func FetchProducts(storeID int) ([]Product, error) {
+	return queryProducts("SELECT "+productColumns+" FROM products WHERE deleted_at IS NULL AND store_id = ?", storeID)
 }
 
-func FetchProducts() ([]Product, error) {
-	rows, err := db.Query("SELECT id, name, price, imageUrl, sizes, temperatures, addons, stock, category FROM products")
+// queryProducts 执行选出 productColumns 的查询并解析结果
+func queryProducts(query string, args ...any) ([]Product, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		log.Printf("Failed to execute query: %v", err)
 		return nil, fmt.Errorf("failed to execute query: %w", err)
@@ -58,8 +106,10 @@ func FetchProducts() ([]Product, error) {
 	for rows.Next() {
 		var p Product
 		var sizes, temperatures, addons string
+		var allergens, dietary, nutrition sql.NullString
 
-		if err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.ImageURL, &sizes, &temperatures, &addons, &p.Stock, &p.Category); err != nil {
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.ImageURL, &sizes, &temperatures, &addons, &p.Stock, &p.Category, &p.CategoryID, &p.IsBundle,
+			&allergens, &dietary, &p.SpicyLevel, &nutrition, &p.StoreID); err != nil {
 			log.Printf("Failed to scan product data: %v", err)
 			return nil, fmt.Errorf("failed to scan product data: %w", err)
 		}
@@ -76,6 +126,10 @@ func FetchProducts() ([]Product, error) {
 			log.Printf("Error unmarshalling addons for product ID %d: %v", p.ID, err)
 			continue // Optionally continue processing other products, ignoring the current one
 		}
+		if err := scanDietary(&p, allergens, dietary, nutrition); err != nil {
+			log.Printf("Error unmarshalling dietary information for product ID %d: %v", p.ID, err)
+			continue
+		}
 
 		products = append(products, p)
 	}
@@ -88,6 +142,22 @@ func FetchProducts() ([]Product, error) {
 	return products, nil
 }
 func AddProduct(p Product) error {
+	if err := resolveCategory(&p); err != nil {
+		return err
+	}
+	if p.IsBundle {
+		if err := validateBundleSlots(p.Slots); err != nil {
+			return err
+		}
+	}
+	if err := validateDietary(&p); err != nil {
+		return err
+	}
+	allergens, dietary, nutrition, err := dietaryValues(p)
+	if err != nil {
+		return err
+	}
+
 	sizes, err := json.Marshal(p.Sizes)
 	if err != nil {
 		return err
@@ -108,17 +178,55 @@ func AddProduct(p Product) error {
 		return err
 	}
 
-	stmt, err := db.Prepare("INSERT INTO products(id, name, price, imageUrl, sizes, temperatures, addons, stock, category) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	// 商品、价格历史和套餐选择位在同一个事务中保存
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	_, err = stmt.Exec(pID, p.Name, p.Price, p.ImageURL, sizes, temperatures, addons, p.Stock, p.Category)
-	return err
+	_, err = tx.Exec("INSERT INTO products("+productColumns+") VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		pID, p.Name, p.Price, p.ImageURL, sizes, temperatures, addons, p.Stock, p.Category, p.CategoryID, p.IsBundle,
+		allergens, dietary, p.SpicyLevel, nutrition, p.StoreID)
+	if err != nil {
+		return err
+	}
+	if err := recordPrice(tx, pID, p.Price, PriceSourceManual, time.Now()); err != nil {
+		return err
+	}
+	if p.IsBundle {
+		if err := saveBundleSlots(tx, pID, p.StoreID, p.Slots); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func UpdateProduct(p Product) error {
+	// 只能修改所属门店未归档的产品
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE id = ? AND store_id = ? AND deleted_at IS NULL)", p.ID, p.StoreID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrProductNotFound
+	}
+	if err := resolveCategory(&p); err != nil {
+		return err
+	}
+	if p.IsBundle {
+		if err := validateBundleSlots(p.Slots); err != nil {
+			return err
+		}
+	}
+	if err := validateDietary(&p); err != nil {
+		return err
+	}
+	allergens, dietary, nutrition, err := dietaryValues(p)
+	if err != nil {
+		return err
+	}
+
 	sizes, err := json.Marshal(p.Sizes)
 	if err != nil {
 		return err
@@ -134,14 +242,31 @@ func UpdateProduct(p Product) error {
 		return err
 	}
 
-	stmt, err := db.Prepare("UPDATE products SET name=?, price=?, imageUrl=?, sizes=?, temperatures=?, addons=?, stock=?, category=? WHERE id=?")
+	// 商品、价格历史和套餐选择位在同一个事务中保存
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	_, err = stmt.Exec(p.Name, p.Price, p.ImageURL, sizes, temperatures, addons, p.Stock, p.Category, p.ID)
-	return err
+	_, err = tx.Exec("UPDATE products SET name=?, price=?, imageUrl=?, sizes=?, temperatures=?, addons=?, stock=?, category=?, category_id=?, is_bundle=?, allergens=?, dietary=?, spicy_level=?, nutrition=? WHERE id=?",
+		p.Name, p.Price, p.ImageURL, sizes, temperatures, addons, p.Stock, p.Category, p.CategoryID, p.IsBundle,
+		allergens, dietary, p.SpicyLevel, nutrition, p.ID)
+	if err != nil {
+		return err
+	}
+	if err := recordPrice(tx, p.ID, p.Price, PriceSourceManual, time.Now()); err != nil {
+		return err
+	}
+	// 取消套餐时只清空原有选择位，不保存请求中的选择位
+	slots := p.Slots
+	if !p.IsBundle {
+		slots = nil
+	}
+	if err := saveBundleSlots(tx, p.ID, p.StoreID, slots); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func GetMaxID() (int, error) {
@@ -0,0 +1,386 @@
+package product
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/config"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	timestampLayout = "2006-01-02 15:04:05"
+
+	PriceSourceInitial   = "initial"
+	PriceSourceManual    = "manual"
+	PriceSourceImport    = "import"
+	PriceSourceScheduled = "scheduled"
+
+	PriceChangePending   = "pending"
+	PriceChangeApplied   = "applied"
+	PriceChangeCancelled = "cancelled"
+)
+
+// PriceRecord 商品价格历史中的一条记录，价格从 EffectiveAt 起生效
+type PriceRecord struct {
+	ID          int     `json:"id"`
+	ProductID   int     `json:"productId"`
+	Price       float64 `json:"price"`
+	EffectiveAt string  `json:"effectiveAt"`
+	Source      string  `json:"source"`
+}
+
+// PriceChange 计划在未来某个时间生效的调价
+type PriceChange struct {
+	ID          int     `json:"id"`
+	ProductID   int     `json:"productId"`
+	Price       float64 `json:"price"`
+	EffectiveAt string  `json:"effectiveAt"`
+	Status      string  `json:"status"`
+	CreatedAt   string  `json:"createdAt"`
+}
+
+// execQuerier 同时适用于 *sql.DB 与 *sql.Tx
+type execQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func migratePrices() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS product_price_history (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		product_id INT NOT NULL,
+		price DECIMAL(10, 2) NOT NULL,
+		effective_at DATETIME NOT NULL,
+		source VARCHAR(16) NOT NULL,
+		INDEX idx_product_time (product_id, effective_at)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating product_price_history table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS product_price_schedule (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		product_id INT NOT NULL,
+		price DECIMAL(10, 2) NOT NULL,
+		effective_at DATETIME NOT NULL,
+		status VARCHAR(16) NOT NULL DEFAULT 'pending',
+		created_at DATETIME NOT NULL,
+		applied_at DATETIME NULL,
+		INDEX idx_status_time (status, effective_at)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating product_price_schedule table: %w", err)
+	}
+
+	return nil
+}
+
+// SeedPriceHistory 没有历史记录的商品以当前价格作为起点；生效时间按门店时区记录，需在加载配置后调用
+func SeedPriceHistory() error {
+	_, err := db.Exec(`INSERT INTO product_price_history (product_id, price, effective_at, source)
+		SELECT p.id, p.price, ?, ? FROM products p
+		WHERE NOT EXISTS (SELECT 1 FROM product_price_history h WHERE h.product_id = p.id)`,
+		formatTimestamp(time.Now()), PriceSourceInitial)
+	if err != nil {
+		return fmt.Errorf("seeding price history: %w", err)
+	}
+	return nil
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.In(config.Location()).Format(timestampLayout)
+}
+
+// parseTimestamp 解析 RFC3339 或门店时区下的 2006-01-02 15:04:05 格式时间
+func parseTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(timestampLayout, s, config.Location())
+}
+
+// recordPrice 价格与最近一条历史不同时写入一条价格历史
+func recordPrice(q execQuerier, productID int, price float64, source string, at time.Time) error {
+	var last float64
+	err := q.QueryRow("SELECT price FROM product_price_history WHERE product_id = ? ORDER BY effective_at DESC, id DESC LIMIT 1", productID).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("querying last price: %w", err)
+	}
+	if err == nil && math.Abs(last-price) < 0.005 {
+		return nil
+	}
+
+	_, err = q.Exec("INSERT INTO product_price_history (product_id, price, effective_at, source) VALUES (?, ?, ?, ?)",
+		productID, price, formatTimestamp(at), source)
+	if err != nil {
+		return fmt.Errorf("recording price: %w", err)
+	}
+	return nil
+}
+
+// EffectivePrice 返回商品在给定时间生效的价格，早于第一条历史记录时返回最早的已知价格
+func EffectivePrice(productID int, at time.Time) (float64, error) {
+	var price float64
+	err := db.QueryRow("SELECT price FROM product_price_history WHERE product_id = ? AND effective_at <= ? ORDER BY effective_at DESC, id DESC LIMIT 1",
+		productID, formatTimestamp(at)).Scan(&price)
+	if err != sql.ErrNoRows {
+		return price, err
+	}
+
+	err = db.QueryRow("SELECT price FROM product_price_history WHERE product_id = ? ORDER BY effective_at, id LIMIT 1", productID).Scan(&price)
+	if err != sql.ErrNoRows {
+		return price, err
+	}
+	return price, db.QueryRow("SELECT price FROM products WHERE id = ?", productID).Scan(&price)
+}
+
+// FetchPriceHistory 返回商品的价格历史，按生效时间先后排序
+func FetchPriceHistory(productID int) ([]PriceRecord, error) {
+	rows, err := db.Query("SELECT id, product_id, price, effective_at, source FROM product_price_history WHERE product_id = ? ORDER BY effective_at, id", productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []PriceRecord{}
+	for rows.Next() {
+		var rec PriceRecord
+		if err := rows.Scan(&rec.ID, &rec.ProductID, &rec.Price, &rec.EffectiveAt, &rec.Source); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// FetchPriceChanges 返回商品的计划调价
+func FetchPriceChanges(productID int) ([]PriceChange, error) {
+	rows, err := db.Query("SELECT id, product_id, price, effective_at, status, created_at FROM product_price_schedule WHERE product_id = ? ORDER BY effective_at, id", productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []PriceChange{}
+	for rows.Next() {
+		var c PriceChange
+		if err := rows.Scan(&c.ID, &c.ProductID, &c.Price, &c.EffectiveAt, &c.Status, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// SchedulePriceChange 安排一次未来生效的调价
+func SchedulePriceChange(c *PriceChange) error {
+	at, err := parseTimestamp(c.EffectiveAt)
+	if err != nil {
+		return fmt.Errorf("invalid effectiveAt %q", c.EffectiveAt)
+	}
+	if !at.After(time.Now()) {
+		return errors.New("effectiveAt must be in the future")
+	}
+	if c.Price < 0 {
+		return errors.New("price must not be negative")
+	}
+	if err := validateTarget(TargetProduct, c.ProductID); err != nil {
+		return err
+	}
+
+	c.EffectiveAt = formatTimestamp(at)
+	c.CreatedAt = formatTimestamp(time.Now())
+	c.Status = PriceChangePending
+	res, err := db.Exec("INSERT INTO product_price_schedule (product_id, price, effective_at, status, created_at) VALUES (?, ?, ?, ?, ?)",
+		c.ProductID, c.Price, c.EffectiveAt, c.Status, c.CreatedAt)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	c.ID = int(id)
+	return err
+}
+
+// applyDuePriceChanges 执行所有已到生效时间的计划调价，价格历史按计划时间记录
+func applyDuePriceChanges(now time.Time) error {
+	rows, err := db.Query("SELECT id, product_id, price, effective_at FROM product_price_schedule WHERE status = ? AND effective_at <= ? ORDER BY effective_at, id",
+		PriceChangePending, formatTimestamp(now))
+	if err != nil {
+		return err
+	}
+	var due []PriceChange
+	for rows.Next() {
+		var c PriceChange
+		if err := rows.Scan(&c.ID, &c.ProductID, &c.Price, &c.EffectiveAt); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range due {
+		if err := applyPriceChange(c, now); err != nil {
+			log.Printf("Error applying price change %d: %v", c.ID, err)
+		}
+	}
+	return nil
+}
+
+func applyPriceChange(c PriceChange, now time.Time) error {
+	at, err := time.ParseInLocation(timestampLayout, c.EffectiveAt, config.Location())
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 只处理仍为待执行的记录，避免与取消操作冲突
+	res, err := tx.Exec("UPDATE product_price_schedule SET status = ?, applied_at = ? WHERE id = ? AND status = ?",
+		PriceChangeApplied, formatTimestamp(now), c.ID, PriceChangePending)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	if _, err := tx.Exec("UPDATE products SET price = ? WHERE id = ?", c.Price, c.ProductID); err != nil {
+		return err
+	}
+	if err := recordPrice(tx, c.ProductID, c.Price, PriceSourceScheduled, at); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RunPriceScheduler 按固定间隔执行到期的计划调价，应在单独的 goroutine 中运行
+func RunPriceScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := applyDuePriceChanges(time.Now()); err != nil {
+			log.Printf("Error applying scheduled price changes: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// HandlePriceHistory 返回商品的价格历史与计划调价，请求体为 {"id": 1}
+func HandlePriceHistory(w http.ResponseWriter, r *http.Request) {
+	var p Product
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	history, err := FetchPriceHistory(p.ID)
+	if err != nil {
+		log.Printf("Error fetching price history: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	changes, err := FetchPriceChanges(p.ID)
+	if err != nil {
+		log.Printf("Error fetching price changes: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"history":   history,
+		"scheduled": changes,
+	})
+}
+
+// HandleSchedulePriceChange 安排一次调价
+func HandleSchedulePriceChange(w http.ResponseWriter, r *http.Request) {
+	var c PriceChange
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := SchedulePriceChange(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// HandleCancelPriceChange 取消一次尚未执行的调价
+func HandleCancelPriceChange(w http.ResponseWriter, r *http.Request) {
+	var c PriceChange
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec("UPDATE product_price_schedule SET status = ? WHERE id = ? AND status = ?", PriceChangeCancelled, c.ID, PriceChangePending)
+	if err != nil {
+		log.Printf("Error cancelling price change: %v", err)
+		http.Error(w, "Failed to cancel price change", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Price change not found or already applied", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Price change cancelled successfully"))
+}
+
+// HandleEffectivePrice 返回商品在某一时间生效的价格，参数为 id 与 at（缺省为当前时间）
+func HandleEffectivePrice(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	productID, err := strconv.Atoi(query.Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	at := time.Now()
+	if v := query.Get("at"); v != "" {
+		if at, err = parseTimestamp(v); err != nil {
+			http.Error(w, "Invalid at", http.StatusBadRequest)
+			return
+		}
+	}
+
+	price, err := EffectivePrice(productID, at)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying effective price: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"productId": productID,
+		"at":        formatTimestamp(at),
+		"price":     price,
+	})
+}
@@ -3,14 +3,21 @@ package product
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"gocode/first/api/store"
 	"net/http"
+	"time"
 )
 
-// ResetProductInfo 更新数据库中的商品信息
+// ResetProductInfo 按名称更新门店的商品信息
 func ResetProductInfo(productData Product) error {
+	if err := resolveCategory(&productData); err != nil {
+		return err
+	}
+
 	// 构造一个更新SQL语句，包括category字段
-	query := `UPDATE products SET price = ?, sizes = ?, temperatures = ?, addons = ?, stock = ?, ImageUrl = ?, category = ? WHERE name = ?`
+	query := `UPDATE products SET price = ?, sizes = ?, temperatures = ?, addons = ?, stock = ?, ImageUrl = ?, category = ?, category_id = ? WHERE name = ? AND store_id = ? AND deleted_at IS NULL`
 
 	// 将slices转换为JSON字符串存储
 	sizes, err := json.Marshal(productData.Sizes)
@@ -29,11 +36,32 @@ func ResetProductInfo(productData Product) error {
 	}
 
 	// 执行SQL语句，包括category
-	_, err = db.Exec(query, productData.Price, sizes, temperatures, addons, productData.Stock, productData.ImageURL, productData.Category, productData.Name)
+	_, err = db.Exec(query, productData.Price, sizes, temperatures, addons, productData.Stock, productData.ImageURL, productData.Category, productData.CategoryID, productData.Name, productData.StoreID)
 	if err != nil {
 		return fmt.Errorf("updating product: %w", err)
 	}
 
+	// 为同名的每个商品记录价格变化
+	rows, err := db.Query("SELECT id FROM products WHERE name = ? AND store_id = ? AND deleted_at IS NULL", productData.Name, productData.StoreID)
+	if err != nil {
+		return fmt.Errorf("querying product ids: %w", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err := recordPrice(db, id, productData.Price, PriceSourceManual, time.Now()); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -50,9 +78,18 @@ func HandleResetProductInfo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	productData.StoreID = storeID
 
 	// 调用ResetProductInfo进行商品信息更新
 	if err := ResetProductInfo(productData); err != nil {
+		if errors.Is(err, ErrUnknownCategory) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, fmt.Sprintf("Error resetting product: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,508 @@
+package product
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnavailable 表示商品在下单时刻不在供应时段内
+var ErrUnavailable = errors.New("product is not available at this time")
+
+const (
+	TargetProduct  = "product"
+	TargetCategory = "category"
+)
+
+// Schedule 商品或分类的每周供应时段
+type Schedule struct {
+	ID         int    `json:"id"`
+	TargetType string `json:"targetType"` // product 或 category
+	TargetID   int    `json:"targetId"`
+	Days       []int  `json:"days"`      // 1-7 表示周一到周日，为空表示每天
+	StartTime  string `json:"startTime"` // 格式 15:04，为空表示全天
+	EndTime    string `json:"endTime"`
+}
+
+// ScheduleOverride 节假日等特殊日期的供应安排，优先于每周时段
+type ScheduleOverride struct {
+	ID         int    `json:"id"`
+	TargetType string `json:"targetType"`
+	TargetID   int    `json:"targetId"`
+	Date       string `json:"date"`   // 格式 2006-01-02
+	Closed     bool   `json:"closed"` // 当天停售
+	StartTime  string `json:"startTime"`
+	EndTime    string `json:"endTime"`
+	Note       string `json:"note"`
+}
+
+func migrateSchedules() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS availability_schedules (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		target_type VARCHAR(16) NOT NULL,
+		target_id INT NOT NULL,
+		days VARCHAR(32) NOT NULL DEFAULT '',
+		start_time VARCHAR(5) NOT NULL DEFAULT '',
+		end_time VARCHAR(5) NOT NULL DEFAULT '',
+		INDEX idx_target (target_type, target_id)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating availability_schedules table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS availability_overrides (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		target_type VARCHAR(16) NOT NULL,
+		target_id INT NOT NULL,
+		date DATE NOT NULL,
+		closed TINYINT(1) NOT NULL DEFAULT 0,
+		start_time VARCHAR(5) NOT NULL DEFAULT '',
+		end_time VARCHAR(5) NOT NULL DEFAULT '',
+		note VARCHAR(255) NOT NULL DEFAULT '',
+		INDEX idx_target_date (target_type, target_id, date)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating availability_overrides table: %w", err)
+	}
+
+	return nil
+}
+
+// isoWeekday 把 time.Weekday 转换为 1-7（周一到周日）
+func isoWeekday(t time.Time) int {
+	if t.Weekday() == time.Sunday {
+		return 7
+	}
+	return int(t.Weekday())
+}
+
+func (s Schedule) hasDay(day int) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// startsOn 判断时间是否落在当天开始的时段内
+func (s Schedule) startsOn(t time.Time) bool {
+	return s.hasDay(isoWeekday(t)) && utils.InSameDayPart(t.Format(clockLayout), s.StartTime, s.EndTime)
+}
+
+// carriesInto 判断时间是否落在前一天开始、跨过午夜的时段内
+func (s Schedule) carriesInto(t time.Time) bool {
+	// 前一天，周一的前一天为周日
+	return s.hasDay((isoWeekday(t)+5)%7+1) && utils.InCarryOver(t.Format(clockLayout), s.StartTime, s.EndTime)
+}
+
+// availability 一次性加载的供应规则，避免逐个商品查询数据库
+type availability struct {
+	schedules map[string][]Schedule
+	overrides map[string][]ScheduleOverride
+}
+
+func targetKey(targetType string, targetID int) string {
+	return targetType + ":" + strconv.Itoa(targetID)
+}
+
+func loadAvailability() (*availability, error) {
+	schedules, err := FetchSchedules()
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := FetchScheduleOverrides()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &availability{
+		schedules: make(map[string][]Schedule),
+		overrides: make(map[string][]ScheduleOverride),
+	}
+	for _, s := range schedules {
+		key := targetKey(s.TargetType, s.TargetID)
+		a.schedules[key] = append(a.schedules[key], s)
+	}
+	for _, o := range overrides {
+		key := targetKey(o.TargetType, o.TargetID)
+		a.overrides[key] = append(a.overrides[key], o)
+	}
+	return a, nil
+}
+
+// override 返回某天的特殊安排
+func (a *availability) override(key string, t time.Time) (ScheduleOverride, bool) {
+	date := t.Format("2006-01-02")
+	for _, o := range a.overrides[key] {
+		if o.Date == date {
+			return o, true
+		}
+	}
+	return ScheduleOverride{}, false
+}
+
+// open 判断某个商品或分类在给定时间是否供应：某天有特殊安排时以特殊安排为准，
+// 否则命中任一每周时段即可，没有配置任何时段的视为全天供应。
+// 跨午夜的时段（包括特殊安排）在次日凌晨仍按开始那天计算
+func (a *availability) open(targetType string, targetID int, t time.Time) bool {
+	key := targetKey(targetType, targetID)
+	schedules := a.schedules[key]
+	now := t.Format(clockLayout)
+
+	if o, ok := a.override(key, t.AddDate(0, 0, -1)); ok {
+		if !o.Closed && utils.InCarryOver(now, o.StartTime, o.EndTime) {
+			return true
+		}
+	} else {
+		for _, s := range schedules {
+			if s.carriesInto(t) {
+				return true
+			}
+		}
+	}
+
+	if o, ok := a.override(key, t); ok {
+		return !o.Closed && utils.InSameDayPart(now, o.StartTime, o.EndTime)
+	}
+	if len(schedules) == 0 {
+		return true
+	}
+	for _, s := range schedules {
+		if s.startsOn(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// productOpen 商品本身及其所属分类都在供应时才可售
+func (a *availability) productOpen(p Product, categories map[int]Category, t time.Time) bool {
+	if p.CategoryID > 0 {
+		c, ok := categories[p.CategoryID]
+		if !ok || !c.OpenAt(t) || !a.open(TargetCategory, c.ID, t) {
+			return false
+		}
+	}
+	return a.open(TargetProduct, p.ID, t)
+}
+
+// CheckAvailable 校验一组按名称给出的商品在给定时间是否都可售，
+// 不在商品表中的名称（例如特惠商品）不做限制
+func CheckAvailable(storeID int, names []string, t time.Time) error {
+	t = t.In(config.Location())
+
+	a, err := loadAvailability()
+	if err != nil {
+		return err
+	}
+	categories, err := categoryMap()
+	if err != nil {
+		return err
+	}
+	products, err := FetchProducts(storeID)
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]Product, len(products))
+	for _, p := range products {
+		byName[p.Name] = p
+	}
+	for _, name := range names {
+		p, ok := byName[name]
+		if !ok {
+			continue
+		}
+		if !a.productOpen(p, categories, t) {
+			return fmt.Errorf("%w: %s", ErrUnavailable, name)
+		}
+	}
+	return nil
+}
+
+func categoryMap() (map[int]Category, error) {
+	categories, err := FetchCategories()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[int]Category, len(categories))
+	for _, c := range categories {
+		m[c.ID] = c
+	}
+	return m, nil
+}
+
+func formatDays(days []int) string {
+	parts := make([]string, 0, len(days))
+	for _, d := range days {
+		parts = append(parts, strconv.Itoa(d))
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseDays(s string) []int {
+	days := []int{}
+	for _, part := range strings.Split(s, ",") {
+		if d, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			days = append(days, d)
+		}
+	}
+	return days
+}
+
+func validateClockRange(start, end string) error {
+	if (start == "") != (end == "") {
+		return errors.New("startTime and endTime must be set together")
+	}
+	for _, v := range []string{start, end} {
+		if v == "" {
+			continue
+		}
+		if _, err := time.Parse(clockLayout, v); err != nil {
+			return fmt.Errorf("invalid time %q, expected HH:MM", v)
+		}
+	}
+	return nil
+}
+
+// validateTarget 校验供应规则指向的商品或分类存在
+func validateTarget(targetType string, targetID int) error {
+	var table string
+	switch targetType {
+	case TargetProduct:
+		table = "products"
+	case TargetCategory:
+		table = "categories"
+	default:
+		return fmt.Errorf("invalid targetType %q", targetType)
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM "+table+" WHERE id = ?)", targetID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%s %d not found", targetType, targetID)
+	}
+	return nil
+}
+
+func validateSchedule(s Schedule) error {
+	for _, d := range s.Days {
+		if d < 1 || d > 7 {
+			return fmt.Errorf("invalid day %d, expected 1-7", d)
+		}
+	}
+	if err := validateClockRange(s.StartTime, s.EndTime); err != nil {
+		return err
+	}
+	return validateTarget(s.TargetType, s.TargetID)
+}
+
+func validateScheduleOverride(o ScheduleOverride) error {
+	if _, err := time.Parse("2006-01-02", o.Date); err != nil {
+		return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", o.Date)
+	}
+	if err := validateClockRange(o.StartTime, o.EndTime); err != nil {
+		return err
+	}
+	return validateTarget(o.TargetType, o.TargetID)
+}
+
+// FetchSchedules 返回全部每周供应时段
+func FetchSchedules() ([]Schedule, error) {
+	rows, err := db.Query("SELECT id, target_type, target_id, days, start_time, end_time FROM availability_schedules ORDER BY target_type, target_id, id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		var s Schedule
+		var days string
+		if err := rows.Scan(&s.ID, &s.TargetType, &s.TargetID, &days, &s.StartTime, &s.EndTime); err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		s.Days = parseDays(days)
+		schedules = append(schedules, s)
+	}
+	return schedules, rows.Err()
+}
+
+// FetchScheduleOverrides 返回全部特殊日期安排
+func FetchScheduleOverrides() ([]ScheduleOverride, error) {
+	rows, err := db.Query("SELECT id, target_type, target_id, DATE_FORMAT(date, '%Y-%m-%d'), closed, start_time, end_time, note FROM availability_overrides ORDER BY date, id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schedule overrides: %w", err)
+	}
+	defer rows.Close()
+
+	var overrides []ScheduleOverride
+	for rows.Next() {
+		var o ScheduleOverride
+		if err := rows.Scan(&o.ID, &o.TargetType, &o.TargetID, &o.Date, &o.Closed, &o.StartTime, &o.EndTime, &o.Note); err != nil {
+			return nil, fmt.Errorf("failed to scan schedule override: %w", err)
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+func SaveSchedule(s *Schedule) error {
+	if s.ID > 0 {
+		_, err := db.Exec("UPDATE availability_schedules SET target_type = ?, target_id = ?, days = ?, start_time = ?, end_time = ? WHERE id = ?",
+			s.TargetType, s.TargetID, formatDays(s.Days), s.StartTime, s.EndTime, s.ID)
+		return err
+	}
+
+	res, err := db.Exec("INSERT INTO availability_schedules (target_type, target_id, days, start_time, end_time) VALUES (?, ?, ?, ?, ?)",
+		s.TargetType, s.TargetID, formatDays(s.Days), s.StartTime, s.EndTime)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	s.ID = int(id)
+	return err
+}
+
+func SaveScheduleOverride(o *ScheduleOverride) error {
+	if o.ID > 0 {
+		_, err := db.Exec("UPDATE availability_overrides SET target_type = ?, target_id = ?, date = ?, closed = ?, start_time = ?, end_time = ?, note = ? WHERE id = ?",
+			o.TargetType, o.TargetID, o.Date, o.Closed, o.StartTime, o.EndTime, o.Note, o.ID)
+		return err
+	}
+
+	res, err := db.Exec("INSERT INTO availability_overrides (target_type, target_id, date, closed, start_time, end_time, note) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		o.TargetType, o.TargetID, o.Date, o.Closed, o.StartTime, o.EndTime, o.Note)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	o.ID = int(id)
+	return err
+}
+
+// HandleSchedules 请求体为空时返回全部供应时段，否则添加或更新一个时段
+func HandleSchedules(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(body) == 0 {
+		schedules, err := FetchSchedules()
+		if err != nil {
+			log.Printf("Failed to fetch schedules: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(schedules)
+		return
+	}
+
+	var s Schedule
+	if err := json.Unmarshal(body, &s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateSchedule(s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := SaveSchedule(&s); err != nil {
+		log.Printf("Failed to save schedule: %v", err)
+		http.Error(w, "Failed to save schedule", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(s)
+}
+
+// HandleDeleteSchedule 根据ID删除供应时段
+func HandleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	var s Schedule
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM availability_schedules WHERE id = ?", s.ID); err != nil {
+		log.Printf("Failed to delete schedule: %v", err)
+		http.Error(w, "Failed to delete schedule", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Schedule deleted successfully"))
+}
+
+// HandleScheduleOverrides 请求体为空时返回全部特殊日期安排，否则添加或更新一条
+func HandleScheduleOverrides(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(body) == 0 {
+		overrides, err := FetchScheduleOverrides()
+		if err != nil {
+			log.Printf("Failed to fetch schedule overrides: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(overrides)
+		return
+	}
+
+	var o ScheduleOverride
+	if err := json.Unmarshal(body, &o); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateScheduleOverride(o); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := SaveScheduleOverride(&o); err != nil {
+		log.Printf("Failed to save schedule override: %v", err)
+		http.Error(w, "Failed to save schedule override", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(o)
+}
+
+// HandleDeleteScheduleOverride 根据ID删除特殊日期安排
+func HandleDeleteScheduleOverride(w http.ResponseWriter, r *http.Request) {
+	var o ScheduleOverride
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM availability_overrides WHERE id = ?", o.ID); err != nil {
+		log.Printf("Failed to delete schedule override: %v", err)
+		http.Error(w, "Failed to delete schedule override", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Schedule override deleted successfully"))
+}
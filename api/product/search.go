@@ -0,0 +1,250 @@
+package product
+
+import (
+	"encoding/json"
+	"fmt"
+	"gocode/first/api/i18n"
+	"gocode/first/api/store"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mozillazg/go-pinyin"
+)
+
+// 搜索结果的排序方式
+const (
+	SortPopularity = "popularity"
+	SortPriceAsc   = "price_asc"
+	SortPriceDesc  = "price_desc"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// SearchQuery 商品搜索条件，零值字段表示不过滤
+type SearchQuery struct {
+	StoreID    int
+	Keyword    string
+	CategoryID int
+	MinPrice   float64
+	MaxPrice   float64
+	InStock    bool
+	Dietary    DietaryFilter
+	Sort       string
+	Page       int
+	PageSize   int
+}
+
+// SearchItem 搜索结果中的商品及其销量
+type SearchItem struct {
+	Product
+	Sales int `json:"sales"`
+}
+
+// SearchResult 分页后的搜索结果
+type SearchResult struct {
+	Total    int          `json:"total"`
+	Page     int          `json:"page"`
+	PageSize int          `json:"pageSize"`
+	Items    []SearchItem `json:"items"`
+}
+
+// parseSearchQuery 从URL参数解析搜索条件
+func parseSearchQuery(r *http.Request) (SearchQuery, error) {
+	v := r.URL.Query()
+	q := SearchQuery{
+		Keyword:  strings.TrimSpace(v.Get("q")),
+		InStock:  v.Get("inStock") == "true",
+		Sort:     v.Get("sort"),
+		Page:     1,
+		PageSize: defaultPageSize,
+	}
+
+	var err error
+	if q.Dietary, err = parseDietaryFilter(v); err != nil {
+		return q, err
+	}
+	if s := v.Get("categoryId"); s != "" {
+		if q.CategoryID, err = strconv.Atoi(s); err != nil {
+			return q, fmt.Errorf("invalid categoryId %q", s)
+		}
+	}
+	if s := v.Get("minPrice"); s != "" {
+		if q.MinPrice, err = strconv.ParseFloat(s, 64); err != nil {
+			return q, fmt.Errorf("invalid minPrice %q", s)
+		}
+	}
+	if s := v.Get("maxPrice"); s != "" {
+		if q.MaxPrice, err = strconv.ParseFloat(s, 64); err != nil {
+			return q, fmt.Errorf("invalid maxPrice %q", s)
+		}
+	}
+	if q.MaxPrice > 0 && q.MaxPrice < q.MinPrice {
+		return q, fmt.Errorf("maxPrice is less than minPrice")
+	}
+	if s := v.Get("page"); s != "" {
+		if q.Page, err = strconv.Atoi(s); err != nil || q.Page < 1 {
+			return q, fmt.Errorf("invalid page %q", s)
+		}
+	}
+	if s := v.Get("pageSize"); s != "" {
+		if q.PageSize, err = strconv.Atoi(s); err != nil || q.PageSize < 1 {
+			return q, fmt.Errorf("invalid pageSize %q", s)
+		}
+		if q.PageSize > maxPageSize {
+			q.PageSize = maxPageSize
+		}
+	}
+
+	switch q.Sort {
+	case "", SortPopularity, SortPriceAsc, SortPriceDesc:
+	default:
+		return q, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+
+	return q, nil
+}
+
+// pinyinKeys 返回名称的拼音全拼与首字母，例如“拿铁”返回 "natie" 与 "nt"，非汉字原样保留
+func pinyinKeys(name string) (string, string) {
+	var full, initials strings.Builder
+	args := pinyin.NewArgs()
+	for _, r := range strings.ToLower(name) {
+		if !unicode.Is(unicode.Han, r) {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				full.WriteRune(r)
+				initials.WriteRune(r)
+			}
+			continue
+		}
+		py := pinyin.SinglePinyin(r, args)
+		if len(py) == 0 || py[0] == "" {
+			continue
+		}
+		full.WriteString(py[0])
+		initials.WriteByte(py[0][0])
+	}
+	return full.String(), initials.String()
+}
+
+// matchKeyword 判断商品名称或分类是否包含关键字，关键字可以是中文、全拼或拼音首字母
+func matchKeyword(p Product, keyword string) bool {
+	keyword = strings.ToLower(keyword)
+	for _, text := range []string{p.Name, p.Category} {
+		if text == "" {
+			continue
+		}
+		if strings.Contains(strings.ToLower(text), keyword) {
+			return true
+		}
+		full, initials := pinyinKeys(text)
+		if strings.Contains(full, keyword) || strings.Contains(initials, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchSales 按商品名称汇总历史订单中的销量
+func fetchSales() (map[string]int, error) {
+	rows, err := db.Query("SELECT goods_name, SUM(goods_number) FROM orderDetails GROUP BY goods_name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sales: %w", err)
+	}
+	defer rows.Close()
+
+	sales := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var count int
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan sales: %w", err)
+		}
+		sales[name] = count
+	}
+	return sales, rows.Err()
+}
+
+// SearchProducts 按条件筛选、排序并分页返回商品
+func SearchProducts(q SearchQuery) (SearchResult, error) {
+	products, err := FetchProducts(q.StoreID)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	sales, err := fetchSales()
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	var items []SearchItem
+	for _, p := range products {
+		if q.CategoryID > 0 && p.CategoryID != q.CategoryID {
+			continue
+		}
+		if p.Price < q.MinPrice || (q.MaxPrice > 0 && p.Price > q.MaxPrice) {
+			continue
+		}
+		if q.InStock && p.Stock <= 0 {
+			continue
+		}
+		if !q.Dietary.Matches(p) {
+			continue
+		}
+		if q.Keyword != "" && !matchKeyword(p, q.Keyword) {
+			continue
+		}
+		items = append(items, SearchItem{Product: p, Sales: sales[p.Name]})
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		switch q.Sort {
+		case SortPriceAsc:
+			return items[i].Price < items[j].Price
+		case SortPriceDesc:
+			return items[i].Price > items[j].Price
+		default:
+			return items[i].Sales > items[j].Sales
+		}
+	})
+
+	result := SearchResult{Total: len(items), Page: q.Page, PageSize: q.PageSize, Items: []SearchItem{}}
+	start := (q.Page - 1) * q.PageSize
+	if start < len(items) {
+		end := min(start+q.PageSize, len(items))
+		result.Items = items[start:end]
+	}
+	return result, nil
+}
+
+// HandleSearchProducts 处理商品搜索请求，参数：q、categoryId、minPrice、maxPrice、inStock、
+// excludeAllergens、dietary、maxSpicy、sort、page、pageSize
+func HandleSearchProducts(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearchQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if q.StoreID, ok = store.RequestStore(w, r); !ok {
+		return
+	}
+
+	result, err := SearchProducts(q)
+	if err == nil {
+		err = localizeSearchItems(result.Items, i18n.RequestLocale(r))
+	}
+	if err != nil {
+		log.Printf("Failed to search products: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
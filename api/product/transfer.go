@@ -0,0 +1,445 @@
+package product
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gocode/first/api/store"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// transferColumns 导入导出文件的列，顺序即导出时的列顺序
+var transferColumns = []string{"id", "name", "price", "category", "imageUrl", "sizes", "temperatures", "addons", "stock"}
+
+// 多值字段在单元格中的分隔符
+const listSeparator = "|"
+
+// RowError 导入文件中某一行的校验错误，行号从1开始且包含表头
+type RowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// ProductChange 导入时一个将被更新的商品及其变化的字段
+type ProductChange struct {
+	Before Product  `json:"before"`
+	After  Product  `json:"after"`
+	Fields []string `json:"fields"`
+}
+
+// ImportResult 导入的校验结果与差异
+type ImportResult struct {
+	Errors  []RowError      `json:"errors"`
+	Creates []Product       `json:"creates"`
+	Updates []ProductChange `json:"updates"`
+	Deletes []Product       `json:"deletes"`
+	Applied bool            `json:"applied"`
+}
+
+func productRecord(p Product) []string {
+	return []string{
+		strconv.Itoa(p.ID),
+		p.Name,
+		strconv.FormatFloat(p.Price, 'f', 2, 64),
+		p.Category,
+		p.ImageURL,
+		strings.Join(p.Sizes, listSeparator),
+		strings.Join(p.Temperatures, listSeparator),
+		strings.Join(p.Addons, listSeparator),
+		strconv.Itoa(p.Stock),
+	}
+}
+
+// HandleExportProducts 导出全部商品，format 为 csv（默认）或 xlsx
+func HandleExportProducts(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	products, err := FetchProducts(storeID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	filename := "products-" + time.Now().Format("20060102")
+	switch r.URL.Query().Get("format") {
+	case "xlsx":
+		f := excelize.NewFile()
+		defer f.Close()
+		sheet := f.GetSheetName(0)
+		if err := f.SetSheetRow(sheet, "A1", &transferColumns); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i, p := range products {
+			cell, _ := excelize.CoordinatesToCellName(1, i+2)
+			record := productRecord(p)
+			if err := f.SetSheetRow(sheet, cell, &record); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.xlsx", filename))
+		if err := f.Write(w); err != nil {
+			log.Printf("Error writing xlsx export: %v", err)
+		}
+	default:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", filename))
+		// 写入 BOM，便于 Excel 正确识别中文
+		w.Write([]byte("\xEF\xBB\xBF"))
+		cw := csv.NewWriter(w)
+		cw.Write(transferColumns)
+		for _, p := range products {
+			cw.Write(productRecord(p))
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("Error writing csv export: %v", err)
+		}
+	}
+}
+
+// readImportRows 读取上传文件的全部行，第一行为表头
+func readImportRows(data []byte, format string) ([][]string, error) {
+	if format == "xlsx" {
+		f, err := excelize.OpenReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.GetRows(f.GetSheetName(0))
+	}
+
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	return cr.ReadAll()
+}
+
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, listSeparator) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseImportRow 把一行数据解析为商品，columns 为表头列名到下标的映射
+func parseImportRow(row []string, columns map[string]int, categories map[string]int) (Product, error) {
+	cell := func(name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	var p Product
+	var err error
+	if v := cell("id"); v != "" && v != "0" {
+		if p.ID, err = strconv.Atoi(v); err != nil {
+			return p, fmt.Errorf("invalid id %q", v)
+		}
+	}
+	if p.Name = cell("name"); p.Name == "" {
+		return p, fmt.Errorf("name is required")
+	}
+	if p.Price, err = strconv.ParseFloat(cell("price"), 64); err != nil || p.Price < 0 {
+		return p, fmt.Errorf("invalid price %q", cell("price"))
+	}
+	if p.Stock, err = strconv.Atoi(cell("stock")); err != nil || p.Stock < 0 {
+		return p, fmt.Errorf("invalid stock %q", cell("stock"))
+	}
+	if p.Category = cell("category"); p.Category != "" {
+		id, ok := categories[p.Category]
+		if !ok {
+			return p, fmt.Errorf("%w %q", ErrUnknownCategory, p.Category)
+		}
+		p.CategoryID = id
+	}
+	p.ImageURL = cell("imageUrl")
+	p.Sizes = splitList(cell("sizes"))
+	p.Temperatures = splitList(cell("temperatures"))
+	p.Addons = splitList(cell("addons"))
+	return p, nil
+}
+
+func sameList(a, b []string) bool {
+	return strings.Join(a, listSeparator) == strings.Join(b, listSeparator)
+}
+
+// changedFields 返回导入行相对现有商品发生变化的字段
+func changedFields(before, after Product) []string {
+	var fields []string
+	if before.Name != after.Name {
+		fields = append(fields, "name")
+	}
+	if math.Abs(before.Price-after.Price) > 0.005 {
+		fields = append(fields, "price")
+	}
+	if before.CategoryID != after.CategoryID {
+		fields = append(fields, "category")
+	}
+	if before.ImageURL != after.ImageURL {
+		fields = append(fields, "imageUrl")
+	}
+	if !sameList(before.Sizes, after.Sizes) {
+		fields = append(fields, "sizes")
+	}
+	if !sameList(before.Temperatures, after.Temperatures) {
+		fields = append(fields, "temperatures")
+	}
+	if !sameList(before.Addons, after.Addons) {
+		fields = append(fields, "addons")
+	}
+	if before.Stock != after.Stock {
+		fields = append(fields, "stock")
+	}
+	return fields
+}
+
+// DiffImport 校验导入的行并与门店现有商品比较，deleteMissing 为 true 时文件中没有的商品视为删除
+func DiffImport(storeID int, rows [][]string, deleteMissing bool) (*ImportResult, error) {
+	result := &ImportResult{Errors: []RowError{}, Creates: []Product{}, Updates: []ProductChange{}, Deletes: []Product{}}
+	if len(rows) == 0 {
+		result.Errors = append(result.Errors, RowError{Row: 1, Message: "file is empty"})
+		return result, nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"name", "price", "stock"} {
+		if _, ok := columns[required]; !ok {
+			result.Errors = append(result.Errors, RowError{Row: 1, Message: "missing column " + required})
+		}
+	}
+	if len(result.Errors) > 0 {
+		return result, nil
+	}
+
+	existing, err := FetchProducts(storeID)
+	if err != nil {
+		return nil, err
+	}
+	categoryList, err := FetchCategories()
+	if err != nil {
+		return nil, err
+	}
+	categories := make(map[string]int, len(categoryList))
+	for _, c := range categoryList {
+		categories[c.Name] = c.ID
+	}
+
+	byID := make(map[int]Product, len(existing))
+	byName := make(map[string]Product, len(existing))
+	for _, p := range existing {
+		byID[p.ID] = p
+		byName[p.Name] = p
+	}
+
+	seenNames := make(map[string]int)
+	matched := make(map[int]bool)
+	for i, row := range rows[1:] {
+		rowNum := i + 2
+		if len(strings.Join(row, "")) == 0 {
+			continue
+		}
+
+		p, err := parseImportRow(row, columns, categories)
+		if err != nil {
+			result.Errors = append(result.Errors, RowError{Row: rowNum, Message: err.Error()})
+			continue
+		}
+		if first, ok := seenNames[p.Name]; ok {
+			result.Errors = append(result.Errors, RowError{Row: rowNum, Message: fmt.Sprintf("duplicate name %q, first seen on row %d", p.Name, first)})
+			continue
+		}
+		seenNames[p.Name] = rowNum
+
+		var before Product
+		var found bool
+		if p.ID > 0 {
+			if before, found = byID[p.ID]; !found {
+				result.Errors = append(result.Errors, RowError{Row: rowNum, Message: fmt.Sprintf("product id %d not found", p.ID)})
+				continue
+			}
+		} else if before, found = byName[p.Name]; found {
+			p.ID = before.ID
+		}
+
+		if !found {
+			p.StoreID = storeID
+			result.Creates = append(result.Creates, p)
+			continue
+		}
+		if matched[p.ID] {
+			result.Errors = append(result.Errors, RowError{Row: rowNum, Message: fmt.Sprintf("product id %d appears more than once", p.ID)})
+			continue
+		}
+		matched[p.ID] = true
+		if other, ok := byName[p.Name]; ok && other.ID != p.ID {
+			result.Errors = append(result.Errors, RowError{Row: rowNum, Message: fmt.Sprintf("name %q is already used by product %d", p.Name, other.ID)})
+			continue
+		}
+		if fields := changedFields(before, p); len(fields) > 0 {
+			result.Updates = append(result.Updates, ProductChange{Before: before, After: p, Fields: fields})
+		}
+	}
+
+	if deleteMissing {
+		for _, p := range existing {
+			if !matched[p.ID] {
+				result.Deletes = append(result.Deletes, p)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// ApplyImport 在一个事务中执行导入的新增、更新与删除
+func ApplyImport(result *ImportResult) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var maxID int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM products").Scan(&maxID); err != nil {
+		return err
+	}
+
+	for _, p := range result.Creates {
+		sizes, temperatures, addons, err := marshalOptions(p)
+		if err != nil {
+			return err
+		}
+		maxID++
+		_, err = tx.Exec("INSERT INTO products(id, name, price, imageUrl, sizes, temperatures, addons, stock, category, category_id, store_id) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			maxID, p.Name, p.Price, p.ImageURL, sizes, temperatures, addons, p.Stock, p.Category, p.CategoryID, p.StoreID)
+		if err != nil {
+			return fmt.Errorf("inserting %s: %w", p.Name, err)
+		}
+		if err := recordPrice(tx, maxID, p.Price, PriceSourceImport, now); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range result.Updates {
+		p := c.After
+		sizes, temperatures, addons, err := marshalOptions(p)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE products SET name=?, price=?, imageUrl=?, sizes=?, temperatures=?, addons=?, stock=?, category=?, category_id=? WHERE id=?",
+			p.Name, p.Price, p.ImageURL, sizes, temperatures, addons, p.Stock, p.Category, p.CategoryID, p.ID)
+		if err != nil {
+			return fmt.Errorf("updating %s: %w", p.Name, err)
+		}
+		if err := recordPrice(tx, p.ID, p.Price, PriceSourceImport, now); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range result.Deletes {
+		if _, err := tx.Exec("UPDATE products SET deleted_at = NOW() WHERE id = ?", p.ID); err != nil {
+			return fmt.Errorf("deleting %s: %w", p.Name, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func marshalOptions(p Product) (sizes, temperatures, addons []byte, err error) {
+	if sizes, err = json.Marshal(p.Sizes); err != nil {
+		return
+	}
+	if temperatures, err = json.Marshal(p.Temperatures); err != nil {
+		return
+	}
+	addons, err = json.Marshal(p.Addons)
+	return
+}
+
+// HandleImportProducts 处理商品批量导入，文件放在表单字段 file 中；
+// dryRun=true 时只返回差异不写入，deleteMissing=true 时删除文件中没有的商品
+func HandleImportProducts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+
+	r.ParseMultipartForm(10 << 20) // 10MB
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Error Retrieving the File", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Error reading file content", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.HasSuffix(strings.ToLower(handler.Filename), ".xlsx") {
+		format = "xlsx"
+	}
+	rows, err := readImportRows(data, format)
+	if err != nil {
+		http.Error(w, "Failed to parse file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	result, err := DiffImport(storeID, rows, query.Get("deleteMissing") == "true")
+	if err != nil {
+		log.Printf("Error diffing import: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(result.Errors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	if query.Get("dryRun") != "true" {
+		if err := ApplyImport(result); err != nil {
+			log.Printf("Error applying import: %v", err)
+			http.Error(w, "Failed to apply import: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Applied = true
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
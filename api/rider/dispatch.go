@@ -0,0 +1,523 @@
+package rider
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// 配送状态
+const (
+	DeliveryAssigned  = "assigned"  // 已派给骑手，等待取餐
+	DeliveryPickedUp  = "picked_up" // 骑手已取餐，配送中
+	DeliveryDelivered = "delivered" // 已送达
+)
+
+// 派单方式
+const (
+	AssignManual  = "manual"
+	AssignNearest = "nearest"
+)
+
+const (
+	// staleLocation 超过该时间没有上报位置的骑手，自动派单时排在有位置的骑手之后
+	staleLocation = 10 * time.Minute
+	// maxTrackingPings 订单跟踪返回的最近位置数
+	maxTrackingPings = 50
+)
+
+var (
+	// ErrInvalidDelivery 表示订单不是外送订单，或请求不合法
+	ErrInvalidDelivery = errors.New("invalid delivery")
+	// ErrDeliveryState 表示配送当前状态不允许该操作
+	ErrDeliveryState = errors.New("invalid delivery state")
+	// ErrNoRiderAvailable 表示没有可以接单的骑手
+	ErrNoRiderAvailable = errors.New("no rider available")
+)
+
+// Delivery 外送订单的配送记录
+type Delivery struct {
+	OrderID     int      `json:"orderId"`
+	OrderNumber string   `json:"orderNumber"`
+	RiderID     int      `json:"riderId,omitempty"`
+	Status      string   `json:"status"` // 为空表示尚未派单
+	AssignedBy  string   `json:"assignedBy,omitempty"`
+	Address     string   `json:"address"`
+	Phone       string   `json:"phone"`
+	Lat         *float64 `json:"lat,omitempty"`
+	Lng         *float64 `json:"lng,omitempty"`
+	CreateTime  string   `json:"createTime"`
+	AssignedAt  string   `json:"assignedAt,omitempty"`
+	PickedUpAt  string   `json:"pickedUpAt,omitempty"`
+	DeliveredAt string   `json:"deliveredAt,omitempty"`
+	StoreID     int      `json:"storeId"`
+}
+
+// Ping 骑手上报的位置
+type Ping struct {
+	Lat       float64 `json:"lat"`
+	Lng       float64 `json:"lng"`
+	CreatedAt string  `json:"createdAt"`
+}
+
+// Tracking 顾客查看的配送进度
+type Tracking struct {
+	Delivery
+	RiderName  string  `json:"riderName,omitempty"`
+	RiderPhone string  `json:"riderPhone,omitempty"`
+	DistanceKm float64 `json:"distanceKm,omitempty"` // 骑手最近位置到收货地址的距离
+	ETAMinutes int     `json:"etaMinutes,omitempty"` // 配送区域的预计送达时间，从下单开始计算
+	Pings      []Ping  `json:"pings"`
+}
+
+func migrateDispatch() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS deliveries (
+		order_id INT PRIMARY KEY,
+		rider_id INT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		assigned_by VARCHAR(16) NOT NULL,
+		assigned_at DATETIME NOT NULL,
+		picked_up_at DATETIME NULL,
+		delivered_at DATETIME NULL,
+		INDEX idx_rider (rider_id, status)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating deliveries table: %w", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS delivery_pings (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id INT NOT NULL,
+		rider_id INT NOT NULL,
+		lat DECIMAL(10,7) NOT NULL,
+		lng DECIMAL(10,7) NOT NULL,
+		created_at DATETIME NOT NULL,
+		INDEX idx_order (order_id, id)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating delivery_pings table: %w", err)
+	}
+	return nil
+}
+
+func riderCapacity() int {
+	if n := config.C.Store.Fulfillment.RiderCapacity; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// deliveryColumns queryDeliveries 解析的列，o 为 orders，d 为 LEFT JOIN 的 deliveries
+const deliveryColumns = `o.order_id, o.order_number, COALESCE(d.rider_id, 0), COALESCE(d.status, ''), COALESCE(d.assigned_by, ''),
+	o.delivery_address, o.delivery_phone, o.delivery_lat, o.delivery_lng, o.create_time,
+	COALESCE(d.assigned_at, ''), COALESCE(d.picked_up_at, ''), COALESCE(d.delivered_at, ''), o.store_id`
+
+const deliveryFrom = " FROM orders o LEFT JOIN deliveries d ON d.order_id = o.order_id WHERE o.order_type = 'delivery'"
+
+// readyCondition 可以派单的外送订单：已支付且已放到后厨，参数为当前门店时间
+const readyCondition = " AND CAST(o.pay_status AS CHAR) IN ('1', 'true') AND (o.release_at IS NULL OR o.release_at <= ?)"
+
+func queryDeliveries(query string, args ...any) ([]Delivery, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		var lat, lng sql.NullFloat64
+		if err := rows.Scan(&d.OrderID, &d.OrderNumber, &d.RiderID, &d.Status, &d.AssignedBy, &d.Address, &d.Phone, &lat, &lng,
+			&d.CreateTime, &d.AssignedAt, &d.PickedUpAt, &d.DeliveredAt, &d.StoreID); err != nil {
+			return nil, err
+		}
+		if lat.Valid && lng.Valid {
+			d.Lat, d.Lng = &lat.Float64, &lng.Float64
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func fetchDelivery(orderID int) (Delivery, error) {
+	deliveries, err := queryDeliveries("SELECT "+deliveryColumns+deliveryFrom+" AND o.order_id = ?", orderID)
+	if err != nil {
+		return Delivery{}, err
+	}
+	if len(deliveries) == 0 {
+		return Delivery{}, fmt.Errorf("%w: order %d is not a delivery order", ErrInvalidDelivery, orderID)
+	}
+	return deliveries[0], nil
+}
+
+// nearestRider 选择门店中离门店最近、仍有空余运力的在线骑手；位置过期的骑手排在后面
+func nearestRider(tx *sql.Tx, storeID int, now time.Time) (int, error) {
+	storeLat, storeLng, err := store.Coordinates(storeID)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(`SELECT r.id, r.lat, r.lng, COALESCE(r.located_at, '') FROM riders r
+		WHERE r.active = 1 AND r.status = ? AND r.store_id = ?
+		AND (SELECT COUNT(*) FROM deliveries d WHERE d.rider_id = r.id AND d.status IN (?, ?)) < ?
+		FOR UPDATE`, StatusAvailable, storeID, DeliveryAssigned, DeliveryPickedUp, riderCapacity())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	best, bestStale, bestDistance := 0, true, math.Inf(1)
+	for rows.Next() {
+		var id int
+		var lat, lng sql.NullFloat64
+		var locatedAt string
+		if err := rows.Scan(&id, &lat, &lng, &locatedAt); err != nil {
+			return 0, err
+		}
+		stale, distance := true, math.Inf(1)
+		if lat.Valid && lng.Valid {
+			distance = utils.DistanceKm(storeLat, storeLng, lat.Float64, lng.Float64)
+			at, err := time.ParseInLocation(dateTimeLayout, locatedAt, config.Location())
+			stale = err != nil || now.Sub(at) > staleLocation
+		}
+		if best == 0 || bestStale && !stale || stale == bestStale && distance < bestDistance {
+			best, bestStale, bestDistance = id, stale, distance
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if best == 0 {
+		return 0, ErrNoRiderAvailable
+	}
+	return best, nil
+}
+
+// Assign 把已支付且已放到后厨的外送订单派给订单门店的骑手，riderID 为0时自动派给最近的空闲骑手；已派单但未取餐的订单可以改派
+func Assign(orderID, riderID int) (Delivery, error) {
+	d, err := fetchDelivery(orderID)
+	if err != nil {
+		return d, err
+	}
+	if d.Status != "" && d.Status != DeliveryAssigned {
+		return d, fmt.Errorf("%w: order is %s", ErrDeliveryState, d.Status)
+	}
+	var ready bool
+	err = db.QueryRow("SELECT COUNT(*) > 0 FROM orders o WHERE o.order_id = ?"+readyCondition, orderID, storeNow()).Scan(&ready)
+	if err != nil {
+		return d, err
+	}
+	if !ready {
+		return d, fmt.Errorf("%w: order is not paid or not yet released to the kitchen", ErrDeliveryState)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return d, err
+	}
+	defer tx.Rollback()
+
+	by := AssignManual
+	if riderID == 0 {
+		by = AssignNearest
+		if riderID, err = nearestRider(tx, d.StoreID, time.Now()); err != nil {
+			return d, err
+		}
+	} else {
+		var active bool
+		var storeID int
+		err := tx.QueryRow("SELECT active, store_id FROM riders WHERE id = ? FOR UPDATE", riderID).Scan(&active, &storeID)
+		if err == sql.ErrNoRows || err == nil && (!active || storeID != d.StoreID) {
+			return d, fmt.Errorf("%w: rider %d not found", ErrInvalidDelivery, riderID)
+		}
+		if err != nil {
+			return d, err
+		}
+	}
+
+	// 只有尚未取餐的配送可以改派
+	var status string
+	err = tx.QueryRow("SELECT status FROM deliveries WHERE order_id = ? FOR UPDATE", orderID).Scan(&status)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec("INSERT INTO deliveries (order_id, rider_id, status, assigned_by, assigned_at) VALUES (?, ?, ?, ?, ?)",
+			orderID, riderID, DeliveryAssigned, by, storeNow())
+	case err != nil:
+	case status != DeliveryAssigned:
+		return d, fmt.Errorf("%w: order is %s", ErrDeliveryState, status)
+	default:
+		_, err = tx.Exec("UPDATE deliveries SET rider_id = ?, assigned_by = ?, assigned_at = ? WHERE order_id = ?",
+			riderID, by, storeNow(), orderID)
+	}
+	if err != nil {
+		return d, err
+	}
+	if err := tx.Commit(); err != nil {
+		return d, err
+	}
+	return fetchDelivery(orderID)
+}
+
+// Unassign 取消尚未取餐的派单，订单回到待派单列表
+func Unassign(orderID int) error {
+	res, err := db.Exec("DELETE FROM deliveries WHERE order_id = ? AND status = ?", orderID, DeliveryAssigned)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: order is not waiting for pickup", ErrDeliveryState)
+	}
+	return nil
+}
+
+// advance 骑手更新自己订单的配送状态：取餐或送达；取餐后订单记为已发货
+func advance(riderID, orderID int, from, to, column string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE deliveries SET status = ?, "+column+" = ? WHERE order_id = ? AND rider_id = ? AND status = ?",
+		to, storeNow(), orderID, riderID, from)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: order %d is not %s for this rider", ErrDeliveryState, orderID, from)
+	}
+	if to == DeliveryPickedUp {
+		if _, err := tx.Exec("UPDATE orders SET is_send = ? WHERE order_id = ?", true, orderID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RecordPing 保存骑手的位置，并记录到骑手所有配送中的订单
+func RecordPing(riderID int, lat, lng float64) error {
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return fmt.Errorf("%w: invalid coordinates", ErrInvalidDelivery)
+	}
+	now := storeNow()
+	if _, err := db.Exec("UPDATE riders SET lat = ?, lng = ?, located_at = ? WHERE id = ?", lat, lng, now, riderID); err != nil {
+		return err
+	}
+	_, err := db.Exec(`INSERT INTO delivery_pings (order_id, rider_id, lat, lng, created_at)
+		SELECT order_id, rider_id, ?, ?, ? FROM deliveries WHERE rider_id = ? AND status IN (?, ?)`,
+		lat, lng, now, riderID, DeliveryAssigned, DeliveryPickedUp)
+	return err
+}
+
+// FetchTracking 查询订单的配送进度，user 必须是下单用户
+func FetchTracking(orderID int, user string) (Tracking, error) {
+	var t Tracking
+	var orderUser string
+	var eta sql.NullInt64
+	err := db.QueryRow(`SELECT o.order_user, z.eta_minutes FROM orders o LEFT JOIN delivery_zones z ON z.id = o.delivery_zone
+		WHERE o.order_id = ?`, orderID).Scan(&orderUser, &eta)
+	if err != nil {
+		return t, err
+	}
+	if orderUser != user {
+		return t, sql.ErrNoRows
+	}
+	if t.Delivery, err = fetchDelivery(orderID); err != nil {
+		return t, err
+	}
+	t.ETAMinutes = int(eta.Int64)
+
+	t.Pings = []Ping{}
+	if t.RiderID == 0 {
+		return t, nil
+	}
+	if err := db.QueryRow("SELECT name, phone FROM riders WHERE id = ?", t.RiderID).Scan(&t.RiderName, &t.RiderPhone); err != nil {
+		return t, err
+	}
+
+	rows, err := db.Query("SELECT lat, lng, created_at FROM delivery_pings WHERE order_id = ? ORDER BY id DESC LIMIT ?", orderID, maxTrackingPings)
+	if err != nil {
+		return t, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Ping
+		if err := rows.Scan(&p.Lat, &p.Lng, &p.CreatedAt); err != nil {
+			return t, err
+		}
+		t.Pings = append(t.Pings, p)
+	}
+	if err := rows.Err(); err != nil {
+		return t, err
+	}
+	// 最近的位置在前，已送达的订单不再计算距离
+	if len(t.Pings) > 0 && t.Lat != nil && t.Lng != nil && t.Status != DeliveryDelivered {
+		t.DistanceKm = math.Round(utils.DistanceKm(t.Pings[0].Lat, t.Pings[0].Lng, *t.Lat, *t.Lng)*100) / 100
+	}
+	return t, nil
+}
+
+// HandlePendingDeliveries 返回门店已支付、已放到后厨且尚未送达的外送订单，包括未派单和配送中的
+func HandlePendingDeliveries(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	deliveries, err := queryDeliveries("SELECT "+deliveryColumns+deliveryFrom+readyCondition+
+		" AND o.store_id = ? AND (d.status IS NULL OR d.status <> ?) ORDER BY o.order_id", storeNow(), storeID, DeliveryDelivered)
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// HandleAssign 派单，请求体为 {"orderId": N, "riderId": N}，riderId 为0时派给最近的空闲骑手
+func HandleAssign(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		OrderID int `json:"orderId"`
+		RiderID int `json:"riderId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	d, err := Assign(data.OrderID, data.RiderID)
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// HandleUnassign 取消派单，请求体为 {"orderId": N}
+func HandleUnassign(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		OrderID int `json:"orderId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := Unassign(data.OrderID); err != nil {
+		writeRiderError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Delivery unassigned successfully"))
+}
+
+// HandleRiderOrders 返回骑手正在配送的订单
+func HandleRiderOrders(w http.ResponseWriter, r *http.Request) {
+	riderID, err := authenticate(r)
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+
+	deliveries, err := queryDeliveries("SELECT "+deliveryColumns+deliveryFrom+
+		" AND d.rider_id = ? AND d.status IN (?, ?) ORDER BY d.assigned_at", riderID, DeliveryAssigned, DeliveryPickedUp)
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// handleAdvance 返回骑手更新配送状态的处理函数，请求体为 {"orderId": N}
+func handleAdvance(from, to, column string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		riderID, err := authenticate(r)
+		if err != nil {
+			writeRiderError(w, err)
+			return
+		}
+		var data struct {
+			OrderID int `json:"orderId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+			return
+		}
+
+		if err := advance(riderID, data.OrderID, from, to, column); err != nil {
+			writeRiderError(w, err)
+			return
+		}
+		d, err := fetchDelivery(data.OrderID)
+		if err != nil {
+			writeRiderError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
+	}
+}
+
+// HandlePickUp 骑手到店取餐
+var HandlePickUp = handleAdvance(DeliveryAssigned, DeliveryPickedUp, "picked_up_at")
+
+// HandleDelivered 骑手送达
+var HandleDelivered = handleAdvance(DeliveryPickedUp, DeliveryDelivered, "delivered_at")
+
+// HandlePing 骑手上报位置，请求体为 {"lat": 0, "lng": 0}
+func HandlePing(w http.ResponseWriter, r *http.Request) {
+	riderID, err := authenticate(r)
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+	var data struct {
+		Lat float64 `json:"lat"`
+		Lng float64 `json:"lng"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := RecordPing(riderID, data.Lat, data.Lng); err != nil {
+		writeRiderError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Location recorded"))
+}
+
+// HandleTracking 顾客查看外送订单的配送进度，参数 user 为下单用户
+func HandleTracking(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["order_id"])
+	if err != nil {
+		http.Error(w, "Invalid order id", http.StatusBadRequest)
+		return
+	}
+
+	t, err := FetchTracking(orderID, r.URL.Query().Get("user"))
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
@@ -0,0 +1,373 @@
+package rider
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/api/store"
+	"gocode/first/config"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 骑手的接单状态
+const (
+	StatusOffline   = "offline"   // 下线，不参与派单
+	StatusAvailable = "available" // 上线，可以接单
+)
+
+const dateTimeLayout = "2006-01-02 15:04:05"
+
+var (
+	// ErrUnauthorized 表示骑手 token 无效或账号已停用
+	ErrUnauthorized = errors.New("invalid rider token")
+	// ErrInvalidRider 表示骑手信息不合法
+	ErrInvalidRider = errors.New("invalid rider")
+)
+
+var db *sql.DB
+
+func init() {
+	var err error
+
+	// 从配置文件中获取数据库连接信息
+	dbc := config.DBConfig
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
+		dbc.Username, dbc.Password, dbc.Host, dbc.Port, dbc.Database)
+
+	// 使用配置信息打开数据库连接
+	db, err = sql.Open("mysql", dsn)
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+
+	// 检查与数据库的连接
+	err = db.Ping()
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	if err = migrateRiders(); err != nil {
+		log.Fatal("Failed to migrate riders:", err)
+	}
+	if err = migrateDispatch(); err != nil {
+		log.Fatal("Failed to migrate deliveries:", err)
+	}
+	// 骑手只为所属门店配送
+	if err = store.EnsureScoped(db, "riders"); err != nil {
+		log.Fatal("Failed to migrate store scope:", err)
+	}
+}
+
+// Rider 骑手账号
+type Rider struct {
+	ID        int      `json:"id"`
+	Name      string   `json:"name"`
+	Phone     string   `json:"phone"`
+	Password  string   `json:"password,omitempty"` // 仅在新建或修改密码时填写
+	Status    string   `json:"status"`
+	Active    bool     `json:"active"`
+	Lat       *float64 `json:"lat,omitempty"` // 最近一次上报的位置
+	Lng       *float64 `json:"lng,omitempty"`
+	LocatedAt string   `json:"locatedAt,omitempty"`
+	Orders    int      `json:"orders"` // 正在配送的订单数
+	StoreID   int      `json:"storeId"`
+}
+
+func migrateRiders() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS riders (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(64) NOT NULL,
+		phone VARCHAR(32) NOT NULL UNIQUE,
+		password_hash VARCHAR(72) NOT NULL,
+		token VARCHAR(64) NULL UNIQUE,
+		status VARCHAR(16) NOT NULL DEFAULT 'offline',
+		active TINYINT(1) NOT NULL DEFAULT 1,
+		lat DECIMAL(10,7) NULL,
+		lng DECIMAL(10,7) NULL,
+		located_at DATETIME NULL,
+		created_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating riders table: %w", err)
+	}
+	return nil
+}
+
+func storeNow() string {
+	return time.Now().In(config.Location()).Format(dateTimeLayout)
+}
+
+// riderColumns queryRiders 解析的列，orders 为正在配送的订单数
+const riderColumns = `r.id, r.name, r.phone, r.status, r.active, r.lat, r.lng, COALESCE(r.located_at, ''),
+	(SELECT COUNT(*) FROM deliveries d WHERE d.rider_id = r.id AND d.status IN ('assigned', 'picked_up')), r.store_id`
+
+func queryRiders(query string, args ...any) ([]Rider, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	riders := []Rider{}
+	for rows.Next() {
+		var r Rider
+		var lat, lng sql.NullFloat64
+		if err := rows.Scan(&r.ID, &r.Name, &r.Phone, &r.Status, &r.Active, &lat, &lng, &r.LocatedAt, &r.Orders, &r.StoreID); err != nil {
+			return nil, err
+		}
+		if lat.Valid && lng.Valid {
+			r.Lat, r.Lng = &lat.Float64, &lng.Float64
+		}
+		riders = append(riders, r)
+	}
+	return riders, rows.Err()
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Login 校验骑手手机号和密码，返回新的 token，旧的 token 失效
+func Login(phone, password string) (string, Rider, error) {
+	var r Rider
+	var hash string
+	err := db.QueryRow("SELECT id, name, phone, status, password_hash FROM riders WHERE phone = ? AND active = 1", phone).
+		Scan(&r.ID, &r.Name, &r.Phone, &r.Status, &hash)
+	if err == sql.ErrNoRows {
+		return "", r, ErrUnauthorized
+	}
+	if err != nil {
+		return "", r, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return "", r, ErrUnauthorized
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", r, err
+	}
+	if _, err := db.Exec("UPDATE riders SET token = ? WHERE id = ?", token, r.ID); err != nil {
+		return "", r, err
+	}
+	r.Active = true
+	return token, r, nil
+}
+
+// authenticate 按请求头 Authorization: Bearer <token> 识别骑手
+func authenticate(r *http.Request) (int, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return 0, ErrUnauthorized
+	}
+	var id int
+	err := db.QueryRow("SELECT id FROM riders WHERE token = ? AND active = 1", token).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrUnauthorized
+	}
+	return id, err
+}
+
+// SaveRider 新建或修改骑手，id 为0时在 rd.StoreID 门店新建且必须设置密码；修改时密码为空表示不修改
+func SaveRider(rd Rider) (Rider, error) {
+	rd.Name, rd.Phone = strings.TrimSpace(rd.Name), strings.TrimSpace(rd.Phone)
+	if rd.Name == "" || rd.Phone == "" {
+		return rd, fmt.Errorf("%w: name and phone are required", ErrInvalidRider)
+	}
+	if rd.ID == 0 && rd.Password == "" {
+		return rd, fmt.Errorf("%w: password is required", ErrInvalidRider)
+	}
+
+	var hash []byte
+	if rd.Password != "" {
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(rd.Password), bcrypt.DefaultCost); err != nil {
+			return rd, err
+		}
+	}
+	rd.Password = ""
+
+	if rd.ID == 0 {
+		res, err := db.Exec("INSERT INTO riders (name, phone, password_hash, status, active, created_at, store_id) VALUES (?, ?, ?, ?, 1, ?, ?)",
+			rd.Name, rd.Phone, string(hash), StatusOffline, storeNow(), rd.StoreID)
+		if err != nil {
+			return rd, err
+		}
+		id, err := res.LastInsertId()
+		rd.ID, rd.Status, rd.Active = int(id), StatusOffline, true
+		return rd, err
+	}
+
+	query, args := "UPDATE riders SET name = ?, phone = ? WHERE id = ?", []any{rd.Name, rd.Phone, rd.ID}
+	if hash != nil {
+		// 修改密码后已登录的设备需要重新登录
+		query, args = "UPDATE riders SET name = ?, phone = ?, password_hash = ?, token = NULL WHERE id = ?", []any{rd.Name, rd.Phone, string(hash), rd.ID}
+	}
+	if _, err := db.Exec(query, args...); err != nil {
+		return rd, err
+	}
+	riders, err := queryRiders("SELECT "+riderColumns+" FROM riders r WHERE r.id = ?", rd.ID)
+	if err != nil {
+		return rd, err
+	}
+	if len(riders) == 0 {
+		return rd, sql.ErrNoRows
+	}
+	return riders[0], nil
+}
+
+// SetStatus 骑手上线或下线，下线不影响已分配的订单
+func SetStatus(riderID int, status string) error {
+	if status != StatusAvailable && status != StatusOffline {
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidRider, status)
+	}
+	_, err := db.Exec("UPDATE riders SET status = ? WHERE id = ?", status, riderID)
+	return err
+}
+
+func writeRiderError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, ErrInvalidRider), errors.Is(err, ErrInvalidDelivery):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrDeliveryState), errors.Is(err, ErrNoRiderAvailable):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Rider error: %v", err)
+		http.Error(w, "Failed to process request", http.StatusInternalServerError)
+	}
+}
+
+// HandleRiders 返回门店全部骑手及其正在配送的订单数
+func HandleRiders(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := store.ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	riders, err := queryRiders("SELECT "+riderColumns+" FROM riders r WHERE r.store_id = ? ORDER BY r.active DESC, r.id", storeID)
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(riders)
+}
+
+// HandleSaveRider 新建或修改骑手账号
+func HandleSaveRider(w http.ResponseWriter, r *http.Request) {
+	var rd Rider
+	if err := json.NewDecoder(r.Body).Decode(&rd); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if rd.StoreID, ok = store.ManagedStore(w, r); !ok {
+		return
+	}
+
+	rd, err := SaveRider(rd)
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rd)
+}
+
+// HandleDeactivateRider 停用骑手账号，已登录的设备失效；正在配送的订单需要先改派
+func HandleDeactivateRider(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	var active int
+	err := db.QueryRow("SELECT COUNT(*) FROM deliveries WHERE rider_id = ? AND status IN (?, ?)", data.ID, DeliveryAssigned, DeliveryPickedUp).Scan(&active)
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+	if active > 0 {
+		writeRiderError(w, fmt.Errorf("%w: rider has %d deliveries in progress", ErrDeliveryState, active))
+		return
+	}
+
+	res, err := db.Exec("UPDATE riders SET active = 0, status = ?, token = NULL WHERE id = ?", StatusOffline, data.ID)
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeRiderError(w, sql.ErrNoRows)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Rider deactivated successfully"))
+}
+
+// HandleRiderLogin 骑手登录，请求体为 {"phone": "...", "password": "..."}
+func HandleRiderLogin(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Phone    string `json:"phone"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	token, rd, err := Login(data.Phone, data.Password)
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"token": token, "rider": rd})
+}
+
+// HandleRiderStatus 骑手上线或下线，请求体为 {"status": "available|offline"}
+func HandleRiderStatus(w http.ResponseWriter, r *http.Request) {
+	riderID, err := authenticate(r)
+	if err != nil {
+		writeRiderError(w, err)
+		return
+	}
+	var data struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Failed to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := SetStatus(riderID, data.Status); err != nil {
+		writeRiderError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Rider status updated successfully"))
+}
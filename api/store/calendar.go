@@ -0,0 +1,173 @@
+package store
+
+import (
+	"gocode/first/config"
+	"sort"
+	"time"
+)
+
+// searchDays 查找下一次营业时间时最多向后查找的天数
+const searchDays = 31
+
+// interval 一段具体的营业时间 [Start, End)
+type interval struct {
+	Start time.Time
+	End   time.Time
+	Note  string
+}
+
+// Calendar 一次性加载的营业时段与特殊安排，逐个时间判断时避免重复查询数据库
+type Calendar struct {
+	hours    []Hours
+	specials map[string][]SpecialHours
+}
+
+func storeToday() string {
+	return time.Now().In(config.Location()).Format("2006-01-02")
+}
+
+// isoWeekday 把 time.Weekday 转换为 1-7（周一到周日）
+func isoWeekday(t time.Time) int {
+	if t.Weekday() == time.Sunday {
+		return 7
+	}
+	return int(t.Weekday())
+}
+
+func (h Hours) hasDay(day int) bool {
+	if len(h.Days) == 0 {
+		return true
+	}
+	for _, d := range h.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// span 返回 day 当天 open 到 close 的营业时间，close 不晚于 open 时营业到次日
+func span(day time.Time, open, close string) interval {
+	o, _ := time.Parse(clockLayout, open)
+	c, _ := time.Parse(clockLayout, close)
+	iv := interval{
+		Start: time.Date(day.Year(), day.Month(), day.Day(), o.Hour(), o.Minute(), 0, 0, day.Location()),
+		End:   time.Date(day.Year(), day.Month(), day.Day(), c.Hour(), c.Minute(), 0, 0, day.Location()),
+	}
+	if !iv.End.After(iv.Start) {
+		iv.End = iv.End.AddDate(0, 0, 1)
+	}
+	return iv
+}
+
+// LoadCalendar 加载门店的营业时段与昨天起的特殊安排
+func LoadCalendar(storeID int) (*Calendar, error) {
+	hours, err := FetchHours(storeID)
+	if err != nil {
+		return nil, err
+	}
+	yesterday := time.Now().In(config.Location()).AddDate(0, 0, -1).Format("2006-01-02")
+	specials, err := FetchSpecialHours(storeID, yesterday)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Calendar{hours: hours, specials: make(map[string][]SpecialHours)}
+	for _, s := range specials {
+		c.specials[s.Date] = append(c.specials[s.Date], s)
+	}
+	return c, nil
+}
+
+// dayIntervals 返回营业日 day 的营业时间：有特殊安排时以特殊安排为准，
+// 否则按每周营业时段，没有配置任何营业时段的视为全天营业
+func (c *Calendar) dayIntervals(day time.Time) []interval {
+	var out []interval
+	if specials, ok := c.specials[day.Format("2006-01-02")]; ok {
+		for _, s := range specials {
+			if s.Closed {
+				return nil
+			}
+			iv := span(day, s.OpenTime, s.CloseTime)
+			iv.Note = s.Note
+			out = append(out, iv)
+		}
+		return out
+	}
+
+	if len(c.hours) == 0 {
+		return []interval{{Start: day, End: day.AddDate(0, 0, 1)}}
+	}
+	weekday := isoWeekday(day)
+	for _, h := range c.hours {
+		if h.hasDay(weekday) {
+			out = append(out, span(day, h.OpenTime, h.CloseTime))
+		}
+	}
+	return out
+}
+
+// intervals 返回从 from 前一天起 days 天内的营业时间，按开始时间排序并合并相连的时段，
+// 营业到次日的时段因此也能覆盖次日凌晨
+func (c *Calendar) intervals(from time.Time, days int) []interval {
+	day := midnight(from.In(config.Location())).AddDate(0, 0, -1)
+	var all []interval
+	for i := 0; i <= days; i++ {
+		all = append(all, c.dayIntervals(day.AddDate(0, 0, i))...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Start.Before(all[j].Start) })
+
+	var merged []interval
+	for _, iv := range all {
+		if n := len(merged); n > 0 && !iv.Start.After(merged[n-1].End) {
+			if iv.End.After(merged[n-1].End) {
+				merged[n-1].End = iv.End
+			}
+			if merged[n-1].Note == "" {
+				merged[n-1].Note = iv.Note
+			}
+			continue
+		}
+		merged = append(merged, iv)
+	}
+	return merged
+}
+
+// current 返回包含 t 的营业时间
+func (c *Calendar) current(t time.Time) (interval, bool) {
+	for _, iv := range c.intervals(t, 2) {
+		if !t.Before(iv.Start) && t.Before(iv.End) {
+			return iv, true
+		}
+	}
+	return interval{}, false
+}
+
+// next 返回 t 之后最近一次开始营业的时间
+func (c *Calendar) next(t time.Time) (interval, bool) {
+	for _, iv := range c.intervals(t, searchDays) {
+		if iv.Start.After(t) {
+			return iv, true
+		}
+	}
+	return interval{}, false
+}
+
+// OpenAt 判断门店在给定时间是否营业
+func (c *Calendar) OpenAt(t time.Time) bool {
+	_, ok := c.current(t)
+	return ok
+}
+
+// OpenAt 判断门店在给定时间是否营业
+func OpenAt(storeID int, t time.Time) (bool, error) {
+	c, err := LoadCalendar(storeID)
+	if err != nil {
+		return false, err
+	}
+	return c.OpenAt(t), nil
+}
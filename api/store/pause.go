@@ -0,0 +1,117 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"gocode/first/config"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Pause 忙碌时暂停接单，Until 为空表示需要手动恢复
+type Pause struct {
+	Paused bool   `json:"paused"`
+	Until  string `json:"until,omitempty"` // 格式 2006-01-02 15:04:05
+	Reason string `json:"reason,omitempty"`
+}
+
+// migratePause 每家门店一行，id 为门店编号
+func migratePause() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS store_pause (
+		id INT PRIMARY KEY,
+		paused_until DATETIME NULL,
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		paused_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating store_pause table: %w", err)
+	}
+	return nil
+}
+
+// FetchPause 返回门店 now 时的暂停接单状态，到期的暂停视为已恢复
+func FetchPause(storeID int, now time.Time) (Pause, error) {
+	var p Pause
+	var until sql.NullString
+	err := db.QueryRow("SELECT paused_until, reason FROM store_pause WHERE id = ?", storeID).Scan(&until, &p.Reason)
+	if err == sql.ErrNoRows {
+		return Pause{}, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	if until.Valid && until.String <= now.In(config.Location()).Format("2006-01-02 15:04:05") {
+		return Pause{}, nil
+	}
+	p.Paused, p.Until = true, until.String
+	return p, nil
+}
+
+// PauseOrdering 门店暂停接单 minutes 分钟，minutes 为0时直到手动恢复
+func PauseOrdering(storeID, minutes int, reason string) (Pause, error) {
+	now := time.Now().In(config.Location())
+	p := Pause{Paused: true, Reason: reason}
+	var until sql.NullString
+	if minutes > 0 {
+		p.Until = now.Add(time.Duration(minutes) * time.Minute).Format("2006-01-02 15:04:05")
+		until = sql.NullString{String: p.Until, Valid: true}
+	}
+	_, err := db.Exec(`INSERT INTO store_pause (id, paused_until, reason, paused_at) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE paused_until = VALUES(paused_until), reason = VALUES(reason), paused_at = VALUES(paused_at)`,
+		storeID, until, reason, now.Format("2006-01-02 15:04:05"))
+	return p, err
+}
+
+// ResumeOrdering 门店恢复接单
+func ResumeOrdering(storeID int) error {
+	_, err := db.Exec("DELETE FROM store_pause WHERE id = ?", storeID)
+	return err
+}
+
+// HandlePause 暂停接单，请求体为 {"minutes": 30, "reason": "..."}，minutes 为0时直到手动恢复
+func HandlePause(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Minutes int    `json:"minutes"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Minutes < 0 {
+		http.Error(w, "minutes must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	p, err := PauseOrdering(storeID, req.Minutes, req.Reason)
+	if err != nil {
+		log.Printf("Failed to pause ordering: %v", err)
+		http.Error(w, "Failed to pause ordering", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// HandleResume 恢复接单
+func HandleResume(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	if err := ResumeOrdering(storeID); err != nil {
+		log.Printf("Failed to resume ordering: %v", err)
+		http.Error(w, "Failed to resume ordering", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Ordering resumed successfully"))
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"encoding/json"
+	"gocode/first/config"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// paidCondition 已支付的订单，pay_status 可能存为 1 或 true
+const paidCondition = "CAST(pay_status AS CHAR) IN ('1', 'true')"
+
+// StoreReport 一家门店在报表期间内已支付订单的汇总
+type StoreReport struct {
+	StoreID   int     `json:"storeId"`
+	Name      string  `json:"name"`
+	Orders    int     `json:"orders"`
+	Revenue   float64 `json:"revenue"`   // 订单金额合计
+	AvgTicket float64 `json:"avgTicket"` // 客单价
+	DineIn    int     `json:"dineIn"`
+	Takeaway  int     `json:"takeaway"`
+	Delivery  int     `json:"delivery"`
+}
+
+// Report 跨门店汇总报表，Total 为全部门店合计
+type Report struct {
+	From   string        `json:"from"`
+	To     string        `json:"to"`
+	Stores []StoreReport `json:"stores"`
+	Total  StoreReport   `json:"total"`
+}
+
+// Consolidate 统计 [from, to] 每天已支付的订单，按门店汇总；未支付的订单不计入，没有订单的门店也列出
+func Consolidate(from, to string) (Report, error) {
+	report := Report{From: from, To: to, Stores: []StoreReport{}}
+	stores, err := FetchStores()
+	if err != nil {
+		return report, err
+	}
+
+	end, err := time.Parse("2006-01-02", to)
+	if err != nil {
+		return report, err
+	}
+	rows, err := db.Query(`SELECT store_id, COUNT(*), COALESCE(SUM(order_price), 0),
+		SUM(order_type = 'dine_in'), SUM(order_type = 'takeaway'), SUM(order_type = 'delivery')
+		FROM orders WHERE `+paidCondition+` AND create_time >= ? AND create_time < ? GROUP BY store_id`,
+		from, end.AddDate(0, 0, 1).Format("2006-01-02"))
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	byStore := make(map[int]StoreReport)
+	for rows.Next() {
+		var s StoreReport
+		if err := rows.Scan(&s.StoreID, &s.Orders, &s.Revenue, &s.DineIn, &s.Takeaway, &s.Delivery); err != nil {
+			return report, err
+		}
+		byStore[s.StoreID] = s
+	}
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	report.Total.Name = "合计"
+	for _, st := range stores {
+		s := byStore[st.ID]
+		s.StoreID, s.Name = st.ID, st.Name
+		if s.Orders > 0 {
+			s.AvgTicket = roundCents(s.Revenue / float64(s.Orders))
+		}
+		report.Stores = append(report.Stores, s)
+
+		report.Total.Orders += s.Orders
+		report.Total.Revenue += s.Revenue
+		report.Total.DineIn += s.DineIn
+		report.Total.Takeaway += s.Takeaway
+		report.Total.Delivery += s.Delivery
+	}
+	report.Total.Revenue = roundCents(report.Total.Revenue)
+	if report.Total.Orders > 0 {
+		report.Total.AvgTicket = roundCents(report.Total.Revenue / float64(report.Total.Orders))
+	}
+	return report, nil
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// HandleReport 返回 ?from=2006-01-02&to=2006-01-02 期间的跨门店汇总报表，仅店主可用；
+// 未指定日期时为今天
+func HandleReport(w http.ResponseWriter, r *http.Request) {
+	if !RequireOwner(w, r) {
+		return
+	}
+
+	today := time.Now().In(config.Location()).Format("2006-01-02")
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" {
+		from = today
+	}
+	if to == "" {
+		to = today
+	}
+	for _, v := range []string{from, to} {
+		if _, err := time.Parse("2006-01-02", v); err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if to < from {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+
+	report, err := Consolidate(from, to)
+	if err != nil {
+		log.Printf("Failed to build store report: %v", err)
+		http.Error(w, "Failed to build store report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
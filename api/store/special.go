@@ -0,0 +1,156 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// SpecialHours 节假日休息或特殊营业时间，当天有特殊安排时不再按每周营业时段计算
+type SpecialHours struct {
+	ID        int    `json:"id"`
+	Date      string `json:"date"`   // 格式 2006-01-02
+	Closed    bool   `json:"closed"` // 当天休息
+	OpenTime  string `json:"openTime"`
+	CloseTime string `json:"closeTime"`
+	Note      string `json:"note"` // 展示给顾客的说明，例如春节休息
+}
+
+func migrateSpecialHours() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS store_special_hours (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		date DATE NOT NULL,
+		closed TINYINT(1) NOT NULL DEFAULT 0,
+		open_time VARCHAR(5) NOT NULL DEFAULT '',
+		close_time VARCHAR(5) NOT NULL DEFAULT '',
+		note VARCHAR(255) NOT NULL DEFAULT '',
+		INDEX idx_date (date)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating store_special_hours table: %w", err)
+	}
+	return nil
+}
+
+func validateSpecialHours(s SpecialHours) error {
+	if _, err := time.Parse("2006-01-02", s.Date); err != nil {
+		return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", s.Date)
+	}
+	if s.Closed {
+		return nil
+	}
+	return validateClockRange(s.OpenTime, s.CloseTime)
+}
+
+// FetchSpecialHours 返回门店 from 当天及以后的特殊安排，from 为空时返回全部
+func FetchSpecialHours(storeID int, from string) ([]SpecialHours, error) {
+	query := "SELECT id, DATE_FORMAT(date, '%Y-%m-%d'), closed, open_time, close_time, note FROM store_special_hours WHERE store_id = ?"
+	args := []any{storeID}
+	if from != "" {
+		query += " AND date >= ?"
+		args = append(args, from)
+	}
+	rows, err := db.Query(query+" ORDER BY date, open_time, id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query special hours: %w", err)
+	}
+	defer rows.Close()
+
+	specials := []SpecialHours{}
+	for rows.Next() {
+		var s SpecialHours
+		if err := rows.Scan(&s.ID, &s.Date, &s.Closed, &s.OpenTime, &s.CloseTime, &s.Note); err != nil {
+			return nil, fmt.Errorf("failed to scan special hours: %w", err)
+		}
+		specials = append(specials, s)
+	}
+	return specials, rows.Err()
+}
+
+func SaveSpecialHours(storeID int, s *SpecialHours) error {
+	if s.Closed {
+		s.OpenTime, s.CloseTime = "", ""
+	}
+	if s.ID > 0 {
+		_, err := db.Exec("UPDATE store_special_hours SET date = ?, closed = ?, open_time = ?, close_time = ?, note = ? WHERE id = ? AND store_id = ?",
+			s.Date, s.Closed, s.OpenTime, s.CloseTime, s.Note, s.ID, storeID)
+		return err
+	}
+
+	res, err := db.Exec("INSERT INTO store_special_hours (store_id, date, closed, open_time, close_time, note) VALUES (?, ?, ?, ?, ?, ?)",
+		storeID, s.Date, s.Closed, s.OpenTime, s.CloseTime, s.Note)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	s.ID = int(id)
+	return err
+}
+
+// HandleSpecialHours 请求体为空时返回门店今天及以后的特殊安排，否则添加或更新一条；
+// 同一天可以有多条特殊营业时间，其中一条为休息时当天休息
+func HandleSpecialHours(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(body) == 0 {
+		specials, err := FetchSpecialHours(storeID, storeToday())
+		if err != nil {
+			log.Printf("Failed to fetch special hours: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(specials)
+		return
+	}
+
+	var s SpecialHours
+	if err := json.Unmarshal(body, &s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateSpecialHours(s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := SaveSpecialHours(storeID, &s); err != nil {
+		log.Printf("Failed to save special hours: %v", err)
+		http.Error(w, "Failed to save special hours", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(s)
+}
+
+// HandleDeleteSpecialHours 根据ID删除特殊安排
+func HandleDeleteSpecialHours(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	var s SpecialHours
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM store_special_hours WHERE id = ? AND store_id = ?", s.ID, storeID); err != nil {
+		log.Printf("Failed to delete special hours: %v", err)
+		http.Error(w, "Failed to delete special hours", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Special hours deleted successfully"))
+}
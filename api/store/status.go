@@ -0,0 +1,159 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/config"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrClosed 表示门店不在营业时间内或已过最后点单时间
+	ErrClosed = errors.New("store is closed")
+	// ErrPaused 表示门店暂停接单
+	ErrPaused = errors.New("ordering is paused")
+)
+
+// Status 门店当前的营业与接单状态，时间格式为 2006-01-02 15:04
+type Status struct {
+	Open        bool   `json:"open"`      // 在营业时间内
+	Accepting   bool   `json:"accepting"` // 可以下即时订单：营业中、未过最后点单时间且未暂停接单
+	Paused      bool   `json:"paused"`
+	PausedUntil string `json:"pausedUntil,omitempty"`
+	PauseReason string `json:"pauseReason,omitempty"`
+	ClosesAt    string `json:"closesAt,omitempty"`    // 营业中时本次营业的结束时间
+	LastOrderAt string `json:"lastOrderAt,omitempty"` // 营业中时最后点单时间
+	NextOpening string `json:"nextOpening,omitempty"` // 不营业时下一次开始营业的时间
+	Note        string `json:"note,omitempty"`        // 特殊安排的说明
+}
+
+func lastOrderCutoff() time.Duration {
+	return time.Duration(config.C.Store.LastOrderMinutes) * time.Minute
+}
+
+// statusAt 根据营业时间与暂停状态计算 now 时的门店状态
+func (c *Calendar) statusAt(now time.Time, p Pause) Status {
+	now = now.In(config.Location())
+	s := Status{Paused: p.Paused, PauseReason: p.Reason}
+	if p.Until != "" {
+		s.PausedUntil = shortTime(p.Until)
+	}
+
+	// 查找范围内一直营业的门店（例如未配置营业时段）没有打烊时间
+	windowEnd := midnight(now).AddDate(0, 0, searchDays)
+	for _, iv := range c.intervals(now, searchDays) {
+		if now.Before(iv.Start) || !now.Before(iv.End) {
+			continue
+		}
+		s.Open, s.Note = true, iv.Note
+		s.Accepting = !p.Paused
+		if iv.End.Before(windowEnd) {
+			lastOrder := iv.End.Add(-lastOrderCutoff())
+			s.ClosesAt = iv.End.Format("2006-01-02 15:04")
+			s.LastOrderAt = lastOrder.Format("2006-01-02 15:04")
+			if !now.Before(lastOrder) {
+				s.Accepting = false
+			}
+		}
+		return s
+	}
+
+	// 当天休息时展示休息的说明
+	for _, sp := range c.specials[now.Format("2006-01-02")] {
+		if sp.Closed {
+			s.Note = sp.Note
+		}
+	}
+	if iv, ok := c.next(now); ok {
+		s.NextOpening = iv.Start.Format("2006-01-02 15:04")
+		if iv.Note != "" {
+			s.Note = iv.Note
+		}
+	}
+	return s
+}
+
+// FetchStatus 返回门店 now 时的营业与接单状态
+func FetchStatus(storeID int, now time.Time) (Status, error) {
+	c, err := LoadCalendar(storeID)
+	if err != nil {
+		return Status{}, err
+	}
+	p, err := FetchPause(storeID, now)
+	if err != nil {
+		return Status{}, err
+	}
+	return c.statusAt(now, p), nil
+}
+
+// CheckOrdering 校验门店 now 时能否下单：pickup 为零值表示即时订单，需门店可以接单；
+// 否则为预约订单，取餐时间需在营业时间内且不在暂停接单期间
+func CheckOrdering(storeID int, now, pickup time.Time) error {
+	c, err := LoadCalendar(storeID)
+	if err != nil {
+		return err
+	}
+	p, err := FetchPause(storeID, now)
+	if err != nil {
+		return err
+	}
+
+	if !pickup.IsZero() {
+		if p.Paused && (p.Until == "" || pickup.In(config.Location()).Format("2006-01-02 15:04:05") < p.Until) {
+			return pausedError(p)
+		}
+		if !c.OpenAt(pickup) {
+			return fmt.Errorf("%w at the pickup time", ErrClosed)
+		}
+		return nil
+	}
+
+	s := c.statusAt(now, p)
+	switch {
+	case s.Accepting:
+		return nil
+	case s.Paused:
+		return pausedError(p)
+	case s.Open:
+		return fmt.Errorf("%w: last orders at %s", ErrClosed, s.LastOrderAt)
+	case s.NextOpening != "":
+		return fmt.Errorf("%w, opens at %s", ErrClosed, s.NextOpening)
+	default:
+		return ErrClosed
+	}
+}
+
+func pausedError(p Pause) error {
+	if p.Until == "" {
+		return ErrPaused
+	}
+	return fmt.Errorf("%w until %s", ErrPaused, shortTime(p.Until))
+}
+
+// shortTime 去掉 2006-01-02 15:04:05 格式中的秒
+func shortTime(s string) string {
+	if len(s) > len("2006-01-02 15:04") {
+		return s[:len("2006-01-02 15:04")]
+	}
+	return s
+}
+
+// HandleStatus 返回门店当前的营业与接单状态以及下一次开始营业的时间
+func HandleStatus(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := RequestStore(w, r)
+	if !ok {
+		return
+	}
+	s, err := FetchStatus(storeID, time.Now())
+	if err != nil {
+		log.Printf("Failed to fetch store status: %v", err)
+		http.Error(w, "Failed to fetch store status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
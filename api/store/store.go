@@ -0,0 +1,219 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"gocode/first/config"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+const clockLayout = "15:04"
+
+// Hours 门店的每周营业时段，同一天可以有多个时段（例如午市和晚市）
+type Hours struct {
+	ID        int    `json:"id"`
+	Days      []int  `json:"days"`      // 1-7 表示周一到周日，为空表示每天
+	OpenTime  string `json:"openTime"`  // 格式 15:04
+	CloseTime string `json:"closeTime"` // 早于 openTime 时表示营业到次日
+}
+
+var db *sql.DB
+
+func init() {
+	var err error
+
+	// 从配置文件中获取数据库连接信息
+	dbc := config.DBConfig
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
+		dbc.Username, dbc.Password, dbc.Host, dbc.Port, dbc.Database)
+
+	// 使用配置信息打开数据库连接
+	db, err = sql.Open("mysql", dsn)
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+
+	// 检查与数据库的连接
+	err = db.Ping()
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	if err = migrateStores(); err != nil {
+		log.Fatal("Failed to migrate stores:", err)
+	}
+	if err = migrateHours(); err != nil {
+		log.Fatal("Failed to migrate store hours:", err)
+	}
+	if err = migrateSpecialHours(); err != nil {
+		log.Fatal("Failed to migrate store special hours:", err)
+	}
+	if err = migratePause(); err != nil {
+		log.Fatal("Failed to migrate store pause:", err)
+	}
+	if err = EnsureScoped(db, "store_hours", "store_special_hours"); err != nil {
+		log.Fatal("Failed to migrate store hours:", err)
+	}
+}
+
+func migrateHours() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS store_hours (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		days VARCHAR(32) NOT NULL DEFAULT '',
+		open_time VARCHAR(5) NOT NULL,
+		close_time VARCHAR(5) NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating store_hours table: %w", err)
+	}
+	return nil
+}
+
+func validateClockRange(open, close string) error {
+	for _, v := range []string{open, close} {
+		if _, err := time.Parse(clockLayout, v); err != nil {
+			return fmt.Errorf("invalid time %q, expected HH:MM", v)
+		}
+	}
+	if open == close {
+		return fmt.Errorf("openTime and closeTime must differ")
+	}
+	return nil
+}
+
+func validateHours(h Hours) error {
+	for _, d := range h.Days {
+		if d < 1 || d > 7 {
+			return fmt.Errorf("invalid day %d, expected 1-7", d)
+		}
+	}
+	return validateClockRange(h.OpenTime, h.CloseTime)
+}
+
+func formatDays(days []int) string {
+	parts := make([]string, 0, len(days))
+	for _, d := range days {
+		parts = append(parts, strconv.Itoa(d))
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseDays(s string) []int {
+	days := []int{}
+	for _, part := range strings.Split(s, ",") {
+		if d, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			days = append(days, d)
+		}
+	}
+	return days
+}
+
+// FetchHours 返回门店的全部每周营业时段
+func FetchHours(storeID int) ([]Hours, error) {
+	rows, err := db.Query("SELECT id, days, open_time, close_time FROM store_hours WHERE store_id = ? ORDER BY open_time, id", storeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query store hours: %w", err)
+	}
+	defer rows.Close()
+
+	hours := []Hours{}
+	for rows.Next() {
+		var h Hours
+		var days string
+		if err := rows.Scan(&h.ID, &days, &h.OpenTime, &h.CloseTime); err != nil {
+			return nil, fmt.Errorf("failed to scan store hours: %w", err)
+		}
+		h.Days = parseDays(days)
+		hours = append(hours, h)
+	}
+	return hours, rows.Err()
+}
+
+func SaveHours(storeID int, h *Hours) error {
+	if h.ID > 0 {
+		_, err := db.Exec("UPDATE store_hours SET days = ?, open_time = ?, close_time = ? WHERE id = ? AND store_id = ?",
+			formatDays(h.Days), h.OpenTime, h.CloseTime, h.ID, storeID)
+		return err
+	}
+
+	res, err := db.Exec("INSERT INTO store_hours (store_id, days, open_time, close_time) VALUES (?, ?, ?, ?)",
+		storeID, formatDays(h.Days), h.OpenTime, h.CloseTime)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	h.ID = int(id)
+	return err
+}
+
+// HandleHours 请求体为空时返回门店的全部营业时段，否则添加或更新一个时段
+func HandleHours(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(body) == 0 {
+		hours, err := FetchHours(storeID)
+		if err != nil {
+			log.Printf("Failed to fetch store hours: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(hours)
+		return
+	}
+
+	var h Hours
+	if err := json.Unmarshal(body, &h); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateHours(h); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := SaveHours(storeID, &h); err != nil {
+		log.Printf("Failed to save store hours: %v", err)
+		http.Error(w, "Failed to save store hours", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(h)
+}
+
+// HandleDeleteHours 根据ID删除营业时段
+func HandleDeleteHours(w http.ResponseWriter, r *http.Request) {
+	storeID, ok := ManagedStore(w, r)
+	if !ok {
+		return
+	}
+	var h Hours
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM store_hours WHERE id = ? AND store_id = ?", h.ID, storeID); err != nil {
+		log.Printf("Failed to delete store hours: %v", err)
+		http.Error(w, "Failed to delete store hours", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Store hours deleted successfully"))
+}
@@ -0,0 +1,459 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocode/first/config"
+	"gocode/first/utils"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultID 默认门店，未指定门店的请求和多门店之前的数据都属于该门店
+const DefaultID = 1
+
+// 管理员角色
+const (
+	RoleManager = "manager" // 只能管理分配给自己的门店
+	RoleOwner   = "owner"   // 可以管理全部门店并查看汇总报表
+)
+
+var (
+	// ErrUnknownStore 表示门店不存在或已停用
+	ErrUnknownStore = errors.New("unknown store")
+	// ErrForbidden 表示管理员无权管理该门店
+	ErrForbidden = errors.New("manager has no access to this store")
+	// ErrUnauthorized 表示请求没有有效的管理员 token
+	ErrUnauthorized = errors.New("manager login required")
+)
+
+// Store 一家门店（分店）
+type Store struct {
+	ID        int     `json:"id"`
+	Name      string  `json:"name"`
+	Address   string  `json:"address"`
+	Phone     string  `json:"phone"`
+	Latitude  float64 `json:"latitude"` // 门店坐标，为0时使用配置文件中的坐标
+	Longitude float64 `json:"longitude"`
+	Active    bool    `json:"active"`
+}
+
+// Manager 通过 Authorization: Bearer <token> 识别的后台管理员
+type Manager struct {
+	ID     int
+	Role   string
+	Stores []int // 分配的门店，店主为全部门店
+}
+
+func migrateStores() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS stores (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(64) NOT NULL,
+		address VARCHAR(255) NOT NULL DEFAULT '',
+		phone VARCHAR(32) NOT NULL DEFAULT '',
+		latitude DOUBLE NOT NULL DEFAULT 0,
+		longitude DOUBLE NOT NULL DEFAULT 0,
+		active TINYINT(1) NOT NULL DEFAULT 1
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating stores table: %w", err)
+	}
+	if _, err := db.Exec("INSERT IGNORE INTO stores (id, name) VALUES (?, ?)", DefaultID, "总店"); err != nil {
+		return fmt.Errorf("seeding default store: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS manager_stores (
+		manager_id INT NOT NULL,
+		store_id INT NOT NULL,
+		PRIMARY KEY (manager_id, store_id)
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating manager_stores table: %w", err)
+	}
+	if err := utils.EnsureColumn(db, "manager", "role", "VARCHAR(16) NOT NULL DEFAULT 'manager'"); err != nil {
+		return err
+	}
+	if err := utils.EnsureColumn(db, "manager", "token", "VARCHAR(128) NULL"); err != nil {
+		return err
+	}
+
+	// 升级到多门店时已有的管理员都管理默认门店，最早注册的管理员成为店主
+	var assigned bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM manager_stores)").Scan(&assigned); err != nil {
+		return err
+	}
+	if !assigned {
+		if _, err := db.Exec("INSERT IGNORE INTO manager_stores (manager_id, store_id) SELECT id, ? FROM manager", DefaultID); err != nil {
+			return fmt.Errorf("assigning managers to the default store: %w", err)
+		}
+	}
+	var owners bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM manager WHERE role = ?)", RoleOwner).Scan(&owners); err != nil {
+		return err
+	}
+	if !owners {
+		if _, err := db.Exec("UPDATE manager SET role = ? ORDER BY id LIMIT 1", RoleOwner); err != nil {
+			return fmt.Errorf("promoting the first manager to owner: %w", err)
+		}
+	}
+	return nil
+}
+
+// EnsureScoped 给业务表加上 store_id 列，已有数据属于默认门店；
+// 订单明细等从属表通过所属的主表区分门店，不需要该列
+func EnsureScoped(db *sql.DB, tables ...string) error {
+	for _, table := range tables {
+		if err := utils.EnsureColumn(db, table, "store_id", fmt.Sprintf("INT NOT NULL DEFAULT %d", DefaultID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const storeColumns = "id, name, address, phone, latitude, longitude, active"
+
+func scanStore(row interface{ Scan(...any) error }) (Store, error) {
+	var s Store
+	err := row.Scan(&s.ID, &s.Name, &s.Address, &s.Phone, &s.Latitude, &s.Longitude, &s.Active)
+	return s, err
+}
+
+// FetchStores 返回全部门店
+func FetchStores() ([]Store, error) {
+	rows, err := db.Query("SELECT " + storeColumns + " FROM stores ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stores: %w", err)
+	}
+	defer rows.Close()
+
+	stores := []Store{}
+	for rows.Next() {
+		s, err := scanStore(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan store: %w", err)
+		}
+		stores = append(stores, s)
+	}
+	return stores, rows.Err()
+}
+
+// Lookup 返回营业中的门店
+func Lookup(id int) (Store, error) {
+	s, err := scanStore(db.QueryRow("SELECT "+storeColumns+" FROM stores WHERE id = ?", id))
+	if err == sql.ErrNoRows || err == nil && !s.Active {
+		return s, fmt.Errorf("%w: %d", ErrUnknownStore, id)
+	}
+	return s, err
+}
+
+// Coordinates 返回门店坐标，门店没有填写坐标时使用配置文件中的坐标
+func Coordinates(storeID int) (float64, float64, error) {
+	s, err := Lookup(storeID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if s.Latitude == 0 && s.Longitude == 0 {
+		return config.C.Store.Latitude, config.C.Store.Longitude, nil
+	}
+	return s.Latitude, s.Longitude, nil
+}
+
+// SaveStore 添加门店，ID 大于0时更新该门店，门店不存在时返回 ErrUnknownStore
+func SaveStore(s *Store) error {
+	if s.ID > 0 {
+		res, err := db.Exec("UPDATE stores SET name = ?, address = ?, phone = ?, latitude = ?, longitude = ?, active = ? WHERE id = ?",
+			s.Name, s.Address, s.Phone, s.Latitude, s.Longitude, s.Active, s.ID)
+		if err != nil {
+			return err
+		}
+		// 内容没有变化时影响行数也为0，需要确认门店是否存在
+		if n, _ := res.RowsAffected(); n == 0 {
+			var exists bool
+			if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM stores WHERE id = ?)", s.ID).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("%w: %d", ErrUnknownStore, s.ID)
+			}
+		}
+		return nil
+	}
+
+	res, err := db.Exec("INSERT INTO stores (name, address, phone, latitude, longitude, active) VALUES (?, ?, ?, ?, ?, ?)",
+		s.Name, s.Address, s.Phone, s.Latitude, s.Longitude, s.Active)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	s.ID = int(id)
+	return err
+}
+
+// ManagerByToken 根据登录 token 查找管理员，token 无效时返回 nil
+func ManagerByToken(token string) (*Manager, error) {
+	if token == "" {
+		return nil, nil
+	}
+	m := &Manager{}
+	err := db.QueryRow("SELECT id, role FROM manager WHERE token = ?", token).Scan(&m.ID, &m.Role)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	query, args := "SELECT store_id FROM manager_stores WHERE manager_id = ? ORDER BY store_id", []any{m.ID}
+	if m.Role == RoleOwner {
+		query, args = "SELECT id FROM stores ORDER BY id", nil
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		m.Stores = append(m.Stores, id)
+	}
+	return m, rows.Err()
+}
+
+func (m *Manager) canManage(storeID int) bool {
+	for _, id := range m.Stores {
+		if id == storeID {
+			return true
+		}
+	}
+	return false
+}
+
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Resolve 返回请求所属的门店：取自 X-Store-ID 请求头或 store_id 参数，都没有时为默认门店，
+// 只管理一家门店的管理员为其门店；带有管理员 token 的请求只能访问分配给该管理员的门店。
+// 顾客可以自行选择门店，只用于菜单、营业状态等公开接口，后台接口使用 ManagedStore
+func Resolve(r *http.Request) (int, error) {
+	m, err := ManagerByToken(bearerToken(r))
+	if err != nil {
+		return 0, err
+	}
+	return resolveFor(r, m)
+}
+
+// requestedStore 返回 X-Store-ID 请求头或 store_id 参数，都没有时为空
+func requestedStore(r *http.Request) string {
+	if v := r.Header.Get("X-Store-ID"); v != "" {
+		return v
+	}
+	return r.URL.Query().Get("store_id")
+}
+
+// Specified 返回请求是否明确指定了门店
+func Specified(r *http.Request) bool {
+	return requestedStore(r) != ""
+}
+
+// resolveFor 返回请求指定的门店，m 不为空时校验管理员可以管理该门店
+func resolveFor(r *http.Request, m *Manager) (int, error) {
+	var err error
+	v := requestedStore(r)
+	id := DefaultID
+	if v != "" {
+		if id, err = strconv.Atoi(v); err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrUnknownStore, v)
+		}
+	} else if m != nil && len(m.Stores) == 1 {
+		id = m.Stores[0]
+	}
+
+	if _, err := Lookup(id); err != nil {
+		return 0, err
+	}
+	if m != nil && !m.canManage(id) {
+		return 0, fmt.Errorf("%w: %d", ErrForbidden, id)
+	}
+	return id, nil
+}
+
+// RequestStore 与 Resolve 相同，出错时写入错误响应并返回 false
+func RequestStore(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := Resolve(r)
+	return id, storeResult(w, err)
+}
+
+// ManagedStore 返回后台请求所属的门店：请求必须带有有效的管理员 token，且门店已分配给该管理员；
+// 出错时写入错误响应（未登录为 401）并返回 false
+func ManagedStore(w http.ResponseWriter, r *http.Request) (int, bool) {
+	m, err := ManagerByToken(bearerToken(r))
+	if err == nil && m == nil {
+		err = ErrUnauthorized
+	}
+	id := 0
+	if err == nil {
+		id, err = resolveFor(r, m)
+	}
+	return id, storeResult(w, err)
+}
+
+// storeResult 在 err 不为空时写入对应的错误响应，返回是否成功
+func storeResult(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrUnauthorized):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, ErrUnknownStore):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Printf("Failed to resolve store: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// RequireOwner 校验请求来自店主，否则写入错误响应并返回 false；用于门店、汇总报表等不属于单个门店的数据
+func RequireOwner(w http.ResponseWriter, r *http.Request) bool {
+	m, err := ManagerByToken(bearerToken(r))
+	if err != nil {
+		log.Printf("Failed to look up manager: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return false
+	}
+	if m == nil {
+		http.Error(w, ErrUnauthorized.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if m.Role != RoleOwner {
+		http.Error(w, "Owner access required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// HandleStores 返回全部门店，顾客端用于选择门店
+func HandleStores(w http.ResponseWriter, r *http.Request) {
+	stores, err := FetchStores()
+	if err != nil {
+		log.Printf("Failed to fetch stores: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stores)
+}
+
+// HandleSaveStore 添加或更新门店，仅店主可用
+func HandleSaveStore(w http.ResponseWriter, r *http.Request) {
+	if !RequireOwner(w, r) {
+		return
+	}
+	var s Store
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(s.Name) == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if s.ID == DefaultID && !s.Active {
+		http.Error(w, "the default store cannot be deactivated", http.StatusBadRequest)
+		return
+	}
+	err := SaveStore(&s)
+	if errors.Is(err, ErrUnknownStore) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save store: %v", err)
+		http.Error(w, "Failed to save store", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// HandleAssignManager 设置管理员管理的门店和角色，仅店主可用；
+// 请求体为 {"managerId": 2, "role": "manager", "stores": [1, 3]}
+func HandleAssignManager(w http.ResponseWriter, r *http.Request) {
+	if !RequireOwner(w, r) {
+		return
+	}
+	var req struct {
+		ManagerID int    `json:"managerId"`
+		Role      string `json:"role"`
+		Stores    []int  `json:"stores"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = RoleManager
+	}
+	if req.Role != RoleManager && req.Role != RoleOwner {
+		http.Error(w, fmt.Sprintf("invalid role %q", req.Role), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Failed to start transaction: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE manager SET role = ? WHERE id = ?", req.Role, req.ManagerID)
+	if err != nil {
+		log.Printf("Failed to update manager role: %v", err)
+		http.Error(w, "Failed to assign manager", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM manager WHERE id = ?)", req.ManagerID).Scan(&exists); err != nil || !exists {
+			http.Error(w, "Manager not found", http.StatusNotFound)
+			return
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM manager_stores WHERE manager_id = ?", req.ManagerID); err != nil {
+		log.Printf("Failed to clear manager stores: %v", err)
+		http.Error(w, "Failed to assign manager", http.StatusInternalServerError)
+		return
+	}
+	for _, id := range req.Stores {
+		if _, err := Lookup(id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := tx.Exec("INSERT IGNORE INTO manager_stores (manager_id, store_id) VALUES (?, ?)", req.ManagerID, id); err != nil {
+			log.Printf("Failed to assign manager store: %v", err)
+			http.Error(w, "Failed to assign manager", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to commit manager stores: %v", err)
+		http.Error(w, "Failed to assign manager", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Manager assigned successfully"))
+}
@@ -62,9 +62,13 @@ func HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if user.ID <= 0 {
+		http.Error(w, "Missing user id", http.StatusBadRequest)
+		return
+	}
 
-	// 根据用户名删除用户，这里使用 Name 字段
-	err = DeleteUserByName(user.Name)
+	// 根据用户ID将用户移入归档
+	err = DeleteUserByID(user.ID)
 	if err != nil {
 		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
 		return
@@ -74,20 +78,61 @@ func HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("User deleted successfully"))
 }
 
-// DeleteUserByName 从数据库中删除一个用户
-func DeleteUserByName(name string) error {
-	// 准备 SQL 语句，这里假设你已经有了数据库连接 `db`
-	stmt, err := db.Prepare("DELETE FROM user WHERE name = ?")
+// DeleteUserByID 将一个用户移入归档
+func DeleteUserByID(id int) error {
+	_, err := db.Exec("UPDATE user SET deleted_at = NOW() WHERE id = ? AND deleted_at IS NULL", id)
 	if err != nil {
-		return fmt.Errorf("error preparing delete statement: %w", err)
+		return fmt.Errorf("error archiving user: %w", err)
 	}
-	defer stmt.Close()
 
-	// 执行 SQL 语句
-	_, err = stmt.Exec(name)
+	return nil
+}
+
+// HandleArchivedUsers 返回已归档的用户
+func HandleArchivedUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := queryUsers(`SELECT id, date, name, address, email, gender, phone FROM user WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC`)
 	if err != nil {
-		return fmt.Errorf("error executing delete statement: %w", err)
+		http.Error(w, "Failed to query user data", http.StatusInternalServerError)
+		log.Println(err)
+		return
 	}
 
-	return nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// HandleRestoreUser 根据ID恢复已归档的用户，邮箱已被其他用户使用时拒绝恢复
+func HandleRestoreUser(w http.ResponseWriter, r *http.Request) {
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var taken bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM user a JOIN user b ON a.email = b.email
+		WHERE b.id = ? AND a.id <> b.id AND a.deleted_at IS NULL)`, user.ID).Scan(&taken)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if taken {
+		http.Error(w, "Email is already used by another user", http.StatusConflict)
+		return
+	}
+
+	res, err := db.Exec("UPDATE user SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", user.ID)
+	if err != nil {
+		http.Error(w, "Failed to restore user", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Archived user not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("User restored successfully"))
 }
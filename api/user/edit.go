@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"gocode/first/config"
+	"gocode/first/utils"
 	"log"
 	"net/http"
 )
@@ -14,6 +15,7 @@ import (
 var db *sql.DB // 假设这是在其他地方初始化的数据库连接
 
 type User struct {
+	ID      int    `json:"id"`
 	Date    string `json:"date"`
 	Name    string `json:"name"`
 	Address string `json:"address"`
@@ -41,18 +43,22 @@ func init() {
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+
+	if err = utils.EnsureColumn(db, "user", "deleted_at", "DATETIME NULL"); err != nil {
+		log.Fatal("Failed to migrate users:", err)
+	}
 }
 func CheckUser(w http.ResponseWriter, r *http.Request) {
 	// Prepare and execute the SQL queries
 	var userCount int
-	err := db.QueryRow("SELECT COUNT(*) FROM user").Scan(&userCount)
+	err := db.QueryRow("SELECT COUNT(*) FROM user WHERE deleted_at IS NULL").Scan(&userCount)
 	if err != nil {
 		http.Error(w, "Failed to query total number of users", http.StatusInternalServerError)
 		return
 	}
 
 	var totalAnnouncements int
-	err = db.QueryRow("SELECT COUNT(*) FROM announcements").Scan(&totalAnnouncements)
+	err = db.QueryRow("SELECT COUNT(*) FROM announcements WHERE deleted_at IS NULL").Scan(&totalAnnouncements)
 	if err != nil {
 		http.Error(w, "Failed to query total number of announcements", http.StatusInternalServerError)
 		return
@@ -87,7 +93,7 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 	} else if user.Gender == "女" {
 		user.Gender = "female"
 	}
-	query := `UPDATE user SET date = ?, address = ?, name = ?, gender = ?, phone = ? WHERE email = ?`
+	query := `UPDATE user SET date = ?, address = ?, name = ?, gender = ?, phone = ? WHERE email = ? AND deleted_at IS NULL`
 	_, err := db.Exec(query, user.Date, user.Address, user.Name, user.Gender, user.Phone, user.Email)
 	if err != nil {
 		http.Error(w, "Failed to update user", http.StatusInternalServerError)
@@ -112,7 +118,7 @@ func CheckEmailExists(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "SELECT EXISTS(SELECT 1 FROM user WHERE email = ?)"
+	query := "SELECT EXISTS(SELECT 1 FROM user WHERE email = ? AND deleted_at IS NULL)"
 	var exists bool
 	err := db.QueryRow(query, req.Email).Scan(&exists)
 	if err != nil {
@@ -132,22 +138,30 @@ func PostGetUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var users []User
-	query := `SELECT date, name, address, email, gender, phone FROM user`
-	rows, err := db.Query(query)
+	users, err := queryUsers(`SELECT id, date, name, address, email, gender, phone FROM user WHERE deleted_at IS NULL`)
 	if err != nil {
 		http.Error(w, "Failed to query user data", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// queryUsers 执行选出用户各列的查询，并将性别从英文转换为中文
+func queryUsers(query string, args ...any) ([]User, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
+	var users []User
 	for rows.Next() {
 		var user User
-		if err := rows.Scan(&user.Date, &user.Name, &user.Address, &user.Email, &user.Gender, &user.Phone); err != nil {
-			http.Error(w, "Failed to parse user data", http.StatusInternalServerError)
-			log.Println(err)
-			return
+		if err := rows.Scan(&user.ID, &user.Date, &user.Name, &user.Address, &user.Email, &user.Gender, &user.Phone); err != nil {
+			return nil, err
 		}
 		// 在存储到数组之前，将性别从英文转换为中文
 		switch user.Gender {
@@ -158,7 +172,5 @@ func PostGetUsers(w http.ResponseWriter, r *http.Request) {
 		}
 		users = append(users, user)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+	return users, rows.Err()
 }
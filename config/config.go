@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
+	_ "time/tzdata"
 
 	_ "github.com/go-sql-driver/mysql"
 	"gopkg.in/yaml.v3"
@@ -40,16 +42,110 @@ type Wechat struct {
 	PrivateKey string `yaml:"private_key"`
 	Domain     string `yaml:"domain"`
 	Port       string `yaml:"port"`
+	// 小程序订阅消息模板，键为通知事件
+	Templates map[string]SubscribeTemplate `yaml:"templates"`
+}
+
+// SubscribeTemplate 小程序订阅消息模板
+type SubscribeTemplate struct {
+	ID   string `yaml:"id"`
+	Page string `yaml:"page"` // 点击消息打开的小程序页面
+	// 通知字段到模板关键词的映射，例如 table: thing2
+	Fields map[string]string `yaml:"fields"`
+}
+
+type Store struct {
+	// 门店编号，写入桌台二维码
+	ID int `yaml:"id"`
+	// 门店所在时区，例如 Asia/Shanghai
+	Timezone string `yaml:"timezone"`
+	// 门店坐标，按半径划分的配送区域以此为圆心
+	Latitude  float64 `yaml:"latitude"`
+	Longitude float64 `yaml:"longitude"`
+	// 桌台二维码的签名密钥
+	QRSecret string `yaml:"qr_secret"`
+	// 扫码后打开的点餐页面地址，二维码内容为该地址加上 token 参数
+	OrderURL string `yaml:"order_url"`
+	// 预订开始前多少分钟发送提醒，为0时使用120分钟
+	ReminderMinutes int `yaml:"reminder_minutes"`
+	// 超过预订时间多少分钟未到店记为爽约，为0时使用15分钟
+	NoShowGraceMinutes int `yaml:"no_show_grace_minutes"`
+	// 预订订金规则
+	Deposit DepositPolicy `yaml:"deposit"`
+	// 外带与外送的收费和时间规则
+	Fulfillment FulfillmentPolicy `yaml:"fulfillment"`
+	// 打烊前多少分钟停止接受即时订单，为0时营业到打烊都可下单
+	LastOrderMinutes int `yaml:"last_order_minutes"`
+	// 预约取餐的时段与出单规则
+	Scheduling SchedulingPolicy `yaml:"scheduling"`
+}
+
+// SchedulingPolicy 预约订单的规则，外带订单填写取餐时间即为预约订单
+type SchedulingPolicy struct {
+	// 取餐时段的长度（分钟），为0时使用15分钟
+	SlotMinutes int `yaml:"slot_minutes"`
+	// 每个取餐时段最多接多少个预约订单，为0时不限
+	SlotCapacity int `yaml:"slot_capacity"`
+	// 取餐时间前多少分钟把预约订单放到后厨，为0时使用30分钟
+	ReleaseMinutes int `yaml:"release_minutes"`
+	// 最多提前多少天预约，为0时使用7天
+	MaxDays int `yaml:"max_days"`
+}
+
+// FulfillmentPolicy 外带与外送订单的规则
+type FulfillmentPolicy struct {
+	// 外带和外送每件商品的打包费（元）
+	PackagingFee float64 `yaml:"packaging_fee"`
+	// 外送费（元）
+	DeliveryFee float64 `yaml:"delivery_fee"`
+	// 商品金额达到该值免外送费，为0时不免
+	FreeDeliveryOver float64 `yaml:"free_delivery_over"`
+	// 外送订单的最低商品金额，为0时不限
+	MinDeliveryAmount float64 `yaml:"min_delivery_amount"`
+	// 外带取餐时间至少在下单后多少分钟，为0时使用15分钟
+	PickupLeadMinutes int `yaml:"pickup_lead_minutes"`
+	// 每位骑手同时配送的订单数，为0时使用1
+	RiderCapacity int `yaml:"rider_capacity"`
+}
+
+// DepositPolicy 预订订金规则，PerPerson 为0时不收订金
+type DepositPolicy struct {
+	// 每位顾客的订金金额（元）
+	PerPerson float64 `yaml:"per_person"`
+	// 达到该人数的预订需要订金，为0时所有预订都需要
+	MinPeople int `yaml:"min_people"`
+	// 爽约达到该次数的顾客无论人数都需要订金，为0时不按爽约记录收取
+	NoShowThreshold int `yaml:"no_show_threshold"`
+	// 下单后多少分钟内未支付订金则取消预订，为0时使用15分钟
+	PayMinutes int `yaml:"pay_minutes"`
+	// 预订开始前至少多少小时取消可全额退还订金，否则订金不退
+	RefundHours int `yaml:"refund_hours"`
+	// 爽约时是否退还订金，默认不退
+	RefundNoShow bool `yaml:"refund_no_show"`
 }
 
 type Config struct {
 	Wechat Wechat `yaml:"wechat"`
+	Store  Store  `yaml:"store"`
 }
 
 var (
 	C = new(Config)
 )
 
+// Location 返回门店所在时区，未配置或无法识别时使用服务器本地时区
+func Location() *time.Location {
+	if C.Store.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(C.Store.Timezone)
+	if err != nil {
+		log.Printf("时区配置无效：%v", err)
+		return time.Local
+	}
+	return loc
+}
+
 func createDBConnection() (*sql.DB, error) {
 	const (
 		username = "root"
@@ -89,7 +185,7 @@ func Load(path string) error {
 	}
 	defer db.Close()
 
-	rows, err := db.Query("SELECT AppID, AppSecret, MchId, MchKey, MchNumber FROM wpay LIMIT 1")
+	rows, err := db.Query("SELECT AppID, AppSecret, MchId, MchKey, MchNumber FROM wpay WHERE store_id = 1 LIMIT 1")
 	if err != nil {
 		log.Printf("数据库查询失败：%v", err)
 		return err
@@ -7,7 +7,9 @@ import (
 	"gocode/first/api/cheapgoods"
 	"gocode/first/api/desk"
 	"gocode/first/api/email"
+	"gocode/first/api/i18n"
 	"gocode/first/api/login"
+	"gocode/first/api/notify"
 	"gocode/first/api/openId"
 	orderHandlers "gocode/first/api/order"
 	"gocode/first/api/pay"
@@ -16,11 +18,15 @@ import (
 	"gocode/first/api/product"
 	"gocode/first/api/redeem"
 	"gocode/first/api/register"
+	"gocode/first/api/rider"
+	"gocode/first/api/store"
 	"gocode/first/api/user"
 	"gocode/first/api/userChart"
 	"gocode/first/config"
 	"gocode/first/utils"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -29,6 +35,13 @@ import (
 func main() {
 	config.Load("stay.yaml")
 	utils.Client = utils.NewWeChatClient()
+	if err := product.SeedPriceHistory(); err != nil {
+		log.Fatal("Failed to seed price history:", err)
+	}
+	// 后台执行到期的计划调价
+	go product.RunPriceScheduler(time.Minute)
+	go notify.RunScheduler(time.Minute)
+	go desk.RunReservationScheduler(time.Minute)
 	r := mux.NewRouter()
 	//fmt.Println("API URL:", config.APIUrl)
 	// 使用login包中定义的CORS中间件
@@ -45,6 +58,23 @@ func main() {
 	r.HandleFunc("/api/products", product.HandleProducts).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/reset", product.HandleResetProductInfo).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/delete", product.HandleDeleteProduct).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/products/archive", product.HandleArchivedProducts).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/products/restore", product.HandleRestoreProduct).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/products/price", product.HandleEffectivePrice).Methods("GET")
+	r.HandleFunc("/api/products/price/history", product.HandlePriceHistory).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/products/price/schedule", product.HandleSchedulePriceChange).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/products/price/cancel", product.HandleCancelPriceChange).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/products/export", product.HandleExportProducts).Methods("GET")
+	r.HandleFunc("/api/products/import", product.HandleImportProducts).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/products/search", product.HandleSearchProducts).Methods("GET")
+	// 菜单分类路由
+	r.HandleFunc("/api/category", product.HandleCategories).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/category/delete", product.HandleDeleteCategory).Methods("POST", "OPTIONS")
+	// 商品与分类的供应时段路由
+	r.HandleFunc("/api/schedule", product.HandleSchedules).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/schedule/delete", product.HandleDeleteSchedule).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/schedule/override", product.HandleScheduleOverrides).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/schedule/override/delete", product.HandleDeleteScheduleOverride).Methods("POST", "OPTIONS")
 	//特惠商品路由
 	r.HandleFunc("/api/cheapgoods", cheapgoods.HandleProducts).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/cheapgoods/reset", cheapgoods.HandleResetProductInfo).Methods("POST", "OPTIONS")
@@ -52,6 +82,8 @@ func main() {
 	// 用户路由
 	r.HandleFunc("/api/user", user.HandleUserRequest).Methods("POST") // 使用HandleUserRequest处理POST请求
 	r.HandleFunc("/api/user/delete", user.HandleDeleteUser).Methods("POST")
+	r.HandleFunc("/api/user/archive", user.HandleArchivedUsers).Methods("POST")
+	r.HandleFunc("/api/user/restore", user.HandleRestoreUser).Methods("POST")
 	r.HandleFunc("/api/user/checkEmail", user.CheckEmailExists).Methods("POST")
 	r.HandleFunc("/api/user/countUser", user.CheckUser).Methods("POST")
 	// 在 main 包中的 main 函数里
@@ -61,6 +93,12 @@ func main() {
 	r.HandleFunc("/api/announcement/add", annocement.InsertAnnouncement).Methods("POST")
 	r.HandleFunc("/api/announcement/update", annocement.UpdateAnnouncement).Methods("POST")
 	r.HandleFunc("/api/announcement/delete", annocement.DeleteAnnouncement).Methods("POST")
+	r.HandleFunc("/api/announcement/archive", annocement.FetchArchivedAnnouncements).Methods("POST")
+	r.HandleFunc("/api/announcement/restore", annocement.RestoreAnnouncement).Methods("POST")
+	// 菜单与公告的多语言译文
+	r.HandleFunc("/api/translation", i18n.HandleTranslations).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/translation/save", i18n.HandleSaveTranslations).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/translation/delete", i18n.HandleDeleteTranslation).Methods("POST", "OPTIONS")
 	// pesonList路由配置
 	r.HandleFunc("/api/personList", personlist.GetPersonList).Methods("POST")
 	r.HandleFunc("/api/personList/add", personlist.InsertPerson).Methods("POST")
@@ -70,19 +108,103 @@ func main() {
 	r.HandleFunc("/api/orders", orderHandlers.GetOrders).Methods("GET")
 	r.HandleFunc("/api/order/check", orderHandlers.CheckOrder).Methods("POST")
 	r.HandleFunc("/api/order/detail/{order_id}", orderHandlers.GetOrderDetail).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/order/ticket/{order_id}", orderHandlers.GetKitchenTicket).Methods("GET")
+	r.HandleFunc("/api/order/session/{session_id}", orderHandlers.GetSessionOrders).Methods("GET")
 	r.HandleFunc("/api/orders/update/{order_id}", orderHandlers.UpdateOrder).Methods("PUT")
 	r.HandleFunc("/api/orders/add", orderHandlers.AddOrder).Methods("POST")
+	r.HandleFunc("/api/orders/quote", orderHandlers.HandleQuoteOrder).Methods("POST")
 	r.HandleFunc("/api/orders/delete", orderHandlers.BatchDeleteOrders).Methods("POST")
 	r.HandleFunc("/api/orders/getSpec", orderHandlers.GetSpecificOrder).Methods("POST")
+	// 门店营业时间、节假日与特殊营业时间、暂停接单和营业状态
+	r.HandleFunc("/api/store/hours", store.HandleHours).Methods("POST")
+	r.HandleFunc("/api/store/hours/delete", store.HandleDeleteHours).Methods("POST")
+	r.HandleFunc("/api/store/special", store.HandleSpecialHours).Methods("POST")
+	r.HandleFunc("/api/store/special/delete", store.HandleDeleteSpecialHours).Methods("POST")
+	r.HandleFunc("/api/store/pause", store.HandlePause).Methods("POST")
+	r.HandleFunc("/api/store/resume", store.HandleResume).Methods("POST")
+	r.HandleFunc("/api/store/status", store.HandleStatus).Methods("GET")
+	// 门店管理、管理员门店分配与跨门店汇总报表
+	r.HandleFunc("/api/stores", store.HandleStores).Methods("GET")
+	r.HandleFunc("/api/stores/save", store.HandleSaveStore).Methods("POST")
+	r.HandleFunc("/api/stores/managers", store.HandleAssignManager).Methods("POST")
+	r.HandleFunc("/api/stores/report", store.HandleReport).Methods("GET")
+	// 预约取餐时段、后厨出餐列表与备餐预测
+	r.HandleFunc("/api/orders/slots", orderHandlers.HandleSlots).Methods("GET")
+	r.HandleFunc("/api/kitchen/orders", orderHandlers.HandleKitchenOrders).Methods("GET")
+	r.HandleFunc("/api/kitchen/forecast", orderHandlers.HandlePrepForecast).Methods("GET")
+	// 配送区域与外送报价
+	r.HandleFunc("/api/delivery/zones", orderHandlers.HandleZones).Methods("GET")
+	r.HandleFunc("/api/delivery/zones/save", orderHandlers.HandleSaveZone).Methods("POST")
+	r.HandleFunc("/api/delivery/zones/delete", orderHandlers.HandleDeleteZone).Methods("POST")
+	r.HandleFunc("/api/delivery/quote", orderHandlers.HandleDeliveryQuote).Methods("GET")
+	// 骑手账号、派单与配送跟踪
+	r.HandleFunc("/api/riders", rider.HandleRiders).Methods("POST")
+	r.HandleFunc("/api/riders/save", rider.HandleSaveRider).Methods("POST")
+	r.HandleFunc("/api/riders/deactivate", rider.HandleDeactivateRider).Methods("POST")
+	r.HandleFunc("/api/delivery/pending", rider.HandlePendingDeliveries).Methods("GET")
+	r.HandleFunc("/api/delivery/assign", rider.HandleAssign).Methods("POST")
+	r.HandleFunc("/api/delivery/unassign", rider.HandleUnassign).Methods("POST")
+	r.HandleFunc("/api/rider/login", rider.HandleRiderLogin).Methods("POST")
+	r.HandleFunc("/api/rider/status", rider.HandleRiderStatus).Methods("POST")
+	r.HandleFunc("/api/rider/orders", rider.HandleRiderOrders).Methods("GET")
+	r.HandleFunc("/api/rider/pickup", rider.HandlePickUp).Methods("POST")
+	r.HandleFunc("/api/rider/deliver", rider.HandleDelivered).Methods("POST")
+	r.HandleFunc("/api/rider/ping", rider.HandlePing).Methods("POST")
+	r.HandleFunc("/api/order/tracking/{order_id}", rider.HandleTracking).Methods("GET")
+	// 分单：按菜品、座位或平均拆分账单，每一份单独支付并出具小票
+	r.HandleFunc("/api/order/split", orderHandlers.HandleCreateSplit).Methods("POST")
+	r.HandleFunc("/api/order/split/pay", orderHandlers.HandlePayPart).Methods("POST")
+	r.HandleFunc("/api/order/split/confirm", orderHandlers.HandleConfirmPart).Methods("POST")
+	r.HandleFunc("/api/order/split/receipt/{part_id}", orderHandlers.GetPartReceipt).Methods("GET")
+	r.HandleFunc("/api/order/split/{id:[0-9]+}", orderHandlers.HandleSplit).Methods("GET")
 	// 添加餐桌数据处理路由
 	r.HandleFunc("/api/desk", desk.HandleTableData).Methods("POST") // 修改此处为HandleTableData
 	r.HandleFunc("/api/desk/delete", desk.HandleDeskData).Methods("POST")
+	r.HandleFunc("/api/desk/archive", desk.HandleArchivedTables).Methods("POST")
+	r.HandleFunc("/api/desk/restore", desk.HandleRestoreTable).Methods("POST")
 	r.HandleFunc("/api/desk/update", desk.HandleUpdateDeskData).Methods("POST")
 	r.HandleFunc("/api/desk/add", desk.HandleAddTable).Methods("POST")
+	// 桌台二维码与扫码就餐会话
+	r.HandleFunc("/api/desk/qrcode/{id}", desk.HandleTableQRCode).Methods("GET")
+	r.HandleFunc("/api/desk/qrcode/rotate", desk.HandleRotateQRCode).Methods("POST")
+	r.HandleFunc("/api/desk/session/open", desk.HandleOpenSession).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/desk/session/close", desk.HandleCloseSession).Methods("POST")
+	// 餐桌实时状态、清台确认与状态记录
+	r.HandleFunc("/api/desk/floor", desk.HandleFloorStatus).Methods("GET")
+	r.HandleFunc("/api/desk/status/confirm", desk.HandleConfirmCleaned).Methods("POST")
+	r.HandleFunc("/api/desk/status/history", desk.HandleStatusHistory).Methods("POST")
+	// 楼面区域、平面图与拼桌
+	r.HandleFunc("/api/desk/areas", desk.HandleAreas).Methods("GET")
+	r.HandleFunc("/api/desk/areas/save", desk.HandleSaveArea).Methods("POST")
+	r.HandleFunc("/api/desk/areas/delete", desk.HandleDeleteArea).Methods("POST")
+	r.HandleFunc("/api/desk/layout", desk.HandleSaveLayout).Methods("POST")
+	r.HandleFunc("/api/desk/merge", desk.HandleMergeTables).Methods("POST")
+	r.HandleFunc("/api/desk/split", desk.HandleSplitTables).Methods("POST")
 	// 添加预订信息处理路由
 	r.HandleFunc("/api/reservation", desk.HandleGetAllReservations).Methods("GET")
 	r.HandleFunc("/api/reservation/add", desk.AddReservation).Methods("POSt")
 	r.HandleFunc("/api/reservation/delete", desk.DeleteReservation).Methods("POSt")
+	r.HandleFunc("/api/reservation/update", desk.HandleUpdateReservation).Methods("POST")
+	r.HandleFunc("/api/reservation/cancel", desk.CancelReservation).Methods("POST")
+	r.HandleFunc("/api/reservation/arrive", desk.HandleArriveReservation).Methods("POST")
+	r.HandleFunc("/api/reservation/noshow", desk.HandleNoShowHistory).Methods("GET")
+	r.HandleFunc("/api/reservation/deposit/pay", desk.HandlePayDeposit).Methods("POST")
+	r.HandleFunc("/api/reservation/deposit/confirm", desk.HandleConfirmDeposit).Methods("POST")
+	r.HandleFunc("/api/reservation/deposit/{id}", desk.HandleDeposit).Methods("GET")
+	r.HandleFunc("/api/reservation/availability", desk.HandleAvailability).Methods("GET")
+	// 预订日历订阅与导出
+	r.HandleFunc("/api/reservation/export", desk.HandleExportReservations).Methods("GET")
+	r.HandleFunc("/api/reservation/calendar", desk.HandleCalendarFeeds).Methods("POST")
+	r.HandleFunc("/api/reservation/calendar/create", desk.HandleCreateCalendarFeed).Methods("POST")
+	r.HandleFunc("/api/reservation/calendar/revoke", desk.HandleRevokeCalendarFeed).Methods("POST")
+	r.HandleFunc("/api/reservation/calendar/{token:[0-9a-f]+}.ics", desk.HandleCalendarFeed).Methods("GET")
+	// 排队取号路由
+	r.HandleFunc("/api/waitlist", desk.HandleWaitlist).Methods("POST")
+	r.HandleFunc("/api/waitlist/join", desk.HandleJoinWaitlist).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/waitlist/call", desk.HandleCallNext).Methods("POST")
+	r.HandleFunc("/api/waitlist/seat", desk.HandleSeatParty).Methods("POST")
+	r.HandleFunc("/api/waitlist/cancel", desk.HandleCancelWaitlist).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/waitlist/{id}", desk.HandleWaitlistEntry).Methods("GET")
 	// 添加用户图表数据处理路由
 	r.HandleFunc("/api/userChart", userChart.ChartDataHandler).Methods("GET")
 	r.HandleFunc("/api/userChart/info", userChart.UserRecordsHandler).Methods("GET")
@@ -115,7 +237,7 @@ func main() {
 	r.HandleFunc("/api/verifyCode", email.VerifyCodeHandler).Methods("POST")
 	r.HandleFunc("/api/auth", auth.AuthHandler).Methods("POST")
 	// 应用CORS，允许来自前端的跨源请求
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"})
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "X-Store-ID"})
 	originsOk := handlers.AllowedOrigins([]string{config.C.Wechat.Domain})
 	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"})
 	credentialsOk := handlers.AllowCredentials() // 允许携带凭证
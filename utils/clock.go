@@ -0,0 +1,32 @@
+package utils
+
+// 以下时段判断中的时间均为 15:04 格式的字符串，start 或 end 为空表示全天，
+// start 大于 end 表示跨午夜的时段（例如 22:00-02:00）
+
+// InClockRange 判断 now 是否在 [start, end) 内，不区分日期
+func InClockRange(now, start, end string) bool {
+	if start == "" || end == "" {
+		return true
+	}
+	if start <= end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// InSameDayPart 判断 now 是否在当天开始的时段内；跨午夜的时段当天只算 start 之后，
+// 午夜之后的部分属于次日，由 InCarryOver 判断
+func InSameDayPart(now, start, end string) bool {
+	if start == "" || end == "" || start <= end {
+		return InClockRange(now, start, end)
+	}
+	return now >= start
+}
+
+// InCarryOver 判断 now 是否在前一天开始、跨过午夜的时段内
+func InCarryOver(now, start, end string) bool {
+	if start == "" || end == "" || start <= end {
+		return false
+	}
+	return now < end
+}
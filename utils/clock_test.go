@@ -0,0 +1,50 @@
+package utils
+
+import "testing"
+
+func TestInClockRange(t *testing.T) {
+	cases := []struct {
+		now, start, end string
+		want            bool
+	}{
+		{"12:00", "", "", true},
+		{"10:00", "10:00", "14:00", true},
+		{"14:00", "10:00", "14:00", false},
+		{"09:59", "10:00", "14:00", false},
+		{"23:00", "22:00", "02:00", true},
+		{"01:30", "22:00", "02:00", true},
+		{"02:00", "22:00", "02:00", false},
+		{"12:00", "22:00", "02:00", false},
+	}
+	for _, c := range cases {
+		if got := InClockRange(c.now, c.start, c.end); got != c.want {
+			t.Errorf("InClockRange(%q, %q, %q) = %v, want %v", c.now, c.start, c.end, got, c.want)
+		}
+	}
+}
+
+// 跨午夜的时段：开始当天只算 start 之后，午夜后的部分算作次日的延续
+func TestOvernightWindowSplitsAcrossDays(t *testing.T) {
+	cases := []struct {
+		now, start, end string
+		sameDay, carry  bool
+	}{
+		{"22:00", "22:00", "02:00", true, false},
+		{"23:59", "22:00", "02:00", true, false},
+		{"00:00", "22:00", "02:00", false, true},
+		{"01:59", "22:00", "02:00", false, true},
+		{"02:00", "22:00", "02:00", false, false},
+		{"21:59", "22:00", "02:00", false, false},
+		{"11:00", "10:00", "14:00", true, false},
+		{"01:00", "10:00", "14:00", false, false},
+		{"01:00", "", "", true, false},
+	}
+	for _, c := range cases {
+		if got := InSameDayPart(c.now, c.start, c.end); got != c.sameDay {
+			t.Errorf("InSameDayPart(%q, %q, %q) = %v, want %v", c.now, c.start, c.end, got, c.sameDay)
+		}
+		if got := InCarryOver(c.now, c.start, c.end); got != c.carry {
+			t.Errorf("InCarryOver(%q, %q, %q) = %v, want %v", c.now, c.start, c.end, got, c.carry)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// erDupEntry MySQL 唯一键冲突的错误码
+const erDupEntry = 1062
+
+// IsDuplicateKey 判断错误是否为 MySQL 唯一键冲突
+func IsDuplicateKey(err error) bool {
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && me.Number == erDupEntry
+}
+
+// EnsureColumn 检查表中是否已有指定列，没有时按给定定义追加该列
+func EnsureColumn(db *sql.DB, table, column, definition string) error {
+	var count int
+	query := `SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`
+	if err := db.QueryRow(query, table, column).Scan(&count); err != nil {
+		return fmt.Errorf("checking column %s.%s: %w", table, column, err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("adding column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// EnsureAutoIncrement 检查主键列是否自增，不是时按给定定义改为自增，已有数据的ID保持不变
+func EnsureAutoIncrement(db *sql.DB, table, column, definition string) error {
+	var count int
+	query := `SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ? AND EXTRA LIKE '%auto_increment%'`
+	if err := db.QueryRow(query, table, column).Scan(&count); err != nil {
+		return fmt.Errorf("checking column %s.%s: %w", table, column, err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s AUTO_INCREMENT", table, column, definition)); err != nil {
+		return fmt.Errorf("making %s.%s auto increment: %w", table, column, err)
+	}
+	return nil
+}
@@ -2,8 +2,10 @@ package utils
 
 import (
 	"context"
+	"crypto/rsa"
 	"gocode/first/config"
 	"log"
+	"strings"
 
 	"github.com/wechatpay-apiv3/wechatpay-go/core"
 	"github.com/wechatpay-apiv3/wechatpay-go/core/option"
@@ -15,8 +17,18 @@ var (
 )
 
 func NewWeChatClient() *core.Client {
-	mini := config.C.Wechat
-	mchPrivateKey, err := utils.LoadPrivateKeyWithPath(mini.PrivateKey)
+	return NewWeChatClientFor(config.C.Wechat)
+}
+
+// NewWeChatClientFor 按给定的商户配置创建微信支付客户端，PrivateKey 可以是私钥文件路径或私钥内容
+func NewWeChatClientFor(mini config.Wechat) *core.Client {
+	var mchPrivateKey *rsa.PrivateKey
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(mini.PrivateKey), "-----BEGIN") {
+		mchPrivateKey, err = utils.LoadPrivateKey(mini.PrivateKey)
+	} else {
+		mchPrivateKey, err = utils.LoadPrivateKeyWithPath(mini.PrivateKey)
+	}
 
 	if err != nil {
 		log.Printf("加载私钥文件错误" + err.Error())